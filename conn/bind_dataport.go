@@ -0,0 +1,175 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"sync"
+)
+
+const (
+	controlPortIndex = 0
+	dataPortIndex    = 1
+)
+
+// DataPortBind listens on the control port for the supernode, and on a separate data port for the peers.
+// Replies are sent through the port which the endpoint was received from.
+// New endpoints from ParseEndpoint use the data port, the ones from ParseControlEndpoint use the control port.
+type DataPortBind struct {
+	mu       sync.RWMutex
+	binds    [2]Bind // control, data
+	dataPort uint16
+	ports    []uint16
+}
+
+// DataPort is implemented by Bind objects which serve the peers on a port other than the control port.
+type DataPort interface {
+	DataPort() uint16
+	ParseControlEndpoint(s string) (Endpoint, error)
+}
+
+var _ Bind = (*DataPortBind)(nil)
+var _ DataPort = (*DataPortBind)(nil)
+var _ PeekLookAtSocketFd = (*DataPortBind)(nil)
+var _ InheritSocketFd = (*DataPortBind)(nil)
+var _ SockBuffer = (*DataPortBind)(nil)
+
+func NewDataPortBind(dataPort uint16, newBind func() Bind) *DataPortBind {
+	return &DataPortBind{
+		binds:    [2]Bind{newBind(), newBind()},
+		dataPort: dataPort,
+	}
+}
+
+// Open opens the control port, and then the data port. Both are required.
+func (bind *DataPortBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if len(bind.ports) != 0 {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	cfns, controlPort, err := bind.binds[controlPortIndex].Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	dfns, dataPort, err := bind.binds[dataPortIndex].Open(bind.dataPort)
+	if err != nil {
+		bind.binds[controlPortIndex].Close()
+		return nil, 0, err
+	}
+	var fns []ReceiveFunc
+	for _, fn := range cfns {
+		fns = append(fns, bind.makeReceiveFunc(fn, controlPortIndex))
+	}
+	for _, fn := range dfns {
+		fns = append(fns, bind.makeReceiveFunc(fn, dataPortIndex))
+	}
+	bind.ports = []uint16{controlPort, dataPort}
+	return fns, controlPort, nil
+}
+
+func (bind *DataPortBind) makeReceiveFunc(fn ReceiveFunc, index int) ReceiveFunc {
+	return func(b []byte) (n int, ep Endpoint, err error) {
+		n, ep, err = fn(b)
+		if ep != nil {
+			ep = &multiPortEndpoint{Endpoint: ep, index: index}
+		}
+		return
+	}
+}
+
+func (bind *DataPortBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	var err error
+	for _, b := range bind.binds {
+		if err2 := b.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	bind.ports = nil
+	return err
+}
+
+func (bind *DataPortBind) SetMark(mark uint32) error {
+	for _, b := range bind.binds {
+		if err := b.SetMark(mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSockBuffer sets the buffer sizes of both ports, the granted sizes of the data port are returned.
+func (bind *DataPortBind) SetSockBuffer(recv int, send int) (grantedRecv int, grantedSend int, err error) {
+	if sb, ok := bind.binds[controlPortIndex].(SockBuffer); ok {
+		sb.SetSockBuffer(recv, send)
+	}
+	sb, ok := bind.binds[dataPortIndex].(SockBuffer)
+	if !ok {
+		return 0, 0, errNoSockBuffer
+	}
+	return sb.SetSockBuffer(recv, send)
+}
+
+func (bind *DataPortBind) Send(buff []byte, end Endpoint) error {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if mpe, ok := end.(*multiPortEndpoint); ok {
+		return bind.binds[mpe.index].Send(buff, mpe.Endpoint)
+	}
+	return bind.binds[dataPortIndex].Send(buff, end)
+}
+
+// ParseEndpoint returns an endpoint sending through the data port, for the peers.
+func (bind *DataPortBind) ParseEndpoint(s string) (Endpoint, error) {
+	ep, err := bind.binds[dataPortIndex].ParseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return &multiPortEndpoint{Endpoint: ep, index: dataPortIndex}, nil
+}
+
+// ParseControlEndpoint returns an endpoint sending through the control port, for the supernode.
+func (bind *DataPortBind) ParseControlEndpoint(s string) (Endpoint, error) {
+	ep, err := bind.binds[controlPortIndex].ParseEndpoint(s)
+	if err != nil {
+		return nil, err
+	}
+	return &multiPortEndpoint{Endpoint: ep, index: controlPortIndex}, nil
+}
+
+// DataPort returns the data port opened, 0 if it's closed.
+func (bind *DataPortBind) DataPort() uint16 {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if len(bind.ports) == 0 {
+		return 0
+	}
+	return bind.ports[dataPortIndex]
+}
+
+func (bind *DataPortBind) PeekLookAtSocketFd4() (fd int, err error) {
+	peek, ok := bind.binds[controlPortIndex].(PeekLookAtSocketFd)
+	if !ok {
+		return -1, errNoPeekLookAtSocketFd
+	}
+	return peek.PeekLookAtSocketFd4()
+}
+
+func (bind *DataPortBind) PeekLookAtSocketFd6() (fd int, err error) {
+	peek, ok := bind.binds[controlPortIndex].(PeekLookAtSocketFd)
+	if !ok {
+		return -1, errNoPeekLookAtSocketFd
+	}
+	return peek.PeekLookAtSocketFd6()
+}
+
+// InheritSocketFd hands over the sockets of the control port only.
+func (bind *DataPortBind) InheritSocketFd(fd4 int, fd6 int) {
+	if ib, ok := bind.binds[controlPortIndex].(InheritSocketFd); ok {
+		ib.InheritSocketFd(fd4, fd6)
+	}
+}
@@ -62,11 +62,17 @@ type LinuxSocketBind struct {
 	sock6 int
 	use4  bool
 	use6  bool
+	// inherit4 and inherit6 are already bound sockets handed over by another
+	// process. They are consumed by the next Open.
+	inherit4 int
+	inherit6 int
 }
 
-func NewLinuxSocketBind() Bind { return &LinuxSocketBind{sock4: -1, sock6: -1, use4: true, use6: true} }
+func NewLinuxSocketBind() Bind {
+	return &LinuxSocketBind{sock4: -1, sock6: -1, use4: true, use6: true, inherit4: -1, inherit6: -1}
+}
 func NewLinuxSocketBindAf(use4 bool, use6 bool) Bind {
-	return &LinuxSocketBind{sock4: -1, sock6: -1, use4: use4, use6: use6}
+	return &LinuxSocketBind{sock4: -1, sock6: -1, use4: use4, use6: use6, inherit4: -1, inherit6: -1}
 }
 
 func NewDefaultBind(use4 bool, use6 bool, bindmode string) Bind {
@@ -78,6 +84,88 @@ func NewDefaultBind(use4 bool, use6 bool, bindmode string) Bind {
 
 var _ Endpoint = (*LinuxSocketEndpoint)(nil)
 var _ Bind = (*LinuxSocketBind)(nil)
+var _ PeekLookAtSocketFd = (*LinuxSocketBind)(nil)
+var _ InheritSocketFd = (*LinuxSocketBind)(nil)
+var _ SockBuffer = (*LinuxSocketBind)(nil)
+
+func (bind *LinuxSocketBind) PeekLookAtSocketFd4() (fd int, err error) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if bind.sock4 == -1 {
+		return -1, net.ErrClosed
+	}
+	return bind.sock4, nil
+}
+
+func (bind *LinuxSocketBind) PeekLookAtSocketFd6() (fd int, err error) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if bind.sock6 == -1 {
+		return -1, net.ErrClosed
+	}
+	return bind.sock6, nil
+}
+
+func (bind *LinuxSocketBind) InheritSocketFd(fd4 int, fd6 int) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	bind.inherit4 = fd4
+	bind.inherit6 = fd6
+}
+
+// openInherited adopts the sockets passed in by InheritSocketFd.
+// If they are not bound to the requested port, they are closed and ok is false.
+func (bind *LinuxSocketBind) openInherited(port uint16) (fns []ReceiveFunc, actualPort uint16, ok bool) {
+	sock4, sock6 := bind.inherit4, bind.inherit6
+	bind.inherit4, bind.inherit6 = -1, -1
+	closeAll := func() {
+		if sock4 != -1 {
+			unix.Close(sock4)
+		}
+		if sock6 != -1 {
+			unix.Close(sock6)
+		}
+	}
+	for _, sock := range []int{sock6, sock4} {
+		if sock == -1 {
+			continue
+		}
+		sa, err := unix.Getsockname(sock)
+		if err != nil {
+			closeAll()
+			return nil, 0, false
+		}
+		var sockport uint16
+		switch sa := sa.(type) {
+		case *unix.SockaddrInet4:
+			sockport = uint16(sa.Port)
+		case *unix.SockaddrInet6:
+			sockport = uint16(sa.Port)
+		}
+		if port != 0 && sockport != port {
+			closeAll()
+			return nil, 0, false
+		}
+		actualPort = sockport
+	}
+	if sock4 != -1 {
+		if bind.use4 {
+			bind.sock4 = sock4
+			fns = append(fns, bind.receiveIPv4)
+		} else {
+			unix.Close(sock4)
+		}
+	}
+	if sock6 != -1 {
+		if bind.use6 {
+			bind.sock6 = sock6
+			fns = append(fns, bind.receiveIPv6)
+		} else {
+			unix.Close(sock6)
+		}
+	}
+	return fns, actualPort, len(fns) > 0
+}
 
 func (*LinuxSocketBind) ParseEndpoint(s string) (Endpoint, error) {
 	var end LinuxSocketEndpoint
@@ -126,6 +214,12 @@ func (bind *LinuxSocketBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
 		return nil, 0, ErrBindAlreadyOpen
 	}
 
+	if bind.inherit4 != -1 || bind.inherit6 != -1 {
+		if fns, actualPort, ok := bind.openInherited(port); ok {
+			return fns, actualPort, nil
+		}
+	}
+
 	originalPort := port
 
 again:
@@ -181,6 +275,50 @@ again:
 	return fns, port, nil
 }
 
+// SetSockBuffer sets the buffer sizes of both sockets, the smaller granted sizes are returned.
+func (bind *LinuxSocketBind) SetSockBuffer(recv int, send int) (grantedRecv int, grantedSend int, err error) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	grantedRecv, grantedSend = -1, -1
+	for _, sock := range []int{bind.sock4, bind.sock6} {
+		if sock == -1 {
+			continue
+		}
+		r, err := setSockBuffer(sock, unix.SO_RCVBUF, unix.SO_RCVBUFFORCE, recv)
+		if err != nil {
+			return 0, 0, err
+		}
+		s, err := setSockBuffer(sock, unix.SO_SNDBUF, unix.SO_SNDBUFFORCE, send)
+		if err != nil {
+			return 0, 0, err
+		}
+		if grantedRecv == -1 || r < grantedRecv {
+			grantedRecv = r
+		}
+		if grantedSend == -1 || s < grantedSend {
+			grantedSend = s
+		}
+	}
+	if grantedRecv == -1 {
+		return 0, 0, net.ErrClosed
+	}
+	return grantedRecv, grantedSend, nil
+}
+
+// setSockBuffer tries forceOpt first, which ignores net.core.rmem_max/wmem_max but needs CAP_NET_ADMIN.
+// The kernel doubles the value for its bookkeeping, so the granted size is halved to be comparable with size.
+func setSockBuffer(sock int, opt int, forceOpt int, size int) (int, error) {
+	if size > 0 {
+		if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, forceOpt, size); err != nil {
+			if err := unix.SetsockoptInt(sock, unix.SOL_SOCKET, opt, size); err != nil {
+				return 0, err
+			}
+		}
+	}
+	granted, err := unix.GetsockoptInt(sock, unix.SOL_SOCKET, opt)
+	return granted / 2, err
+}
+
 func (bind *LinuxSocketBind) SetMark(value uint32) error {
 	bind.mu.RLock()
 	defer bind.mu.RUnlock()
@@ -364,7 +502,7 @@ func create4(port uint16) (int, uint16, error) {
 
 	fd, err := unix.Socket(
 		unix.AF_INET,
-		unix.SOCK_DGRAM,
+		unix.SOCK_DGRAM|unix.SOCK_CLOEXEC,
 		0,
 	)
 
@@ -408,7 +546,7 @@ func create6(port uint16) (int, uint16, error) {
 
 	fd, err := unix.Socket(
 		unix.AF_INET6,
-		unix.SOCK_DGRAM,
+		unix.SOCK_DGRAM|unix.SOCK_CLOEXEC,
 		0,
 	)
 
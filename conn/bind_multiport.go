@@ -0,0 +1,196 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// MultiPortBind listens on several consecutive ports with one Bind for each port.
+// Received packets from all ports are fanned in, and replies are sent through
+// the port which the endpoint was received from.
+// New endpoints from ParseEndpoint always use the first port.
+type MultiPortBind struct {
+	mu    sync.RWMutex
+	binds []Bind
+	ports []uint16
+}
+
+// ListenPorts is implemented by Bind objects which listen on more than one port.
+type ListenPorts interface {
+	ListenPorts() []uint16
+}
+
+type multiPortEndpoint struct {
+	Endpoint
+	index int
+}
+
+var errNoPeekLookAtSocketFd = errors.New("bind does not support PeekLookAtSocketFd")
+var errNoSockBuffer = errors.New("bind does not support SockBuffer")
+
+var _ Bind = (*MultiPortBind)(nil)
+var _ PeekLookAtSocketFd = (*MultiPortBind)(nil)
+var _ InheritSocketFd = (*MultiPortBind)(nil)
+var _ ListenPorts = (*MultiPortBind)(nil)
+var _ SockBuffer = (*MultiPortBind)(nil)
+
+func NewMultiPortBind(count int, newBind func() Bind) *MultiPortBind {
+	if count < 1 {
+		count = 1
+	}
+	bind := &MultiPortBind{
+		binds: make([]Bind, count),
+	}
+	for i := range bind.binds {
+		bind.binds[i] = newBind()
+	}
+	return bind
+}
+
+// Open opens the first port as usual, and then the following consecutive ones.
+// All ports are required. If port is 0, the first port is random, and it retries with another one
+// if a following port is in use.
+func (bind *MultiPortBind) Open(port uint16) ([]ReceiveFunc, uint16, error) {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	if len(bind.ports) != 0 {
+		return nil, 0, ErrBindAlreadyOpen
+	}
+	var tries int
+again:
+	fns, actualPort, err := bind.binds[0].Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	ports := []uint16{actualPort}
+	for i := 1; i < len(bind.binds); i++ {
+		var bfns []ReceiveFunc
+		nextPort := int(actualPort) + i
+		if nextPort > 65535 {
+			err = fmt.Errorf("listen port %v: out of range", nextPort)
+		} else {
+			bfns, _, err = bind.binds[i].Open(uint16(nextPort))
+		}
+		if err != nil {
+			for _, b := range bind.binds[:i] {
+				b.Close()
+			}
+			if port == 0 && tries < 100 {
+				tries++
+				goto again
+			}
+			return nil, 0, fmt.Errorf("listen port %v: %w", nextPort, err)
+		}
+		for _, fn := range bfns {
+			fns = append(fns, bind.makeReceiveFunc(fn, i))
+		}
+		ports = append(ports, uint16(nextPort))
+	}
+	bind.ports = ports
+	return fns, actualPort, nil
+}
+
+func (bind *MultiPortBind) makeReceiveFunc(fn ReceiveFunc, index int) ReceiveFunc {
+	return func(b []byte) (n int, ep Endpoint, err error) {
+		n, ep, err = fn(b)
+		if ep != nil {
+			ep = &multiPortEndpoint{Endpoint: ep, index: index}
+		}
+		return
+	}
+}
+
+func (bind *MultiPortBind) Close() error {
+	bind.mu.Lock()
+	defer bind.mu.Unlock()
+	var err error
+	for _, b := range bind.binds {
+		if err2 := b.Close(); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	bind.ports = nil
+	return err
+}
+
+func (bind *MultiPortBind) SetMark(mark uint32) error {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	for _, b := range bind.binds {
+		if err := b.SetMark(mark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSockBuffer sets the buffer sizes of every port, the granted sizes of the first port are returned.
+func (bind *MultiPortBind) SetSockBuffer(recv int, send int) (grantedRecv int, grantedSend int, err error) {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	sb, ok := bind.binds[0].(SockBuffer)
+	if !ok {
+		return 0, 0, errNoSockBuffer
+	}
+	if grantedRecv, grantedSend, err = sb.SetSockBuffer(recv, send); err != nil {
+		return 0, 0, err
+	}
+	for _, b := range bind.binds[1:] {
+		if sb, ok := b.(SockBuffer); ok {
+			sb.SetSockBuffer(recv, send)
+		}
+	}
+	return grantedRecv, grantedSend, nil
+}
+
+func (bind *MultiPortBind) Send(buff []byte, end Endpoint) error {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	if mpe, ok := end.(*multiPortEndpoint); ok {
+		if mpe.index < len(bind.binds) {
+			return bind.binds[mpe.index].Send(buff, mpe.Endpoint)
+		}
+		end = mpe.Endpoint
+	}
+	return bind.binds[0].Send(buff, end)
+}
+
+func (bind *MultiPortBind) ParseEndpoint(s string) (Endpoint, error) {
+	return bind.binds[0].ParseEndpoint(s)
+}
+
+// ListenPorts returns all the ports opened, the first one is the main port.
+func (bind *MultiPortBind) ListenPorts() []uint16 {
+	bind.mu.RLock()
+	defer bind.mu.RUnlock()
+	return append([]uint16{}, bind.ports...)
+}
+
+func (bind *MultiPortBind) PeekLookAtSocketFd4() (fd int, err error) {
+	peek, ok := bind.binds[0].(PeekLookAtSocketFd)
+	if !ok {
+		return -1, errNoPeekLookAtSocketFd
+	}
+	return peek.PeekLookAtSocketFd4()
+}
+
+func (bind *MultiPortBind) PeekLookAtSocketFd6() (fd int, err error) {
+	peek, ok := bind.binds[0].(PeekLookAtSocketFd)
+	if !ok {
+		return -1, errNoPeekLookAtSocketFd
+	}
+	return peek.PeekLookAtSocketFd6()
+}
+
+// InheritSocketFd hands over the sockets of the first port only.
+func (bind *MultiPortBind) InheritSocketFd(fd4 int, fd6 int) {
+	if ib, ok := bind.binds[0].(InheritSocketFd); ok {
+		ib.InheritSocketFd(fd4, fd6)
+	}
+}
@@ -108,12 +108,16 @@ again:
 	if bind.use4 {
 		ipv4, port, err = listenNet("udp4", port)
 		if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
-			ipv6.Close()
+			if ipv6 != nil {
+				ipv6.Close()
+			}
 			tries++
 			goto again
 		}
 		if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-			ipv6.Close()
+			if ipv6 != nil {
+				ipv6.Close()
+			}
 			return nil, 0, err
 		}
 	}
@@ -122,12 +126,16 @@ again:
 		// Listen on the same port as we're using for ipv4.
 		ipv6, port, err = listenNet("udp6", port)
 		if uport == 0 && errors.Is(err, syscall.EADDRINUSE) && tries < 100 {
-			ipv4.Close()
+			if ipv4 != nil {
+				ipv4.Close()
+			}
 			tries++
 			goto again
 		}
 		if err != nil && !errors.Is(err, syscall.EAFNOSUPPORT) {
-			ipv4.Close()
+			if ipv4 != nil {
+				ipv4.Close()
+			}
 			return nil, 0, err
 		}
 	}
@@ -59,6 +59,20 @@ type PeekLookAtSocketFd interface {
 	PeekLookAtSocketFd6() (fd int, err error)
 }
 
+// InheritSocketFd is implemented by Bind objects that can take over sockets
+// which are already bound, instead of creating new ones on the next Open.
+// Pass -1 for an address family that is not handed over.
+type InheritSocketFd interface {
+	InheritSocketFd(fd4 int, fd6 int)
+}
+
+// SockBuffer is implemented by Bind objects which can set SO_RCVBUF and SO_SNDBUF
+// of their opened sockets. 0 keeps the current size. It returns the sizes granted
+// by the OS, which may be smaller than requested.
+type SockBuffer interface {
+	SetSockBuffer(recv int, send int) (grantedRecv int, grantedSend int, err error)
+}
+
 // An Endpoint maintains the source/destination caching for a peer.
 //
 //	dst: the remote address of a peer ("endpoint" in uapi terminology)
@@ -154,8 +168,11 @@ func LookupIP(host_port string, Af int, AfPrefer int) (string, string, error) {
 	if host_port == "" {
 		return "", "", fmt.Errorf("error lookup ip from empty string")
 	}
+	host_port, err := ResolveURL(host_port)
+	if err != nil {
+		return "", "", err
+	}
 	var conn net.Conn
-	var err error
 	var af_try_order []string
 
 	var NetStr string
@@ -0,0 +1,39 @@
+// +build !linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"errors"
+	"net"
+)
+
+// PathMTU returns the MTU of the interface which the ip:port is routed through.
+func PathMTU(dst string) (int, error) {
+	c, err := net.Dial("udp", dst)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	local := c.LocalAddr().(*net.UDPAddr).IP
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return 0, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(local) {
+				return iface.MTU, nil
+			}
+		}
+	}
+	return 0, errors.New("no interface for " + local.String())
+}
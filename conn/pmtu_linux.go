@@ -0,0 +1,37 @@
+// +build linux
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// PathMTU returns the path MTU to the ip:port known by the kernel, which is the route MTU
+// until a smaller one is discovered by ICMP.
+func PathMTU(dst string) (int, error) {
+	c, err := net.Dial("udp", dst)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+	rc, err := c.(*net.UDPConn).SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_MTU
+	if c.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+	var mtu int
+	err = rc.Control(func(fd uintptr) {
+		mtu, err = unix.GetsockoptInt(int(fd), level, opt)
+	})
+	return mtu, err
+}
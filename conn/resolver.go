@@ -0,0 +1,116 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package conn
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An EndpointResolver resolves the name part of a connurl like scheme://name to a host:port.
+// ttl is how long the result may be cached, 0 means don't cache.
+type EndpointResolver interface {
+	Resolve(name string) (host_port string, ttl time.Duration, err error)
+}
+
+// DefaultResolveTTL is the cache TTL of the builtin srv resolver.
+var DefaultResolveTTL = 60 * time.Second
+
+var resolvers = struct {
+	sync.RWMutex
+	m map[string]EndpointResolver
+}{
+	m: map[string]EndpointResolver{
+		"dns": dnsResolver{},
+		"srv": srvResolver{},
+	},
+}
+
+var resolveCache = struct {
+	sync.Mutex
+	m map[string]resolveCacheItem
+}{
+	m: make(map[string]resolveCacheItem),
+}
+
+type resolveCacheItem struct {
+	host_port string
+	expire    time.Time
+}
+
+// RegisterResolver makes connurls of scheme://name resolved by r, for service-discovery systems.
+func RegisterResolver(scheme string, r EndpointResolver) {
+	resolvers.Lock()
+	defer resolvers.Unlock()
+	resolvers.m[scheme] = r
+}
+
+// IsDynamicURL reports whether the connurl has a scheme, so that it should be resolved again periodically.
+func IsDynamicURL(connurl string) bool {
+	return strings.Contains(connurl, "://")
+}
+
+// ResolveURL resolves a connurl with a scheme to a host:port, a connurl without scheme is returned as is.
+func ResolveURL(connurl string) (string, error) {
+	i := strings.Index(connurl, "://")
+	if i < 0 {
+		return connurl, nil
+	}
+	scheme, name := connurl[:i], connurl[i+3:]
+	resolvers.RLock()
+	r, has := resolvers.m[scheme]
+	resolvers.RUnlock()
+	if !has {
+		return "", fmt.Errorf("unknown endpoint scheme: %v", scheme)
+	}
+
+	resolveCache.Lock()
+	item, has := resolveCache.m[connurl]
+	resolveCache.Unlock()
+	if has && time.Now().Before(item.expire) {
+		return item.host_port, nil
+	}
+
+	host_port, ttl, err := r.Resolve(name)
+	if err != nil {
+		return "", fmt.Errorf("resolve %v: %v", connurl, err)
+	}
+	if ttl > 0 {
+		resolveCache.Lock()
+		resolveCache.m[connurl] = resolveCacheItem{host_port: host_port, expire: time.Now().Add(ttl)}
+		resolveCache.Unlock()
+	}
+	return host_port, nil
+}
+
+// dnsResolver resolves dns://host:port. The host is looked up again each time, by LookupIP.
+type dnsResolver struct{}
+
+func (dnsResolver) Resolve(name string) (string, time.Duration, error) {
+	if _, _, err := net.SplitHostPort(name); err != nil {
+		return "", 0, err
+	}
+	return name, 0, nil
+}
+
+// srvResolver resolves srv://_service._proto.name to the target of the SRV record with the highest priority.
+type srvResolver struct{}
+
+func (srvResolver) Resolve(name string) (string, time.Duration, error) {
+	_, addrs, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(addrs) == 0 {
+		return "", 0, fmt.Errorf("no SRV record")
+	}
+	target := strings.TrimSuffix(addrs[0].Target, ".")
+	return net.JoinHostPort(target, strconv.Itoa(int(addrs[0].Port))), DefaultResolveTTL, nil
+}
@@ -0,0 +1,356 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const (
+	etherTypeARP  = 0x0806
+	etherTypeIPv6 = 0x86dd
+	ethHeaderLen  = 14
+	arpLen        = 28
+	ipv6HeaderLen = 40
+	icmpv6NS      = 135
+	icmpv6NA      = 136
+	ndOptSrcLL    = 1
+	ndOptTargetLL = 2
+)
+
+type neighborEntry struct {
+	mac    tap.MacAddress
+	time   time.Time
+	static bool // from ARPProxy.Static, never relearned nor expired
+}
+
+// arpProxy answers ARP requests and IPv6 neighbor solicitations from the local TAP,
+// by the IP->MAC learned from the frames received from the VPN, instead of flooding them to all nodes.
+// ARPProxy.Enabled handles both, InterfaceConf.NDProxy handles the neighbor discovery only.
+type arpProxy struct {
+	enabled   bool
+	arp       bool
+	nd        bool
+	timeout   time.Duration // 0 means valid as long as the MAC is in the L2FIB
+	neighbors map[[16]byte]*neighborEntry
+	answered  map[string]uint64
+	sync.RWMutex
+}
+
+func (device *Device) loadARPProxy() {
+	conf := device.EdgeConfig.ARPProxy
+	if !conf.Enabled && !device.EdgeConfig.Interface.NDProxy {
+		return
+	}
+	p := &device.arpProxy
+	p.enabled = true
+	p.arp = conf.Enabled
+	p.nd = true
+	p.timeout = mtypes.S2TD(conf.Timeout)
+	p.neighbors = make(map[[16]byte]*neighborEntry)
+	p.answered = make(map[string]uint64)
+	for _, entry := range conf.Static {
+		ip := net.ParseIP(entry.IP)
+		hwaddr, err := net.ParseMAC(entry.MacAddr)
+		if ip == nil || err != nil || len(hwaddr) != 6 {
+			device.log.Errorf("Invalid ARPProxy.Static entry: %v %v", entry.IP, entry.MacAddr)
+			continue
+		}
+		var key [16]byte
+		copy(key[:], ip.To16())
+		e := &neighborEntry{static: true}
+		copy(e.mac[:], hwaddr)
+		p.neighbors[key] = e
+	}
+}
+
+func (p *arpProxy) learn(ip net.IP, mac tap.MacAddress) bool {
+	if ip.IsUnspecified() || tap.IsNotUnicast(mac) {
+		return false
+	}
+	var key [16]byte
+	copy(key[:], ip.To16())
+	p.Lock()
+	defer p.Unlock()
+	e, ok := p.neighbors[key]
+	if ok && e.static {
+		return false
+	}
+	if !ok {
+		e = &neighborEntry{}
+		p.neighbors[key] = e
+	}
+	changed := e.mac != mac
+	e.mac = mac
+	e.time = time.Now()
+	return changed
+}
+
+// learnNeighbor learns the IP->MAC from ARP and neighbor discovery frames received from the VPN.
+// Gratuitous ARP and unsolicited NA are learned the same way, so a moved IP overrides the old MAC.
+func (device *Device) learnNeighbor(frame []byte) {
+	p := &device.arpProxy
+	if !p.enabled || len(frame) < ethHeaderLen {
+		return
+	}
+	var ip net.IP
+	var mac tap.MacAddress
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		arp := frame[ethHeaderLen:]
+		if !p.arp || !isEthIPv4ARP(arp) {
+			return
+		}
+		copy(mac[:], arp[8:14])
+		ip = net.IP(arp[14:18])
+	case etherTypeIPv6:
+		icmp, src, ok := parseND(frame)
+		if !p.nd || !ok {
+			return
+		}
+		mac = tap.GetSrcMacAddr(frame)
+		switch icmp[0] {
+		case icmpv6NS:
+			ip = src
+			if ll, ok := ndOption(icmp[24:], ndOptSrcLL); ok {
+				mac = ll
+			}
+		case icmpv6NA:
+			ip = net.IP(icmp[8:24])
+			if ll, ok := ndOption(icmp[24:], ndOptTargetLL); ok {
+				mac = ll
+			}
+		default:
+			return
+		}
+	default:
+		return
+	}
+	if p.learn(ip, mac) && device.LogLevel.LogInternal {
+		fmt.Printf("Internal: ARPProxy [%v -> %v] learned.\n", ip, mac.String())
+	}
+}
+
+// lookupNeighbor returns the MAC of the ip if it's static, or learned and still in the L2FIB of a remote node.
+func (device *Device) lookupNeighbor(ip net.IP) (tap.MacAddress, bool) {
+	p := &device.arpProxy
+	var key [16]byte
+	copy(key[:], ip.To16())
+	p.RLock()
+	e, ok := p.neighbors[key]
+	var entry neighborEntry
+	if ok {
+		entry = *e
+	}
+	p.RUnlock()
+	if !ok {
+		return tap.MacAddress{}, false
+	}
+	if entry.static {
+		return entry.mac, true
+	}
+	if p.timeout > 0 && time.Since(entry.time) > p.timeout {
+		return tap.MacAddress{}, false
+	}
+	val, ok := device.l2fib.Load(entry.mac)
+	if !ok || val.(*IdAndTime).ID == device.ID {
+		return tap.MacAddress{}, false
+	}
+	return entry.mac, true
+}
+
+// proxyNeighbor answers the ARP request or neighbor solicitation read from the TAP if we know the target.
+// It returns true if it's answered, and the frame shouldn't be flooded.
+// ARP probes and DAD are never answered, they must reach the real owner.
+func (device *Device) proxyNeighbor(frame []byte) bool {
+	if !device.arpProxy.enabled || len(frame) < ethHeaderLen {
+		return false
+	}
+	var reply []byte
+	var kind string
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case etherTypeARP:
+		arp := frame[ethHeaderLen:]
+		if !device.arpProxy.arp || !isEthIPv4ARP(arp) || binary.BigEndian.Uint16(arp[6:8]) != 1 {
+			return false
+		}
+		senderIP, targetIP := net.IP(arp[14:18]), net.IP(arp[24:28])
+		if senderIP.IsUnspecified() || senderIP.Equal(targetIP) {
+			return false // probe or gratuitous
+		}
+		mac, ok := device.lookupNeighbor(targetIP)
+		if !ok {
+			return false
+		}
+		reply, kind = arpReply(frame, mac), "ARP"
+	case etherTypeIPv6:
+		icmp, src, ok := parseND(frame)
+		if !device.arpProxy.nd || !ok || icmp[0] != icmpv6NS || src.IsUnspecified() || !nsAddressed(frame, net.IP(icmp[8:24])) {
+			return false
+		}
+		mac, ok := device.lookupNeighbor(net.IP(icmp[8:24]))
+		if !ok {
+			return false
+		}
+		reply, kind = ndReply(frame, mac), "ND"
+	default:
+		return false
+	}
+	buf := make([]byte, MessageTransportOffsetContent+path.EgHeaderLen+len(reply))
+	copy(buf[MessageTransportOffsetContent+path.EgHeaderLen:], reply)
+	if _, err := device.tap.device.Write(buf, MessageTransportOffsetContent+path.EgHeaderLen); err != nil {
+		device.log.Errorf("Failed to write %v proxy reply to TUN device: %v", kind, err)
+		return false
+	}
+	device.arpProxy.Lock()
+	device.arpProxy.answered[kind]++
+	device.arpProxy.Unlock()
+	return true
+}
+
+func isEthIPv4ARP(arp []byte) bool {
+	return len(arp) >= arpLen &&
+		binary.BigEndian.Uint16(arp[0:2]) == 1 && binary.BigEndian.Uint16(arp[2:4]) == 0x0800 &&
+		arp[4] == 6 && arp[5] == 4
+}
+
+// parseND returns the ICMPv6 message and the IPv6 source of a neighbor discovery frame.
+// Only the ND without extension headers, and with hop limit 255 as RFC 4861 requires.
+func parseND(frame []byte) (icmp []byte, src net.IP, ok bool) {
+	if len(frame) < ethHeaderLen+ipv6HeaderLen+24 {
+		return nil, nil, false
+	}
+	ip6 := frame[ethHeaderLen:]
+	if ip6[0]>>4 != 6 || ip6[6] != 58 || ip6[7] != 255 {
+		return nil, nil, false
+	}
+	icmp = ip6[ipv6HeaderLen:]
+	if icmp[0] != icmpv6NS && icmp[0] != icmpv6NA {
+		return nil, nil, false
+	}
+	return icmp, net.IP(ip6[8:24]), true
+}
+
+// solicitedNodeMulticast returns the solicited-node multicast address of ip, ff02::1:ffXX:XXXX with its last 24 bits.
+func solicitedNodeMulticast(ip net.IP) net.IP {
+	ret := net.ParseIP("ff02::1:ff00:0")
+	copy(ret[13:16], ip.To16()[13:16])
+	return ret
+}
+
+// nsAddressed reports whether the neighbor solicitation is sent to the solicited-node multicast address of the target,
+// with the matching 33:33:xx:xx:xx:xx destination MAC. The others are left to the owner, especially the unicast ones:
+// they are the reachability probes of a cached entry, which only the owner can confirm.
+func nsAddressed(frame []byte, target net.IP) bool {
+	dst := net.IP(frame[ethHeaderLen+24 : ethHeaderLen+40])
+	if !dst.Equal(solicitedNodeMulticast(target)) {
+		return false
+	}
+	return frame[0] == 0x33 && frame[1] == 0x33 && string(frame[2:6]) == string(dst[12:16])
+}
+
+func ndOption(opts []byte, optType byte) (mac tap.MacAddress, ok bool) {
+	for len(opts) >= 8 {
+		optLen := int(opts[1]) * 8
+		if optLen == 0 || optLen > len(opts) {
+			break
+		}
+		if opts[0] == optType && optLen >= 8 {
+			copy(mac[:], opts[2:8])
+			return mac, true
+		}
+		opts = opts[optLen:]
+	}
+	return mac, false
+}
+
+func arpReply(request []byte, mac tap.MacAddress) []byte {
+	arp := request[ethHeaderLen:]
+	reply := make([]byte, ethHeaderLen+arpLen)
+	copy(reply[0:6], arp[8:14]) // to the requester
+	copy(reply[6:12], mac[:])
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeARP)
+	r := reply[ethHeaderLen:]
+	copy(r[0:6], arp[0:6])
+	binary.BigEndian.PutUint16(r[6:8], 2)
+	copy(r[8:14], mac[:])
+	copy(r[14:18], arp[24:28])
+	copy(r[18:24], arp[8:14])
+	copy(r[24:28], arp[14:18])
+	return reply
+}
+
+func ndReply(request []byte, mac tap.MacAddress) []byte {
+	ns := request[ethHeaderLen:]
+	icmpLen := 24 + 8
+	reply := make([]byte, ethHeaderLen+ipv6HeaderLen+icmpLen)
+	copy(reply[0:6], request[6:12]) // to the requester
+	copy(reply[6:12], mac[:])
+	binary.BigEndian.PutUint16(reply[12:14], etherTypeIPv6)
+	ip6 := reply[ethHeaderLen:]
+	ip6[0] = 0x60
+	binary.BigEndian.PutUint16(ip6[4:6], uint16(icmpLen))
+	ip6[6] = 58
+	ip6[7] = 255
+	copy(ip6[8:24], ns[ipv6HeaderLen+8:ipv6HeaderLen+24]) // from the target
+	copy(ip6[24:40], ns[8:24])
+	icmp := ip6[ipv6HeaderLen:]
+	icmp[0] = icmpv6NA
+	icmp[4] = 0x60 // Solicited and Override
+	copy(icmp[8:24], ns[ipv6HeaderLen+8:ipv6HeaderLen+24])
+	icmp[24] = ndOptTargetLL
+	icmp[25] = 1
+	copy(icmp[26:32], mac[:])
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip6[8:24], ip6[24:40], icmp))
+	return reply
+}
+
+func icmpv6Checksum(src []byte, dst []byte, icmp []byte) uint16 {
+	return pseudoHeaderChecksum(src, dst, 58, icmp)
+}
+
+// pseudoHeaderChecksum is the internet checksum of the payload of TCP/UDP/ICMPv6, with the IPv4 or IPv6 pseudo header.
+func pseudoHeaderChecksum(src []byte, dst []byte, proto uint8, payload []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src)
+	add(dst)
+	sum += uint32(len(payload))
+	sum += uint32(proto)
+	add(payload)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func (p *arpProxy) stats() mtypes.ARPProxyStats {
+	ret := mtypes.ARPProxyStats{
+		Answered: make(map[string]uint64),
+	}
+	p.RLock()
+	defer p.RUnlock()
+	ret.Entries = len(p.neighbors)
+	for kind, n := range p.answered {
+		ret.Answered[kind] = n
+	}
+	return ret
+}
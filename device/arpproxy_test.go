@@ -0,0 +1,179 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func serializeFrame(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func arpFrame(t *testing.T, op uint16, srcMac net.HardwareAddr, srcIP net.IP, dstMac net.HardwareAddr, dstIP net.IP) []byte {
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: srcMac, DstMAC: net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4, Operation: op,
+			SourceHwAddress: srcMac, SourceProtAddress: srcIP.To4(), DstHwAddress: dstMac, DstProtAddress: dstIP.To4()},
+	)
+}
+
+func ndFrame(t *testing.T, icmpType uint8, srcMac net.HardwareAddr, srcIP net.IP, target net.IP) []byte {
+	ip6 := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolICMPv6, HopLimit: 255, SrcIP: srcIP, DstIP: net.ParseIP("ff02::1:ff00:2")}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(icmpType, 0)}
+	icmp.SetNetworkLayerForChecksum(ip6)
+	var body gopacket.SerializableLayer
+	if icmpType == layers.ICMPv6TypeNeighborSolicitation {
+		body = &layers.ICMPv6NeighborSolicitation{TargetAddress: target, Options: layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: srcMac}}}
+	} else {
+		body = &layers.ICMPv6NeighborAdvertisement{TargetAddress: target, Flags: 0x20, Options: layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: srcMac}}}
+	}
+	return serializeFrame(t,
+		&layers.Ethernet{SrcMAC: srcMac, DstMAC: net.HardwareAddr{0x33, 0x33, 0xff, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv6},
+		ip6, icmp, body,
+	)
+}
+
+func TestARPProxy(t *testing.T) {
+	thetap, _ := tap.CreateDummyTAP()
+	device := &Device{ID: 1}
+	device.log = NewLogger(LogLevelError, "")
+	device.tap.device = thetap
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.EdgeConfig.ARPProxy = mtypes.ARPProxyInfo{
+		Enabled: true,
+		Static:  []mtypes.ARPProxyEntry{{IP: "10.0.0.9", MacAddr: "AA:BB:CC:DD:00:09"}},
+	}
+	device.loadARPProxy()
+
+	localMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}
+	remoteMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 2}
+	var remote tap.MacAddress
+	copy(remote[:], remoteMac)
+	localIP, remoteIP := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	localIP6, remoteIP6 := net.ParseIP("fd00::1"), net.ParseIP("fd00::2")
+	request := arpFrame(t, layers.ARPRequest, localMac, localIP, net.HardwareAddr{0, 0, 0, 0, 0, 0}, remoteIP)
+	ns := ndFrame(t, layers.ICMPv6TypeNeighborSolicitation, localMac, localIP6, remoteIP6)
+
+	if device.proxyNeighbor(request) || device.proxyNeighbor(ns) {
+		t.Fatal("answered before learned")
+	}
+	// gratuitous ARP and unsolicited NA from Node 2
+	device.learnNeighbor(arpFrame(t, layers.ARPRequest, remoteMac, remoteIP, net.HardwareAddr{0, 0, 0, 0, 0, 0}, remoteIP))
+	device.learnNeighbor(ndFrame(t, layers.ICMPv6TypeNeighborAdvertisement, remoteMac, remoteIP6, remoteIP6))
+	if device.proxyNeighbor(request) {
+		t.Fatal("answered while the MAC is not in the L2FIB")
+	}
+	device.l2fib.Store(remote, &IdAndTime{ID: 2, Time: time.Now()})
+
+	if !device.proxyNeighbor(request) {
+		t.Fatal("ARP request not answered")
+	}
+	if !device.proxyNeighbor(ns) {
+		t.Fatal("NS not answered")
+	}
+	if !device.proxyNeighbor(arpFrame(t, layers.ARPRequest, localMac, localIP, net.HardwareAddr{0, 0, 0, 0, 0, 0}, net.ParseIP("10.0.0.9"))) {
+		t.Error("static entry not answered")
+	}
+	// probe and DAD must reach the owner
+	if device.proxyNeighbor(arpFrame(t, layers.ARPRequest, localMac, net.IPv4zero, net.HardwareAddr{0, 0, 0, 0, 0, 0}, remoteIP)) {
+		t.Error("ARP probe answered")
+	}
+	if device.proxyNeighbor(ndFrame(t, layers.ICMPv6TypeNeighborSolicitation, localMac, net.IPv6unspecified, remoteIP6)) {
+		t.Error("DAD answered")
+	}
+	_, written, _ := thetap.(*tap.DummyTap).Counters()
+	if written != 3 {
+		t.Errorf("expected 3 replies written, got %v", written)
+	}
+
+	reply := gopacket.NewPacket(arpReply(request, remote), layers.LayerTypeEthernet, gopacket.Default)
+	arp, _ := reply.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if arp == nil || arp.Operation != layers.ARPReply || !net.IP(arp.SourceProtAddress).Equal(remoteIP.To4()) ||
+		net.HardwareAddr(arp.SourceHwAddress).String() != remoteMac.String() || net.HardwareAddr(arp.DstHwAddress).String() != localMac.String() {
+		t.Errorf("bad ARP reply: %v", reply.Dump())
+	}
+	na := ndReply(ns, remote)
+	reply = gopacket.NewPacket(na, layers.LayerTypeEthernet, gopacket.Default)
+	adv, _ := reply.Layer(layers.LayerTypeICMPv6NeighborAdvertisement).(*layers.ICMPv6NeighborAdvertisement)
+	if adv == nil || !adv.TargetAddress.Equal(remoteIP6) || !adv.Solicited() || !adv.Override() {
+		t.Errorf("bad NA: %v", reply.Dump())
+	}
+	ip6 := na[ethHeaderLen:]
+	if icmpv6Checksum(ip6[8:24], ip6[24:40], ip6[ipv6HeaderLen:]) != 0 {
+		t.Error("bad NA checksum")
+	}
+
+	stats := device.arpProxy.stats()
+	if stats.Entries != 3 || stats.Answered["ARP"] != 2 || stats.Answered["ND"] != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestNDProxy(t *testing.T) {
+	thetap, _ := tap.CreateDummyTAP()
+	device := &Device{ID: 1}
+	device.log = NewLogger(LogLevelError, "")
+	device.tap.device = thetap
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.EdgeConfig.Interface.NDProxy = true
+	device.loadARPProxy()
+
+	if got := solicitedNodeMulticast(net.ParseIP("fd00::12:3456:789a")); !got.Equal(net.ParseIP("ff02::1:ff56:789a")) {
+		t.Errorf("solicited-node multicast = %v", got)
+	}
+
+	localMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}
+	remoteMac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 2}
+	var remote tap.MacAddress
+	copy(remote[:], remoteMac)
+	remoteIP, remoteIP6 := net.ParseIP("10.0.0.2"), net.ParseIP("fd00::2")
+	device.learnNeighbor(arpFrame(t, layers.ARPRequest, remoteMac, remoteIP, net.HardwareAddr{0, 0, 0, 0, 0, 0}, remoteIP))
+	device.learnNeighbor(ndFrame(t, layers.ICMPv6TypeNeighborAdvertisement, remoteMac, remoteIP6, remoteIP6))
+	device.l2fib.Store(remote, &IdAndTime{ID: 2, Time: time.Now()})
+
+	if device.proxyNeighbor(arpFrame(t, layers.ARPRequest, localMac, net.ParseIP("10.0.0.1"), net.HardwareAddr{0, 0, 0, 0, 0, 0}, remoteIP)) {
+		t.Error("ARP answered by NDProxy")
+	}
+	ns := ndFrame(t, layers.ICMPv6TypeNeighborSolicitation, localMac, net.ParseIP("fd00::1"), remoteIP6)
+	if !device.proxyNeighbor(ns) {
+		t.Fatal("NS to the solicited-node multicast not answered")
+	}
+
+	// to the group of another address, or with the wrong MAC
+	wrong := append([]byte(nil), ns...)
+	copy(wrong[ethHeaderLen+24:ethHeaderLen+40], net.ParseIP("ff02::1:ff00:3"))
+	if device.proxyNeighbor(wrong) {
+		t.Error("NS to another solicited-node group answered")
+	}
+	wrong = append([]byte(nil), ns...)
+	wrong[5] = 3
+	if device.proxyNeighbor(wrong) {
+		t.Error("NS with a wrong multicast MAC answered")
+	}
+
+	// unicast to the target, the reachability probe is left to the owner
+	unicast := append([]byte(nil), ns...)
+	copy(unicast[0:6], remoteMac)
+	copy(unicast[ethHeaderLen+24:ethHeaderLen+40], remoteIP6)
+	if device.proxyNeighbor(unicast) {
+		t.Error("unicast NS answered")
+	}
+	if s := device.arpProxy.stats(); s.Answered["ND"] != 1 || s.Answered["ARP"] != 0 {
+		t.Errorf("stats = %+v", s)
+	}
+}
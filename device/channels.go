@@ -109,9 +109,9 @@ type autodrainingOutboundQueue struct {
 // The returned channel must not be closed. Senders should signal shutdown using
 // some other means, such as sending a sentinel nil values.
 // All sends to the channel must be best-effort, because there may be no receivers.
-func newAutodrainingOutboundQueue(device *Device) *autodrainingOutboundQueue {
+func newAutodrainingOutboundQueue(device *Device, size int) *autodrainingOutboundQueue {
 	q := &autodrainingOutboundQueue{
-		c: make(chan *QueueOutboundElement, QueueOutboundSize),
+		c: make(chan *QueueOutboundElement, size),
 	}
 	runtime.SetFinalizer(q, device.flushOutboundQueue)
 	return q
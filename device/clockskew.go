@@ -0,0 +1,107 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type pingDelay struct {
+	delay float64 // raw one-way delay(sec) of the pings from the peer, by the clocks of both ends
+	time  time.Time
+}
+
+// clockSkew estimates the clock offset to each peer by the pings of both directions.
+// Every ping echoes the delay of the last ping received from each peer, so that a node knows the delays of both directions:
+// the sum is the RTT, which doesn't depend on the clocks, and the half of the difference is the clock offset, if the link is symmetric.
+// With DynamicRoute.ClockSkew, an offset over Threshold is logged, and the latency falls back to the half of the RTT if UseRTT.
+type clockSkew struct {
+	threshold float64
+	useRTT    bool
+	delays    map[mtypes.Vertex]pingDelay
+	stat      map[mtypes.Vertex]mtypes.ClockSkewStats
+	sync.Mutex
+}
+
+func (device *Device) loadClockSkew() {
+	c := &device.clockSkew
+	c.threshold = device.EdgeConfig.DynamicRoute.ClockSkew.Threshold
+	c.useRTT = device.EdgeConfig.DynamicRoute.ClockSkew.UseRTT
+	c.delays = make(map[mtypes.Vertex]pingDelay)
+	c.stat = make(map[mtypes.Vertex]mtypes.ClockSkewStats)
+}
+
+// echo returns the delay of the ping received from the peer in window, to put in our ping to it.
+// Only its own entry, the delays from the other peers are none of its business.
+func (c *clockSkew) echo(id mtypes.Vertex, now time.Time, window time.Duration) map[mtypes.Vertex]float64 {
+	c.Lock()
+	defer c.Unlock()
+	d, ok := c.delays[id]
+	if !ok {
+		return nil
+	}
+	if now.Sub(d.time) > window {
+		delete(c.delays, id)
+		return nil
+	}
+	return map[mtypes.Vertex]float64{id: d.delay}
+}
+
+// measure records the delay of a ping from the peer, and the delay of our ping echoed by it, 0 if none.
+// It returns the latency to use, and whether the offset crossed the threshold, up or down.
+func (c *clockSkew) measure(id mtypes.Vertex, delay float64, echo float64, now time.Time) (latency float64, crossed bool) {
+	if c.delays == nil {
+		return delay, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	c.delays[id] = pingDelay{delay: delay, time: now}
+	if echo == 0 {
+		return delay, false
+	}
+	old := c.stat[id]
+	s := mtypes.ClockSkewStats{
+		Offset:  (echo - delay) / 2,
+		RTT:     echo + delay,
+		Updated: now,
+	}
+	s.Exceeded = c.threshold > 0 && math.Abs(s.Offset) > c.threshold
+	c.stat[id] = s
+	if s.Exceeded && c.useRTT && s.RTT >= 0 {
+		delay = s.RTT / 2
+	}
+	return delay, s.Exceeded != old.Exceeded
+}
+
+func (c *clockSkew) stats() map[mtypes.Vertex]mtypes.ClockSkewStats {
+	c.Lock()
+	defer c.Unlock()
+	ret := make(map[mtypes.Vertex]mtypes.ClockSkewStats, len(c.stat))
+	for id, s := range c.stat {
+		ret[id] = s
+	}
+	return ret
+}
+
+// measureClockSkew is called on a ping from the peer, and returns the latency to use
+func (device *Device) measureClockSkew(peer *Peer, content mtypes.PingMsg, delay float64) float64 {
+	latency, crossed := device.clockSkew.measure(peer.ID, delay, content.Echo[device.ID], device.graph.GetCurrentTime())
+	if !crossed {
+		return latency
+	}
+	s := device.clockSkew.stats()[peer.ID]
+	if s.Exceeded {
+		device.log.Errorf("Clock of peer %v is %.3fs off from ours, more than ClockSkew.Threshold %vs. The latency to it is not reliable, check the NTP", peer.ID.ToString(), s.Offset, device.clockSkew.threshold)
+	} else if device.LogLevel.LogControl {
+		fmt.Printf("Control: Clock of peer %v is %.3fs off from ours, back in ClockSkew.Threshold\n", peer.ID.ToString(), s.Offset)
+	}
+	return latency
+}
@@ -0,0 +1,60 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestClockSkew(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{DynamicRoute: mtypes.DynamicRouteInfo{ClockSkew: mtypes.ClockSkewInfo{Threshold: 0.5, UseRTT: true}}}
+	device.loadClockSkew()
+	c := &device.clockSkew
+	now := time.Now()
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+	// the first ping from 2 echoes nothing
+	if latency, crossed := c.measure(2, 0.010, 0, now); latency != 0.010 || crossed {
+		t.Errorf("no echo: latency %v, crossed %v", latency, crossed)
+	}
+	if echo := c.echo(2, now, time.Minute); len(echo) != 1 || echo[2] != 0.010 {
+		t.Errorf("echo = %v", echo)
+	}
+	if echo := c.echo(3, now, time.Minute); len(echo) != 0 {
+		t.Errorf("echo to 3 = %v", echo)
+	}
+	if len(c.stats()) != 0 {
+		t.Errorf("stats without echo: %v", c.stats())
+	}
+
+	// 10ms each way, the clock of 2 is 0.1s ahead: 2 -> us reads -0.09, us -> 2 reads 0.11
+	latency, crossed := c.measure(2, -0.090, 0.110, now)
+	if s := c.stats()[2]; !near(s.Offset, 0.1) || !near(s.RTT, 0.02) || s.Exceeded || crossed || latency != -0.090 {
+		t.Errorf("in threshold: %+v, latency %v, crossed %v", s, latency, crossed)
+	}
+
+	// 1s ahead, over the threshold, the latency is half of the RTT
+	latency, crossed = c.measure(2, -0.990, 1.010, now)
+	if s := c.stats()[2]; !near(s.Offset, 1) || !s.Exceeded || !crossed || !near(latency, 0.010) {
+		t.Errorf("over threshold: %+v, latency %v, crossed %v", s, latency, crossed)
+	}
+	if _, crossed = c.measure(2, -0.990, 1.010, now); crossed {
+		t.Error("crossed again")
+	}
+	if _, crossed = c.measure(2, 0.010, 0.010, now); !crossed || c.stats()[2].Exceeded {
+		t.Error("not back in threshold")
+	}
+
+	// the old delays are not echoed
+	if echo := c.echo(2, now.Add(2*time.Minute), time.Minute); len(echo) != 0 {
+		t.Errorf("echo = %v", echo)
+	}
+}
@@ -0,0 +1,271 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// The TCP control channel carries the control messages between an EdgeNode and the SuperNode,
+// while the data plane stays on UDP. The EdgeNode connects to /edge/control of the EdgeAPI, and
+// upgrades the connection after proving it owns its private key:
+// the SuperNode sends a random challenge, the EdgeNode replies HMAC-SHA256(DH(edge, super), challenge).
+// Then each message is a frame of usage(1 byte) + length(4 bytes, big endian) + EgHeader + body.
+const (
+	ControlUpgrade         = "eg-control"
+	ControlChallengeHeader = "Eg-Control-Challenge"
+	ControlChallengeLen    = 32
+	ControlMaxFrameLen     = 1 << 20
+	ControlDialTimeout     = 8 * time.Second
+)
+
+// ControlConn is one TCP control channel. Send is safe for concurrent use.
+type ControlConn struct {
+	device *Device
+	conn   net.Conn
+	r      *bufio.Reader
+	wlock  sync.Mutex
+}
+
+func NewControlConn(device *Device, conn net.Conn, r *bufio.Reader) *ControlConn {
+	return &ControlConn{
+		device: device,
+		conn:   conn,
+		r:      r,
+	}
+}
+
+func (c *ControlConn) Send(usage path.Usage, packet []byte) error {
+	return c.send(usage, unknownAction, packet)
+}
+
+// SendServerUpdate sends a ServerUpdate, whose action is counted in MessageStats.
+func (c *ControlConn) SendServerUpdate(action mtypes.ServerCommand, packet []byte) error {
+	return c.send(path.ServerUpdate, action, packet)
+}
+
+func (c *ControlConn) send(usage path.Usage, action mtypes.ServerCommand, packet []byte) error {
+	if len(packet) > ControlMaxFrameLen {
+		return fmt.Errorf("control frame too large: %v", len(packet))
+	}
+	frame := make([]byte, 5+len(packet))
+	frame[0] = byte(usage)
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(packet)))
+	copy(frame[5:], packet)
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(ControlDialTimeout))
+	if _, err := c.conn.Write(frame); err != nil {
+		c.conn.Close()
+		return err
+	}
+	c.device.msgCount.sent.count(usage, action)
+	return nil
+}
+
+// Recv reads the next frame. timeout is the read deadline, 0 means no deadline.
+func (c *ControlConn) Recv(timeout time.Duration) (usage path.Usage, packet []byte, err error) {
+	if timeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetReadDeadline(time.Time{})
+	}
+	var head [5]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	usage = path.Usage(head[0])
+	length := binary.BigEndian.Uint32(head[1:5])
+	if length < path.EgHeaderLen || length > ControlMaxFrameLen {
+		return usage, nil, fmt.Errorf("invalid control frame length: %v", length)
+	}
+	packet = make([]byte, length)
+	_, err = io.ReadFull(c.r, packet)
+	return
+}
+
+func (c *ControlConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *ControlConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// ControlAuth returns HMAC-SHA256(DH(our private key, pk), challenge).
+func (device *Device) ControlAuth(pk NoisePublicKey, challenge []byte) []byte {
+	device.staticIdentity.RLock()
+	ss := device.staticIdentity.privateKey.sharedSecret(pk)
+	device.staticIdentity.RUnlock()
+	mac := hmac.New(sha256.New, ss[:])
+	mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// ProcessControl processes a control message received from the TCP control channel, like the ones from UDP.
+func (device *Device) ProcessControl(peer *Peer, usage path.Usage, packet []byte) error {
+	if usage == path.NormalPacket || !usage.IsValid_EgType() {
+		return fmt.Errorf("not a control message: %v", usage.ToString())
+	}
+	if !device.IsSuperNode && !device.ingress.check(peer.ID, usage) {
+		return fmt.Errorf("%v not allowed from peer %v", usage.ToString(), peer.ID.ToString())
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Recv %v From:%v via TCP\n", device.sprint_received(usage, packet[path.EgHeaderLen:]), peer.ID.ToString())
+	}
+	return device.process_received(usage, peer, packet[path.EgHeaderLen:])
+}
+
+func (device *Device) controlSuperPeer() *Peer {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.SuperPeer {
+		return peer
+	}
+	return nil
+}
+
+// sendControlTCP sends to the supernode by the TCP control channel, returns false if it's not connected.
+func (device *Device) sendControlTCP(usage path.Usage, packet []byte) bool {
+	device.controlConn.RLock()
+	cc := device.controlConn.conn
+	device.controlConn.RUnlock()
+	if cc == nil {
+		return false
+	}
+	return cc.Send(usage, packet) == nil
+}
+
+// dialControl connects to the TCP control channel of the supernode.
+func (device *Device) dialControl(superPeer *Peer) (*ControlConn, error) {
+	q := url.Values{}
+	q.Add("NodeID", device.ID.ToString())
+	q.Add("PubKey", device.staticIdentity.publicKey.ToString())
+	req, err := http.NewRequest("GET", device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl+"/edge/control?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", ControlUpgrade)
+	host := req.URL.Host
+	if req.URL.Port() == "" {
+		if req.URL.Scheme == "https" {
+			host = net.JoinHostPort(req.URL.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(req.URL.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{Timeout: ControlDialTimeout}
+	var conn net.Conn
+	if req.URL.Scheme == "https" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: req.URL.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ControlDialTimeout))
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("upgrade failed: %v %v", resp.Status, string(body))
+	}
+	challenge, err := base64.StdEncoding.DecodeString(resp.Header.Get(ControlChallengeHeader))
+	if err != nil || len(challenge) != ControlChallengeLen {
+		conn.Close()
+		return nil, errors.New("invalid challenge")
+	}
+	superPeer.handshake.mutex.RLock()
+	pk := superPeer.handshake.remoteStatic
+	superPeer.handshake.mutex.RUnlock()
+	if _, err = conn.Write(device.ControlAuth(pk, challenge)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return NewControlConn(device, conn, r), nil
+}
+
+// RoutineControlTCP keeps the TCP control channel to the supernode connected, if ControlTransport is tcp.
+// The supernode replies every Register, so nothing received in PeerAliveTimeout means the connection is half-open.
+// It's closed then, and the control messages fall back to UDP until it's connected again.
+func (device *Device) RoutineControlTCP() {
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode || device.EdgeConfig.DynamicRoute.SuperNode.ControlTransport != mtypes.ControlTransportTCP {
+		return
+	}
+	retry := mtypes.S2TD(device.EdgeConfig.DynamicRoute.ConnNextTry)
+	if retry <= 0 {
+		retry = time.Second
+	}
+	for {
+		superPeer := device.controlSuperPeer()
+		if superPeer == nil {
+			time.Sleep(retry)
+			continue
+		}
+		cc, err := device.dialControl(superPeer)
+		if err != nil {
+			if device.LogLevel.LogControl {
+				fmt.Printf("Control: Connect TCP control channel failed, use UDP: %v\n", err)
+			}
+			time.Sleep(retry)
+			continue
+		}
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: TCP control channel connected to %v\n", cc.RemoteAddr())
+		}
+		device.controlConn.Lock()
+		device.controlConn.conn = cc
+		device.controlConn.Unlock()
+		device.Chan_SendRegisterStart <- struct{}{}
+		for {
+			usage, packet, err := cc.Recv(mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout))
+			if err != nil {
+				if device.LogLevel.LogControl {
+					fmt.Printf("Control: TCP control channel closed, use UDP: %v\n", err)
+				}
+				break
+			}
+			if err := device.ProcessControl(superPeer, usage, packet); err != nil {
+				device.log.Errorf("Process TCP control message failed: %v", err)
+			}
+		}
+		device.controlConn.Lock()
+		device.controlConn.conn = nil
+		device.controlConn.Unlock()
+		cc.Close()
+		time.Sleep(retry)
+	}
+}
@@ -7,6 +7,7 @@ package device
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -22,7 +23,6 @@ import (
 	"github.com/KusakabeSi/EtherGuard-VPN/ratelimiter"
 	"github.com/KusakabeSi/EtherGuard-VPN/rwcancel"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
-	fixed_time_cache "github.com/KusakabeSi/go-cache"
 )
 
 type Device struct {
@@ -52,6 +52,8 @@ type Device struct {
 		netlinkCancel *rwcancel.RWCancel
 		port          uint16 // listening port
 		fwmark        uint32 // mark value (0 = disabled)
+		sockRecvBuf   int    // SO_RCVBUF (0 = OS default)
+		sockSendBuf   int    // SO_SNDBUF (0 = OS default)
 	}
 
 	staticIdentity struct {
@@ -74,7 +76,13 @@ type Device struct {
 		LocalV6      net.IP
 	}
 
-	state_hashes mtypes.StateHash
+	state_hashes    mtypes.StateHash
+	nhTableReceived AtomicBool // the NhTable is in sync with the supernode
+	nhStatus        nhTableStatus
+	nhTableRejected nhTableRejected
+	tapError        tapErrorStats
+	noRouteStat     noRouteStats
+	superSigningKey ed25519.PublicKey // verifies the control messages from supernode, nil if not required
 
 	event_tryendpoint chan struct{}
 
@@ -90,17 +98,41 @@ type Device struct {
 	Chan_SendPingStart      chan struct{}
 	Chan_SendRegisterStart  chan struct{}
 	Chan_HttpPostStart      chan struct{}
+	Chan_Renumbered         chan mtypes.Vertex // the new NodeID from the supernode, restart to use it
+	Chan_NhTableChanged     chan struct{}      // signaled after the NhTable is replaced, never blocks
 
 	indexTable    IndexTable
 	cookieChecker CookieChecker
 
-	IsSuperNode bool
-	ID          mtypes.Vertex
-	graph       *path.IG
-	l2fib       sync.Map
-	LogLevel    mtypes.LoggerInfo
-	DupData     fixed_time_cache.Cache
-	Version     string
+	IsSuperNode  bool
+	ID           mtypes.Vertex
+	graph        *path.IG
+	l2fib        sync.Map
+	LogLevel     mtypes.LoggerInfo
+	dropLog      dropLogLimiter
+	dupCheck     dupCheck
+	msgCount     msgCount
+	etherType    etherTypeFilter
+	arpProxy     arpProxy
+	innerACL     innerACL
+	breaker      flapBreaker
+	pingProbe    pingProbe
+	pingSchedule pingSchedule
+	clockSkew    clockSkew
+	ingress      ingressAllowlist
+	registered   registerReply
+	superBalance superBalance
+	flood        reliableFlood
+	mssClamp     bool
+	reorder      reorderBuffer
+	latencyLog   latencyLog
+	unknownStat  mtypes.UnknownUnicastStats
+	traces       traceWaiters
+	Version      string
+	controlConn  struct {
+		sync.RWMutex
+		conn *ControlConn // TCP control channel to the supernode, nil if not connected
+	}
 
 	HttpPostCount uint64
 	JWTSecret     mtypes.JWTSecret
@@ -128,8 +160,10 @@ type Device struct {
 }
 
 type IdAndTime struct {
-	ID   mtypes.Vertex
-	Time time.Time
+	ID      mtypes.Vertex
+	Time    time.Time
+	Timeout time.Duration // 0 means never expire
+	Static  bool          // from L2FIBStatic, the ID will not be relearned
 }
 
 // deviceState represents the state of a Device.
@@ -171,6 +205,9 @@ func (device *Device) isUp() bool {
 func removePeerLocked(device *Device, peer *Peer, key NoisePublicKey) {
 	// stop routing and processing of packets
 	peer.Stop()
+	peer.handshake.mutex.Lock()
+	peer.handshake.clearOldPresharedKey()
+	peer.handshake.mutex.Unlock()
 
 	// remove from peer map
 	id := peer.ID
@@ -364,15 +401,34 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		device.EdgeConfigPath = configpath
 		device.EdgeConfig = econfig
 		device.SuperConfig = &mtypes.SuperConfig{}
-		device.DupData = *fixed_time_cache.NewCache(mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeout), false, mtypes.S2TD(60))
+		device.initDupCheck(econfig)
 		device.event_tryendpoint = make(chan struct{}, 1<<6)
 		device.Chan_save_config = make(chan struct{}, 1<<5)
 		device.Chan_Device_Initialized = make(chan struct{}, 1<<5)
 		device.Chan_SendPingStart = make(chan struct{}, 1<<5)
 		device.Chan_SendRegisterStart = make(chan struct{}, 1<<5)
 		device.Chan_HttpPostStart = make(chan struct{}, 1<<5)
+		device.Chan_Renumbered = make(chan mtypes.Vertex, 1)
+		device.Chan_NhTableChanged = make(chan struct{}, 1)
 		device.LogLevel = econfig.LogLevel
 		device.SuperConfig.DampingResistance = device.EdgeConfig.DynamicRoute.DampingResistance
+		device.loadL2FIBStatic()
+		device.loadEtherTypeFilter()
+		device.loadARPProxy()
+		device.loadInnerACL()
+		device.loadIngressAllowlist()
+		device.loadFlapBreaker()
+		device.loadPingProbe()
+		device.loadPingSchedule()
+		device.loadClockSkew()
+		device.loadReliableFlood()
+		device.mssClamp = econfig.Interface.MSSClamp
+		device.loadReorderBuffer()
+		device.loadLatencyLog()
+		device.loadSuperSigningKey()
+		device.loadSuperBalance()
+		device.net.sockRecvBuf = econfig.Interface.SockRecvBufferSize
+		device.net.sockSendBuf = econfig.Interface.SockSendBufferSize
 
 	}
 
@@ -383,6 +439,7 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 		}
 		if IsSuperNode {
 			go device.RoutineResetEndpoint()
+			go device.RoutineResolveEndpoint()
 		} else {
 			go device.RoutineTryReceivedEndpoint()
 			go device.RoutineDetectOfflineAndTryNextEndpoint()
@@ -390,8 +447,17 @@ func NewDevice(tapDevice tap.Device, id mtypes.Vertex, bind conn.Bind, logger *L
 			go device.RoutineSendPing(device.Chan_SendPingStart)
 			go device.RoutineSpreadAllMyNeighbor()
 			go device.RoutineResetEndpoint()
+			go device.RoutineResolveEndpoint()
 			go device.RoutineClearL2FIB()
+			go device.RoutineDupCheck()
+			go device.RoutineReorderFlush()
+			go device.RoutineReliableFlood()
+			go device.RoutineFlushLatencyLog()
 			go device.RoutineRecalculateNhTable()
+			go device.RoutineSupernodeLost()
+			go device.RoutinePollNhTable()
+			go device.RoutineExpireBootstrap()
+			go device.RoutineControlTCP()
 			go device.RoutinePostPeerInfo(device.Chan_HttpPostStart)
 		}
 	}()
@@ -625,6 +691,7 @@ func (device *Device) Close() {
 	device.state.stopping.Wait()
 
 	device.rate.limiter.Close()
+	device.latencyLog.close()
 
 	device.log.Verbosef("Device closed")
 	close(device.closed)
@@ -672,6 +739,86 @@ func (device *Device) Bind() conn.Bind {
 	return device.net.bind
 }
 
+// Ready reports why the edge is not ready to forward packets yet, or nil if it is.
+// In super mode, it needs an alive supernode and a NhTable received from it.
+func (device *Device) Ready() error {
+	if !device.isUp() {
+		return errors.New("device is not up")
+	}
+	if device.IsSuperNode || !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return nil
+	}
+	if !device.nhTableReceived.Get() {
+		return errors.New("NhTable not received")
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	for _, peer := range device.peers.keyMap {
+		if peer.ID == mtypes.NodeID_SuperNode && peer.IsPeerAlive() {
+			return nil
+		}
+	}
+	return errors.New("SuperNode not connected")
+}
+
+// Metrics returns the dedup and control message stats, and the outbound queue and endpoint of each peer.
+func (device *Device) Metrics() mtypes.EdgeMetrics {
+	metrics := mtypes.EdgeMetrics{
+		DupCheck:        device.DupCheckStats(),
+		Messages:        device.MessageStats(),
+		EtherType:       device.etherType.stats(),
+		ARPProxy:        device.arpProxy.stats(),
+		Flood:           device.flood.stats(),
+		Unknown:         device.unknownUnicastStats(),
+		NoRoute:         device.noRouteStat.stats(),
+		InnerACL:        device.innerACL.stats(),
+		Ingress:         device.ingress.stats(),
+		Breakers:        device.breaker.stats(time.Now()),
+		PingProbe:       device.pingProbe.stats(time.Now(), mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)),
+		ClockSkew:       device.clockSkew.stats(),
+		Reorder:         device.reorder.stats(),
+		Recalc:          device.graph.RecalcStats(),
+		Asymmetric:      device.graph.Asymmetric(),
+		Register:        device.registered.stats(),
+		NhTableRejected: device.nhTableRejected.load(),
+		TapError:        device.tapError.stats(),
+		Queues:          make(map[mtypes.Vertex]mtypes.PeerQueueStats),
+		Endpoints:       make(map[mtypes.Vertex]mtypes.PeerEndpointStats),
+	}
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	metrics.SuperNode = device.superBalance.stats(device.peers.SuperPeer)
+	for _, peer := range device.peers.keyMap {
+		metrics.Queues[peer.ID] = peer.QueueStats()
+		metrics.Endpoints[peer.ID] = mtypes.PeerEndpointStats{
+			Endpoint:   peer.GetEndpointDstStr(),
+			LastChange: peer.LastEndpointChange.Load().(time.Time),
+			PathMTU:    int(atomic.LoadInt32(&peer.pathMTU)),
+		}
+	}
+	return metrics
+}
+
+// ListenPorts returns all the UDP ports we are listening on, the first one is the main port.
+func (device *Device) ListenPorts() []uint16 {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if lp, ok := device.net.bind.(conn.ListenPorts); ok {
+		return lp.ListenPorts()
+	}
+	return []uint16{device.net.port}
+}
+
+// DataPort returns the UDP port serving the peers if it's separated from the control port by ListenPort_Data, 0 if not.
+func (device *Device) DataPort() uint16 {
+	device.net.RLock()
+	defer device.net.RUnlock()
+	if dp, ok := device.net.bind.(conn.DataPort); ok {
+		return dp.DataPort()
+	}
+	return 0
+}
+
 func (device *Device) BindSetMark(mark uint32) error {
 	device.net.Lock()
 	defer device.net.Unlock()
@@ -741,6 +888,11 @@ func (device *Device) BindUpdate() error {
 		}
 	}
 
+	// set socket buffer sizes
+	if netc.sockRecvBuf != 0 || netc.sockSendBuf != 0 {
+		device.setSockBufferLocked()
+	}
+
 	// clear cached source addresses
 	device.peers.RLock()
 	for _, peer := range device.peers.keyMap {
@@ -764,6 +916,26 @@ func (device *Device) BindUpdate() error {
 	return nil
 }
 
+// setSockBufferLocked applies SockRecvBufferSize and SockSendBufferSize, and logs the sizes granted by the OS.
+// It's not fatal if the OS grants less, the tunnel still works with smaller buffers.
+func (device *Device) setSockBufferLocked() {
+	netc := &device.net
+	sb, ok := netc.bind.(conn.SockBuffer)
+	if !ok {
+		device.log.Errorf("SockRecvBufferSize and SockSendBufferSize are not supported by this bind")
+		return
+	}
+	recv, send, err := sb.SetSockBuffer(netc.sockRecvBuf, netc.sockSendBuf)
+	if err != nil {
+		device.log.Errorf("Failed to set UDP socket buffer: %v", err)
+		return
+	}
+	device.log.Verbosef("UDP socket buffer: recv %v bytes (requested %v), send %v bytes (requested %v)", recv, netc.sockRecvBuf, send, netc.sockSendBuf)
+	if recv < netc.sockRecvBuf || send < netc.sockSendBuf {
+		device.log.Errorf("UDP socket buffer is smaller than requested: recv %v/%v, send %v/%v. Raise net.core.rmem_max and net.core.wmem_max, or run with CAP_NET_ADMIN", recv, netc.sockRecvBuf, send, netc.sockSendBuf)
+	}
+}
+
 func (device *Device) BindClose() error {
 	device.net.Lock()
 	err := closeBindLocked(device)
@@ -0,0 +1,69 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+)
+
+const (
+	DropLogPerSecond = 10 // max drop logs printed per second
+	DropLogDumpLen   = 32 // bytes of the dropped packet to print
+)
+
+type dropLogLimiter struct {
+	sync.Mutex
+	windowStart time.Time
+	count       int
+	suppressed  int
+}
+
+func (l *dropLogLimiter) allow() (ok bool, suppressed int) {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	if now.Sub(l.windowStart) >= time.Second {
+		suppressed = l.suppressed
+		l.windowStart = now
+		l.count = 0
+		l.suppressed = 0
+	}
+	if l.count >= DropLogPerSecond {
+		l.suppressed += 1
+		return false, suppressed
+	}
+	l.count += 1
+	return true, suppressed
+}
+
+// LogDrop prints why a received packet is dropped, with the source endpoint
+// and the first bytes of the packet. It is rate limited to DropLogPerSecond.
+func (device *Device) LogDrop(reason string, endpoint conn.Endpoint, packet []byte) {
+	if !device.LogLevel.LogDrop {
+		return
+	}
+	ok, suppressed := device.dropLog.allow()
+	if suppressed > 0 {
+		fmt.Printf("Drop: %v drop logs suppressed\n", suppressed)
+	}
+	if !ok {
+		return
+	}
+	src := "nil"
+	if endpoint != nil {
+		src = endpoint.DstToString()
+	}
+	dump := packet
+	if len(dump) > DropLogDumpLen {
+		dump = dump[:DropLogDumpLen]
+	}
+	fmt.Printf("Drop: %v From:%v Len:%v Data:%v\n", reason, src, len(packet), hex.EncodeToString(dump))
+}
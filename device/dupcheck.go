@@ -0,0 +1,127 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	DupCheckAdjustInterval = time.Second * 10
+	DupCheckRateHigh       = 0.05  // widen the window if the duplicate rate is higher than this
+	DupCheckRateLow        = 0.005 // narrow the window if the duplicate rate is lower than this
+)
+
+var dupCheckTable = crc32.MakeTable(crc32.Castagnoli)
+
+type dupCheck struct {
+	sync.Mutex
+	seen       map[uint32]time.Time // crc32 of the packet -> first seen time
+	window     time.Duration
+	min_window time.Duration
+	max_window time.Duration
+	checked    uint64 // in this adjust interval
+	duplicated uint64 // in this adjust interval
+	suppressed map[mtypes.Vertex]uint64
+}
+
+func (device *Device) initDupCheck(econfig *mtypes.EdgeConfig) {
+	device.dupCheck.seen = make(map[uint32]time.Time)
+	device.dupCheck.suppressed = make(map[mtypes.Vertex]uint64)
+	device.dupCheck.max_window = mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeout)
+	device.dupCheck.min_window = mtypes.S2TD(econfig.DynamicRoute.DupCheckTimeoutMin)
+	if device.dupCheck.min_window <= 0 || device.dupCheck.min_window > device.dupCheck.max_window {
+		device.dupCheck.min_window = device.dupCheck.max_window
+	}
+	device.dupCheck.window = device.dupCheck.max_window
+}
+
+// CheckNoDup returns false if the same packet is seen in the dedup window.
+// The first seen time is kept, so a packet looping in the mesh can't refresh itself.
+// Nothing is recorded if the window is disabled, because RoutineDupCheck doesn't run to expire it.
+func (device *Device) CheckNoDup(src_nodeID mtypes.Vertex, packet []byte) bool {
+	crc32result := crc32.Checksum(packet, dupCheckTable)
+	now := time.Now()
+	device.dupCheck.Lock()
+	defer device.dupCheck.Unlock()
+	first, ok := device.dupCheck.seen[crc32result]
+	dup := ok && now.Sub(first) < device.dupCheck.window
+	if !dup && device.dupCheck.window > 0 {
+		device.dupCheck.seen[crc32result] = now
+	}
+	device.dupCheck.checked += 1
+	if dup {
+		device.dupCheck.duplicated += 1
+		device.dupCheck.suppressed[src_nodeID] += 1
+	}
+	return !dup
+}
+
+// DupCheckStats returns the current dedup window and the suppressed duplicates per source.
+func (device *Device) DupCheckStats() mtypes.DupCheckStats {
+	device.dupCheck.Lock()
+	defer device.dupCheck.Unlock()
+	stats := mtypes.DupCheckStats{
+		Window:     device.dupCheck.window.Seconds(),
+		Entries:    len(device.dupCheck.seen),
+		Suppressed: make(map[mtypes.Vertex]uint64, len(device.dupCheck.suppressed)),
+	}
+	for src, count := range device.dupCheck.suppressed {
+		stats.Suppressed[src] = count
+	}
+	return stats
+}
+
+// RoutineDupCheck removes the expired entries of the dedup table.
+// If DupCheckTimeoutMin is set, it also doubles the dedup window when the duplicate rate is high,
+// and halves it when low. The window stays in the range [DupCheckTimeoutMin, DupCheckTimeout].
+func (device *Device) RoutineDupCheck() {
+	if device.dupCheck.max_window <= 0 {
+		return
+	}
+	interval := DupCheckAdjustInterval
+	if device.dupCheck.min_window < interval {
+		interval = device.dupCheck.min_window
+	}
+	for {
+		time.Sleep(interval)
+		now := time.Now()
+		device.dupCheck.Lock()
+		old_window := device.dupCheck.window
+		var rate float64
+		if device.dupCheck.checked > 0 {
+			rate = float64(device.dupCheck.duplicated) / float64(device.dupCheck.checked)
+		}
+		if rate > DupCheckRateHigh {
+			device.dupCheck.window *= 2
+			if device.dupCheck.window > device.dupCheck.max_window {
+				device.dupCheck.window = device.dupCheck.max_window
+			}
+		} else if rate < DupCheckRateLow {
+			device.dupCheck.window /= 2
+			if device.dupCheck.window < device.dupCheck.min_window {
+				device.dupCheck.window = device.dupCheck.min_window
+			}
+		}
+		new_window := device.dupCheck.window
+		device.dupCheck.checked = 0
+		device.dupCheck.duplicated = 0
+		for crc, first := range device.dupCheck.seen {
+			if now.Sub(first) >= new_window {
+				delete(device.dupCheck.seen, crc)
+			}
+		}
+		device.dupCheck.Unlock()
+		if new_window != old_window && device.LogLevel.LogInternal {
+			fmt.Printf("Internal: Dup check window %v -> %v, duplicate rate: %.4f\n", old_window, new_window, rate)
+		}
+	}
+}
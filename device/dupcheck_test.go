@@ -0,0 +1,40 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestCheckNoDup(t *testing.T) {
+	device := &Device{}
+	econfig := &mtypes.EdgeConfig{}
+	econfig.DynamicRoute.DupCheckTimeout = 40
+	device.initDupCheck(econfig)
+	if !device.CheckNoDup(2, []byte("hello")) {
+		t.Error("first packet reported as duplicate")
+	}
+	if device.CheckNoDup(2, []byte("hello")) {
+		t.Error("duplicate not detected")
+	}
+	if s := device.DupCheckStats(); s.Entries != 1 || s.Suppressed[2] != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	device = &Device{}
+	econfig.DynamicRoute.DupCheckTimeout = -1
+	device.initDupCheck(econfig)
+	for i := 0; i < 2; i++ {
+		if !device.CheckNoDup(2, []byte("hello")) {
+			t.Error("duplicate detected with the dedup window disabled")
+		}
+	}
+	if s := device.DupCheckStats(); s.Entries != 0 {
+		t.Errorf("%v entries recorded with the dedup window disabled", s.Entries)
+	}
+}
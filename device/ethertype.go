@@ -0,0 +1,68 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// etherTypeFilter drops the frames not in InterfaceConf.AllowedEtherTypes, in both directions of the TAP
+type etherTypeFilter struct {
+	allowed map[uint16]bool // nil means allow all
+	dropped map[uint16]uint64
+	sync.Mutex
+}
+
+func (device *Device) loadEtherTypeFilter() {
+	if len(device.EdgeConfig.Interface.AllowedEtherTypes) == 0 {
+		return
+	}
+	device.etherType.allowed = make(map[uint16]bool)
+	device.etherType.dropped = make(map[uint16]uint64)
+	for _, s := range device.EdgeConfig.Interface.AllowedEtherTypes {
+		et, err := mtypes.ParseEtherType(s)
+		if err != nil {
+			device.log.Errorf("%v", err)
+			continue
+		}
+		device.etherType.allowed[et] = true
+	}
+}
+
+// etherTypeAllowed checks the ethernet frame against AllowedEtherTypes, and counts the dropped ones
+func (device *Device) etherTypeAllowed(frame []byte) bool {
+	f := &device.etherType
+	if f.allowed == nil {
+		return true
+	}
+	et := tap.GetEtherType(frame)
+	if et < 0x0600 {
+		et = mtypes.EtherTypeLLC
+	}
+	if f.allowed[et] {
+		return true
+	}
+	f.Lock()
+	f.dropped[et]++
+	f.Unlock()
+	device.LogDrop("EtherType "+mtypes.EtherTypeString(et)+" not allowed", nil, frame)
+	return false
+}
+
+func (f *etherTypeFilter) stats() mtypes.EtherTypeStats {
+	ret := mtypes.EtherTypeStats{
+		Dropped: make(map[string]uint64),
+	}
+	f.Lock()
+	defer f.Unlock()
+	for et, n := range f.dropped {
+		ret.Dropped[mtypes.EtherTypeString(et)] = n
+	}
+	return ret
+}
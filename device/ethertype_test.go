@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestEtherTypeFilter(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.EdgeConfig.Interface.AllowedEtherTypes = []string{"IPv4", "ARP", "0x86DD"}
+	device.loadEtherTypeFilter()
+
+	frame := func(tags ...uint16) []byte {
+		f := make([]byte, 12, 64)
+		for _, et := range tags {
+			f = append(f, byte(et>>8), byte(et), 0, 1)
+		}
+		return f
+	}
+	tests := []struct {
+		frame   []byte
+		allowed bool
+	}{
+		{frame(0x0800), true},
+		{frame(0x0806), true},
+		{frame(0x86dd), true},
+		{frame(0x8100, 0x0800), true},
+		{frame(0x88a8, 0x8100, 0x86dd), true},
+		{frame(0x88cc), false},
+		{frame(0x8100, 0x88cc), false},
+		{frame(0x0026), false}, // STP, 802.3 LLC
+	}
+	for i, test := range tests {
+		if allowed := device.etherTypeAllowed(test.frame); allowed != test.allowed {
+			t.Errorf("frame %v: expected allowed=%v", i, test.allowed)
+		}
+	}
+	dropped := device.etherType.stats().Dropped
+	if dropped["0x88cc"] != 2 || dropped["LLC"] != 1 {
+		t.Errorf("unexpected dropped stats: %v", dropped)
+	}
+}
@@ -0,0 +1,108 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+type flapState struct {
+	lastPing  time.Time
+	ups       []time.Time // the re-connections in the window
+	openUntil time.Time
+	trips     uint64
+}
+
+// flapBreaker stops a peer whose connection keeps dropping and coming back from churning the graph.
+// A ping from a peer not heard for PeerAliveTimeout is a re-connection. After Cycles of them in Window, the breaker
+// trips: for Cooldown, the peer is reported to be unreachable(Infinity), and we don't try its endpoints.
+type flapBreaker struct {
+	cycles   int // 0 means disabled
+	window   time.Duration
+	cooldown time.Duration
+	peers    map[mtypes.Vertex]*flapState
+	sync.Mutex
+}
+
+func (device *Device) loadFlapBreaker() {
+	conf := device.EdgeConfig.DynamicRoute.FlapBreaker
+	if conf.Cycles <= 0 {
+		return
+	}
+	b := &device.breaker
+	b.cycles = conf.Cycles
+	b.window = mtypes.S2TD(conf.Window)
+	b.cooldown = mtypes.S2TD(conf.Cooldown)
+	b.peers = make(map[mtypes.Vertex]*flapState)
+}
+
+// ping records a ping from the peer. It returns whether the breaker of it is open, and whether it's just tripped.
+func (b *flapBreaker) ping(id mtypes.Vertex, now time.Time, aliveTimeout time.Duration) (open bool, tripped bool) {
+	if b.cycles == 0 {
+		return false, false
+	}
+	b.Lock()
+	defer b.Unlock()
+	s, ok := b.peers[id]
+	if !ok {
+		s = &flapState{}
+		b.peers[id] = s
+	}
+	reconnected := !s.lastPing.IsZero() && now.Sub(s.lastPing) > aliveTimeout
+	s.lastPing = now
+	if now.Before(s.openUntil) {
+		return true, false
+	}
+	if !reconnected {
+		return false, false
+	}
+	s.ups = append(s.ups, now)
+	for len(s.ups) > 0 && now.Sub(s.ups[0]) > b.window {
+		s.ups = s.ups[1:]
+	}
+	if len(s.ups) < b.cycles {
+		return false, false
+	}
+	s.ups = nil
+	s.openUntil = now.Add(b.cooldown)
+	s.trips++
+	return true, true
+}
+
+func (b *flapBreaker) isOpen(id mtypes.Vertex, now time.Time) bool {
+	if b.cycles == 0 {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	s, ok := b.peers[id]
+	return ok && now.Before(s.openUntil)
+}
+
+func (b *flapBreaker) stats(now time.Time) map[mtypes.Vertex]mtypes.FlapBreakerState {
+	ret := make(map[mtypes.Vertex]mtypes.FlapBreakerState)
+	b.Lock()
+	defer b.Unlock()
+	for id, s := range b.peers {
+		state := mtypes.FlapBreakerState{
+			Trips: s.trips,
+		}
+		for _, t := range s.ups {
+			if now.Sub(t) <= b.window {
+				state.Cycles++
+			}
+		}
+		if now.Before(s.openUntil) {
+			state.Open = true
+			state.OpenUntil = s.openUntil
+		}
+		ret[id] = state
+	}
+	return ret
+}
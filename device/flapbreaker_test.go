@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestFlapBreaker(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{DynamicRoute: mtypes.DynamicRouteInfo{FlapBreaker: mtypes.FlapInfo{Cycles: 3, Window: 60, Cooldown: 30}}}
+	device.loadFlapBreaker()
+	b := &device.breaker
+	alive := 5 * time.Second
+	now := time.Now()
+
+	// steady pings are not re-connections
+	for i := 0; i < 10; i++ {
+		if open, _ := b.ping(1, now.Add(time.Duration(i)*time.Second), alive); open {
+			t.Fatal("tripped by steady pings")
+		}
+	}
+	if s := b.stats(now)[1].Cycles; s != 0 {
+		t.Errorf("cycles = %v, want 0", s)
+	}
+
+	// re-connected 3 times in the window
+	now = now.Add(10 * time.Second)
+	for i := 1; i <= 3; i++ {
+		now = now.Add(10 * time.Second)
+		open, tripped := b.ping(1, now, alive)
+		if open != (i == 3) || tripped != (i == 3) {
+			t.Fatalf("#%v: open %v tripped %v", i, open, tripped)
+		}
+	}
+	if !b.isOpen(1, now) || b.isOpen(2, now) {
+		t.Error("wrong peer taken as down")
+	}
+	if s := b.stats(now)[1]; !s.Open || s.Trips != 1 || !s.OpenUntil.Equal(now.Add(30*time.Second)) {
+		t.Errorf("stats = %+v", s)
+	}
+	if open, tripped := b.ping(1, now.Add(20*time.Second), alive); !open || tripped {
+		t.Errorf("during cooldown: open %v tripped %v", open, tripped)
+	}
+
+	// closed after the cooldown
+	now = now.Add(30 * time.Second)
+	if b.isOpen(1, now) {
+		t.Error("still open after the cooldown")
+	}
+	if open, _ := b.ping(1, now, alive); open {
+		t.Error("open after the cooldown")
+	}
+
+	// re-connections out of the window don't add up
+	for i := 0; i < 5; i++ {
+		now = now.Add(40 * time.Second)
+		if open, _ := b.ping(1, now, alive); open {
+			t.Fatalf("#%v: tripped by re-connections out of the window", i)
+		}
+	}
+
+	// disabled
+	d := &Device{}
+	if open, _ := d.breaker.ping(1, now, alive); open || d.breaker.isOpen(1, now) || len(d.breaker.stats(now)) != 0 {
+		t.Error("disabled breaker is open")
+	}
+}
@@ -0,0 +1,92 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// ingressAllowlist drops the messages a peer is not supposed to send, by its role. The supernode sends only ServerUpdate
+// and RegisterReply, and the other edges send only the frames and the edge to edge control messages,
+// so that a compromised edge can't inject the routing updates. EdgeConfig.MessageAllowlist narrows them further.
+type ingressAllowlist struct {
+	superNode map[path.Usage]bool // nil means the default of the role
+	peers     map[path.Usage]bool
+	stat      mtypes.IngressStats
+	sync.Mutex
+}
+
+// usageFromSuperNode and usageFromPeer are the defaults of the roles, the most a peer of the role may send
+func usageFromSuperNode(usage path.Usage) bool {
+	return usage.IsControl_Super2Edge()
+}
+
+func usageFromPeer(usage path.Usage) bool {
+	return usage.IsNormal() || usage.IsControl_Edge2Edge()
+}
+
+func (device *Device) loadIngressAllowlist() {
+	a := &device.ingress
+	a.stat.Dropped = make(map[mtypes.Vertex]map[string]uint64)
+	parse := func(names []string, role func(path.Usage) bool, role_name string) map[path.Usage]bool {
+		if len(names) == 0 {
+			return nil
+		}
+		ret := make(map[path.Usage]bool)
+		for _, name := range names {
+			usage, err := path.ParseUsage(name)
+			if err != nil || !role(usage) {
+				device.log.Errorf("MessageAllowlist.%v: %v is never accepted from it", role_name, name)
+				continue
+			}
+			ret[usage] = true
+		}
+		return ret
+	}
+	a.superNode = parse(device.EdgeConfig.MessageAllowlist.SuperNode, usageFromSuperNode, "SuperNode")
+	a.peers = parse(device.EdgeConfig.MessageAllowlist.Peers, usageFromPeer, "Peers")
+}
+
+// allowed reports whether the peer may send the message. The supernode itself accepts Register and Pong only, checked elsewhere.
+func (a *ingressAllowlist) allowed(peer mtypes.Vertex, usage path.Usage) bool {
+	if peer == mtypes.NodeID_SuperNode {
+		return usageFromSuperNode(usage) && (a.superNode == nil || a.superNode[usage])
+	}
+	return usageFromPeer(usage) && (a.peers == nil || a.peers[usage])
+}
+
+// check counts the message if it's not allowed
+func (a *ingressAllowlist) check(peer mtypes.Vertex, usage path.Usage) bool {
+	if a.allowed(peer, usage) {
+		return true
+	}
+	a.Lock()
+	defer a.Unlock()
+	if a.stat.Dropped == nil {
+		a.stat.Dropped = make(map[mtypes.Vertex]map[string]uint64)
+	}
+	if _, ok := a.stat.Dropped[peer]; !ok {
+		a.stat.Dropped[peer] = make(map[string]uint64)
+	}
+	a.stat.Dropped[peer][usage.ToString()]++
+	return false
+}
+
+func (a *ingressAllowlist) stats() mtypes.IngressStats {
+	a.Lock()
+	defer a.Unlock()
+	ret := mtypes.IngressStats{Dropped: make(map[mtypes.Vertex]map[string]uint64, len(a.stat.Dropped))}
+	for peer, usages := range a.stat.Dropped {
+		ret.Dropped[peer] = make(map[string]uint64, len(usages))
+		for usage, n := range usages {
+			ret.Dropped[peer][usage] = n
+		}
+	}
+	return ret
+}
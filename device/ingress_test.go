@@ -0,0 +1,83 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestIngressAllowlist(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.loadIngressAllowlist()
+	a := &device.ingress
+	tests := []struct {
+		name  string
+		peer  mtypes.Vertex
+		usage path.Usage
+		want  bool
+	}{
+		{"NhTable push from the supernode", mtypes.NodeID_SuperNode, path.ServerUpdate, true},
+		{"RegisterReply from the supernode", mtypes.NodeID_SuperNode, path.RegisterReply, true},
+		{"frame from the supernode", mtypes.NodeID_SuperNode, path.NormalPacket, false},
+		{"ping from the supernode", mtypes.NodeID_SuperNode, path.PingPacket, false},
+		{"NhTable push injected by an edge", 2, path.ServerUpdate, false},
+		{"RegisterReply injected by an edge", 2, path.RegisterReply, false},
+		{"Register to an edge", 2, path.Register, false},
+		{"frame from an edge", 2, path.NormalPacket, true},
+		{"ping from an edge", 2, path.PingPacket, true},
+		{"trace from an edge", 2, path.TracePacket, true},
+	}
+	for _, tt := range tests {
+		if got := a.check(tt.peer, tt.usage); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if s := a.stats(); s.Dropped[2]["ServerUpdate"] != 1 || s.Dropped[mtypes.NodeID_SuperNode]["NormalPacket"] != 1 {
+		t.Errorf("stats = %v", s.Dropped)
+	}
+
+	// the injection by the TCP control channel is rejected too
+	if err := device.ProcessControl(&Peer{ID: 2}, path.ServerUpdate, make([]byte, path.EgHeaderLen+1)); err == nil {
+		t.Error("ServerUpdate from an edge processed")
+	}
+
+	// narrowed by the config, it can't be widened
+	device.EdgeConfig.MessageAllowlist = mtypes.MessageAllowlistInfo{
+		SuperNode: []string{"ServerUpdate"},
+		Peers:     []string{"NormalPacket", "PingPacket", "PongPacket"},
+	}
+	device.loadIngressAllowlist()
+	for _, tt := range []struct {
+		peer  mtypes.Vertex
+		usage path.Usage
+		want  bool
+	}{
+		{mtypes.NodeID_SuperNode, path.ServerUpdate, true},
+		{mtypes.NodeID_SuperNode, path.RegisterReply, false},
+		{2, path.PingPacket, true},
+		{2, path.QueryPeer, false},
+		{2, path.TracePacket, false},
+	} {
+		if got := a.allowed(tt.peer, tt.usage); got != tt.want {
+			t.Errorf("narrowed %v from %v: got %v, want %v", tt.usage.ToString(), tt.peer.ToString(), got, tt.want)
+		}
+	}
+}
+
+func TestParseUsage(t *testing.T) {
+	for v := path.NormalPacket; v.IsValid_EgType(); v++ {
+		if got, err := path.ParseUsage(v.ToString()); err != nil || got != v {
+			t.Errorf("ParseUsage(%v) = %v, %v", v.ToString(), got, err)
+		}
+	}
+	if _, err := path.ParseUsage("MessageTransportType"); err == nil {
+		t.Error("parsed a wireguard message type")
+	}
+}
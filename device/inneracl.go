@@ -0,0 +1,137 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// innerACL drops the frames from a node whose inner source IP is not in PeerInfo.AllowedInnerCIDRs of it,
+// so a compromised node can't spoof the IPs of others. The frames without an IP are not checked.
+// The frames claiming to come from such a node must arrive from it or from our next hop to it,
+// or another compromised node could put its NodeID as the source.
+type innerACL struct {
+	allowed map[mtypes.Vertex][]*net.IPNet // nodes without AllowedInnerCIDRs are not in it
+	dropped map[mtypes.Vertex]uint64
+	sync.Mutex
+}
+
+func (device *Device) loadInnerACL() {
+	a := &device.innerACL
+	for _, peerconf := range device.EdgeConfig.Peers {
+		if len(peerconf.AllowedInnerCIDRs) == 0 {
+			continue
+		}
+		if a.allowed == nil {
+			a.allowed = make(map[mtypes.Vertex][]*net.IPNet)
+			a.dropped = make(map[mtypes.Vertex]uint64)
+		}
+		for _, s := range peerconf.AllowedInnerCIDRs {
+			_, cidr, err := net.ParseCIDR(s)
+			if err != nil {
+				device.log.Errorf("AllowedInnerCIDRs of %v: %v", peerconf.NodeID, err)
+				continue
+			}
+			a.allowed[peerconf.NodeID] = append(a.allowed[peerconf.NodeID], cidr)
+		}
+	}
+}
+
+// innerSrcIP returns the source IP of an IPv4 or IPv6 packet, or the sender IP of an ARP, in the ethernet frame.
+// It's nil for other frames.
+func innerSrcIP(frame []byte) net.IP {
+	if len(frame) < ethHeaderLen {
+		return nil
+	}
+	l3 := ethHeaderLen
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	for etherType == etherTypeVLAN && len(frame) >= l3+4 {
+		etherType = binary.BigEndian.Uint16(frame[l3+2 : l3+4])
+		l3 += 4
+	}
+	ip := frame[l3:]
+	switch etherType {
+	case etherTypeIPv4:
+		if len(ip) >= ipv4HeaderLen && ip[0]>>4 == 4 {
+			return net.IP(ip[12:16])
+		}
+	case etherTypeIPv6:
+		if len(ip) >= ipv6HeaderLen && ip[0]>>4 == 6 {
+			return net.IP(ip[8:24])
+		}
+	case etherTypeARP:
+		if isEthIPv4ARP(ip) {
+			return net.IP(ip[14:18])
+		}
+	}
+	return nil
+}
+
+func (a *innerACL) restricted(src mtypes.Vertex) bool {
+	_, ok := a.allowed[src]
+	return ok
+}
+
+func (a *innerACL) drop(src mtypes.Vertex) {
+	a.Lock()
+	a.dropped[src]++
+	a.Unlock()
+}
+
+// check reports whether the frame from src is allowed by its AllowedInnerCIDRs, and counts the dropped ones.
+// It returns the source IP for logging.
+func (a *innerACL) check(src mtypes.Vertex, frame []byte) (bool, net.IP) {
+	if a.allowed == nil {
+		return true, nil
+	}
+	cidrs, ok := a.allowed[src]
+	if !ok {
+		return true, nil
+	}
+	ip := innerSrcIP(frame)
+	if ip == nil {
+		return true, nil
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true, ip
+		}
+	}
+	a.drop(src)
+	return false, ip
+}
+
+// innerACLAllowed checks a frame from the node src, received from the peer from, before writing it to the TAP
+func (device *Device) innerACLAllowed(src mtypes.Vertex, from mtypes.Vertex, frame []byte) bool {
+	if device.innerACL.restricted(src) && from != src {
+		if next := device.graph.Next(device.ID, src); from != next {
+			device.innerACL.drop(src)
+			device.LogDrop("frame from "+src.ToString()+" received from "+from.ToString()+", not the next hop "+next.ToString(), nil, frame)
+			return false
+		}
+	}
+	ok, ip := device.innerACL.check(src, frame)
+	if !ok {
+		device.LogDrop("inner source IP "+ip.String()+" not in AllowedInnerCIDRs of "+src.ToString(), nil, frame)
+	}
+	return ok
+}
+
+func (a *innerACL) stats() mtypes.InnerACLStats {
+	ret := mtypes.InnerACLStats{
+		Dropped: make(map[mtypes.Vertex]uint64),
+	}
+	a.Lock()
+	defer a.Unlock()
+	for id, n := range a.dropped {
+		ret.Dropped[id] = n
+	}
+	return ret
+}
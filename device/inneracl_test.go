@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/google/gopacket/layers"
+)
+
+func TestInnerACL(t *testing.T) {
+	device := &Device{}
+	device.ID = 1
+	device.graph, _ = path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	device.graph.SetNHTable(mtypes.NextHopTable{1: {2: 2, 3: 4, 4: 4}})
+	device.EdgeConfig = &mtypes.EdgeConfig{Peers: []mtypes.PeerInfo{
+		{NodeID: 2, AllowedInnerCIDRs: []string{"10.0.0.0/30", "fd00::1/128"}},
+		{NodeID: 3, AllowedInnerCIDRs: []string{"10.0.0.9/32"}},
+		{NodeID: 4},
+	}}
+	device.loadInnerACL()
+
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}
+	ipv4 := tcpFrame(t, false, true, 1460)
+	ipv6 := tcpFrame(t, true, true, 1440)
+	arp := arpFrame(t, layers.ARPRequest, mac, net.ParseIP("10.0.0.1"), net.HardwareAddr{0, 0, 0, 0, 0, 0}, net.ParseIP("10.0.0.2"))
+	nd := ndFrame(t, layers.ICMPv6TypeNeighborSolicitation, mac, net.ParseIP("fe80::1"), net.ParseIP("fd00::2"))
+	llc := append(append([]byte{}, ipv4[:12]...), 0, 46)
+	llc = append(llc, make([]byte, 46)...)
+	tests := []struct {
+		name  string
+		src   mtypes.Vertex
+		from  mtypes.Vertex
+		frame []byte
+		want  bool
+	}{
+		{"IPv4 in range", 2, 2, ipv4, true},
+		{"IPv6 in range", 2, 2, ipv6, true},
+		{"ARP in range", 2, 2, arp, true},
+		{"link-local not allowed", 2, 2, nd, false},
+		{"IPv4 out of range", 3, 3, ipv4, false},
+		{"IPv6 out of range", 3, 3, ipv6, false},
+		{"ARP out of range", 3, 3, arp, false},
+		{"not IP", 3, 3, llc, true},
+		{"from the next hop", 3, 4, llc, true},
+		{"not from the next hop", 2, 4, ipv4, false},
+		{"no restriction", 4, 2, ipv4, true},
+		{"unknown node", 5, 2, ipv6, true},
+	}
+	for _, tt := range tests {
+		if got := device.innerACLAllowed(tt.src, tt.from, tt.frame); got != tt.want {
+			t.Errorf("%v: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if s := device.innerACL.stats(); s.Dropped[2] != 2 || s.Dropped[3] != 3 || len(s.Dropped) != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+}
@@ -0,0 +1,91 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const latencyLogFlushInterval = 10 * time.Second
+
+// latencyLog appends the raw latency measured by every ping to DynamicRouteInfo.LatencyLogFile, one CSV line per sample.
+// It's for analyzing offline or replaying into the SimNet, the routing doesn't read it back.
+type latencyLog struct {
+	file io.WriteCloser
+	w    *bufio.Writer
+	sync.Mutex
+}
+
+func (device *Device) loadLatencyLog() {
+	filename := device.EdgeConfig.DynamicRoute.LatencyLogFile
+	if filename == "" {
+		return
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		device.log.Errorf("LatencyLogFile: %v", err)
+		return
+	}
+	device.latencyLog.open(f)
+}
+
+func (l *latencyLog) open(file io.WriteCloser) {
+	l.Lock()
+	defer l.Unlock()
+	l.file = file
+	l.w = bufio.NewWriter(file)
+}
+
+func (l *latencyLog) record(sample mtypes.LatencySample) {
+	if sample.Latency >= mtypes.Infinity {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.w == nil {
+		return
+	}
+	l.w.WriteString(sample.ToCSV() + "\n")
+}
+
+func (l *latencyLog) flush() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.w == nil {
+		return nil
+	}
+	return l.w.Flush()
+}
+
+func (l *latencyLog) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.w == nil {
+		return
+	}
+	l.w.Flush()
+	l.file.Close()
+	l.w = nil
+}
+
+// RoutineFlushLatencyLog writes the buffered latency samples to LatencyLogFile periodically
+func (device *Device) RoutineFlushLatencyLog() {
+	if device.EdgeConfig.DynamicRoute.LatencyLogFile == "" {
+		return
+	}
+	for !device.isClosed() {
+		time.Sleep(latencyLogFlushInterval)
+		if err := device.latencyLog.flush(); err != nil {
+			device.log.Errorf("LatencyLogFile: %v", err)
+		}
+	}
+}
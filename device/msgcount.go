@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// msgCounters counts the control messages by type.
+// ServerUpdate is counted by its Action, so a flapping UpdateNhTable stands out.
+// The callers pass the Action they know already, the body is never parsed for counting.
+type msgCounters struct {
+	usage  [path.RegisterReply + 1]uint64
+	action [mtypes.Renumber + 1]uint64
+}
+
+type msgCount struct {
+	sent msgCounters
+	recv msgCounters
+}
+
+// unknownAction counts a ServerUpdate as ServerUpdate, like the ones forwarded for others or failed to parse.
+const unknownAction mtypes.ServerCommand = -1
+
+func (c *msgCounters) count(usage path.Usage, action mtypes.ServerCommand) {
+	if usage == path.ServerUpdate && action >= 0 && int(action) < len(c.action) {
+		atomic.AddUint64(&c.action[action], 1)
+		return
+	}
+	if int(usage) < len(c.usage) {
+		atomic.AddUint64(&c.usage[usage], 1)
+	}
+}
+
+func (c *msgCounters) stats() map[string]uint64 {
+	ret := make(map[string]uint64)
+	for i := range c.usage {
+		if n := atomic.LoadUint64(&c.usage[i]); n > 0 {
+			ret[path.Usage(i).ToString()] = n
+		}
+	}
+	for i := range c.action {
+		if n := atomic.LoadUint64(&c.action[i]); n > 0 {
+			action := mtypes.ServerCommand(i)
+			ret[action.ToString()] = n
+		}
+	}
+	return ret
+}
+
+// MessageStats returns how many control messages of each type were sent and received.
+// Received counts the messages processed by us, sent also counts the ones forwarded for others.
+func (device *Device) MessageStats() mtypes.MessageStats {
+	return mtypes.MessageStats{
+		Sent: device.msgCount.sent.stats(),
+		Recv: device.msgCount.recv.stats(),
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,37 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestMsgCounters(t *testing.T) {
+	var c msgCounters
+	for i := 0; i < 3; i++ {
+		c.count(path.ServerUpdate, mtypes.UpdateNhTable)
+	}
+	c.count(path.PongPacket, unknownAction)
+	c.count(path.ServerUpdate, unknownAction)
+
+	stats := c.stats()
+	expected := map[string]uint64{
+		"UpdateNhTable": 3,
+		"PongPacket":    1,
+		"ServerUpdate":  1,
+	}
+	if len(stats) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, stats)
+	}
+	for k, v := range expected {
+		if stats[k] != v {
+			t.Errorf("%v: expected %v, got %v", k, v, stats[k])
+		}
+	}
+}
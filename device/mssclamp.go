@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+)
+
+const (
+	etherTypeIPv4 = 0x0800
+	etherTypeVLAN = 0x8100
+	ipv4HeaderLen = 20
+	ipv4FragMask  = 0x3fff // more fragments flag and fragment offset
+	tcpHeaderLen  = 20
+	tcpFlagSYN    = 0x02
+	tcpOptMSS     = 2
+)
+
+// mssLimit is the MTU of the TAP, or the tunnel MTU to the peer if it's smaller and known
+func (device *Device) mssLimit(peer *Peer) int {
+	mtu := int(atomic.LoadInt32(&device.tap.mtu))
+	if peer != nil {
+		if tmtu := int(atomic.LoadInt32(&peer.tunnelMTU)); tmtu > 0 && tmtu < mtu {
+			mtu = tmtu
+		}
+	}
+	return mtu
+}
+
+// clampMSS rewrites the MSS option of the TCP SYN in the frame if InterfaceConf.MSSClamp is on,
+// so the TCP segments of the connection fit in the MTU without fragmentation.
+// The peer is the next hop of the frame read from the TAP, or where the frame written to the TAP came from.
+func (device *Device) clampMSS(frame []byte, peer *Peer) {
+	if !device.mssClamp {
+		return
+	}
+	clampMSS(frame, device.mssLimit(peer))
+}
+
+// clampMSS lowers the MSS option of an IPv4 or IPv6 TCP SYN in the ethernet frame to fit the mtu.
+// It returns true if the frame is changed.
+func clampMSS(frame []byte, mtu int) bool {
+	src, dst, tcp, iphlen := tcpSegmentOf(frame)
+	mss := mtu - iphlen - tcpHeaderLen
+	if len(tcp) < tcpHeaderLen || tcp[13]&tcpFlagSYN == 0 || mss <= 0 {
+		return false
+	}
+	doff := int(tcp[12]>>4) * 4
+	if doff < tcpHeaderLen || doff > len(tcp) {
+		return false
+	}
+	opts := tcp[tcpHeaderLen:doff]
+	for len(opts) > 0 {
+		switch opts[0] {
+		case 0: // end of options
+			return false
+		case 1: // no-operation
+			opts = opts[1:]
+			continue
+		}
+		if len(opts) < 2 || opts[1] < 2 || int(opts[1]) > len(opts) {
+			return false
+		}
+		if opts[0] == tcpOptMSS && opts[1] == 4 {
+			if int(binary.BigEndian.Uint16(opts[2:4])) <= mss {
+				return false
+			}
+			binary.BigEndian.PutUint16(opts[2:4], uint16(mss))
+			// SYNs are small, recalculate the checksum instead of the incremental update, which needs the option aligned
+			tcp[16], tcp[17] = 0, 0
+			binary.BigEndian.PutUint16(tcp[16:18], pseudoHeaderChecksum(src, dst, 6, tcp))
+			return true
+		}
+		opts = opts[opts[1]:]
+	}
+	return false
+}
+
+// tcpSegmentOf returns the addresses and the TCP segment of an IPv4 or IPv6 TCP ethernet frame, tcp is nil otherwise.
+// iphlen is the IP header length without options. 802.1Q tags are skipped, IPv6 extension headers are not TCP.
+// A fragmented packet is not TCP either, the first fragment included: it has the TCP header but not the whole segment,
+// so the checksum and the segment length can't be right. The fragments are passed unmodified by MSSClamp and ReorderBufferMs.
+// The IPv6 fragments have the fragment extension header, so they are never TCP here.
+func tcpSegmentOf(frame []byte) (src, dst, tcp []byte, iphlen int) {
+	if len(frame) < ethHeaderLen {
+		return
+	}
+	l3 := ethHeaderLen
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	for etherType == etherTypeVLAN && len(frame) >= l3+4 {
+		etherType = binary.BigEndian.Uint16(frame[l3+2 : l3+4])
+		l3 += 4
+	}
+	ip := frame[l3:]
+	switch etherType {
+	case etherTypeIPv4:
+		if len(ip) < ipv4HeaderLen || ip[0]>>4 != 4 || ip[9] != 6 {
+			return
+		}
+		if binary.BigEndian.Uint16(ip[6:8])&ipv4FragMask != 0 {
+			return // a fragment
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(ip[2:4]))
+		if ihl < ipv4HeaderLen || total < ihl || total > len(ip) {
+			return
+		}
+		return ip[12:16], ip[16:20], ip[ihl:total], ipv4HeaderLen
+	case etherTypeIPv6:
+		if len(ip) < ipv6HeaderLen || ip[0]>>4 != 6 || ip[6] != 6 {
+			return
+		}
+		total := ipv6HeaderLen + int(binary.BigEndian.Uint16(ip[4:6]))
+		if total > len(ip) {
+			return
+		}
+		return ip[8:24], ip[24:40], ip[ipv6HeaderLen:total], ipv6HeaderLen
+	}
+	return
+}
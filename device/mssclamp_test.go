@@ -0,0 +1,152 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func tcpFrame(t *testing.T, v6 bool, syn bool, mss uint16) []byte {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}, DstMAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 2}}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, SYN: syn, ACK: !syn, Window: 65535, Options: []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{byte(mss >> 8), byte(mss)}},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}}
+	if v6 {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, NextHeader: layers.IPProtocolTCP, HopLimit: 64, SrcIP: net.ParseIP("fd00::1"), DstIP: net.ParseIP("fd00::2")}
+		tcp.SetNetworkLayerForChecksum(ip6)
+		return serializeFrame(t, eth, ip6, tcp)
+	}
+	eth.EthernetType = layers.EthernetTypeIPv4
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4()}
+	tcp.SetNetworkLayerForChecksum(ip4)
+	return serializeFrame(t, eth, ip4, tcp)
+}
+
+func frameMSS(t *testing.T, frame []byte) (mss uint16, checksumOK bool) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if tcp == nil {
+		t.Fatalf("not a TCP frame: %v", packet.Dump())
+	}
+	for _, opt := range tcp.Options {
+		if opt.OptionType == layers.TCPOptionKindMSS {
+			mss = binary.BigEndian.Uint16(opt.OptionData)
+		}
+	}
+	ip := packet.NetworkLayer().LayerContents()
+	segment := append(tcp.Contents, tcp.Payload...)
+	if ip[0]>>4 == 4 {
+		return mss, pseudoHeaderChecksum(ip[12:16], ip[16:20], 6, segment) == 0
+	}
+	return mss, pseudoHeaderChecksum(ip[8:24], ip[24:40], 6, segment) == 0
+}
+
+func TestClampMSS(t *testing.T) {
+	tests := []struct {
+		v6      bool
+		syn     bool
+		mss     uint16
+		mtu     int
+		changed bool
+		want    uint16
+	}{
+		{false, true, 1460, DefaultMTU, true, DefaultMTU - 40},
+		{true, true, 1440, DefaultMTU, true, DefaultMTU - 60},
+		{false, true, 1200, DefaultMTU, false, 1200},
+		{true, true, 1300, 1300, true, 1240},
+		{false, false, 1460, DefaultMTU, false, 1460},
+	}
+	for i, tt := range tests {
+		frame := tcpFrame(t, tt.v6, tt.syn, tt.mss)
+		if changed := clampMSS(frame, tt.mtu); changed != tt.changed {
+			t.Errorf("#%v: changed = %v, want %v", i, changed, tt.changed)
+		}
+		mss, ok := frameMSS(t, frame)
+		if mss != tt.want {
+			t.Errorf("#%v: MSS = %v, want %v", i, mss, tt.want)
+		}
+		if !ok {
+			t.Errorf("#%v: bad TCP checksum", i)
+		}
+	}
+
+	device := &Device{}
+	device.tap.mtu = DefaultMTU
+	peer := &Peer{}
+	if limit := device.mssLimit(peer); limit != DefaultMTU {
+		t.Errorf("unknown path MTU: limit = %v, want %v", limit, DefaultMTU)
+	}
+	peer.tunnelMTU = 1300
+	if limit := device.mssLimit(peer); limit != 1300 {
+		t.Errorf("smaller tunnel MTU: limit = %v, want 1300", limit)
+	}
+	frame := tcpFrame(t, false, true, 1460)
+	device.clampMSS(frame, peer)
+	if mss, _ := frameMSS(t, frame); mss != 1460 {
+		t.Errorf("clamped while MSSClamp is off: %v", mss)
+	}
+	device.mssClamp = true
+	device.clampMSS(frame, peer)
+	if mss, _ := frameMSS(t, frame); mss != 1260 {
+		t.Errorf("MSS = %v, want 1260", mss)
+	}
+}
+
+// fragmentOf turns the TCP frame into the first fragment of a larger packet, or a later one if offset > 0.
+// An IPv6 fragment gets the fragment extension header.
+func fragmentOf(frame []byte, v6 bool, offset uint16) []byte {
+	ip := frame[ethHeaderLen:]
+	if !v6 {
+		binary.BigEndian.PutUint16(ip[6:8], 0x2000|offset/8) // more fragments
+		return frame
+	}
+	frag := make([]byte, 8)
+	frag[0] = ip[6] // next header
+	binary.BigEndian.PutUint16(frag[2:4], offset&^7|1)
+	binary.BigEndian.PutUint32(frag[4:8], 0x12345678)
+	ip[6] = 44
+	binary.BigEndian.PutUint16(ip[4:6], binary.BigEndian.Uint16(ip[4:6])+8)
+	out := append([]byte(nil), frame[:ethHeaderLen+ipv6HeaderLen]...)
+	out = append(out, frag...)
+	return append(out, ip[ipv6HeaderLen:]...)
+}
+
+func TestFragmentedInnerPackets(t *testing.T) {
+	for _, v6 := range []bool{false, true} {
+		for _, offset := range []uint16{0, 1480} {
+			frame := fragmentOf(tcpFrame(t, v6, true, 1460), v6, offset)
+			orig := append([]byte(nil), frame...)
+			if _, _, tcp, _ := tcpSegmentOf(frame); tcp != nil {
+				t.Errorf("v6 %v offset %v: fragment taken as TCP", v6, offset)
+			}
+			if clampMSS(frame, 1300) || !reflect.DeepEqual(frame, orig) {
+				t.Errorf("v6 %v offset %v: fragment modified by MSSClamp", v6, offset)
+			}
+			if innerSrcIP(frame) == nil {
+				t.Errorf("v6 %v offset %v: no source IP for AllowedInnerCIDRs", v6, offset)
+			}
+
+			// passed through the reorder buffer right away, nothing held
+			r := &reorderBuffer{timeout: time.Second, flows: make(map[reorderKey]*reorderFlow)}
+			written := 0
+			r.push(append(make([]byte, reorderTestOffset), frame...), reorderTestOffset, time.Now(), func([]byte, int) { written++ })
+			if s := r.stats(); written != 1 || s.Flows != 0 {
+				t.Errorf("v6 %v offset %v: written %v, stats %+v", v6, offset, written, s)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn/bindtest"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+// chanTap is a TAP device backed by channels
+type chanTap struct {
+	mtu      int
+	inbound  chan []byte // frames to be read by the device
+	outbound chan []byte // frames written by the device
+	closed   chan struct{}
+	events   chan tap.Event
+}
+
+func newChanTap(mtu int) *chanTap {
+	t := &chanTap{
+		mtu:      mtu,
+		inbound:  make(chan []byte, 16),
+		outbound: make(chan []byte, 16),
+		closed:   make(chan struct{}),
+		events:   make(chan tap.Event, 1<<5),
+	}
+	return t
+}
+
+func (t *chanTap) Read(buf []byte, offset int) (int, error) {
+	select {
+	case frame := <-t.inbound:
+		return copy(buf[offset:], frame), nil
+	case <-t.closed:
+		return 0, errors.New("device closed")
+	}
+}
+
+func (t *chanTap) Write(buf []byte, offset int) (int, error) {
+	frame := append([]byte{}, buf[offset:]...)
+	select {
+	case t.outbound <- frame:
+	case <-t.closed:
+	}
+	return len(frame), nil
+}
+
+func (t *chanTap) Flush() error           { return nil }
+func (t *chanTap) MTU() (int, error)      { return t.mtu, nil }
+func (t *chanTap) Name() (string, error)  { return "chantap", nil }
+func (t *chanTap) Events() chan tap.Event { return t.events }
+func (t *chanTap) Close() error           { close(t.closed); return nil }
+
+// genTestPair creates two connected edges with NodeID 1 and 2 in static mode
+func genTestPair(t *testing.T, mtu int) (devices [2]*Device, taps [2]*chanTap) {
+	binds := bindtest.NewChannelBinds()
+	nhTable := mtypes.NextHopTable{
+		1: {2: 2},
+		2: {1: 1},
+	}
+	var keys [2]NoisePrivateKey
+	for i := range devices {
+		var err error
+		if keys[i], err = newPrivateKey(); err != nil {
+			t.Fatal(err)
+		}
+		econfig := &mtypes.EdgeConfig{
+			NodeID:       mtypes.Vertex(i + 1),
+			DefaultTTL:   200,
+			NextHopTable: nhTable,
+		}
+		econfig.Interface.MTU = uint16(mtu)
+		graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		graph.SetNHTable(nhTable)
+		taps[i] = newChanTap(mtu)
+		devices[i] = NewDevice(taps[i], econfig.NodeID, binds[i], NewLogger(LogLevelError, ""), graph, false, "", econfig, nil, nil, "test")
+		t.Cleanup(devices[i].Close)
+		devices[i].SetPrivateKey(keys[i])
+	}
+	for i, d := range devices {
+		other := 1 - i
+		peer, err := d.NewPeer(keys[other].PublicKey(), mtypes.Vertex(other+1), false, 0, mtypes.PeerQueueInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		endpoint, err := binds[i].ParseEndpoint("127.0.0.1:" + []string{"1", "2"}[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer.SetEndpointFromPacket(endpoint)
+		peer.Start()
+		if err := d.Up(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return
+}
+
+func TestJumboFrameRoundTrip(t *testing.T) {
+	const mtu = 9000
+	if MaxMTU < mtu {
+		t.Skipf("MaxMTU is %v on this platform", MaxMTU)
+	}
+	_, taps := genTestPair(t, mtu)
+
+	frame := make([]byte, 14+mtu)
+	copy(frame[0:6], []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:12], []byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01})
+	frame[12], frame[13] = 0x08, 0x00
+	for i := 14; i < len(frame); i++ {
+		frame[i] = byte(i)
+	}
+	taps[0].inbound <- frame
+	select {
+	case got := <-taps[1].outbound:
+		if !bytes.Equal(got, frame) {
+			t.Fatalf("frame corrupted: got %v bytes, expected %v bytes", len(got), len(frame))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("frame not received")
+	}
+}
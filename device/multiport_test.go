@@ -0,0 +1,42 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+)
+
+func TestMultiPortBindOpen(t *testing.T) {
+	newBind := func() conn.Bind { return conn.NewStdNetBindAf(true, false) }
+	bind := conn.NewMultiPortBind(3, newBind)
+	_, port, err := bind.Open(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports := bind.ListenPorts()
+	if len(ports) != 3 || ports[0] != port || ports[1] != port+1 || ports[2] != port+2 {
+		t.Errorf("ListenPorts = %v, want 3 ports from %v", ports, port)
+	}
+	bind.Close()
+
+	// an extra port in use fails the whole bind
+	busy, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(port) + 1})
+	if err != nil {
+		t.Skip(err)
+	}
+	defer busy.Close()
+	bind = conn.NewMultiPortBind(3, newBind)
+	if _, _, err := bind.Open(port); err == nil {
+		bind.Close()
+		t.Error("opened with an extra port in use")
+	}
+	if len(bind.ListenPorts()) != 0 {
+		t.Error("ports left open after a failed Open")
+	}
+}
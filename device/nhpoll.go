@@ -0,0 +1,61 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// RoutinePollNhTable polls /edge/nhtable when no UpdateNhTable is pushed in NhTablePollTimeout,
+// for the edges which can reach the EdgeAPI but not receive the pushes, like behind a strict NAT.
+// It keeps polling every NhTablePollTimeout until a push arrives again.
+func (device *Device) RoutinePollNhTable() {
+	timeout := mtypes.S2TD(device.EdgeConfig.DynamicRoute.SuperNode.NhTablePollTimeout)
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode || timeout <= 0 || device.EdgeConfig.DynamicRoute.SuperNode.ControlTransport == mtypes.ControlTransportHTTP {
+		return
+	}
+	last := time.Now() // the last push or poll
+	for {
+		time.Sleep(mtypes.S2TD(1))
+		if pushed := device.nhTableLastAnnounced(); pushed.After(last) {
+			last = pushed
+		}
+		if time.Since(last) < timeout {
+			continue
+		}
+		last = time.Now()
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: No UpdateNhTable in %v, poll the NhTable\n", timeout)
+		}
+		if err := device.pollNhTable(); err != nil {
+			device.log.Errorf("RoutinePollNhTable: %v", err)
+		}
+	}
+}
+
+// pollNhTable downloads the NhTable if it's not the one we have. The supernode replies 304 if it is,
+// otherwise the NhTable with its state hash in NhTableStateHeader.
+func (device *Device) pollNhTable() error {
+	local_NhTableHash := device.state_hashes.NhTable.Load().(string)
+	body, salt, State_hash, err := device.requestNhTable(local_NhTableHash, true)
+	if err != nil {
+		return err
+	}
+	if body == nil {
+		if local_NhTableHash != "" {
+			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
+		}
+		return nil
+	}
+	if salt != nil && !nhTableHashMatch(body, salt, State_hash) {
+		device.nhTableRejected.add()
+		return fmt.Errorf("polled NhTable doesn't match the hash %v", State_hash)
+	}
+	return device.applyNhTable(body, State_hash)
+}
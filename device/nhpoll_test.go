@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestPollNhTable(t *testing.T) {
+	body := []byte(`{"1":{"2":2}}`)
+	salt := []byte("salt")
+	sum := md5.Sum(append(append([]byte(nil), body...), salt...))
+	hash := hex.EncodeToString(sum[:])
+
+	const PSKey = "yl/4SNFee7+kNekajVCrK0toqXJ4mlT4IN0klyAgyqU="
+	state := hash
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Since := r.URL.Query().Get("Since")
+		Time, _ := strconv.ParseInt(r.URL.Query().Get("Time"), 10, 64)
+		if sig, err := mtypes.PollSig(PSKey, Time, []byte(Since)); err != nil || sig != r.URL.Query().Get("Sig") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if Since == hash {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set(NhTableSaltHeader, base64.StdEncoding.EncodeToString(salt))
+		w.Header().Set(NhTableStateHeader, state)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	device := &Device{}
+	device.log = NewLogger(LogLevelError, "")
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = server.URL
+	device.EdgeConfig.DynamicRoute.SuperNode.PSKey = PSKey
+	device.graph, _ = path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	device.state_hashes.NhTable.Store("")
+
+	state = "wrong"
+	if err := device.pollNhTable(); err == nil {
+		t.Error("NhTable not matching the state accepted")
+	}
+	if h := device.state_hashes.NhTable.Load().(string); h != "" {
+		t.Errorf("hash = %q after a rejected poll", h)
+	}
+	state = hash
+	if err := device.pollNhTable(); err != nil {
+		t.Fatal(err)
+	}
+	if h := device.state_hashes.NhTable.Load().(string); h != hash {
+		t.Errorf("hash = %q, want %q", h, hash)
+	}
+	if nh := device.graph.GetNHTable(false); nh[1][2] != 2 {
+		t.Errorf("NhTable = %v", nh)
+	}
+	if err := device.pollNhTable(); err != nil {
+		t.Errorf("not modified: %v", err)
+	}
+
+	device.EdgeConfig.DynamicRoute.SuperNode.PSKey = "FJfjc+wRfk0FSuUkHlXl6D8xPzOKYdy3bxeYr5cpevQ="
+	if err := device.pollNhTable(); err == nil {
+		t.Error("poll with a wrong PSKey accepted")
+	}
+}
@@ -0,0 +1,109 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// SuperNhTableStatus is the last NhTable hash announced by a supernode.
+type SuperNhTableStatus struct {
+	Hash     string
+	Received time.Time
+}
+
+// NhTableStatus tells whether the local NhTable matches the one of the supernodes.
+type NhTableStatus struct {
+	Hash       string
+	Changed    time.Time
+	SuperNodes map[string]SuperNhTableStatus // key: v4 or v6
+}
+
+// Converged reports whether the local NhTable is the one all supernodes announced.
+func (s NhTableStatus) Converged() bool {
+	if s.Hash == "" || len(s.SuperNodes) == 0 {
+		return false
+	}
+	for _, super := range s.SuperNodes {
+		if super.Hash != s.Hash {
+			return false
+		}
+	}
+	return true
+}
+
+type nhTableStatus struct {
+	sync.Mutex
+	changed time.Time
+	super   map[string]SuperNhTableStatus
+}
+
+// superPeerAF returns v4 or v6 by the public key of the supernode peer, or http for a poll without a peer.
+func (device *Device) superPeerAF(peer *Peer) string {
+	if peer == nil {
+		return mtypes.ControlTransportHTTP
+	}
+	pk := peer.handshake.remoteStatic.ToString()
+	switch pk {
+	case device.EdgeConfig.DynamicRoute.SuperNode.PubKeyV4:
+		return mtypes.AddressFamilyV4
+	case device.EdgeConfig.DynamicRoute.SuperNode.PubKeyV6:
+		return mtypes.AddressFamilyV6
+	}
+	return pk
+}
+
+func (device *Device) nhTableAnnounced(peer *Peer, State_hash string) {
+	device.nhStatus.Lock()
+	defer device.nhStatus.Unlock()
+	if device.nhStatus.super == nil {
+		device.nhStatus.super = make(map[string]SuperNhTableStatus)
+	}
+	device.nhStatus.super[device.superPeerAF(peer)] = SuperNhTableStatus{
+		Hash:     State_hash,
+		Received: time.Now(),
+	}
+}
+
+// nhTableLastAnnounced returns when the last UpdateNhTable came from any supernode
+func (device *Device) nhTableLastAnnounced() (last time.Time) {
+	device.nhStatus.Lock()
+	defer device.nhStatus.Unlock()
+	for _, super := range device.nhStatus.super {
+		if super.Received.After(last) {
+			last = super.Received
+		}
+	}
+	return
+}
+
+func (device *Device) nhTableChanged() {
+	device.nhStatus.Lock()
+	device.nhStatus.changed = time.Now()
+	device.nhStatus.Unlock()
+	select {
+	case device.Chan_NhTableChanged <- struct{}{}:
+	default:
+	}
+}
+
+// NhTableStatus returns the hash of the local NhTable and the hashes announced by the supernodes.
+func (device *Device) NhTableStatus() NhTableStatus {
+	device.nhStatus.Lock()
+	defer device.nhStatus.Unlock()
+	ret := NhTableStatus{
+		Hash:       device.state_hashes.NhTable.Load().(string),
+		Changed:    device.nhStatus.changed,
+		SuperNodes: make(map[string]SuperNhTableStatus, len(device.nhStatus.super)),
+	}
+	for af, super := range device.nhStatus.super {
+		ret.SuperNodes[af] = super
+	}
+	return ret
+}
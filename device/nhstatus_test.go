@@ -0,0 +1,29 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNhTableStatusConverged(t *testing.T) {
+	now := time.Now()
+	for _, tc := range []struct {
+		name   string
+		status NhTableStatus
+		want   bool
+	}{
+		{"no supernode", NhTableStatus{Hash: "a"}, false},
+		{"no local table", NhTableStatus{SuperNodes: map[string]SuperNhTableStatus{"v4": {"", now}}}, false},
+		{"match", NhTableStatus{Hash: "a", SuperNodes: map[string]SuperNhTableStatus{"v4": {"a", now}, "v6": {"a", now}}}, true},
+		{"one differs", NhTableStatus{Hash: "a", SuperNodes: map[string]SuperNhTableStatus{"v4": {"a", now}, "v6": {"b", now}}}, false},
+	} {
+		if got := tc.status.Converged(); got != tc.want {
+			t.Errorf("%v: Converged() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	// NhTableSaltHeader carries the salt of the state hashes with /edge/nhtable, base64 encoded,
+	// so the edge can check the downloaded NhTable against the hash announced by UpdateNhTable.
+	NhTableSaltHeader = "Eg-State-Salt"
+	// NhTableStateHeader carries the state hash of the NhTable downloaded by polling /edge/nhtable with Since
+	NhTableStateHeader = "Eg-State"
+
+	nhTableDownloadAttempts = 3
+)
+
+// nhTableRejected counts the downloaded NhTables not matching the announced hash
+type nhTableRejected struct {
+	sync.Mutex
+	count uint64
+}
+
+func (r *nhTableRejected) add() {
+	r.Lock()
+	r.count++
+	r.Unlock()
+}
+
+func (r *nhTableRejected) load() uint64 {
+	r.Lock()
+	defer r.Unlock()
+	return r.count
+}
+
+// nhTableHashMatch reports whether the NhTable body is the one of the announced hash, which is md5(body + salt).
+func nhTableHashMatch(body []byte, salt []byte, hash string) bool {
+	sum := md5.Sum(append(append([]byte(nil), body...), salt...))
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+// downloadNhTable downloads the NhTable of State_hash from the supernode, and checks it against the hash.
+// A corrupted or truncated one is rejected and downloaded again, up to nhTableDownloadAttempts times.
+// The check is skipped if the supernode doesn't send NhTableSaltHeader. body is nil if the supernode refused it.
+func (device *Device) downloadNhTable(State_hash string) (body []byte, err error) {
+	for attempt := 1; attempt <= nhTableDownloadAttempts; attempt++ {
+		var salt []byte
+		body, salt, _, err = device.requestNhTable(State_hash, false)
+		if err != nil || body == nil || salt == nil || nhTableHashMatch(body, salt, State_hash) {
+			return
+		}
+		device.nhTableRejected.add()
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: Downloaded NhTable doesn't match the hash %v, attempt %v/%v\n", State_hash, attempt, nhTableDownloadAttempts)
+		}
+	}
+	return nil, fmt.Errorf("downloaded NhTable doesn't match the hash %v after %v attempts", State_hash, nhTableDownloadAttempts)
+}
+
+// requestNhTable downloads the NhTable once. salt is nil if the supernode doesn't send it.
+// With since, State_hash is the hash of the NhTable we have, and the request is signed with the PSKey. body is nil if it's not modified,
+// and state is the hash of the new one from NhTableStateHeader. Otherwise state is State_hash, and body is nil if the supernode refused it.
+func (device *Device) requestNhTable(State_hash string, since bool) (body []byte, salt []byte, state string, err error) {
+	client := &http.Client{
+		Timeout: 8 * time.Second,
+	}
+	downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable"
+	req, err := http.NewRequest("GET", downloadurl, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	q := req.URL.Query()
+	q.Add("NodeID", device.ID.ToString())
+	q.Add("PubKey", device.staticIdentity.publicKey.ToString())
+	if since {
+		Time := time.Now().UnixNano()
+		sig, err := mtypes.PollSig(device.EdgeConfig.DynamicRoute.SuperNode.PSKey, Time, []byte(State_hash))
+		if err != nil {
+			return nil, nil, "", err
+		}
+		q.Add("Since", State_hash)
+		q.Add("Time", strconv.FormatInt(Time, 10))
+		q.Add("Sig", sig)
+	} else {
+		q.Add("State", State_hash)
+	}
+	req.URL.RawQuery = q.Encode()
+	if device.LogLevel.LogControl {
+		fmt.Println("Control: Download NhTable from :" + req.URL.RequestURI())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+	allbytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	state = State_hash
+	switch {
+	case since && resp.StatusCode == http.StatusNotModified:
+		return nil, nil, State_hash, nil
+	case since && resp.StatusCode != http.StatusOK:
+		return nil, nil, "", fmt.Errorf("poll NhTable failed: %v %v", resp.StatusCode, string(allbytes))
+	case since:
+		if state = resp.Header.Get(NhTableStateHeader); state == "" {
+			return nil, nil, "", fmt.Errorf("poll NhTable failed: no %v", NhTableStateHeader)
+		}
+	case resp.StatusCode != http.StatusOK:
+		device.log.Errorf("Control: Download NhTable failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
+		return nil, nil, State_hash, nil
+	}
+	if device.LogLevel.LogControl {
+		fmt.Println("Control: Download NhTable result :" + string(allbytes))
+	}
+	if s := resp.Header.Get(NhTableSaltHeader); s != "" {
+		if salt, err = base64.StdEncoding.DecodeString(s); err != nil {
+			return nil, nil, "", fmt.Errorf("invalid %v : %v", NhTableSaltHeader, err)
+		}
+	}
+	return allbytes, salt, state, nil
+}
+
+// applyNhTable installs the downloaded NhTable of the state hash.
+func (device *Device) applyNhTable(body []byte, State_hash string) error {
+	var NhTable mtypes.NextHopTable
+	if err := json.Unmarshal(body, &NhTable); err != nil {
+		return fmt.Errorf("JSON decode error: %v", err)
+	}
+	device.graph.SetNHTable(NhTable)
+	device.state_hashes.NhTable.Store(State_hash)
+	device.nhTableChanged()
+	device.nhTableReceived.Set(true)
+	return nil
+}
@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestDownloadNhTable(t *testing.T) {
+	body := []byte(`{"1":{"2":2}}`)
+	salt := []byte("salt")
+	sum := md5.Sum(append(append([]byte(nil), body...), salt...))
+	hash := hex.EncodeToString(sum[:])
+
+	truncated := 1 // the first response is cut short
+	sendSalt := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sendSalt {
+			w.Header().Set(NhTableSaltHeader, base64.StdEncoding.EncodeToString(salt))
+		}
+		if truncated > 0 {
+			truncated--
+			w.Write(body[:len(body)-1])
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	device := &Device{}
+	device.log = NewLogger(LogLevelError, "")
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = server.URL
+
+	got, err := device.downloadNhTable(hash)
+	if err != nil || string(got) != string(body) {
+		t.Fatalf("got %s, %v", got, err)
+	}
+	if n := device.nhTableRejected.load(); n != 1 {
+		t.Errorf("rejected %v, want 1", n)
+	}
+
+	truncated = nhTableDownloadAttempts
+	if _, err := device.downloadNhTable(hash); err == nil {
+		t.Error("corrupted NhTable accepted")
+	}
+	if n := device.nhTableRejected.load(); n != 1+nhTableDownloadAttempts {
+		t.Errorf("rejected %v, want %v", n, 1+nhTableDownloadAttempts)
+	}
+
+	// not checked without the salt, like an older supernode
+	truncated, sendSalt = 1, false
+	if got, err := device.downloadNhTable(hash); err != nil || len(got) != len(body)-1 {
+		t.Errorf("got %s, %v", got, err)
+	}
+}
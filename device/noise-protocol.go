@@ -15,6 +15,7 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/poly1305"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tai64n"
 )
@@ -53,6 +54,30 @@ const (
 	WGLabelCookie     = "cookie--"
 )
 
+// The primitives of NoiseConstruction. They are fixed at build time, not negotiated.
+const (
+	CipherDH   = "Curve25519"
+	CipherAEAD = "ChaCha20Poly1305"
+	CipherHash = "BLAKE2s"
+)
+
+func GetCipherSuite() mtypes.CipherSuite {
+	return mtypes.CipherSuite{
+		Construction: NoiseConstruction,
+		DH:           CipherDH,
+		AEAD:         CipherAEAD,
+		Hash:         CipherHash,
+	}
+}
+
+// CheckCipherSuite fails if the build doesn't provide the expected NoiseConstruction. Empty means no check.
+func CheckCipherSuite(expected string) error {
+	if expected != "" && expected != NoiseConstruction {
+		return fmt.Errorf("CipherSuite mismatch: expected %v, but this build provides %v", expected, NoiseConstruction)
+	}
+	return nil
+}
+
 const (
 	MessageInitiationSize      = 145                                           // size of handshake initiation message
 	MessageResponseSize        = 89                                            // size of response message
@@ -115,6 +140,9 @@ type Handshake struct {
 	hash                      [blake2s.Size]byte       // hash value
 	chainKey                  [blake2s.Size]byte       // chain key
 	presharedKey              NoisePresharedKey        // psk
+	oldPresharedKey           NoisePresharedKey        // the replaced psk, accepted until oldPresharedKeyExpire
+	oldPresharedKeyExpire     time.Time                // end of the grace time of oldPresharedKey
+	respondWithOld            bool                     // seal the next response with oldPresharedKey
 	localEphemeral            NoisePrivateKey          // ephemeral secret key
 	localIndex                uint32                   // used to clear hash-table
 	remoteIndex               uint32                   // index for sending
@@ -177,6 +205,7 @@ func (device *Device) CreateMessageInitiation(peer *Peer) (*MessageInitiation, e
 	handshake := &peer.handshake
 	handshake.mutex.Lock()
 	defer handshake.mutex.Unlock()
+	handshake.expireOldPresharedKey(time.Now())
 
 	// create ephemeral key
 	var err error
@@ -335,6 +364,10 @@ func (device *Device) ConsumeMessageInitiation(msg *MessageInitiation) *Peer {
 	if now.After(handshake.lastInitiationConsumption) {
 		handshake.lastInitiationConsumption = now
 	}
+	handshake.expireOldPresharedKey(now)
+	// the initiator retries without confirming the session of our last response, try the other preshared key
+	unconfirmed := peer.keypairs.loadNext() != nil
+	handshake.respondWithOld = unconfirmed && !handshake.respondWithOld && handshake.hasOldPresharedKey(now)
 	handshake.state = handshakeInitiationConsumed
 
 	handshake.mutex.Unlock()
@@ -390,13 +423,15 @@ func (device *Device) CreateMessageResponse(peer *Peer) (*MessageResponse, error
 	var tau [blake2s.Size]byte
 	var key [chacha20poly1305.KeySize]byte
 
+	psk := handshake.responsePresharedKey(time.Now())
 	KDF3(
 		&handshake.chainKey,
 		&tau,
 		&key,
 		handshake.chainKey[:],
-		handshake.presharedKey[:],
+		psk[:],
 	)
+	setZero(psk[:])
 
 	handshake.mixHash(tau[:])
 
@@ -427,6 +462,7 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 	var (
 		hash     [blake2s.Size]byte
 		chainKey [blake2s.Size]byte
+		usedOld  bool
 	)
 
 	ok := func() bool {
@@ -462,33 +498,44 @@ func (device *Device) ConsumeMessageResponse(msg *MessageResponse) *Peer {
 			setZero(ss[:])
 		}()
 
-		// add preshared key (psk)
-
-		var tau [blake2s.Size]byte
-		var key [chacha20poly1305.KeySize]byte
-		KDF3(
-			&chainKey,
-			&tau,
-			&key,
-			chainKey[:],
-			handshake.presharedKey[:],
-		)
-		mixHash(&hash, &hash, tau[:])
-
-		// authenticate transcript
-
-		aead, _ := chacha20poly1305.New(key[:])
-		_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
-		if err != nil {
-			return false
+		// add preshared key (psk), the primary one or the secondary one in its grace time
+
+		baseChainKey, baseHash := chainKey, hash
+		defer setZero(baseChainKey[:])
+		for i, psk := range handshake.presharedKeys(time.Now()) {
+			chainKey, hash = baseChainKey, baseHash
+			var tau [blake2s.Size]byte
+			var key [chacha20poly1305.KeySize]byte
+			KDF3(
+				&chainKey,
+				&tau,
+				&key,
+				chainKey[:],
+				psk[:],
+			)
+			setZero(psk[:])
+			mixHash(&hash, &hash, tau[:])
+
+			// authenticate transcript
+
+			aead, _ := chacha20poly1305.New(key[:])
+			_, err := aead.Open(nil, ZeroNonce[:], msg.Empty[:], hash[:])
+			if err != nil {
+				continue
+			}
+			mixHash(&hash, &hash, msg.Empty[:])
+			usedOld = i > 0
+			return true
 		}
-		mixHash(&hash, &hash, msg.Empty[:])
-		return true
+		return false
 	}()
 
 	if !ok {
 		return nil
 	}
+	if usedOld {
+		device.log.Verbosef("%v - ConsumeMessageResponse: accepted under the old preshared key", lookup.peer)
+	}
 
 	// update handshake state
 
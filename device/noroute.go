@@ -0,0 +1,53 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// noRouteStats counts the unicast packets without a next hop, by how DynamicRoute.NoRoutePolicy handled them
+type noRouteStats struct {
+	sync.Mutex
+	stat mtypes.NoRouteStats
+}
+
+func (s *noRouteStats) add(flooded bool) {
+	s.Lock()
+	defer s.Unlock()
+	if flooded {
+		s.stat.Flooded++
+	} else {
+		s.stat.Dropped++
+	}
+}
+
+func (s *noRouteStats) stats() mtypes.NoRouteStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.stat
+}
+
+// noRoute is called for a packet to dst without a next hop in the NhTable. It returns true if the packet should be
+// spread to all the peers instead, by NoRoutePolicy "flood". Only the normal packets are flooded, the others are dropped.
+// The spread doesn't depend on the NhTable, so it still works when the NhTable is empty or expired.
+func (device *Device) noRoute(dst mtypes.Vertex, usage path.Usage, endpoint conn.Endpoint, packet []byte) bool {
+	flood := usage == path.NormalPacket && device.EdgeConfig.DynamicRoute.NoRoutePolicy == mtypes.NoRouteFlood
+	device.noRouteStat.add(flood)
+	if !flood {
+		device.LogDrop("no route to "+dst.ToString(), endpoint, packet)
+		return false
+	}
+	if device.LogLevel.LogNormal {
+		fmt.Printf("Normal: No route to %v, flooded to all peers\n", dst.ToString())
+	}
+	return true
+}
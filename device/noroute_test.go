@@ -0,0 +1,33 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestNoRoutePolicy(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	packet := make([]byte, path.EgHeaderLen+60)
+
+	if device.noRoute(2, path.NormalPacket, nil, packet) {
+		t.Error("flooded with the default policy")
+	}
+	device.EdgeConfig.DynamicRoute.NoRoutePolicy = mtypes.NoRouteFlood
+	if !device.noRoute(2, path.NormalPacket, nil, packet) {
+		t.Error("not flooded with flood")
+	}
+	if device.noRoute(2, path.PingPacket, nil, packet) {
+		t.Error("control message flooded")
+	}
+	if s := device.noRouteStat.stats(); s.Dropped != 2 || s.Flooded != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
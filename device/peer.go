@@ -163,8 +163,13 @@ type Peer struct {
 	device           *Device
 	endpoint         conn.Endpoint
 	endpoint_trylist *endpoint_trylist
+	holePunching     AtomicBool
 
 	LastPacketReceivedAdd1Sec atomic.Value // *time.Time
+	LastEndpointChange        atomic.Value // time.Time, the last time the peer roamed to a new endpoint
+	roamingPending            atomic.Value // string, the new endpoint waiting for a handshake
+	pathMTU                   int32        // the path MTU to the endpoint, 0 if unknown
+	tunnelMTU                 int32        // the largest MTU of the TAP fits in the path MTU, 0 if unknown
 
 	SingleWayLatency atomic.Value
 	stopping         sync.WaitGroup // routines pending stop
@@ -184,9 +189,11 @@ type Peer struct {
 		txBytes           uint64 // bytes send to peer (endpoint)
 		rxBytes           uint64 // bytes received from peer
 		lastHandshakeNano int64  // nano seconds since epoch
+		outboundDropped   uint64 // dropped from the outbound queue by drop-oldest
 	}
 
 	disableRoaming bool
+	disabled       AtomicBool // PeerInfo.Disabled, never started until enabled again
 
 	timers struct {
 		retransmitHandshake     *Timer
@@ -207,6 +214,8 @@ type Peer struct {
 		staged   chan *QueueOutboundElement // staged packets before a handshake is available
 		outbound *autodrainingOutboundQueue // sequential ordering of udp transmission
 		inbound  *autodrainingInboundQueue  // sequential ordering of tun writing
+
+		dropOldest bool // drop the oldest packet instead of blocking while outbound is full
 	}
 
 	cookieGenerator             CookieGenerator
@@ -214,7 +223,7 @@ type Peer struct {
 	persistentKeepaliveInterval uint32 // accessed atomically
 }
 
-func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool, PersistentKeepalive uint32) (*Peer, error) {
+func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool, PersistentKeepalive uint32, queue mtypes.PeerQueueInfo) (*Peer, error) {
 	if !isSuper {
 		if id < mtypes.NodeID_Special {
 			//pass check
@@ -251,6 +260,8 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	peer := new(Peer)
 	atomic.SwapUint32(&peer.persistentKeepaliveInterval, PersistentKeepalive)
 	peer.LastPacketReceivedAdd1Sec.Store(&time.Time{})
+	peer.LastEndpointChange.Store(time.Time{})
+	peer.roamingPending.Store("")
 	peer.Lock()
 	defer peer.Unlock()
 
@@ -258,7 +269,12 @@ func (device *Device) NewPeer(pk NoisePublicKey, id mtypes.Vertex, isSuper bool,
 	peer.device = device
 	peer.endpoint_trylist = NewEndpoint_trylist(peer, mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout))
 	peer.SingleWayLatency.Store(mtypes.Infinity)
-	peer.queue.outbound = newAutodrainingOutboundQueue(device)
+	if queue.Depth > 0 {
+		peer.queue.outbound = newAutodrainingOutboundQueue(device, queue.Depth)
+	} else {
+		peer.queue.outbound = newAutodrainingOutboundQueue(device, QueueOutboundSize)
+	}
+	peer.queue.dropOldest = queue.FullPolicy == mtypes.QueueFullDropOldest
 	peer.queue.inbound = newAutodrainingInboundQueue(device)
 	peer.queue.staged = make(chan *QueueOutboundElement, QueueStagedSize)
 	// map public key
@@ -366,6 +382,9 @@ func (peer *Peer) Start() {
 	if peer.device.isClosed() {
 		return
 	}
+	if peer.disabled.Get() {
+		return
+	}
 
 	// prevent simultaneous start/stop operations
 	peer.state.Lock()
@@ -464,13 +483,49 @@ func (peer *Peer) Stop() {
 	peer.ZeroAndFlushAll()
 }
 
+// SetPersistentKeepalive sets the interval(sec) of the wireguard keepalive to the peer, 0 to disable.
+func (peer *Peer) SetPersistentKeepalive(secs uint32) {
+	old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, secs)
+
+	// Send immediate keepalive if we're turning it on and before it wasn't on.
+	if old == 0 && secs != 0 && peer.device.isUp() {
+		peer.SendKeepalive()
+	}
+}
+
+// SetDisabled stops the peer and keeps it stopped, or starts it again if the device is up.
+// A disabled peer keeps its config, but doesn't handshake, nothing is sent to it and it's routed around in P2P mode.
+func (peer *Peer) SetDisabled(disabled bool) {
+	if peer.disabled.Swap(disabled) == disabled {
+		return
+	}
+	device := peer.device
+	device.log.Verbosef("%v - Disabled: %v", peer, disabled)
+	if disabled {
+		peer.Stop()
+	} else if device.isUp() {
+		peer.Start()
+	}
+	if device.IsSuperNode || device.graph == nil {
+		return
+	}
+	device.graph.SetDisabled(peer.ID, disabled)
+	if device.EdgeConfig.DynamicRoute.P2P.UseP2P && device.p2pRouting() {
+		device.graph.RecalculateNhTableNow(false)
+	}
+}
+
+func (peer *Peer) IsDisabled() bool {
+	return peer.disabled.Get()
+}
+
 func (peer *Peer) SetPSK(psk NoisePresharedKey) {
 	if !peer.device.IsSuperNode && peer.ID < mtypes.NodeID_Special && peer.device.EdgeConfig.DynamicRoute.P2P.UseP2P {
 		peer.device.log.Verbosef("Preshared keys disabled in P2P mode.")
 		return
 	}
 	peer.handshake.mutex.Lock()
-	peer.handshake.presharedKey = psk
+	peer.handshake.setPresharedKey(psk, time.Now())
 	peer.handshake.mutex.Unlock()
 }
 
@@ -489,7 +544,12 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af int, af_perfer int,
 		//}
 		return nil
 	}
-	endpoint, err := peer.device.net.bind.ParseEndpoint(connIP)
+	var endpoint conn.Endpoint
+	if dp, ok := peer.device.net.bind.(conn.DataPort); ok && peer.ID == mtypes.NodeID_SuperNode {
+		endpoint, err = dp.ParseControlEndpoint(connIP) // the supernode stays on the control port
+	} else {
+		endpoint, err = peer.device.net.bind.ParseEndpoint(connIP)
+	}
 	if err != nil {
 		return err
 	}
@@ -497,9 +557,34 @@ func (peer *Peer) SetEndpointFromConnURL(connurl string, af int, af_perfer int,
 	peer.ConnURL = connurl
 	peer.ConnAF = af
 	peer.SetEndpointFromPacket(endpoint)
+	go peer.checkPathMTU(connIP)
 	return nil
 }
 
+// checkPathMTU discovers the path MTU to the endpoint, and complains if the frames of the TAP don't fit in it
+func (peer *Peer) checkPathMTU(dst string) {
+	if peer.device.IsSuperNode {
+		return
+	}
+	pmtu, err := conn.PathMTU(dst)
+	if err != nil {
+		if peer.device.LogLevel.LogInternal {
+			fmt.Printf("Internal: Discover path MTU to %v failed: %v\n", dst, err)
+		}
+		return
+	}
+	atomic.StoreInt32(&peer.pathMTU, int32(pmtu))
+	overhead := TunnelOverheadV4
+	if addr, err := net.ResolveUDPAddr("udp", dst); err == nil && addr.IP.To4() == nil {
+		overhead = TunnelOverheadV6
+	}
+	atomic.StoreInt32(&peer.tunnelMTU, int32(pmtu-overhead))
+	mtu := int(atomic.LoadInt32(&peer.device.tap.mtu))
+	if mtu+overhead > pmtu {
+		peer.device.log.Errorf("MTU %v is too large for the path MTU %v to NodeID:%v(%v), frames will be fragmented or dropped. Use MTU <= %v", mtu, pmtu, peer.ID.ToString(), dst, pmtu-overhead)
+	}
+}
+
 func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 	if peer.disableRoaming {
 		return
@@ -529,6 +614,50 @@ func (peer *Peer) SetEndpointFromPacket(endpoint conn.Endpoint) {
 
 }
 
+// SetEndpointFromReceived updates the endpoint from an authenticated packet, and logs it if the peer roamed.
+// With RoamingRequireHandshake, only a handshake message can move the peer to a new endpoint,
+// unless the new address is in the same RoamingIPv6PrefixLen prefix, like a rotated IPv6 privacy address.
+func (peer *Peer) SetEndpointFromReceived(endpoint conn.Endpoint, isHandshake bool) {
+	if peer.disableRoaming {
+		return
+	}
+	peer.RLock()
+	old := peer.endpoint
+	peer.RUnlock()
+	if old == nil || bytes.Equal(old.DstToBytes(), endpoint.DstToBytes()) {
+		peer.SetEndpointFromPacket(endpoint)
+		return
+	}
+	prefixLen := peer.device.EdgeConfig.RoamingIPv6PrefixLen
+	samePrefix := sameIPv6Prefix(old.DstIP(), endpoint.DstIP(), prefixLen)
+	if !isHandshake && peer.device.EdgeConfig.RoamingRequireHandshake && !samePrefix {
+		if peer.roamingPending.Swap(endpoint.DstToString()) != endpoint.DstToString() && peer.device.LogLevel.LogControl {
+			fmt.Printf("Control: Peer %v endpoint changed %v -> %v, waiting for handshake\n", peer.ID.ToString(), old.DstToString(), endpoint.DstToString())
+		}
+		return
+	}
+	peer.SetEndpointFromPacket(endpoint)
+	peer.roamingPending.Store("")
+	peer.LastEndpointChange.Store(time.Now())
+	go peer.checkPathMTU(endpoint.DstToString())
+	if peer.device.LogLevel.LogControl {
+		if samePrefix {
+			fmt.Printf("Control: Peer %v endpoint changed %v -> %v, within the same /%v\n", peer.ID.ToString(), old.DstToString(), endpoint.DstToString(), prefixLen)
+		} else {
+			fmt.Printf("Control: Peer %v endpoint changed %v -> %v\n", peer.ID.ToString(), old.DstToString(), endpoint.DstToString())
+		}
+	}
+}
+
+// sameIPv6Prefix reports whether a and b are IPv6 addresses with the same first bits, false if bits is 0.
+func sameIPv6Prefix(a, b net.IP, bits int) bool {
+	if bits <= 0 || a.To4() != nil || b.To4() != nil || len(a) != net.IPv6len || len(b) != net.IPv6len {
+		return false
+	}
+	mask := net.CIDRMask(bits, 8*net.IPv6len)
+	return a.Mask(mask).Equal(b.Mask(mask))
+}
+
 func (peer *Peer) GetEndpointSrcStr() string {
 	peer.RLock()
 	defer peer.RUnlock()
@@ -592,7 +721,44 @@ func (device *Device) SaveToConfig(peer *Peer, endpoint conn.Endpoint) {
 
 func (device *Device) SaveConfig() {
 	if device.EdgeConfig.DynamicRoute.SaveNewPeers {
-		configbytes, _ := yaml.Marshal(device.EdgeConfig)
-		ioutil.WriteFile(device.EdgeConfigPath, configbytes, 0644)
+		if err := device.saveEdgeConfig(); err != nil && device.LogLevel.LogInternal {
+			fmt.Printf("Internal: Save new peers failed: %v\n", err)
+		}
+	}
+}
+
+// saveEdgeConfig writes the EdgeConfig back to the config file. It refuses if the file has ${VAR}, because they would be
+// written back by their values, which may be secrets, and the escaped $${VAR} would be expanded on the next start.
+func (device *Device) saveEdgeConfig() error {
+	if raw, err := ioutil.ReadFile(device.EdgeConfigPath); err == nil && mtypes.UsesEnv(raw) {
+		return fmt.Errorf("config file %v has ${VAR}, not written back", device.EdgeConfigPath)
+	}
+	configbytes, _ := yaml.Marshal(device.EdgeConfig)
+	return ioutil.WriteFile(device.EdgeConfigPath, configbytes, 0644)
+}
+
+// SnapshotPeers returns all regular peers with the endpoint they are using right now,
+// in the same format as the Peers section of the edge config.
+func (device *Device) SnapshotPeers() []mtypes.PeerInfo {
+	device.peers.RLock()
+	defer device.peers.RUnlock()
+	ret := make([]mtypes.PeerInfo, 0, len(device.peers.IDMap))
+	for id, peer := range device.peers.IDMap {
+		peer.handshake.mutex.RLock()
+		pubkeystr := peer.handshake.remoteStatic.ToString()
+		pskstr := peer.handshake.presharedKey.ToString()
+		if bytes.Equal(peer.handshake.presharedKey[:], make([]byte, 32)) {
+			pskstr = ""
+		}
+		peer.handshake.mutex.RUnlock()
+		ret = append(ret, mtypes.PeerInfo{
+			NodeID:              id,
+			PubKey:              pubkeystr,
+			PSKey:               pskstr,
+			EndPoint:            peer.GetEndpointDstStr(),
+			PersistentKeepalive: atomic.LoadUint32(&peer.persistentKeepaliveInterval),
+			Static:              peer.StaticConn,
+		})
 	}
+	return ret
 }
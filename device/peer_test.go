@@ -0,0 +1,32 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSameIPv6Prefix(t *testing.T) {
+	tests := []struct {
+		a, b string
+		bits int
+		want bool
+	}{
+		{"2001:db8:1:2:aaaa::1", "2001:db8:1:2:bbbb::2", 64, true},
+		{"2001:db8:1:2::1", "2001:db8:1:3::1", 64, false},
+		{"2001:db8:1:2::1", "2001:db8:1:3::1", 56, true},
+		{"2001:db8:1:2::1", "2001:db8:1:2::2", 0, false},
+		{"2001:db8:1:2::1", "2001:db8:1:2::2", 128, false},
+		{"10.0.0.1", "10.0.0.2", 64, false},
+		{"::ffff:10.0.0.1", "::ffff:10.0.0.2", 64, false},
+	}
+	for _, tt := range tests {
+		if got := sameIPv6Prefix(net.ParseIP(tt.a), net.ParseIP(tt.b), tt.bits); got != tt.want {
+			t.Errorf("sameIPv6Prefix(%v, %v, %v) = %v, want %v", tt.a, tt.b, tt.bits, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// pingProbe folds the path MTU discovery into the periodic pings. With DynamicRouteInfo.PingProbeMTUs, every ping
+// is padded to one of them in turn, as large as a data packet carrying an ethernet frame of that MTU.
+// The receiver records which of them arrive from each peer, a lost large ping is a size-dependent loss.
+type pingProbe struct {
+	mtus     []int
+	turn     uint32
+	received map[mtypes.Vertex]map[int]time.Time // the probed MTUs received from the peer, and when
+	sync.Mutex
+}
+
+func (device *Device) loadPingProbe() {
+	p := &device.pingProbe
+	p.mtus = device.EdgeConfig.DynamicRoute.PingProbeMTUs
+	p.received = make(map[mtypes.Vertex]map[int]time.Time)
+}
+
+// next returns the MTU to probe by the next ping, 0 if disabled
+func (p *pingProbe) next() int {
+	if len(p.mtus) == 0 {
+		return 0
+	}
+	return p.mtus[int(atomic.AddUint32(&p.turn, 1)-1)%len(p.mtus)]
+}
+
+// pingPadding returns the bytes to append to the ping body for the probed MTU
+func pingPadding(mtu int, body []byte) []byte {
+	size := ethHeaderLen + mtu - len(body)
+	if size <= 0 {
+		return nil
+	}
+	return make([]byte, size)
+}
+
+func (p *pingProbe) record(id mtypes.Vertex, mtu int, now time.Time) {
+	if mtu <= 0 || p.received == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if _, ok := p.received[id]; !ok {
+		p.received[id] = make(map[int]time.Time)
+	}
+	p.received[id][mtu] = now
+}
+
+// stats returns the probed MTUs received from each peer in window, the older ones are forgotten
+func (p *pingProbe) stats(now time.Time, window time.Duration) map[mtypes.Vertex]mtypes.PingProbeStats {
+	ret := make(map[mtypes.Vertex]mtypes.PingProbeStats)
+	p.Lock()
+	defer p.Unlock()
+	for id, mtus := range p.received {
+		var s mtypes.PingProbeStats
+		for mtu, t := range mtus {
+			if now.Sub(t) > window {
+				delete(mtus, mtu)
+				continue
+			}
+			s.Received = append(s.Received, mtu)
+			if mtu > s.MaxMTU {
+				s.MaxMTU = mtu
+			}
+		}
+		if len(mtus) == 0 {
+			delete(p.received, id)
+			continue
+		}
+		sort.Ints(s.Received)
+		ret[id] = s
+	}
+	return ret
+}
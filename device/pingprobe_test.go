@@ -0,0 +1,59 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestPingProbe(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{DynamicRoute: mtypes.DynamicRouteInfo{PingProbeMTUs: []int{1280, 1420, 9000}}}
+	device.loadPingProbe()
+	p := &device.pingProbe
+
+	// padded as large as a frame of the MTU, and still parsed
+	for _, want := range []int{1280, 1420, 9000, 1280} {
+		mtu := p.next()
+		if mtu != want {
+			t.Fatalf("next() = %v, want %v", mtu, want)
+		}
+		body, _ := mtypes.GetByte(&mtypes.PingMsg{Src_nodeID: 1, Time: time.Now(), ProbeMTU: mtu})
+		body = append(body, pingPadding(mtu, body)...)
+		if len(body) != ethHeaderLen+mtu {
+			t.Errorf("padded to %v, want %v", len(body), ethHeaderLen+mtu)
+		}
+		content, err := mtypes.ParsePingMsg(body)
+		if err != nil || content.Src_nodeID != 1 || content.ProbeMTU != mtu {
+			t.Fatalf("ParsePingMsg = %+v, %v", content, err)
+		}
+	}
+
+	now := time.Now()
+	p.record(2, 0, now) // not a probe
+	p.record(2, 1280, now.Add(-time.Minute))
+	p.record(2, 1420, now)
+	p.record(2, 9000, now.Add(-time.Hour))
+	p.record(3, 9000, now.Add(-time.Hour))
+	stats := p.stats(now, 2*time.Minute)
+	if want := map[mtypes.Vertex]mtypes.PingProbeStats{2: {MaxMTU: 1420, Received: []int{1280, 1420}}}; !reflect.DeepEqual(stats, want) {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	// disabled
+	d := &Device{}
+	if mtu := d.pingProbe.next(); mtu != 0 {
+		t.Errorf("disabled next() = %v", mtu)
+	}
+	d.pingProbe.record(2, 1280, now)
+	if len(d.pingProbe.stats(now, time.Minute)) != 0 {
+		t.Error("disabled probe recorded")
+	}
+}
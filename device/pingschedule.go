@@ -0,0 +1,72 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// pingSchedule pings the peers with PeerInfo.PingInterval on their own timers, and the others every SendPingInterval.
+// It's empty if no peer overrides the interval, and RoutineSendPing pings all the peers together as usual.
+type pingSchedule struct {
+	interval map[mtypes.Vertex]time.Duration
+	last     map[mtypes.Vertex]time.Time
+	sync.Mutex
+}
+
+func (device *Device) loadPingSchedule() {
+	s := &device.pingSchedule
+	for _, peerconf := range device.EdgeConfig.Peers {
+		if peerconf.PingInterval <= 0 {
+			continue
+		}
+		if s.interval == nil {
+			s.interval = make(map[mtypes.Vertex]time.Duration)
+			s.last = make(map[mtypes.Vertex]time.Time)
+		}
+		s.interval[peerconf.NodeID] = mtypes.S2TD(peerconf.PingInterval)
+	}
+}
+
+func (s *pingSchedule) enabled() bool {
+	return s.interval != nil
+}
+
+// due returns the peers to ping now, and how long until the next one is due. global <= 0 means the peers
+// without PingInterval are not pinged, like before the supernode sends SendPingInterval. wait is 0 if nothing is due ever.
+func (s *pingSchedule) due(peers []mtypes.Vertex, global time.Duration, now time.Time) (ping []mtypes.Vertex, wait time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	for _, id := range peers {
+		interval, ok := s.interval[id]
+		if !ok {
+			interval = global
+		}
+		if interval <= 0 {
+			continue
+		}
+		next := s.last[id].Add(interval)
+		if !now.Before(next) {
+			ping = append(ping, id)
+			s.last[id] = now
+			next = now.Add(interval)
+		}
+		if left := next.Sub(now); wait == 0 || left < wait {
+			wait = left
+		}
+	}
+	return
+}
+
+// reset makes all the peers due, when RoutineSendPing is kicked by Chan_SendPingStart
+func (s *pingSchedule) reset() {
+	s.Lock()
+	defer s.Unlock()
+	s.last = make(map[mtypes.Vertex]time.Time)
+}
@@ -0,0 +1,51 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestPingSchedule(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{Peers: []mtypes.PeerInfo{{NodeID: 2, PingInterval: 1}, {NodeID: 3, PingInterval: 0}}}
+	device.loadPingSchedule()
+	s := &device.pingSchedule
+	if !s.enabled() {
+		t.Fatal("not enabled")
+	}
+	peers := []mtypes.Vertex{2, 3, 4}
+	due := func(global time.Duration, now time.Time) ([]mtypes.Vertex, time.Duration) {
+		ping, wait := s.due(peers, global, now)
+		sort.Slice(ping, func(i, j int) bool { return ping[i] < ping[j] })
+		return ping, wait
+	}
+
+	now := time.Now()
+	if ping, wait := due(0, now); !reflect.DeepEqual(ping, []mtypes.Vertex{2}) || wait != time.Second {
+		t.Errorf("without SendPingInterval: %v %v", ping, wait)
+	}
+	if ping, wait := due(5*time.Second, now); !reflect.DeepEqual(ping, []mtypes.Vertex{3, 4}) || wait != time.Second {
+		t.Errorf("first: %v %v", ping, wait)
+	}
+	for i := 1; i <= 4; i++ {
+		if ping, _ := due(5*time.Second, now.Add(time.Duration(i)*time.Second)); !reflect.DeepEqual(ping, []mtypes.Vertex{2}) {
+			t.Errorf("#%v: %v", i, ping)
+		}
+	}
+	if ping, _ := due(5*time.Second, now.Add(5*time.Second)); !reflect.DeepEqual(ping, []mtypes.Vertex{2, 3, 4}) {
+		t.Errorf("after SendPingInterval: %v", ping)
+	}
+	s.reset()
+	if ping, _ := due(5*time.Second, now.Add(5500*time.Millisecond)); len(ping) != 3 {
+		t.Errorf("after reset: %v", ping)
+	}
+}
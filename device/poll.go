@@ -0,0 +1,82 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// With ControlTransport http, the EdgeNode never talks to the supernode by UDP or TCP, so the supernode needs no private key.
+// RoutineRegister posts the RegisterMsg to /edge/poll instead, signed with the PSKey, and the reply tells the state hashes
+// which would have been pushed. The pongs can't be sent to the supernode either, so RoutinePostPeerInfo posts them after each poll.
+// HolePunch and Renumber are only pushed, so they never reach the EdgeNode.
+func (device *Device) pollSuper(body []byte) error {
+	Time := time.Now().UnixNano()
+	sig, err := mtypes.PollSig(device.EdgeConfig.DynamicRoute.SuperNode.PSKey, Time, body)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout: 8 * time.Second,
+	}
+	pollurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/poll"
+	req, err := http.NewRequest("POST", pollurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("NodeID", device.ID.ToString())
+	q.Add("PubKey", device.staticIdentity.publicKey.ToString())
+	q.Add("Time", strconv.FormatInt(Time, 10))
+	q.Add("Sig", sig)
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Poll %v\n", pollurl)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	allbytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("poll failed: %v %v", resp.StatusCode, string(allbytes))
+	}
+	var reply mtypes.RegisterReplyMsg
+	if err := json.Unmarshal(allbytes, &reply); err != nil {
+		return fmt.Errorf("JSON decode error: %v", err)
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Poll result %v\n", string(allbytes))
+	}
+	device.registerReplyReceived(reply)
+	if reply.SuperParamStateHash != "" {
+		device.process_UpdateSuperParamsMsg(nil, reply.SuperParamStateHash)
+	}
+	if reply.PeerStateHash != "" {
+		device.process_UpdatePeerMsg(nil, reply.PeerStateHash)
+	}
+	if reply.NhStateHash != "" {
+		device.process_UpdateNhTableMsg(nil, reply.NhStateHash)
+	}
+	select {
+	case device.Chan_HttpPostStart <- struct{}{}:
+	default:
+	}
+	return nil
+}
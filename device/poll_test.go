@@ -0,0 +1,66 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestPollSuper(t *testing.T) {
+	const PSKey = "yl/4SNFee7+kNekajVCrK0toqXJ4mlT4IN0klyAgyqU="
+	lastTime := int64(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		Time, _ := strconv.ParseInt(r.URL.Query().Get("Time"), 10, 64)
+		if sig, err := mtypes.PollSig(PSKey, Time, body); err != nil || sig != r.URL.Query().Get("Sig") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if Time <= lastTime {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lastTime = Time
+		ret, _ := json.Marshal(mtypes.RegisterReplyMsg{Version: "v1", Warnings: []string{"old version"}})
+		w.Write(ret)
+	}))
+	defer server.Close()
+
+	device := &Device{}
+	device.log = NewLogger(LogLevelError, "")
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = server.URL
+	device.EdgeConfig.DynamicRoute.SuperNode.PSKey = PSKey
+	device.state_hashes.NhTable.Store("")
+	device.state_hashes.Peer.Store("")
+	device.state_hashes.SuperParam.Store("")
+
+	body, _ := mtypes.GetByte(mtypes.RegisterMsg{Node_id: 1, Version: "v1"})
+	for i := 0; i < 2; i++ {
+		if err := device.pollSuper(body); err != nil {
+			t.Fatalf("poll %v: %v", i, err)
+		}
+	}
+	if s := device.registered.stats(); s.Replies != 2 || s.Version != "v1" || len(s.Warnings) != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	device.EdgeConfig.DynamicRoute.SuperNode.PSKey = "FJfjc+wRfk0FSuUkHlXl6D8xPzOKYdy3bxeYr5cpevQ="
+	if err := device.pollSuper(body); err == nil {
+		t.Error("poll with a wrong PSKey accepted")
+	}
+	device.EdgeConfig.DynamicRoute.SuperNode.PSKey = ""
+	if err := device.pollSuper(body); err == nil {
+		t.Error("poll without PSKey sent")
+	}
+}
@@ -0,0 +1,64 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import "time"
+
+// A replaced preshared key is kept as the secondary one for PresharedKeyGraceTime, because the other side may not be
+// rotated yet. The handshake responses are accepted under either key. As the responder, we don't know which key the
+// initiator has, so we try the primary one first, and the secondary one if the initiator retries without confirming
+// the session of our response.
+
+// setPresharedKey replaces the preshared key, and keeps the old one as the secondary. handshake.mutex must be locked.
+func (handshake *Handshake) setPresharedKey(psk NoisePresharedKey, now time.Time) {
+	if psk == handshake.presharedKey {
+		return
+	}
+	if !isZero(handshake.presharedKey[:]) {
+		handshake.oldPresharedKey = handshake.presharedKey
+		handshake.oldPresharedKeyExpire = now.Add(PresharedKeyGraceTime)
+	}
+	handshake.presharedKey = psk
+	handshake.respondWithOld = false
+}
+
+// hasOldPresharedKey reports whether the secondary preshared key is still in its grace time.
+// handshake.mutex must be locked, a read lock is enough.
+func (handshake *Handshake) hasOldPresharedKey(now time.Time) bool {
+	return !handshake.oldPresharedKeyExpire.IsZero() && now.Before(handshake.oldPresharedKeyExpire)
+}
+
+// expireOldPresharedKey wipes the secondary preshared key once its grace time has passed.
+// It's called on every new handshake. handshake.mutex must be write locked.
+func (handshake *Handshake) expireOldPresharedKey(now time.Time) {
+	if !handshake.oldPresharedKeyExpire.IsZero() && !handshake.hasOldPresharedKey(now) {
+		handshake.clearOldPresharedKey()
+	}
+}
+
+// clearOldPresharedKey wipes the secondary preshared key. handshake.mutex must be locked.
+func (handshake *Handshake) clearOldPresharedKey() {
+	setZero(handshake.oldPresharedKey[:])
+	handshake.oldPresharedKeyExpire = time.Time{}
+	handshake.respondWithOld = false
+}
+
+// presharedKeys returns the preshared keys to accept a handshake response under, the primary one first.
+// handshake.mutex must be locked, a read lock is enough.
+func (handshake *Handshake) presharedKeys(now time.Time) []NoisePresharedKey {
+	if handshake.hasOldPresharedKey(now) {
+		return []NoisePresharedKey{handshake.presharedKey, handshake.oldPresharedKey}
+	}
+	return []NoisePresharedKey{handshake.presharedKey}
+}
+
+// responsePresharedKey returns the preshared key to seal the handshake response with. handshake.mutex must be locked.
+func (handshake *Handshake) responsePresharedKey(now time.Time) NoisePresharedKey {
+	if handshake.respondWithOld && handshake.hasOldPresharedKey(now) {
+		return handshake.oldPresharedKey
+	}
+	return handshake.presharedKey
+}
@@ -0,0 +1,49 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPresharedKeyGrace(t *testing.T) {
+	var h Handshake
+	now := time.Now()
+	old := NoisePresharedKey{1}
+	psk := NoisePresharedKey{2}
+
+	h.setPresharedKey(old, now)
+	if keys := h.presharedKeys(now); len(keys) != 1 || keys[0] != old {
+		t.Fatalf("first key: %v", keys)
+	}
+
+	h.setPresharedKey(psk, now)
+	if keys := h.presharedKeys(now); len(keys) != 2 || keys[0] != psk || keys[1] != old {
+		t.Fatalf("in the grace time: %v", keys)
+	}
+	if h.responsePresharedKey(now) != psk {
+		t.Error("responded with the old key first")
+	}
+	h.respondWithOld = true
+	if h.responsePresharedKey(now) != old {
+		t.Error("not responded with the old key on retry")
+	}
+
+	// setting the same key again doesn't extend the grace time
+	h.setPresharedKey(psk, now.Add(time.Minute))
+	later := now.Add(PresharedKeyGraceTime)
+	if keys := h.presharedKeys(later); len(keys) != 1 || keys[0] != psk {
+		t.Fatalf("after the grace time: %v", keys)
+	}
+	if h.responsePresharedKey(later) != psk {
+		t.Error("responded with the expired key")
+	}
+	h.expireOldPresharedKey(later)
+	if !isZero(h.oldPresharedKey[:]) || !h.oldPresharedKeyExpire.IsZero() {
+		t.Error("expired key not wiped")
+	}
+}
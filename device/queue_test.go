@@ -0,0 +1,55 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueOutboundDropOldestStopSignal(t *testing.T) {
+	device := &Device{}
+	device.PopulatePools()
+	peer := &Peer{device: device}
+	peer.queue.outbound = newAutodrainingOutboundQueue(device, 4)
+	peer.queue.dropOldest = true
+
+	// the queue is full with the stop signal in front, and nobody receives
+	peer.queue.outbound.c <- nil
+	for len(peer.queue.outbound.c) < cap(peer.queue.outbound.c) {
+		peer.queue.outbound.c <- device.NewOutboundElement()
+	}
+	done := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 1000; j++ {
+					peer.queueOutbound(device.NewOutboundElement())
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queueOutbound blocked on a full queue")
+	}
+	stop := 0
+	for len(peer.queue.outbound.c) > 0 {
+		if <-peer.queue.outbound.c == nil {
+			stop++
+		}
+	}
+	if stop != 1 {
+		t.Errorf("%v stop signals in the queue, want 1", stop)
+	}
+}
@@ -121,6 +121,7 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 		deathSpiral = 0
 
 		if size < MinMessageSize {
+			device.LogDrop("packet too small", endpoint, buffer[:size])
 			continue
 		}
 
@@ -145,6 +146,7 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			// check size
 
 			if len(packet) < MessageTransportSize {
+				device.LogDrop("transport packet too small", endpoint, packet)
 				continue
 			}
 
@@ -156,12 +158,14 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			value := device.indexTable.Lookup(receiver)
 			keypair := value.keypair
 			if keypair == nil {
+				device.LogDrop("unknown receiver index", endpoint, packet)
 				continue
 			}
 
 			// check keypair expiry
 
 			if keypair.created.Add(RejectAfterTime).Before(time.Now()) {
+				device.LogDrop("keypair expired", endpoint, packet)
 				continue
 			}
 
@@ -203,6 +207,10 @@ func (device *Device) RoutineReceiveIncoming(recv conn.ReceiveFunc) {
 			device.log.Verbosef("Received message with unknown type")
 		}
 
+		if !okay {
+			device.LogDrop("invalid size for "+msgType.ToString(), endpoint, packet)
+		}
+
 		if okay {
 			select {
 			case device.queue.handshake.c <- QueueHandshakeElement{
@@ -299,6 +307,7 @@ func (device *Device) RoutineHandshake(id int) {
 
 			if !device.cookieChecker.CheckMAC1(elem.packet) {
 				device.log.Verbosef("Received packet with invalid mac1")
+				device.LogDrop("invalid mac1", elem.endpoint, elem.packet)
 				goto skip
 			}
 
@@ -345,6 +354,7 @@ func (device *Device) RoutineHandshake(id int) {
 			peer := device.ConsumeMessageInitiation(&msg)
 			if peer == nil {
 				device.log.Verbosef("Received invalid initiation message from %s", elem.endpoint.DstToString())
+				device.LogDrop("invalid initiation message", elem.endpoint, elem.packet)
 				goto skip
 			}
 
@@ -354,7 +364,7 @@ func (device *Device) RoutineHandshake(id int) {
 			peer.timersAnyAuthenticatedPacketReceived()
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			peer.SetEndpointFromReceived(elem.endpoint, true)
 
 			device.log.Verbosef("%v - Received handshake initiation", peer)
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
@@ -382,7 +392,7 @@ func (device *Device) RoutineHandshake(id int) {
 			}
 
 			// update endpoint
-			peer.SetEndpointFromPacket(elem.endpoint)
+			peer.SetEndpointFromReceived(elem.endpoint, true)
 
 			device.log.Verbosef("%v - Received handshake response", peer)
 			atomic.AddUint64(&peer.stats.rxBytes, uint64(len(elem.packet)))
@@ -431,6 +441,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 		should_process := false
 		should_receive := false
 		should_transfer := false
+		flood_stamped := false
 		currentTime := time.Now()
 		storeTime := currentTime.Add(time.Second)
 		if currentTime.After((*peer.LastPacketReceivedAdd1Sec.Load().(*time.Time))) {
@@ -446,7 +457,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			goto skip
 		}
 
-		peer.SetEndpointFromPacket(elem.endpoint)
+		peer.SetEndpointFromReceived(elem.endpoint, false)
 		if peer.ReceivedWithKeypair(elem.keypair) {
 			peer.timersHandshakeComplete()
 			peer.SendStagedPackets()
@@ -465,6 +476,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 
 		if len(elem.packet) <= path.EgHeaderLen {
 			device.log.Errorf("Invalid EgHeader from peer %v", peer)
+			device.LogDrop("invalid EgHeader from peer "+peer.ID.ToString(), elem.endpoint, elem.packet)
 			goto skip
 		}
 		EgHeader, _ = path.NewEgHeader(elem.packet[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU) // EG header
@@ -475,6 +487,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 			if device.LogLevel.LogTransit {
 				fmt.Printf("Transit: Invalid packet usage:%v ttl:%v, content %v PL:%v S:%v D:%v From:%v IP:%v\n", elem.Type.ToString(), elem.TTL, base64.StdEncoding.EncodeToString([]byte(elem.packet)), len(elem.packet), src_nodeID.ToString(), dst_nodeID.ToString(), peer.ID.ToString(), peer.endpoint.DstToString())
 			}
+			device.LogDrop("unknown packet usage "+elem.Type.ToString()+" from peer "+peer.ID.ToString(), elem.endpoint, elem.packet)
+			goto skip
+		}
+		if !device.IsSuperNode && !device.ingress.check(peer.ID, packet_type) {
+			device.log.Errorf("received %v not allowed from peer S:%v From:%v IP:%v", packet_type.ToString(), src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
+			device.LogDrop(packet_type.ToString()+" not allowed from peer "+peer.ID.ToString(), elem.endpoint, elem.packet)
 			goto skip
 		}
 		if device.IsSuperNode {
@@ -482,6 +500,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				should_process = true
 			} else {
 				device.log.Errorf("received unsupported packet_type %v S:%v From:%v IP:%v", packet_type, src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
+				device.LogDrop("unsupported packet usage "+packet_type.ToString()+" from peer "+peer.ID.ToString(), elem.endpoint, elem.packet)
 				goto skip
 			}
 			switch dst_nodeID {
@@ -501,6 +520,8 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					should_receive = true
 				case mtypes.NodeID_Spread:
 					should_receive = true
+				case mtypes.NodeID_Default:
+					should_receive = device.graph.Next(device.ID, mtypes.NodeID_Default) == mtypes.NodeID_Invalid // the end of the default route, a gateway
 				}
 			}
 			if packet_type.IsControl_Edge2Edge() {
@@ -513,18 +534,12 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					should_process = true
 				}
 			}
-			if packet_type.IsControl_Super2Edge() {
-				if peer.ID == mtypes.NodeID_SuperNode {
-					switch dst_nodeID {
-					case device.ID:
-						should_process = true
-					case mtypes.NodeID_SuperNode:
-						should_process = true
-					}
-
-				} else {
-					device.log.Errorf("received ServerUpdate packet from non supernode S:%v From:%v IP:%v", src_nodeID, peer.ID.ToString(), peer.endpoint.DstToString())
-					goto skip
+			if packet_type.IsControl_Super2Edge() { // from the supernode only, see ingressAllowlist
+				switch dst_nodeID {
+				case device.ID:
+					should_process = true
+				case mtypes.NodeID_SuperNode:
+					should_process = true
 				}
 			}
 
@@ -534,7 +549,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				should_transfer = true
 			case mtypes.NodeID_Spread:
 				packet := elem.packet[path.EgHeaderLen:] //packet body
-				if device.CheckNoDup(packet) {
+				if device.CheckNoDup(src_nodeID, packet) {
 					should_transfer = true
 				} else {
 					if device.LogLevel.LogTransit {
@@ -548,14 +563,34 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				should_transfer = false
 			case mtypes.NodeID_Invalid:
 				should_transfer = false
+			case mtypes.NodeID_Default:
+				should_transfer = !should_receive
 			default:
 				if device.graph.Next(device.ID, dst_nodeID) != mtypes.NodeID_Invalid {
 					should_transfer = true
+				} else if device.noRoute(dst_nodeID, packet_type, elem.endpoint, elem.packet) {
+					// spread it like the origin does, and remember it so it's not spread again when it comes back
+					EgHeader.SetDst(mtypes.NodeID_Spread)
+					dst_nodeID = mtypes.NodeID_Spread
+					device.CheckNoDup(src_nodeID, elem.packet[path.EgHeaderLen:])
+					should_transfer = true
 				} else {
 					device.log.Verbosef("No route to peer ID %v", dst_nodeID)
 				}
 			}
 		}
+		if packet_type == path.NormalPacket && dst_nodeID == mtypes.NodeID_Broadcast {
+			var deliver bool
+			deliver, flood_stamped = device.ackFlood(peer, src_nodeID, elem.packet[path.EgHeaderLen:])
+			if !deliver {
+				goto skip // retransmitted by ReliableFlood, but we have it already
+			}
+		}
+		if packet_type == path.TracePacket && !device.IsSuperNode {
+			// stamped and forwarded by process_trace on every hop
+			should_process = true
+			should_transfer = false
+		}
 		if should_transfer {
 			l2ttl := elem.TTL
 			if l2ttl == 0 {
@@ -599,16 +634,26 @@ func (peer *Peer) RoutineSequentialReceiver() {
 				err = device.process_received(packet_type, peer, elem.packet[path.EgHeaderLen:])
 				if err != nil {
 					device.log.Errorf(err.Error())
+					device.LogDrop("malformed "+packet_type.ToString()+" from peer "+peer.ID.ToString()+": "+err.Error(), elem.endpoint, elem.packet)
 				}
 			}
 		}
 
 		if should_receive { // Write message to tap device
 			if packet_type == path.NormalPacket {
+				if flood_stamped {
+					elem.packet = elem.packet[:len(elem.packet)-floodSeqLen] // forwarded with it already
+				}
 				if len(elem.packet) <= path.EgHeaderLen+12 {
 					device.log.Errorf("Invalid Normal packet: Ethernet packet too small from peer %v", peer.ID.ToString())
 					goto skip
 				}
+				if !device.etherTypeAllowed(elem.packet[path.EgHeaderLen:]) {
+					goto skip
+				}
+				if !device.innerACLAllowed(src_nodeID, peer.ID, elem.packet[path.EgHeaderLen:]) {
+					goto skip
+				}
 				if device.LogLevel.LogNormal {
 					packet_len := len(elem.packet) - path.EgHeaderLen
 					fmt.Printf("Normal: Recv Len:%v S:%v D:%v TTL:%v From:%v IP:%v:\n", strconv.Itoa(packet_len), src_nodeID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
@@ -620,7 +665,7 @@ func (peer *Peer) RoutineSequentialReceiver() {
 					val, ok := device.l2fib.Load(src_macaddr)
 					if ok {
 						idtime := val.(*IdAndTime)
-						if idtime.ID != src_nodeID {
+						if !idtime.Static && idtime.ID != src_nodeID {
 							idtime.ID = src_nodeID
 							if device.LogLevel.LogInternal {
 								fmt.Printf("Internal: L2FIB [%v -> %v] updated.\n", src_macaddr.String(), src_nodeID)
@@ -629,15 +674,18 @@ func (peer *Peer) RoutineSequentialReceiver() {
 						idtime.Time = time.Now()
 					} else {
 						device.l2fib.Store(src_macaddr, &IdAndTime{
-							ID:   src_nodeID,
-							Time: time.Now(),
+							ID:      src_nodeID,
+							Time:    time.Now(),
+							Timeout: device.l2fibTimeout(elem.packet[path.EgHeaderLen:]),
 						}) // Write to l2fib table
 						if device.LogLevel.LogInternal {
 							fmt.Printf("Internal: L2FIB [%v -> %v] added.\n", src_macaddr.String(), src_nodeID)
 						}
 					}
 				}
-				_, err = device.tap.device.Write(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
+				device.learnNeighbor(elem.packet[path.EgHeaderLen:])
+				device.clampMSS(elem.packet[path.EgHeaderLen:], peer)
+				err = device.writeTap(elem.buffer[:MessageTransportOffsetContent+len(elem.packet)], MessageTransportOffsetContent+path.EgHeaderLen)
 				if err != nil && !device.isClosed() {
 					device.log.Errorf("Failed to write packet to TUN device: %v", err)
 				}
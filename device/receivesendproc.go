@@ -11,10 +11,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/crc32"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -30,6 +30,15 @@ import (
 )
 
 func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet []byte, offset int) {
+	device.sendPacket(peer, usage, unknownAction, ttl, packet, offset)
+}
+
+// SendServerUpdate sends a ServerUpdate, whose action is counted in MessageStats.
+func (device *Device) SendServerUpdate(peer *Peer, action mtypes.ServerCommand, packet []byte) {
+	device.sendPacket(peer, path.ServerUpdate, action, 0, packet, MessageTransportOffsetContent)
+}
+
+func (device *Device) sendPacket(peer *Peer, usage path.Usage, action mtypes.ServerCommand, ttl uint8, packet []byte, offset int) {
 	if peer == nil {
 		return
 	} else if peer.endpoint == nil {
@@ -70,6 +79,9 @@ func (device *Device) SendPacket(peer *Peer, usage path.Usage, ttl uint8, packet
 	elem.TTL = ttl
 	elem.packet = elem.buffer[offset : offset+len(packet)]
 	if peer.isRunning.Get() {
+		if usage != path.NormalPacket {
+			device.msgCount.sent.count(usage, action)
+		}
 		peer.StagePacket(elem)
 		elem = nil
 		peer.SendStagedPackets()
@@ -85,6 +97,7 @@ func (device *Device) BoardcastPacket(skip_list map[mtypes.Vertex]bool, usage pa
 	for node_id, should_send := range send_list {
 		if should_send {
 			peer_out := device.peers.IDMap[node_id]
+			device.trackFlood(peer_out, usage, ttl, packet)
 			go device.SendPacket(peer_out, usage, ttl, packet, offset)
 		}
 	}
@@ -118,14 +131,20 @@ func (device *Device) TransitBoardcastPacket(src_nodeID mtypes.Vertex, in_id mty
 		if device.LogLevel.LogTransit {
 			fmt.Printf("Transit: Transfer From:%v Me:%v To:%v S:%v D:%v TTL:%v\n", in_id, device.ID, peer_out.ID, src_nodeID.ToString(), peer_out.ID.ToString(), ttl)
 		}
+		device.trackFlood(peer_out, usage, ttl, packet)
 		go device.SendPacket(peer_out, usage, ttl, packet, offset)
 	}
 	device.peers.RUnlock()
 }
 
 func (device *Device) Send2Super(usage path.Usage, ttl uint8, packet []byte, offset int) {
+	if device.sendControlTCP(usage, packet) && usage != path.Register {
+		return // Register goes by UDP as well, so that the supernode knows our UDP endpoint
+	}
 	device.peers.RLock()
-	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode && device.superBalance.enabled() {
+		device.send2SuperBalanced(usage, ttl, packet, offset)
+	} else if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
 		for _, peer_out := range device.peers.SuperPeer {
 			/*if device.LogTransit {
 				fmt.Printf("Send to supernode %s\n", peer_out.endpoint.DstToString())
@@ -136,16 +155,10 @@ func (device *Device) Send2Super(usage path.Usage, ttl uint8, packet []byte, off
 	device.peers.RUnlock()
 }
 
-func (device *Device) CheckNoDup(packet []byte) bool {
-	hasher := crc32.New(crc32.MakeTable(crc32.Castagnoli))
-	hasher.Write(packet)
-	crc32result := hasher.Sum32()
-	_, ok := device.DupData.Get(crc32result)
-	device.DupData.Set(crc32result, true)
-	return !ok
-}
-
 func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []byte) (err error) {
+	if device.IsSuperNode || msg_type != path.ServerUpdate {
+		device.msgCount.recv.count(msg_type, unknownAction)
+	}
 	if device.IsSuperNode {
 		switch msg_type {
 		case path.Register:
@@ -167,7 +180,15 @@ func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []b
 		switch msg_type {
 		case path.ServerUpdate:
 			if content, err := mtypes.ParseServerUpdateMsg(body); err == nil {
+				device.msgCount.recv.count(msg_type, content.Action)
 				device.process_ServerUpdateMsg(peer, content)
+			} else {
+				device.msgCount.recv.count(msg_type, unknownAction)
+				return err
+			}
+		case path.RegisterReply:
+			if content, err := mtypes.ParseRegisterReplyMsg(body); err == nil {
+				return device.process_RegisterReplyMsg(peer, content)
 			} else {
 				return err
 			}
@@ -195,6 +216,19 @@ func (device *Device) process_received(msg_type path.Usage, peer *Peer, body []b
 			} else {
 				return err
 			}
+		case path.TracePacket:
+			if content, err := mtypes.ParseTraceMsg(body); err == nil {
+				return device.process_trace(peer, content)
+			} else {
+				return err
+			}
+		case path.BroadcastAck:
+			if content, err := mtypes.ParseBroadcastAckMsg(body); err == nil {
+				device.flood.ack(peer.ID, content)
+				return nil
+			} else {
+				return err
+			}
 		default:
 			err = errors.New("not a valid msg_type")
 		}
@@ -214,6 +248,11 @@ func (device *Device) sprint_received(msg_type path.Usage, body []byte) string {
 			return content.ToString()
 		}
 		return "ServerUpdate: Parse failed"
+	case path.RegisterReply:
+		if content, err := mtypes.ParseRegisterReplyMsg(body); err == nil {
+			return content.ToString()
+		}
+		return "RegisterReplyMsg: Parse failed"
 	case path.PingPacket:
 		if content, err := mtypes.ParsePingMsg(body); err == nil {
 			return content.ToString()
@@ -234,20 +273,37 @@ func (device *Device) sprint_received(msg_type path.Usage, body []byte) string {
 			return content.ToString()
 		}
 		return "BoardcastPeerMsg: Parse failed"
+	case path.TracePacket:
+		if content, err := mtypes.ParseTraceMsg(body); err == nil {
+			return content.ToString()
+		}
+		return "TraceMsg: Parse failed"
+	case path.BroadcastAck:
+		if content, err := mtypes.ParseBroadcastAckMsg(body); err == nil {
+			return content.ToString()
+		}
+		return "BroadcastAckMsg: Parse failed"
 	default:
 		return "UnknownMsg: Not a valid msg_type"
 	}
 }
 
-func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
+// GeneratePingPacket makes a ping to the peer to, with the delay of its last ping echoed
+func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, to mtypes.Vertex, request_reply int) ([]byte, path.Usage, uint8, error) {
+	probeMTU := device.pingProbe.next()
 	body, err := mtypes.GetByte(&mtypes.PingMsg{
 		Src_nodeID:   src_nodeID,
 		Time:         device.graph.GetCurrentTime(),
 		RequestReply: request_reply,
+		ProbeMTU:     probeMTU,
+		Echo:         device.clockSkew.echo(to, device.graph.GetCurrentTime(), mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)),
 	})
 	if err != nil {
 		return nil, path.PingPacket, 0, err
 	}
+	if probeMTU > 0 {
+		body = append(body, pingPadding(probeMTU, body)...) // ignored by the gob decoder
+	}
 	buf := make([]byte, path.EgHeaderLen+len(body))
 	header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
 	if err != nil {
@@ -261,7 +317,7 @@ func (device *Device) GeneratePingPacket(src_nodeID mtypes.Vertex, request_reply
 
 func (device *Device) SendPing(peer *Peer, times int, replies int, interval float64) {
 	for i := 0; i < times; i++ {
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, replies)
+		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, peer.ID, replies)
 		device.SendPacket(peer, usage, ttl, packet, MessageTransportOffsetContent)
 		time.Sleep(mtypes.S2TD(interval))
 	}
@@ -277,29 +333,81 @@ func compareVersion(v1 string, v2 string) bool {
 	return v1 == v2
 }
 
-func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.RegisterMsg) error {
+// versionAtLeast reports whether version v is not older than min.
+// The leading "v" and the "-" suffix from git describe are ignored, the rest is compared part by part.
+// A missing part is 0, so "0.3" equals "0.3.0".
+func versionAtLeast(v string, min string) bool {
+	split := func(s string) []string {
+		s = strings.TrimPrefix(s, "v")
+		if strings.Contains(s, "-") {
+			s = strings.Split(s, "-")[0]
+		}
+		return strings.Split(s, ".")
+	}
+	vs := split(v)
+	mins := split(min)
+	for i := 0; i < len(vs) || i < len(mins); i++ {
+		a, b := "0", "0"
+		if i < len(vs) {
+			a = vs[i]
+		}
+		if i < len(mins) {
+			b = mins[i]
+		}
+		ai, erra := strconv.ParseUint(a, 10, 64)
+		bi, errb := strconv.ParseUint(b, 10, 64)
+		if erra == nil && errb == nil {
+			if ai != bi {
+				return ai > bi
+			}
+			continue
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+// RegisterCheck checks the RegisterMsg from the peer with peerID at the supernode of the version.
+// It returns the ThrowError to reply, or NoAction if it's accepted.
+func RegisterCheck(sconfig *mtypes.SuperConfig, version string, peerID mtypes.Vertex, content mtypes.RegisterMsg) mtypes.ServerUpdateMsg {
 	ServerUpdateMsg := mtypes.ServerUpdateMsg{
-		Node_id: peer.ID,
+		Node_id: peerID,
 		Action:  mtypes.NoAction,
 		Code:    0,
 		Params:  "",
 	}
-	if peer.ID != content.Node_id {
+	if peerID != content.Node_id {
 		ServerUpdateMsg = mtypes.ServerUpdateMsg{
-			Node_id: peer.ID,
+			Node_id: peerID,
 			Action:  mtypes.ThrowError,
 			Code:    int(syscall.EPERM),
-			Params:  fmt.Sprintf("Your nodeID: %v is not match with registered nodeID: %v", content.Node_id, peer.ID),
+			Params:  fmt.Sprintf("Your nodeID: %v is not match with registered nodeID: %v", content.Node_id, peerID),
 		}
 	}
-	if !compareVersion(content.Version, device.Version) {
+	if MinVersion := sconfig.MinSupportedVersion; MinVersion != "" {
+		if !versionAtLeast(content.Version, MinVersion) {
+			ServerUpdateMsg = mtypes.ServerUpdateMsg{
+				Node_id: peerID,
+				Action:  mtypes.ThrowError,
+				Code:    int(syscall.ENOSYS),
+				Params:  fmt.Sprintf("Your version: \"%v\" is older than the minimum version supported by this supernode: \"%v\" (supernode version: \"%v\"). Please upgrade this edge node.", content.Version, MinVersion, version),
+			}
+		}
+	} else if !compareVersion(content.Version, version) {
 		ServerUpdateMsg = mtypes.ServerUpdateMsg{
-			Node_id: peer.ID,
+			Node_id: peerID,
 			Action:  mtypes.ThrowError,
 			Code:    int(syscall.ENOSYS),
-			Params:  fmt.Sprintf("Your version: \"%v\" is not compatible with our version: \"%v\"", content.Version, device.Version),
+			Params:  fmt.Sprintf("Your version: \"%v\" is not compatible with our version: \"%v\". Set MinSupportedVersion at the supernode to allow different versions.", content.Version, version),
 		}
 	}
+	return ServerUpdateMsg
+}
+
+func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.RegisterMsg) error {
+	ServerUpdateMsg := RegisterCheck(device.SuperConfig, device.Version, peer.ID, content)
 	if ServerUpdateMsg.Action != mtypes.NoAction {
 		body, err := mtypes.GetByte(&ServerUpdateMsg)
 		if err != nil {
@@ -310,7 +418,7 @@ func (device *Device) server_process_RegisterMsg(peer *Peer, content mtypes.Regi
 		header.SetSrc(device.ID)
 		copy(buf[path.EgHeaderLen:], body)
 		header.SetDst(mtypes.NodeID_SuperNode)
-		device.SendPacket(peer, path.ServerUpdate, 0, buf, MessageTransportOffsetContent)
+		device.SendServerUpdate(peer, ServerUpdateMsg.Action, buf)
 		return nil
 	}
 	device.Chan_server_register <- content
@@ -324,6 +432,16 @@ func (device *Device) server_process_Pong(peer *Peer, content mtypes.PongMsg) er
 
 func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
 	Timediff := device.graph.GetCurrentTime().Sub(content.Time).Seconds()
+	Timediff = device.measureClockSkew(peer, content, Timediff)
+	device.latencyLog.record(mtypes.LatencySample{Time: device.graph.GetCurrentTime(), Src: content.Src_nodeID, Dst: device.ID, Latency: Timediff})
+	device.pingProbe.record(peer.ID, content.ProbeMTU, time.Now())
+	breakerOpen, tripped := device.breaker.ping(peer.ID, time.Now(), mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout))
+	if tripped && device.LogLevel.LogControl {
+		fmt.Printf("Control: Peer %v re-connected %v times in %v, taken as down for %v\n", peer.ID.ToString(), device.breaker.cycles, device.breaker.window, device.breaker.cooldown)
+	}
+	if breakerOpen {
+		Timediff = mtypes.Infinity // advertise the link as down until the breaker closes
+	}
 	OldTimediff := peer.SingleWayLatency.Load().(float64)
 	NewTimediff := Timediff
 	if (OldTimediff < mtypes.Infinity) == (NewTimediff < mtypes.Infinity) {
@@ -339,7 +457,7 @@ func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
 		TimeToAlive:    device.EdgeConfig.DynamicRoute.PeerAliveTimeout,
 		AdditionalCost: device.EdgeConfig.DynamicRoute.AdditionalCost,
 	}
-	if device.EdgeConfig.DynamicRoute.P2P.UseP2P && time.Now().After(device.graph.NhTableExpire) {
+	if device.EdgeConfig.DynamicRoute.P2P.UseP2P && device.p2pRouting() {
 		device.graph.UpdateLatencyMulti([]mtypes.PongMsg{PongMSG}, true, false)
 	}
 	body, err := mtypes.GetByte(&PongMSG)
@@ -358,13 +476,15 @@ func (device *Device) process_ping(peer *Peer, content mtypes.PingMsg) error {
 		header.SetDst(mtypes.NodeID_Spread)
 		device.SpreadPacket(make(map[mtypes.Vertex]bool), path.PongPacket, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
 	}
-	go device.SendPing(peer, content.RequestReply, 0, 3)
+	if !breakerOpen {
+		go device.SendPing(peer, content.RequestReply, 0, 3)
+	}
 	return nil
 }
 
 func (device *Device) process_pong(peer *Peer, content mtypes.PongMsg) error {
 	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
-		if time.Now().After(device.graph.NhTableExpire) {
+		if device.p2pRouting() {
 			device.graph.UpdateLatency(content.Src_nodeID, content.Dst_nodeID, content.Timediff, device.EdgeConfig.DynamicRoute.PeerAliveTimeout, content.AdditionalCost, true, false)
 		}
 		if !peer.AskedForNeighbor {
@@ -439,15 +559,12 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 
 		for nodeID, thepeer := range device.peers.IDMap {
 			pk := thepeer.handshake.remoteStatic
-			psk := thepeer.handshake.presharedKey
 			if val, ok := peer_infos[pk.ToString()]; ok {
 				if val.NodeID != nodeID {
 					device.RemovePeer(pk)
 					continue
-				} else if val.PSKey != psk.ToString() {
-					device.RemovePeer(pk)
-					continue
 				}
+				// a new PSKey is set below, the old one is still accepted for PresharedKeyGraceTime
 			} else {
 				device.RemovePeer(pk)
 				continue
@@ -477,19 +594,24 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 				if device.graph.Weight(peerinfo.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
 					device.graph.UpdateLatency(peerinfo.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
 				}
-				thepeer, err = device.NewPeer(sk, peerinfo.NodeID, false, 0)
+				thepeer, err = device.NewPeer(sk, peerinfo.NodeID, false, peerinfo.PersistentKeepalive, mtypes.PeerQueueInfo{})
 				if err != nil {
 					device.log.Errorf("Failed to create peer with ID:%v PunKey:%v :%v", peerinfo.NodeID.ToString(), PubKey, err)
 					continue
 				}
+			} else {
+				thepeer.SetPersistentKeepalive(peerinfo.PersistentKeepalive)
 			}
-			if peerinfo.PSKey != "" {
-				pk, err := Str2PSKey(peerinfo.PSKey)
-				if err != nil {
-					device.log.Errorf("Error decode base64:", err)
-					continue
-				}
-				thepeer.SetPSK(pk)
+			psk, err := Str2PSKey(peerinfo.PSKey)
+			if err != nil {
+				device.log.Errorf("Error decode base64:", err)
+				continue
+			}
+			thepeer.handshake.mutex.RLock()
+			changed := psk != thepeer.handshake.presharedKey
+			thepeer.handshake.mutex.RUnlock()
+			if changed {
+				thepeer.SetPSK(psk)
 			}
 
 			thepeer.endpoint_trylist.UpdateSuper(*peerinfo.Connurl, !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP, device.EdgeConfig.AfPrefer)
@@ -508,56 +630,27 @@ func (device *Device) process_UpdatePeerMsg(peer *Peer, State_hash string) error
 
 func (device *Device) process_UpdateNhTableMsg(peer *Peer, State_hash string) error {
 	if device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		device.nhTableAnnounced(peer, State_hash)
 		if device.state_hashes.NhTable.Load().(string) == State_hash {
 			if device.LogLevel.LogControl {
 				fmt.Println("Control: Same Hash, skip download nhTable")
 			}
 			device.graph.NhTableExpire = time.Now().Add(device.graph.SuperNodeInfoTimeout)
+			device.nhTableReceived.Set(true)
 			return nil
 		}
-		var NhTable mtypes.NextHopTable
-		// Download from supernode
-		client := &http.Client{
-			Timeout: 8 * time.Second,
-		}
-		downloadurl := device.EdgeConfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl + "/edge/nhtable" ////////////////////////////////////////////////////////////////////////////////////////////////
-		req, err := http.NewRequest("GET", downloadurl, nil)
+		allbytes, err := device.downloadNhTable(State_hash)
 		if err != nil {
 			device.log.Errorf(err.Error())
 			return err
 		}
-		q := req.URL.Query()
-		q.Add("NodeID", device.ID.ToString())
-		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
-		q.Add("State", State_hash)
-		req.URL.RawQuery = q.Encode()
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable from :" + req.URL.RequestURI())
-		}
-		resp, err := client.Do(req)
-		if err != nil {
-			device.log.Errorf(err.Error())
-			return err
-		}
-		defer resp.Body.Close()
-		allbytes, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
-			device.log.Errorf(err.Error())
-			return err
-		}
-		if resp.StatusCode != 200 {
-			device.log.Errorf("Control: Download NhTable failed: " + strconv.Itoa(resp.StatusCode) + " " + string(allbytes))
+		if allbytes == nil {
 			return nil
 		}
-		if device.LogLevel.LogControl {
-			fmt.Println("Control: Download NhTable result :" + string(allbytes))
-		}
-		if err := json.Unmarshal(allbytes, &NhTable); err != nil {
-			device.log.Errorf("JSON decode error:", err.Error())
+		if err := device.applyNhTable(allbytes, State_hash); err != nil {
+			device.log.Errorf(err.Error())
 			return err
 		}
-		device.graph.SetNHTable(NhTable)
-		device.state_hashes.NhTable.Store(State_hash)
 	}
 	return nil
 }
@@ -635,6 +728,7 @@ func (device *Device) process_UpdateSuperParamsMsg(peer *Peer, State_hash string
 		if SuperParams.AdditionalCost >= 0 {
 			device.EdgeConfig.DynamicRoute.AdditionalCost = SuperParams.AdditionalCost
 		}
+		device.SuperConfig.TTLMargin = SuperParams.TTLMargin
 
 		device.state_hashes.SuperParam.Store(State_hash)
 	}
@@ -649,6 +743,13 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 		return nil
 	}
 
+	if !device.verifyServerUpdate(content) {
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: Ignored %v. Bad signature.\n", content.Action.ToString())
+		}
+		return nil
+	}
+
 	switch content.Action {
 	case mtypes.Shutdown:
 		device.log.Errorf("Shutdown: " + content.Params)
@@ -665,12 +766,127 @@ func (device *Device) process_ServerUpdateMsg(peer *Peer, content mtypes.ServerU
 		return device.process_UpdatePeerMsg(peer, content.Params)
 	case mtypes.UpdateSuperParams:
 		return device.process_UpdateSuperParamsMsg(peer, content.Params)
+	case mtypes.HolePunch:
+		return device.process_HolePunchMsg(content.Params)
+	case mtypes.Renumber:
+		return device.process_RenumberMsg(content.Params)
 	default:
 		device.log.Errorf("Unknown Action: %v", content.ToString())
 	}
 	return nil
 }
 
+func (device *Device) loadSuperSigningKey() {
+	if device.EdgeConfig.DynamicRoute.SuperNode.SigningPubKey == "" {
+		return
+	}
+	key, err := mtypes.ParseSigningPubKey(device.EdgeConfig.DynamicRoute.SuperNode.SigningPubKey)
+	if err != nil {
+		device.log.Errorf("Invalid SigningPubKey: %v", err)
+		return
+	}
+	device.superSigningKey = key
+}
+
+// verifyServerUpdate checks the signature of UpdateNhTable and UpdatePeer if SigningPubKey is set.
+// They may be relayed by other edges, so the encryption with the supernode doesn't prove who sent them.
+func (device *Device) verifyServerUpdate(content mtypes.ServerUpdateMsg) bool {
+	if device.superSigningKey == nil {
+		return true
+	}
+	switch content.Action {
+	case mtypes.UpdateNhTable, mtypes.UpdatePeer, mtypes.Renumber:
+		return content.Verify(device.superSigningKey)
+	}
+	return true
+}
+
+// process_RenumberMsg applies the new NodeID assigned by the supernode to the EdgeConfig, with the NextHopTable rewritten,
+// saves it to the config if it can, and asks for a restart by Chan_Renumbered. The supernode sends it several times, the repeats are ignored.
+func (device *Device) process_RenumberMsg(params string) error {
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return nil
+	}
+	NewNodeID, err := mtypes.String2NodeID(params)
+	if err != nil {
+		return err
+	}
+	if NewNodeID >= mtypes.NodeID_Special {
+		return fmt.Errorf("Renumber: invalid NodeID : %v", NewNodeID)
+	}
+	if NewNodeID == device.EdgeConfig.NodeID {
+		return nil
+	}
+	device.EdgeConfig.NextHopTable = mtypes.RenumberNhTable(device.EdgeConfig.NextHopTable, device.EdgeConfig.NodeID, NewNodeID)
+	device.EdgeConfig.NodeID = NewNodeID
+	if err := device.saveEdgeConfig(); err != nil {
+		// still renumber, the restart takes it from EG_RENUMBERED. But a cold start would come up with the old NodeID
+		device.log.Errorf("Renumber: save config failed: %v, set NodeID to %v in the config by hand", err, NewNodeID.ToString())
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Renumbered from %v to %v by supernode, restarting\n", device.ID.ToString(), NewNodeID.ToString())
+	}
+	select {
+	case device.Chan_Renumbered <- NewNodeID:
+	default:
+	}
+	return nil
+}
+
+func (device *Device) process_HolePunchMsg(params string) error {
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return nil
+	}
+	var content mtypes.API_HolePunch
+	if err := json.Unmarshal([]byte(params), &content); err != nil {
+		return err
+	}
+	device.peers.RLock()
+	thepeer, has := device.peers.IDMap[content.PeerID]
+	device.peers.RUnlock()
+	if !has || thepeer.StaticConn || thepeer.IsPeerAlive() || device.breaker.isOpen(thepeer.ID, time.Now()) {
+		return nil
+	}
+	if thepeer.holePunching.Swap(true) {
+		// Already punching for this peer
+		return nil
+	}
+	go device.RoutineHolePunch(thepeer, content)
+	return nil
+}
+
+// RoutineHolePunch waits until the time given by the SuperNode, then sends pings to every endpoint of the peer.
+// The peer does the same at the same time, so that both NATs have the mapping when the packets arrive.
+func (device *Device) RoutineHolePunch(thepeer *Peer, content mtypes.API_HolePunch) {
+	defer thepeer.holePunching.Set(false)
+	wait := content.StartAt.Sub(device.graph.GetCurrentTime())
+	if wait > mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout) {
+		return
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: HolePunch for peer %v in %v\n", thepeer.ID.ToString(), wait)
+	}
+	time.Sleep(wait)
+	urls := content.Connurl.GetList(!device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP)
+	sorted := make([]string, 0, len(urls))
+	for url := range urls {
+		sorted = append(sorted, url)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return urls[sorted[i]] < urls[sorted[j]] })
+	for _, url := range sorted {
+		if thepeer.IsPeerAlive() {
+			return
+		}
+		if err := thepeer.SetEndpointFromConnURL(url, 0, device.EdgeConfig.AfPrefer, false); err != nil {
+			continue
+		}
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: HolePunch for peer %v at endpoint %v\n", thepeer.ID.ToString(), url)
+		}
+		device.SendPing(thepeer, 3, 1, 0.2)
+	}
+}
+
 func (device *Device) process_RequestPeerMsg(content mtypes.QueryPeerMsg) error { //Send all my peers to all my peers
 	if device.EdgeConfig.DynamicRoute.P2P.UseP2P {
 		device.peers.RLock()
@@ -733,7 +949,7 @@ func (device *Device) process_BoardcastPeerMsg(peer *Peer, content mtypes.Boardc
 			if device.graph.Weight(content.NodeID, device.ID, false) == mtypes.Infinity { // add node to graph
 				device.graph.UpdateLatency(content.NodeID, device.ID, mtypes.Infinity, 0, device.EdgeConfig.DynamicRoute.AdditionalCost, true, false)
 			}
-			thepeer, err = device.NewPeer(pk, content.NodeID, false, 0)
+			thepeer, err = device.NewPeer(pk, content.NodeID, false, 0, mtypes.PeerQueueInfo{})
 			if err != nil {
 				return err
 			}
@@ -760,6 +976,8 @@ func (device *Device) RoutineTryReceivedEndpoint() {
 			if thepeer.LastPacketReceivedAdd1Sec.Load().(*time.Time).Add(mtypes.S2TD(device.EdgeConfig.DynamicRoute.PeerAliveTimeout)).After(time.Now()) {
 				//Peer alives
 				continue
+			} else if device.breaker.isOpen(thepeer.ID, time.Now()) {
+				continue
 			} else {
 				FastTry, connurl := thepeer.endpoint_trylist.GetNextTry()
 				if connurl == "" {
@@ -817,6 +1035,10 @@ func (device *Device) RoutineSendPing(startchan chan struct{}) {
 	if !(device.EdgeConfig.DynamicRoute.P2P.UseP2P || device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode) {
 		return
 	}
+	if device.pingSchedule.enabled() {
+		device.routineSendPingScheduled(startchan)
+		return
+	}
 	var waitchan <-chan time.Time
 	startchan <- struct{}{}
 	for {
@@ -835,8 +1057,54 @@ func (device *Device) RoutineSendPing(startchan chan struct{}) {
 			}
 		case <-waitchan:
 		}
-		packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, 0)
-		device.SpreadPacket(make(map[mtypes.Vertex]bool), usage, ttl, packet, MessageTransportOffsetContent)
+		// like SpreadPacket, but each peer gets its own echo
+		device.peers.RLock()
+		for peer_id, peer_out := range device.peers.IDMap {
+			packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, peer_id, 0)
+			go device.SendPacket(peer_out, usage, ttl, packet, MessageTransportOffsetContent)
+		}
+		device.peers.RUnlock()
+	}
+}
+
+// routineSendPingScheduled is RoutineSendPing with the PeerInfo.PingInterval of some peers, each peer is pinged on its own timer
+func (device *Device) routineSendPingScheduled(startchan chan struct{}) {
+	var waitchan <-chan time.Time
+	startchan <- struct{}{}
+	for {
+		device.peers.RLock()
+		ids := make([]mtypes.Vertex, 0, len(device.peers.IDMap))
+		for id := range device.peers.IDMap {
+			ids = append(ids, id)
+		}
+		device.peers.RUnlock()
+		ping, wait := device.pingSchedule.due(ids, mtypes.S2TD(device.EdgeConfig.DynamicRoute.SendPingInterval), time.Now())
+		for _, id := range ping {
+			device.peers.RLock()
+			peer := device.peers.IDMap[id]
+			device.peers.RUnlock()
+			if peer == nil {
+				continue
+			}
+			packet, usage, ttl, _ := device.GeneratePingPacket(device.ID, id, 0)
+			go device.SendPacket(peer, usage, ttl, packet, MessageTransportOffsetContent)
+		}
+		if wait > 0 {
+			waitchan = time.After(wait)
+		} else {
+			waitchan = time.After(time.Second) // check for the new peers
+		}
+		select {
+		case <-startchan:
+			if device.LogLevel.LogControl {
+				fmt.Println("Control: Start RoutineSendPing()")
+			}
+			for len(startchan) > 0 {
+				<-startchan
+			}
+			device.pingSchedule.reset()
+		case <-waitchan:
+		}
 	}
 }
 
@@ -865,7 +1133,7 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 		local_PeerStateHash := device.state_hashes.Peer.Load().(string)
 		local_NhTableHash := device.state_hashes.NhTable.Load().(string)
 		local_SuperParamState := device.state_hashes.SuperParam.Load().(string)
-		body, _ := mtypes.GetByte(mtypes.RegisterMsg{
+		reg_msg := mtypes.RegisterMsg{
 			Node_id:             device.ID,
 			PeerStateHash:       local_PeerStateHash,
 			NhStateHash:         local_NhTableHash,
@@ -873,7 +1141,19 @@ func (device *Device) RoutineRegister(startchan chan struct{}) {
 			Version:             device.Version,
 			JWTSecret:           device.JWTSecret,
 			HttpPostCount:       device.HttpPostCount,
-		})
+			ListenPorts:         device.ListenPorts(),
+			DataPort:            device.DataPort(),
+		}
+		if device.EdgeConfig.DynamicRoute.SuperNode.ControlTransport == mtypes.ControlTransportHTTP {
+			// the poll may go over plain http, and the posts are signed with the PSKey anyway
+			reg_msg.JWTSecret = mtypes.JWTSecret{}
+			body, _ := mtypes.GetByte(reg_msg)
+			if err := device.pollSuper(body); err != nil {
+				device.log.Errorf("RoutineRegister: %v", err)
+			}
+			continue
+		}
+		body, _ := mtypes.GetByte(reg_msg)
 		buf := make([]byte, path.EgHeaderLen+len(body))
 		header, _ := path.NewEgHeader(buf[0:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
 		header.SetDst(mtypes.NodeID_SuperNode)
@@ -929,20 +1209,26 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		LocalV4s := make(map[string]float64)
 		LocalV6s := make(map[string]float64)
 		if !device.EdgeConfig.DynamicRoute.SuperNode.SkipLocalIP {
-			if !device.peers.LocalV4.Equal(net.IP{}) {
-				LocalV4 := net.UDPAddr{
-					IP:   device.peers.LocalV4,
-					Port: int(device.net.port),
-				}
-
-				LocalV4s[LocalV4.String()] = 100
+			ports := device.ListenPorts()
+			if dataPort := device.DataPort(); dataPort != 0 {
+				ports = []uint16{dataPort}
 			}
-			if !device.peers.LocalV6.Equal(net.IP{}) {
-				LocalV6 := net.UDPAddr{
-					IP:   device.peers.LocalV6,
-					Port: int(device.net.port),
+			for i, port := range ports {
+				if !device.peers.LocalV4.Equal(net.IP{}) {
+					LocalV4 := net.UDPAddr{
+						IP:   device.peers.LocalV4,
+						Port: int(port),
+					}
+
+					LocalV4s[LocalV4.String()] = 100 + float64(i)
+				}
+				if !device.peers.LocalV6.Equal(net.IP{}) {
+					LocalV6 := net.UDPAddr{
+						IP:   device.peers.LocalV6,
+						Port: int(port),
+					}
+					LocalV6s[LocalV6.String()] = 100 + float64(i)
 				}
-				LocalV6s[LocalV6.String()] = 100
 			}
 		}
 		for _, AIP := range device.EdgeConfig.DynamicRoute.SuperNode.AdditionalLocalIP {
@@ -968,12 +1254,6 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 			LocalV6s: LocalV6s,
 		})
 		body = mtypes.Gzip(body)
-		bodyhash := base64.StdEncoding.EncodeToString(body)
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_report_peerinfo_jwt_claims{
-			PostCount: device.HttpPostCount,
-			BodyHash:  bodyhash,
-		})
-		tokenString, _ := token.SignedString(device.JWTSecret[:])
 		// Construct post request
 		client := &http.Client{
 			Timeout: 8 * time.Second,
@@ -987,7 +1267,25 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 		q := req.URL.Query()
 		q.Add("NodeID", device.ID.ToString())
 		q.Add("PubKey", device.staticIdentity.publicKey.ToString())
-		q.Add("JWTSig", tokenString)
+		if device.EdgeConfig.DynamicRoute.SuperNode.ControlTransport == mtypes.ControlTransportHTTP {
+			// the JWTSecret is not sent by the polls, sign with the PSKey
+			Time := time.Now().UnixNano()
+			sig, err := mtypes.PollSig(device.EdgeConfig.DynamicRoute.SuperNode.PSKey, Time, body)
+			if err != nil {
+				device.log.Errorf("RoutinePostPeerInfo: %v", err)
+				continue
+			}
+			q.Add("Time", strconv.FormatInt(Time, 10))
+			q.Add("Sig", sig)
+		} else {
+			bodyhash := base64.StdEncoding.EncodeToString(body)
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, mtypes.API_report_peerinfo_jwt_claims{
+				PostCount: device.HttpPostCount,
+				BodyHash:  bodyhash,
+			})
+			tokenString, _ := token.SignedString(device.JWTSecret[:])
+			q.Add("JWTSig", tokenString)
+		}
 		req.URL.RawQuery = q.Encode()
 		req.Header.Set("Content-Type", "application/octet-stream")
 		req.Header.Set("Content-Encoding", "gzip")
@@ -1013,15 +1311,22 @@ func (device *Device) RoutinePostPeerInfo(startchan <-chan struct{}) {
 }
 
 func (device *Device) RoutineRecalculateNhTable() {
-	if device.graph.TimeoutCheckInterval == 0 {
+	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
 		return
 	}
-
-	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
+	if device.graph.RecalcOnInterval() {
+		go device.RoutineRecalcInterval()
+	}
+	go device.graph.RoutinePollExternalCost(func() {
+		if device.p2pRouting() {
+			device.graph.RecalculateNhTableNow(false)
+		}
+	})
+	if device.graph.TimeoutCheckInterval == 0 || !device.graph.RecalcOnEvent() {
 		return
 	}
 	for {
-		if time.Now().After(device.graph.NhTableExpire) {
+		if device.p2pRouting() {
 			device.graph.RecalculateNhTable(false)
 		}
 		time.Sleep(device.graph.TimeoutCheckInterval)
@@ -1029,6 +1334,96 @@ func (device *Device) RoutineRecalculateNhTable() {
 
 }
 
+// RoutineRecalcInterval recalculates the NhTable every RecalcInterval, while we are routing by ourself.
+func (device *Device) RoutineRecalcInterval() {
+	for {
+		time.Sleep(device.graph.RecalcInterval)
+		if device.p2pRouting() {
+			device.graph.RecalculateNhTableNow(false)
+		}
+	}
+}
+
+// supernodeLostPolicy returns SupernodeLostPolicy. Empty means p2p_fallback in P2P mode, keep_last otherwise.
+func (device *Device) supernodeLostPolicy() string {
+	switch {
+	case device.EdgeConfig.DynamicRoute.SupernodeLostPolicy != "":
+		return device.EdgeConfig.DynamicRoute.SupernodeLostPolicy
+	case device.EdgeConfig.DynamicRoute.P2P.UseP2P:
+		return mtypes.SupernodeLostP2PFallback
+	default:
+		return mtypes.SupernodeLostKeepLast
+	}
+}
+
+// p2pRouting reports whether we calculate the NhTable by ourself from the P2P-learned latencies.
+// That's when there is no supernode, or all supernodes are lost in p2p_fallback.
+// All supernodes are lost when the NhTable from them is expired.
+func (device *Device) p2pRouting() bool {
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return true
+	}
+	return device.supernodeLostPolicy() == mtypes.SupernodeLostP2PFallback && time.Now().After(device.graph.NhTableExpire)
+}
+
+// RoutineSupernodeLost logs the transitions between supernode connected and all supernodes lost,
+// and applies SupernodeLostPolicy when lost.
+func (device *Device) RoutineSupernodeLost() {
+	if !device.EdgeConfig.DynamicRoute.SuperNode.UseSuperNode {
+		return
+	}
+	policy := device.supernodeLostPolicy()
+	lost := true // not connected yet
+	for {
+		time.Sleep(mtypes.S2TD(1))
+		now_lost := time.Now().After(device.graph.NhTableExpire)
+		if now_lost == lost {
+			continue
+		}
+		lost = now_lost
+		if !lost {
+			if device.LogLevel.LogControl {
+				fmt.Printf("Control: Supernode connected, use the NhTable from supernode\n")
+			}
+			continue
+		}
+		if device.LogLevel.LogControl {
+			fmt.Printf("Control: All supernodes lost, SupernodeLostPolicy: %v\n", policy)
+		}
+		switch policy {
+		case mtypes.SupernodeLostDropAll:
+			device.state_hashes.NhTable.Store("") // download again when the supernode is back
+			device.nhTableChanged()
+			device.nhTableReceived.Set(false)
+			device.graph.ClearNHTable()
+		case mtypes.SupernodeLostP2PFallback:
+			device.graph.RecalculateNhTableNow(false)
+		}
+	}
+}
+
+// RoutineExpireBootstrap stops using the NextHopTable from the config after BootstrapNhTableTTL,
+// if no NhTable from supernode has replaced it yet.
+func (device *Device) RoutineExpireBootstrap() {
+	expire := device.graph.BootstrapExpire()
+	if expire.IsZero() {
+		return
+	}
+	time.Sleep(time.Until(expire))
+	if !device.graph.DropBootstrap() {
+		return
+	}
+	if device.LogLevel.LogControl {
+		fmt.Printf("Control: Bootstrap NhTable expired\n")
+	}
+	if device.p2pRouting() {
+		device.graph.RecalculateNhTableNow(false)
+	} else {
+		device.graph.ClearNHTable()
+	}
+	device.nhTableChanged()
+}
+
 func (device *Device) RoutineSpreadAllMyNeighbor() {
 	if !device.EdgeConfig.DynamicRoute.P2P.UseP2P {
 		return
@@ -1074,15 +1469,108 @@ func (device *Device) RoutineResetEndpoint() {
 	}
 }
 
+// RoutineResolveEndpoint resolves the endpoints with a scheme, like srv:// or dns://, again periodically,
+// and updates the endpoint of the peer when the resolution changes.
+func (device *Device) RoutineResolveEndpoint() {
+	var ResolveEndpointInterval float64
+	if device.IsSuperNode {
+		ResolveEndpointInterval = device.SuperConfig.ResolveEndpointInterval
+	} else {
+		ResolveEndpointInterval = device.EdgeConfig.ResolveEndpointInterval
+	}
+	if ResolveEndpointInterval <= 0.01 {
+		return
+	}
+	timeout := mtypes.S2TD(ResolveEndpointInterval)
+	for {
+		time.Sleep(timeout)
+		device.peers.RLock()
+		peers := make([]*Peer, 0, len(device.peers.keyMap))
+		for _, peer := range device.peers.keyMap {
+			peers = append(peers, peer)
+		}
+		device.peers.RUnlock()
+		for _, peer := range peers {
+			connurl := peer.ConnURL
+			if !conn.IsDynamicURL(connurl) {
+				continue
+			}
+			_, connIP, err := conn.LookupIP(connurl, peer.ConnAF, device.EdgeConfig.AfPrefer)
+			if err != nil {
+				device.log.Errorf("Failed to resolve %v: %v", connurl, err)
+				continue
+			}
+			if connIP == peer.GetEndpointDstStr() {
+				continue
+			}
+			if device.LogLevel.LogControl {
+				fmt.Printf("Control: Endpoint of %v resolved to %v, was %v\n", connurl, connIP, peer.GetEndpointDstStr())
+			}
+			if err := peer.SetEndpointFromConnURL(connurl, peer.ConnAF, device.EdgeConfig.AfPrefer, peer.StaticConn); err != nil {
+				device.log.Errorf("Failed to bind %v: %v", connurl, err)
+			}
+		}
+	}
+}
+
+// l2fibTimeoutOf converts the timeout in the config, <= 0.01 means never expire
+func l2fibTimeoutOf(timeout float64) time.Duration {
+	if timeout <= 0.01 {
+		return 0
+	}
+	return mtypes.S2TD(timeout)
+}
+
+// l2fibTimeout returns the timeout for a learned entry, L2FIBTimeoutVLAN overrides L2FIBTimeout for tagged frames
+func (device *Device) l2fibTimeout(packet []byte) time.Duration {
+	if vid, tagged := tap.GetVLANID(packet); tagged {
+		if timeout, has := device.EdgeConfig.L2FIBTimeoutVLAN[vid]; has {
+			return l2fibTimeoutOf(timeout)
+		}
+	}
+	return l2fibTimeoutOf(device.EdgeConfig.L2FIBTimeout)
+}
+
+func (device *Device) loadL2FIBStatic() {
+	for _, entry := range device.EdgeConfig.L2FIBStatic {
+		hwaddr, err := net.ParseMAC(entry.MacAddr)
+		if err != nil || len(hwaddr) != 6 {
+			device.log.Errorf("Invalid L2FIBStatic MacAddr: %v", entry.MacAddr)
+			continue
+		}
+		var mac tap.MacAddress
+		copy(mac[:], hwaddr)
+		device.l2fib.Store(mac, &IdAndTime{
+			ID:      entry.NodeID,
+			Time:    time.Now(),
+			Timeout: l2fibTimeoutOf(entry.Timeout),
+			Static:  true,
+		})
+	}
+}
+
 func (device *Device) RoutineClearL2FIB() {
-	if device.EdgeConfig.L2FIBTimeout <= 0.01 {
+	// Check at the shortest timeout among all sources
+	var interval time.Duration
+	update_interval := func(timeout time.Duration) {
+		if timeout > 0 && (interval == 0 || timeout < interval) {
+			interval = timeout
+		}
+	}
+	update_interval(l2fibTimeoutOf(device.EdgeConfig.L2FIBTimeout))
+	for _, timeout := range device.EdgeConfig.L2FIBTimeoutVLAN {
+		update_interval(l2fibTimeoutOf(timeout))
+	}
+	for _, entry := range device.EdgeConfig.L2FIBStatic {
+		update_interval(l2fibTimeoutOf(entry.Timeout))
+	}
+	if interval == 0 {
 		return
 	}
-	timeout := mtypes.S2TD(device.EdgeConfig.L2FIBTimeout)
 	for {
 		device.l2fib.Range(func(k interface{}, v interface{}) bool {
 			val := v.(*IdAndTime)
-			if time.Now().After(val.Time.Add(timeout)) {
+			if val.Timeout > 0 && time.Now().After(val.Time.Add(val.Timeout)) {
 				mac := k.(tap.MacAddress)
 				device.l2fib.Delete(k)
 				if device.LogLevel.LogInternal {
@@ -1091,6 +1579,6 @@ func (device *Device) RoutineClearL2FIB() {
 			}
 			return true
 		})
-		time.Sleep(timeout)
+		time.Sleep(interval)
 	}
 }
@@ -0,0 +1,63 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// registerReply keeps the last RegisterReplyMsg from the supernode, for the metrics
+type registerReply struct {
+	stat mtypes.RegisterStatus
+	sync.Mutex
+}
+
+// update records the reply, it returns whether the warnings changed since the last one
+func (r *registerReply) update(content mtypes.RegisterReplyMsg, inSync bool, now time.Time) (warningsChanged bool) {
+	r.Lock()
+	defer r.Unlock()
+	warningsChanged = !reflect.DeepEqual(r.stat.Warnings, content.Warnings)
+	r.stat.Replies++
+	r.stat.LastReply = now
+	r.stat.Version = content.Version
+	r.stat.InSync = inSync
+	r.stat.SuperParams = content.SuperParams
+	r.stat.Warnings = content.Warnings
+	return
+}
+
+func (r *registerReply) stats() mtypes.RegisterStatus {
+	r.Lock()
+	defer r.Unlock()
+	return r.stat
+}
+
+func (device *Device) process_RegisterReplyMsg(peer *Peer, content mtypes.RegisterReplyMsg) error {
+	if peer.ID != mtypes.NodeID_SuperNode {
+		if device.LogLevel.LogControl {
+			fmt.Println("Control: Ignored RegisterReplyMsg. Not from supernode.")
+		}
+		return nil
+	}
+	device.registerReplyReceived(content)
+	return nil
+}
+
+func (device *Device) registerReplyReceived(content mtypes.RegisterReplyMsg) {
+	inSync := content.NhStateHash == device.state_hashes.NhTable.Load().(string) &&
+		content.PeerStateHash == device.state_hashes.Peer.Load().(string) &&
+		content.SuperParamStateHash == device.state_hashes.SuperParam.Load().(string)
+	if device.registered.update(content, inSync, time.Now()) {
+		for _, w := range content.Warnings {
+			device.log.Errorf("Supernode: %v", w)
+		}
+	}
+}
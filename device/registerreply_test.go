@@ -0,0 +1,34 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestRegisterReply(t *testing.T) {
+	var r registerReply
+	if s := r.stats(); !s.LastReply.IsZero() || s.Replies != 0 {
+		t.Fatalf("stats before any reply = %+v", s)
+	}
+	now := time.Now()
+	warn := mtypes.RegisterReplyMsg{Version: "v1", Warnings: []string{"old version"}}
+	if !r.update(warn, true, now) {
+		t.Error("first warning not reported")
+	}
+	if r.update(warn, true, now) {
+		t.Error("same warning reported again")
+	}
+	if !r.update(mtypes.RegisterReplyMsg{Version: "v1"}, false, now) {
+		t.Error("cleared warning not reported")
+	}
+	if s := r.stats(); s.Replies != 3 || s.InSync || len(s.Warnings) != 0 || !s.LastReply.Equal(now) {
+		t.Errorf("stats = %+v", s)
+	}
+}
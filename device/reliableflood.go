@@ -0,0 +1,282 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const floodMaxPending = 4096 // frames beyond this are sent without waiting for the ack
+
+// floodSeqLen is the sequence number appended to the selected frames by the origin, and removed before writing to the TAP
+const floodSeqLen = 4
+
+type floodKey struct {
+	src mtypes.Vertex // where the broadcast comes from
+	seq uint32        // given by src to every frame it floods
+}
+
+type floodPending struct {
+	packet   []byte // EgHeader + frame
+	ttl      uint8
+	retries  int
+	deadline time.Time
+}
+
+type floodResend struct {
+	peer   mtypes.Vertex
+	packet []byte
+	ttl    uint8
+}
+
+// reliableFlood makes the broadcast frames selected by EdgeConfig.ReliableFlood acknowledged hop by hop.
+// Every node sending or forwarding such a frame to a peer from the broadcast list waits for a BroadcastAck from it,
+// and retransmits if there is none in Timeout. The receiver acks the retransmissions again, but delivers them only once.
+// The frames are told apart by the origin and a sequence number appended by it, so identical frames are still delivered each.
+type reliableFlood struct {
+	etherTypes map[uint16]bool
+	dstMacs    map[tap.MacAddress]bool
+	timeout    time.Duration
+	retries    int
+	seq        uint32
+	pending    map[floodKey]map[mtypes.Vertex]*floodPending
+	seen       map[floodKey]time.Time
+	stat       mtypes.ReliableFloodStats
+	sync.Mutex
+}
+
+func (device *Device) loadReliableFlood() {
+	conf := device.EdgeConfig.ReliableFlood
+	if len(conf.EtherTypes) == 0 && len(conf.DstMacs) == 0 {
+		return
+	}
+	f := &device.flood
+	f.etherTypes = make(map[uint16]bool)
+	f.dstMacs = make(map[tap.MacAddress]bool)
+	f.timeout = mtypes.S2TD(conf.Timeout)
+	f.retries = conf.Retries
+	f.seq = uint32(time.Now().UnixNano()) // not to be taken as the retransmissions of the frames before a restart
+	f.pending = make(map[floodKey]map[mtypes.Vertex]*floodPending)
+	f.seen = make(map[floodKey]time.Time)
+	for _, s := range conf.EtherTypes {
+		et, err := mtypes.ParseEtherType(s)
+		if err != nil {
+			device.log.Errorf("ReliableFlood: %v", err)
+			continue
+		}
+		f.etherTypes[et] = true
+	}
+	for _, s := range conf.DstMacs {
+		hwaddr, err := net.ParseMAC(s)
+		if err != nil || len(hwaddr) != 6 {
+			device.log.Errorf("ReliableFlood: invalid MacAddr : %v", s)
+			continue
+		}
+		var mac tap.MacAddress
+		copy(mac[:], hwaddr)
+		f.dstMacs[mac] = true
+	}
+}
+
+func (f *reliableFlood) enabled() bool {
+	return f.pending != nil
+}
+
+// match reports whether the ethernet frame is selected by EtherTypes or DstMacs
+func (f *reliableFlood) match(frame []byte) bool {
+	if len(frame) < ethHeaderLen {
+		return false
+	}
+	et := tap.GetEtherType(frame)
+	if et < 0x0600 {
+		et = mtypes.EtherTypeLLC
+	}
+	return f.etherTypes[et] || f.dstMacs[tap.GetDstMacAddr(frame)]
+}
+
+// stamp appends the next sequence number to a selected broadcast packet from us. The packet must have room for it.
+func (f *reliableFlood) stamp(packet []byte) []byte {
+	if !f.enabled() || len(packet) <= path.EgHeaderLen || !f.match(packet[path.EgHeaderLen:]) {
+		return packet
+	}
+	f.Lock()
+	f.seq++
+	seq := f.seq
+	f.Unlock()
+	var buf [floodSeqLen]byte
+	binary.BigEndian.PutUint32(buf[:], seq)
+	return append(packet, buf[:]...)
+}
+
+func floodSeqOf(frame []byte) uint32 {
+	return binary.BigEndian.Uint32(frame[len(frame)-floodSeqLen:])
+}
+
+// track remembers a selected broadcast packet sent to the peer, to retransmit it until acked
+func (f *reliableFlood) track(peer mtypes.Vertex, ttl uint8, packet []byte, now time.Time) bool {
+	if !f.enabled() || len(packet) < path.EgHeaderLen+ethHeaderLen+floodSeqLen || !f.match(packet[path.EgHeaderLen:]) {
+		return false
+	}
+	header, _ := path.NewEgHeader(packet[:path.EgHeaderLen], 0)
+	key := floodKey{src: header.GetSrc(), seq: floodSeqOf(packet)}
+	f.Lock()
+	defer f.Unlock()
+	if f.stat.Pending >= floodMaxPending {
+		return false
+	}
+	if _, ok := f.pending[key]; !ok {
+		f.pending[key] = make(map[mtypes.Vertex]*floodPending)
+	}
+	if _, ok := f.pending[key][peer]; !ok {
+		f.stat.Pending++
+	}
+	f.pending[key][peer] = &floodPending{
+		packet:   append([]byte(nil), packet...),
+		ttl:      ttl,
+		retries:  f.retries,
+		deadline: now.Add(f.timeout),
+	}
+	f.stat.Sent++
+	return true
+}
+
+func (f *reliableFlood) ack(peer mtypes.Vertex, content mtypes.BroadcastAckMsg) {
+	if !f.enabled() {
+		return
+	}
+	key := floodKey{src: content.Src, seq: content.Seq}
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.pending[key][peer]; !ok {
+		return
+	}
+	delete(f.pending[key], peer)
+	if len(f.pending[key]) == 0 {
+		delete(f.pending, key)
+	}
+	f.stat.Pending--
+	f.stat.Acked++
+}
+
+// receive checks a broadcast frame from src, with the sequence number. It returns whether to ack it, and whether it's a retransmission already delivered.
+func (f *reliableFlood) receive(src mtypes.Vertex, frame []byte, now time.Time) (ack bool, dup bool) {
+	if !f.enabled() || len(frame) < ethHeaderLen+floodSeqLen || !f.match(frame) {
+		return false, false
+	}
+	key := floodKey{src: src, seq: floodSeqOf(frame)}
+	f.Lock()
+	defer f.Unlock()
+	if first, ok := f.seen[key]; ok && now.Sub(first) < f.seenWindow() {
+		f.stat.Duplicates++
+		return true, true
+	}
+	f.seen[key] = now
+	return true, false
+}
+
+// seenWindow covers all the retransmissions of a frame
+func (f *reliableFlood) seenWindow() time.Duration {
+	return f.timeout * time.Duration(f.retries+2)
+}
+
+// expire returns the packets to retransmit, and gives up the ones out of retries
+func (f *reliableFlood) expire(now time.Time) (resend []floodResend, failed int) {
+	f.Lock()
+	defer f.Unlock()
+	for key, peers := range f.pending {
+		for peer, p := range peers {
+			if now.Before(p.deadline) {
+				continue
+			}
+			if p.retries <= 0 {
+				delete(peers, peer)
+				f.stat.Pending--
+				f.stat.Failed++
+				failed++
+				continue
+			}
+			p.retries--
+			p.deadline = now.Add(f.timeout)
+			f.stat.Retransmitted++
+			resend = append(resend, floodResend{peer: peer, packet: p.packet, ttl: p.ttl})
+		}
+		if len(peers) == 0 {
+			delete(f.pending, key)
+		}
+	}
+	for key, first := range f.seen {
+		if now.Sub(first) >= f.seenWindow() {
+			delete(f.seen, key)
+		}
+	}
+	return
+}
+
+func (f *reliableFlood) stats() mtypes.ReliableFloodStats {
+	f.Lock()
+	defer f.Unlock()
+	return f.stat
+}
+
+// trackFlood is called before sending a broadcast packet to the peer
+func (device *Device) trackFlood(peer *Peer, usage path.Usage, ttl uint8, packet []byte) {
+	if peer == nil || usage != path.NormalPacket {
+		return
+	}
+	device.flood.track(peer.ID, ttl, packet, time.Now())
+}
+
+// ackFlood acks a broadcast frame from src to the peer which sent it to us if it's selected by ReliableFlood.
+// It returns whether the frame should be delivered, false for a retransmission already delivered,
+// and whether it has the sequence number to remove before writing to the TAP.
+func (device *Device) ackFlood(peer *Peer, src mtypes.Vertex, frame []byte) (deliver bool, stamped bool) {
+	ack, dup := device.flood.receive(src, frame, time.Now())
+	if !ack {
+		return true, false
+	}
+	body, err := mtypes.GetByte(&mtypes.BroadcastAckMsg{Src: src, Seq: floodSeqOf(frame)})
+	if err == nil {
+		buf := make([]byte, path.EgHeaderLen+len(body))
+		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+		header.SetSrc(device.ID)
+		header.SetDst(peer.ID)
+		copy(buf[path.EgHeaderLen:], body)
+		device.SendPacket(peer, path.BroadcastAck, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+	}
+	return !dup, true
+}
+
+// RoutineReliableFlood retransmits the ReliableFlood broadcast frames not acked in Timeout
+func (device *Device) RoutineReliableFlood() {
+	f := &device.flood
+	if !f.enabled() {
+		return
+	}
+	interval := f.timeout / 2
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	for !device.isClosed() {
+		time.Sleep(interval)
+		resend, failed := f.expire(time.Now())
+		device.peers.RLock()
+		for _, r := range resend {
+			go device.SendPacket(device.peers.IDMap[r.peer], path.NormalPacket, r.ttl, r.packet, MessageTransportOffsetContent)
+		}
+		device.peers.RUnlock()
+		if failed > 0 && device.LogLevel.LogControl {
+			fmt.Printf("Control: ReliableFlood: %v broadcast frames not acked after %v retries\n", failed, f.retries)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/google/gopacket/layers"
+)
+
+func TestReliableFlood(t *testing.T) {
+	device := &Device{}
+	device.EdgeConfig = &mtypes.EdgeConfig{ReliableFlood: mtypes.ReliableFloodInfo{EtherTypes: []string{"ARP"}, Timeout: 0.5, Retries: 2}}
+	device.loadReliableFlood()
+	f := &device.flood
+
+	mac := net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}
+	frame := arpFrame(t, layers.ARPRequest, mac, net.ParseIP("10.0.0.1"), net.HardwareAddr{0, 0, 0, 0, 0, 0}, net.ParseIP("10.0.0.2"))
+	packet := make([]byte, path.EgHeaderLen+len(frame))
+	header, _ := path.NewEgHeader(packet[:path.EgHeaderLen], 0)
+	header.SetSrc(1)
+	header.SetDst(mtypes.NodeID_Broadcast)
+	copy(packet[path.EgHeaderLen:], frame)
+	ipv4 := append(make([]byte, path.EgHeaderLen), tcpFrame(t, false, true, 1460)...)
+	if stamped := f.stamp(ipv4); len(stamped) != len(ipv4) {
+		t.Error("stamped a frame not selected")
+	}
+	packet = f.stamp(packet)
+	if len(packet) != path.EgHeaderLen+len(frame)+floodSeqLen {
+		t.Fatal("ARP frame not stamped")
+	}
+	frame = packet[path.EgHeaderLen:]
+
+	now := time.Now()
+	if f.track(2, 200, ipv4, now) {
+		t.Error("tracked a frame not selected")
+	}
+	if !f.track(2, 200, packet, now) || !f.track(3, 200, packet, now) {
+		t.Fatal("ARP frame not tracked")
+	}
+	f.ack(2, mtypes.BroadcastAckMsg{Src: 1, Seq: floodSeqOf(frame)})
+	if s := f.stats(); s.Pending != 1 || s.Sent != 2 || s.Acked != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// 3 didn't ack, retransmit twice then give up
+	for i := 1; i <= 3; i++ {
+		resend, failed := f.expire(now.Add(time.Duration(i) * 500 * time.Millisecond))
+		if i < 3 && (len(resend) != 1 || resend[0].peer != 3 || failed != 0) {
+			t.Fatalf("#%v: resend %v, failed %v", i, resend, failed)
+		}
+		if i == 3 && (len(resend) != 0 || failed != 1) {
+			t.Fatalf("#%v: resend %v, failed %v", i, resend, failed)
+		}
+	}
+	if s := f.stats(); s.Pending != 0 || s.Retransmitted != 2 || s.Failed != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// the receiver acks the retransmissions, but delivers once
+	if ack, dup := f.receive(1, frame, now); !ack || dup {
+		t.Errorf("first receive: ack %v dup %v", ack, dup)
+	}
+	if ack, dup := f.receive(1, frame, now.Add(time.Second)); !ack || !dup {
+		t.Errorf("retransmission: ack %v dup %v", ack, dup)
+	}
+	if ack, _ := f.receive(1, ipv4[path.EgHeaderLen:], now); ack {
+		t.Error("acked a frame not selected")
+	}
+	// the same frame sent again by the origin is a new one
+	again := f.stamp(append([]byte(nil), packet[:path.EgHeaderLen+len(frame)-floodSeqLen]...))
+	if ack, dup := f.receive(1, again[path.EgHeaderLen:], now.Add(time.Second)); !ack || dup {
+		t.Errorf("same frame sent again: ack %v dup %v", ack, dup)
+	}
+	f.expire(now.Add(2 * time.Second))
+	if ack, dup := f.receive(1, frame, now.Add(2*time.Second)); !ack || dup {
+		t.Errorf("after the window: ack %v dup %v", ack, dup)
+	}
+}
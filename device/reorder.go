@@ -0,0 +1,237 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+
+	reorderMaxFlows       = 4096 // new flows beyond this are not tracked
+	reorderMaxHeldPerFlow = 64
+	reorderMaxHeld        = 1024
+	reorderFlowIdle       = 60 * time.Second
+)
+
+type reorderKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+}
+
+type reorderFrame struct {
+	seq    uint32
+	end    uint32 // seq + segment length
+	buf    []byte
+	offset int
+	time   time.Time
+}
+
+type reorderFlow struct {
+	next     uint32 // the next expected seq
+	held     []reorderFrame
+	lastSeen time.Time
+}
+
+// reorderBuffer holds the out-of-order TCP segments received from the VPN for up to InterfaceConf.ReorderBufferMs,
+// and writes them to the TAP in order once the gap is filled. Multiple paths or a route change can reorder frames,
+// which TCP takes as loss. Other frames are written right away.
+type reorderBuffer struct {
+	timeout time.Duration // 0 means disabled
+	flows   map[reorderKey]*reorderFlow
+	held    int
+	stat    mtypes.ReorderStats
+	sync.Mutex
+}
+
+func (device *Device) loadReorderBuffer() {
+	if device.EdgeConfig.Interface.ReorderBufferMs <= 0 {
+		return
+	}
+	r := &device.reorder
+	r.timeout = mtypes.S2TD(device.EdgeConfig.Interface.ReorderBufferMs / 1000)
+	r.flows = make(map[reorderKey]*reorderFlow)
+}
+
+// seqAfter reports whether the TCP sequence number a is after b
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// writeTap writes the frame in buf[offset:] to the TAP, through the reordering buffer if it's enabled
+func (device *Device) writeTap(buf []byte, offset int) error {
+	var err error
+	write := func(buf []byte, offset int) {
+		if _, werr := device.tap.device.Write(buf, offset); werr != nil {
+			err = werr
+		}
+	}
+	if device.reorder.timeout == 0 {
+		write(buf, offset)
+		return err
+	}
+	device.reorder.push(buf, offset, time.Now(), write)
+	return err
+}
+
+// push writes the frame in buf[offset:] by write, or holds a copy of it if a segment before it is missing.
+// The frames held by the flow are written after it if it fills the gap.
+func (r *reorderBuffer) push(buf []byte, offset int, now time.Time, write func([]byte, int)) {
+	src, dst, tcp, _ := tcpSegmentOf(buf[offset:])
+	if len(tcp) < tcpHeaderLen {
+		write(buf, offset)
+		return
+	}
+	doff := int(tcp[12]>>4) * 4
+	if doff < tcpHeaderLen || doff > len(tcp) {
+		write(buf, offset)
+		return
+	}
+	var key reorderKey
+	copy(key.src[:], src)
+	copy(key.dst[:], dst)
+	key.sport = binary.BigEndian.Uint16(tcp[0:2])
+	key.dport = binary.BigEndian.Uint16(tcp[2:4])
+	flags := tcp[13]
+	seq := binary.BigEndian.Uint32(tcp[4:8])
+	seglen := uint32(len(tcp) - doff)
+	if flags&tcpFlagSYN != 0 {
+		seglen++
+	}
+	if flags&tcpFlagFIN != 0 {
+		seglen++
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	flow, ok := r.flows[key]
+	if flags&tcpFlagRST != 0 {
+		if ok {
+			r.flush(flow, write, &r.stat.TimedOut)
+			delete(r.flows, key)
+		}
+		write(buf, offset)
+		return
+	}
+	if seglen == 0 {
+		write(buf, offset) // pure ACK, nothing to reorder
+		if ok {
+			flow.lastSeen = now
+		}
+		return
+	}
+	if !ok {
+		if len(r.flows) < reorderMaxFlows {
+			r.flows[key] = &reorderFlow{next: seq + seglen, lastSeen: now}
+		}
+		write(buf, offset)
+		return
+	}
+	flow.lastSeen = now
+	if !seqAfter(seq, flow.next) {
+		write(buf, offset)
+		if seqAfter(seq+seglen, flow.next) {
+			flow.next = seq + seglen
+		}
+		r.drain(flow, write)
+		return
+	}
+	held := make([]byte, len(buf))
+	copy(held[offset:], buf[offset:])
+	i := sort.Search(len(flow.held), func(i int) bool { return seqAfter(flow.held[i].seq, seq) })
+	flow.held = append(flow.held, reorderFrame{})
+	copy(flow.held[i+1:], flow.held[i:])
+	flow.held[i] = reorderFrame{seq: seq, end: seq + seglen, buf: held, offset: offset, time: now}
+	r.held++
+	r.stat.Reordered++
+	if len(flow.held) > reorderMaxHeldPerFlow || r.held > reorderMaxHeld {
+		r.flush(flow, write, &r.stat.Overflow)
+	}
+}
+
+// drain writes the held frames of the flow that are no longer after the next expected seq. r must be locked.
+func (r *reorderBuffer) drain(flow *reorderFlow, write func([]byte, int)) {
+	n := 0
+	for ; n < len(flow.held) && !seqAfter(flow.held[n].seq, flow.next); n++ {
+		f := flow.held[n]
+		write(f.buf, f.offset)
+		if seqAfter(f.end, flow.next) {
+			flow.next = f.end
+		}
+	}
+	flow.held = flow.held[n:]
+	r.held -= n
+	r.stat.Restored += uint64(n)
+}
+
+// flush writes all the held frames of the flow in order, giving up the missing segments before them. r must be locked.
+func (r *reorderBuffer) flush(flow *reorderFlow, write func([]byte, int), counter *uint64) {
+	for _, f := range flow.held {
+		write(f.buf, f.offset)
+		if seqAfter(f.end, flow.next) {
+			flow.next = f.end
+		}
+	}
+	*counter += uint64(len(flow.held))
+	r.held -= len(flow.held)
+	flow.held = nil
+}
+
+// expire flushes the flows whose oldest held frame is older than the timeout, and forgets the idle flows
+func (r *reorderBuffer) expire(now time.Time, write func([]byte, int)) (flushed bool) {
+	r.Lock()
+	defer r.Unlock()
+	for key, flow := range r.flows {
+		if len(flow.held) > 0 && now.Sub(flow.held[0].time) >= r.timeout {
+			r.flush(flow, write, &r.stat.TimedOut)
+			flushed = true
+		}
+		if len(flow.held) == 0 && now.Sub(flow.lastSeen) > reorderFlowIdle {
+			delete(r.flows, key)
+		}
+	}
+	return
+}
+
+func (r *reorderBuffer) stats() mtypes.ReorderStats {
+	r.Lock()
+	defer r.Unlock()
+	ret := r.stat
+	ret.Flows = len(r.flows)
+	ret.Held = r.held
+	return ret
+}
+
+// RoutineReorderFlush writes the frames held by the reordering buffer longer than ReorderBufferMs
+func (device *Device) RoutineReorderFlush() {
+	if device.reorder.timeout == 0 {
+		return
+	}
+	interval := device.reorder.timeout / 2
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	write := func(buf []byte, offset int) {
+		if _, err := device.tap.device.Write(buf, offset); err != nil && !device.isClosed() {
+			device.log.Errorf("Failed to write packet to TUN device: %v", err)
+		}
+	}
+	for !device.isClosed() {
+		time.Sleep(interval)
+		if device.reorder.expire(time.Now(), write) {
+			if err := device.tap.device.Flush(); err != nil {
+				device.log.Errorf("Unable to flush packets: %v", err)
+			}
+		}
+	}
+}
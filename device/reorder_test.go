@@ -0,0 +1,102 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+const reorderTestOffset = 8
+
+func dataFrame(t *testing.T, seq uint32, size int) []byte {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}, DstMAC: net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.ParseIP("10.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.2").To4()}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: seq, ACK: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip4)
+	frame := serializeFrame(t, eth, ip4, tcp, gopacket.Payload(make([]byte, size)))
+	return append(make([]byte, reorderTestOffset), frame...)
+}
+
+type reorderRecorder struct {
+	seqs []uint32
+}
+
+func (rec *reorderRecorder) write(buf []byte, offset int) {
+	_, _, tcp, _ := tcpSegmentOf(buf[offset:])
+	rec.seqs = append(rec.seqs, binary.BigEndian.Uint32(tcp[4:8]))
+}
+
+func TestReorderBuffer(t *testing.T) {
+	r := &reorderBuffer{timeout: 20 * time.Millisecond, flows: make(map[reorderKey]*reorderFlow)}
+	rec := &reorderRecorder{}
+	now := time.Now()
+	push := func(seq uint32) {
+		r.push(dataFrame(t, seq, 100), reorderTestOffset, now, rec.write)
+	}
+
+	// 1000 starts the flow, 1200 and 1300 wait for 1100
+	push(1000)
+	push(1200)
+	push(1300)
+	if want := []uint32{1000}; !reflect.DeepEqual(rec.seqs, want) {
+		t.Fatalf("written %v, want %v", rec.seqs, want)
+	}
+	if s := r.stats(); s.Flows != 1 || s.Held != 2 || s.Reordered != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+	push(1100)
+	if want := []uint32{1000, 1100, 1200, 1300}; !reflect.DeepEqual(rec.seqs, want) {
+		t.Fatalf("written %v, want %v", rec.seqs, want)
+	}
+	if s := r.stats(); s.Held != 0 || s.Restored != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// 1400 is lost, 1500 is written after the timeout
+	rec.seqs = nil
+	push(1500)
+	if r.expire(now.Add(10*time.Millisecond), rec.write) || len(rec.seqs) != 0 {
+		t.Fatalf("flushed before the timeout: %v", rec.seqs)
+	}
+	if !r.expire(now.Add(20*time.Millisecond), rec.write) {
+		t.Fatalf("not flushed after the timeout")
+	}
+	push(1600)
+	if want := []uint32{1500, 1600}; !reflect.DeepEqual(rec.seqs, want) {
+		t.Fatalf("written %v, want %v", rec.seqs, want)
+	}
+	if s := r.stats(); s.Held != 0 || s.TimedOut != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// the buffer is bounded
+	rec.seqs = nil
+	for i := 0; i <= reorderMaxHeldPerFlow; i++ {
+		push(1800 + uint32(i)*100)
+	}
+	if len(rec.seqs) != reorderMaxHeldPerFlow+1 || rec.seqs[0] != 1800 {
+		t.Fatalf("written %v frames, want %v", len(rec.seqs), reorderMaxHeldPerFlow+1)
+	}
+	if s := r.stats(); s.Held != 0 || s.Overflow != reorderMaxHeldPerFlow+1 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// not TCP
+	d := &Device{}
+	d.reorder.timeout = r.timeout
+	written := 0
+	d.reorder.push(append(make([]byte, reorderTestOffset), arpFrame(t, layers.ARPRequest, net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0, 1}, net.ParseIP("10.0.0.1"), net.HardwareAddr{0, 0, 0, 0, 0, 0}, net.ParseIP("10.0.0.2"))...), reorderTestOffset, now, func([]byte, int) { written++ })
+	if written != 1 {
+		t.Errorf("non-TCP frame written %v times", written)
+	}
+}
@@ -238,6 +238,9 @@ func (device *Device) RoutineReadFromTUN() {
 				if !errors.Is(err, os.ErrClosed) {
 					device.log.Errorf("Failed to read packet from TUN device: %v", err)
 				}
+				if device.recoverTapError(err) {
+					continue
+				}
 				go device.Close()
 			}
 			device.PutMessageBuffer(elem.buffer)
@@ -259,7 +262,7 @@ func (device *Device) RoutineReadFromTUN() {
 		if tap.IsNotUnicast(dstMacAddr) {
 			dst_nodeID = mtypes.NodeID_Broadcast
 		} else if val, ok := device.l2fib.Load(dstMacAddr); !ok { //Lookup failed
-			dst_nodeID = mtypes.NodeID_Broadcast
+			dst_nodeID = device.unknownUnicastDst(elem.packet[path.EgHeaderLen:])
 		} else {
 			dst_nodeID = val.(*IdAndTime).ID
 		}
@@ -274,17 +277,28 @@ func (device *Device) RoutineReadFromTUN() {
 			}
 			continue
 		}
+		if !device.etherTypeAllowed(elem.packet[path.EgHeaderLen:]) {
+			continue
+		}
+		if dst_nodeID == mtypes.NodeID_Broadcast && device.proxyNeighbor(elem.packet[path.EgHeaderLen:]) {
+			continue
+		}
+		if dst_nodeID == mtypes.NodeID_Invalid {
+			continue // dropped by UnknownUnicast
+		}
 
 		if dst_nodeID != mtypes.NodeID_Broadcast {
 			var peer *Peer
 			next_id := device.graph.Next(device.ID, dst_nodeID)
 			if next_id != mtypes.NodeID_Invalid {
+				elem.TTL = device.unicastTTL(dst_nodeID)
 				device.peers.RLock()
 				peer = device.peers.IDMap[next_id]
 				device.peers.RUnlock()
 				if peer == nil {
 					continue
 				}
+				device.clampMSS(elem.packet[path.EgHeaderLen:], peer)
 				if device.LogLevel.LogNormal {
 					packet_len := len(elem.packet) - path.EgHeaderLen
 					fmt.Printf("Normal: Send Len:%v S:%v D:%v TTL:%v To:%v IP:%v:\n", packet_len, device.ID.ToString(), dst_nodeID.ToString(), elem.TTL, peer.ID.ToString(), peer.GetEndpointDstStr())
@@ -296,14 +310,37 @@ func (device *Device) RoutineReadFromTUN() {
 					elem = nil
 					peer.SendStagedPackets()
 				}
+			} else if device.noRoute(dst_nodeID, elem.Type, nil, elem.packet) {
+				EgBody.SetDst(mtypes.NodeID_Spread)
+				device.clampMSS(elem.packet[path.EgHeaderLen:], nil)
+				device.SpreadPacket(make(map[mtypes.Vertex]bool), elem.Type, elem.TTL, elem.packet, offset)
 			}
 		} else {
+			device.clampMSS(elem.packet[path.EgHeaderLen:], nil)
+			elem.packet = device.flood.stamp(elem.packet)
 			device.BoardcastPacket(make(map[mtypes.Vertex]bool, 0), elem.Type, elem.TTL, elem.packet, offset)
 		}
 
 	}
 }
 
+// unicastTTL is the hop count to dst in the NhTable plus the TTLMargin from the supernode, so a loop is caught sooner.
+// It's DefaultTTL if there is no TTLMargin or the path is unknown.
+func (device *Device) unicastTTL(dst mtypes.Vertex) uint8 {
+	margin := int(device.SuperConfig.TTLMargin)
+	if margin == 0 {
+		return device.EdgeConfig.DefaultTTL
+	}
+	hops := device.graph.Hops(device.ID, dst)
+	if hops < 0 {
+		return device.EdgeConfig.DefaultTTL
+	}
+	if hops+margin > 255 {
+		return 255
+	}
+	return uint8(hops + margin)
+}
+
 func (peer *Peer) StagePacket(elem *QueueOutboundElement) {
 	for {
 		select {
@@ -347,8 +384,7 @@ top:
 			elem.Lock()
 
 			// add to parallel and sequential queue
-			if peer.isRunning.Get() {
-				peer.queue.outbound.c <- elem
+			if peer.isRunning.Get() && peer.queueOutbound(elem) {
 				peer.device.queue.encryption.c <- elem
 			} else {
 				peer.device.PutMessageBuffer(elem.buffer)
@@ -360,6 +396,66 @@ top:
 	}
 }
 
+// queueOutbound adds elem to the sequential queue. It blocks while the queue is full,
+// unless the peer uses drop-oldest, so that a congested peer can't stall the whole device.
+// Returns false if elem is not queued because the peer is stopping.
+func (peer *Peer) queueOutbound(elem *QueueOutboundElement) bool {
+	if !peer.queue.dropOldest {
+		peer.queue.outbound.c <- elem
+		return true
+	}
+	for {
+		select {
+		case peer.queue.outbound.c <- elem:
+			return true
+		default:
+		}
+		select {
+		case tooOld := <-peer.queue.outbound.c:
+			if tooOld == nil {
+				// Stop signal of RoutineSequentialSender, never evict it
+				peer.putBackStopSignal()
+				return false
+			}
+			peer.dropOutbound(tooOld)
+		default:
+		}
+	}
+}
+
+// putBackStopSignal puts the stop signal of RoutineSequentialSender back without blocking,
+// by dropping the queued packets to make room. They would be flushed on stop anyway.
+func (peer *Peer) putBackStopSignal() {
+	for {
+		select {
+		case peer.queue.outbound.c <- nil:
+			return
+		default:
+		}
+		select {
+		case elem := <-peer.queue.outbound.c:
+			peer.dropOutbound(elem)
+		default:
+		}
+	}
+}
+
+func (peer *Peer) dropOutbound(elem *QueueOutboundElement) {
+	elem.Lock() // wait for the encryption
+	peer.device.PutMessageBuffer(elem.buffer)
+	peer.device.PutOutboundElement(elem)
+	atomic.AddUint64(&peer.stats.outboundDropped, 1)
+}
+
+// QueueStats returns the current depth and drop count of the outbound queue.
+func (peer *Peer) QueueStats() mtypes.PeerQueueStats {
+	return mtypes.PeerQueueStats{
+		Depth:    len(peer.queue.outbound.c),
+		Capacity: cap(peer.queue.outbound.c),
+		Dropped:  atomic.LoadUint64(&peer.stats.outboundDropped),
+	}
+}
+
 func (peer *Peer) FlushStagedPackets() {
 	for {
 		select {
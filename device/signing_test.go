@@ -0,0 +1,50 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestVerifyServerUpdate(t *testing.T) {
+	key, err := mtypes.ParseSigningKey("YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := mtypes.ParseSigningPubKey(mtypes.SigningPubKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := mtypes.ServerUpdateMsg{Node_id: mtypes.NodeID_SuperNode, Action: mtypes.UpdateNhTable, Params: "hash"}
+	signed.Sign(key)
+	forged := signed
+	forged.Params = "other"
+	unsigned := mtypes.ServerUpdateMsg{Node_id: mtypes.NodeID_SuperNode, Action: mtypes.UpdatePeer, Params: "hash"}
+	other := mtypes.ServerUpdateMsg{Node_id: mtypes.NodeID_SuperNode, Action: mtypes.UpdateSuperParams, Params: "hash"}
+
+	var device Device
+	for _, msg := range []mtypes.ServerUpdateMsg{signed, forged, unsigned, other} {
+		if !device.verifyServerUpdate(msg) {
+			t.Errorf("%v: rejected without SigningPubKey", msg.ToString())
+		}
+	}
+	device.superSigningKey = pub
+	for _, tc := range []struct {
+		msg  mtypes.ServerUpdateMsg
+		want bool
+	}{
+		{signed, true},
+		{forged, false},
+		{unsigned, false},
+		{other, true},
+	} {
+		if got := device.verifyServerUpdate(tc.msg); got != tc.want {
+			t.Errorf("%v: verifyServerUpdate() = %v, want %v", tc.msg.ToString(), got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// superBalance spreads the control messages to the supernode over its V4 and V6 sessions by SuperInfo.WeightV4 and WeightV6,
+// with the smooth weighted round-robin. A session not alive gets no share, but it's still sent the Register,
+// so that it's back in the rotation once the supernode answers it. A session with weight 0 is a standby, it gets the
+// Register too, to stay registered and keep its NAT mapping.
+type superBalance struct {
+	names   map[NoisePublicKey]string // V4 or V6
+	weights map[NoisePublicKey]int
+	current map[NoisePublicKey]int
+	sent    map[NoisePublicKey]uint64
+	sync.Mutex
+}
+
+func (device *Device) loadSuperBalance() {
+	conf := device.EdgeConfig.DynamicRoute.SuperNode
+	if conf.WeightV4 == 0 && conf.WeightV6 == 0 {
+		return
+	}
+	b := &device.superBalance
+	b.names = make(map[NoisePublicKey]string)
+	b.weights = make(map[NoisePublicKey]int)
+	b.current = make(map[NoisePublicKey]int)
+	b.sent = make(map[NoisePublicKey]uint64)
+	for _, s := range []struct {
+		name   string
+		pubkey string
+		weight int
+	}{{"V4", conf.PubKeyV4, conf.WeightV4}, {"V6", conf.PubKeyV6, conf.WeightV6}} {
+		if s.pubkey == "" {
+			continue
+		}
+		pk, err := Str2PubKey(s.pubkey)
+		if err != nil {
+			device.log.Errorf("SuperNode.PubKey%v: %v", s.name, err)
+			continue
+		}
+		b.names[pk] = s.name
+		b.weights[pk] = s.weight
+	}
+}
+
+func (b *superBalance) enabled() bool {
+	return b.weights != nil
+}
+
+// pick returns the next session to send to among the alive ones with a weight, and the others: not alive or weight 0.
+// chosen is nil if none is alive.
+func (b *superBalance) pick(peers map[NoisePublicKey]*Peer, alive func(*Peer) bool) (chosen *Peer, down []*Peer) {
+	b.Lock()
+	defer b.Unlock()
+	var best NoisePublicKey
+	total := 0
+	for pk, peer := range peers {
+		w := b.weights[pk]
+		if w <= 0 || !alive(peer) {
+			b.current[pk] = 0
+			down = append(down, peer)
+			continue
+		}
+		b.current[pk] += w
+		total += w
+		if chosen == nil || b.current[pk] > b.current[best] {
+			chosen, best = peer, pk
+		}
+	}
+	if chosen != nil {
+		b.current[best] -= total
+		b.sent[best]++
+	}
+	return
+}
+
+func (b *superBalance) stats(peers map[NoisePublicKey]*Peer) map[string]mtypes.SuperSessionStats {
+	if !b.enabled() {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	ret := make(map[string]mtypes.SuperSessionStats, len(b.names))
+	for pk, name := range b.names {
+		s := mtypes.SuperSessionStats{Weight: b.weights[pk], Sent: b.sent[pk]}
+		if peer, ok := peers[pk]; ok {
+			s.Alive = peer.IsPeerAlive()
+		}
+		ret[name] = s
+	}
+	return ret
+}
+
+// send2SuperBalanced sends to one of the supernode sessions by the weights. peers must be locked.
+func (device *Device) send2SuperBalanced(usage path.Usage, ttl uint8, packet []byte, offset int) {
+	chosen, down := device.superBalance.pick(device.peers.SuperPeer, (*Peer).IsPeerAlive)
+	if chosen != nil {
+		go device.SendPacket(chosen, usage, ttl, packet, offset)
+	}
+	if chosen == nil || usage == path.Register {
+		for _, peer := range down {
+			go device.SendPacket(peer, usage, ttl, packet, offset)
+		}
+	}
+}
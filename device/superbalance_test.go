@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+)
+
+func TestSuperBalance(t *testing.T) {
+	v4, v6 := NoisePublicKey{4}, NoisePublicKey{6}
+	b := &superBalance{
+		names:   map[NoisePublicKey]string{v4: "V4", v6: "V6"},
+		weights: map[NoisePublicKey]int{v4: 3, v6: 1},
+		current: make(map[NoisePublicKey]int),
+		sent:    make(map[NoisePublicKey]uint64),
+	}
+	peers := map[NoisePublicKey]*Peer{v4: {}, v6: {}}
+	down := map[*Peer]bool{}
+	alive := func(peer *Peer) bool { return !down[peer] }
+
+	count := map[*Peer]int{}
+	for i := 0; i < 8; i++ {
+		chosen, dead := b.pick(peers, alive)
+		if chosen == nil || len(dead) != 0 {
+			t.Fatalf("#%v: chosen %v, down %v", i, chosen, dead)
+		}
+		count[chosen]++
+	}
+	if count[peers[v4]] != 6 || count[peers[v6]] != 2 {
+		t.Errorf("V4 %v, V6 %v, want 6 and 2", count[peers[v4]], count[peers[v6]])
+	}
+
+	// V4 is down, everything goes to V6, and V4 is reported to be probed
+	down[peers[v4]] = true
+	for i := 0; i < 3; i++ {
+		chosen, dead := b.pick(peers, alive)
+		if chosen != peers[v6] || len(dead) != 1 || dead[0] != peers[v4] {
+			t.Fatalf("#%v: chosen %v, down %v", i, chosen, dead)
+		}
+	}
+	down[peers[v6]] = true
+	if chosen, dead := b.pick(peers, alive); chosen != nil || len(dead) != 2 {
+		t.Errorf("all down: chosen %v, down %v", chosen, dead)
+	}
+
+	// weight 0 gets no share, but it's reported to be sent the Register
+	b.weights[v6] = 0
+	down = map[*Peer]bool{}
+	for i := 0; i < 3; i++ {
+		if chosen, dead := b.pick(peers, alive); chosen != peers[v4] || len(dead) != 1 || dead[0] != peers[v6] {
+			t.Fatalf("#%v: chosen %v, down %v with V6 weight 0", i, chosen, dead)
+		}
+	}
+}
@@ -9,11 +9,19 @@ import (
 	"fmt"
 	"sync/atomic"
 
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
 	"github.com/KusakabeSi/EtherGuard-VPN/tap"
 )
 
 const DefaultMTU = 1404
 
+// The overhead of a frame over the underlay: IP + UDP + transport header + EgHeader + Ethernet header
+const (
+	TunnelOverheadV4 = 20 + 8 + MessageTransportSize + path.EgHeaderLen + 14
+	TunnelOverheadV6 = 40 + 8 + MessageTransportSize + path.EgHeaderLen + 14
+	MaxMTU           = MaxContentSize - path.EgHeaderLen - 14 // jumbo frames are fine except on android/ios/windows
+)
+
 func (device *Device) RoutineTUNEventReader() {
 	device.log.Verbosef("Routine: event worker - started")
 
@@ -29,9 +37,9 @@ func (device *Device) RoutineTUNEventReader() {
 				continue
 			}
 			var tooLarge string
-			if mtu > MaxContentSize {
-				tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxContentSize)
-				mtu = MaxContentSize
+			if mtu > MaxMTU {
+				tooLarge = fmt.Sprintf(" (too large, capped at %v)", MaxMTU)
+				mtu = MaxMTU
 			}
 			old := atomic.SwapInt32(&device.tap.mtu, int32(mtu))
 			if int(old) != mtu {
@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const (
+	tapErrorRetryInterval    = time.Second
+	tapErrorMaxRetryInterval = 30 * time.Second
+)
+
+// tapErrorStats counts the TAP read errors survived by InterfaceConf.OnTapError
+type tapErrorStats struct {
+	sync.Mutex
+	stat mtypes.TapErrorStats
+}
+
+func (s *tapErrorStats) add(err error, reconnected bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.stat.Errors++
+	s.stat.LastError = err.Error()
+	if reconnected {
+		s.stat.Reconnects++
+	}
+}
+
+func (s *tapErrorStats) stats() mtypes.TapErrorStats {
+	s.Lock()
+	defer s.Unlock()
+	return s.stat
+}
+
+// recoverTapError handles a read error of the TAP by InterfaceConf.OnTapError. It returns true if the reader should
+// keep reading, after waiting or re-establishing the connection, and false if the device should be closed.
+func (device *Device) recoverTapError(err error) bool {
+	if device.IsSuperNode || errors.Is(err, os.ErrClosed) {
+		return false
+	}
+	switch device.EdgeConfig.Interface.OnTapError {
+	case mtypes.OnTapErrorRetry:
+		time.Sleep(tapErrorRetryInterval)
+		device.tapError.add(err, false)
+		return !device.isClosed()
+	case mtypes.OnTapErrorReconnect:
+		r, ok := device.tap.device.(tap.Reconnector)
+		if !ok {
+			time.Sleep(tapErrorRetryInterval)
+			device.tapError.add(err, false)
+			return !device.isClosed()
+		}
+		interval := tapErrorRetryInterval
+		for !device.isClosed() {
+			rerr := r.Reconnect()
+			if rerr == nil {
+				device.tapError.add(err, true)
+				if device.LogLevel.LogControl {
+					fmt.Printf("Control: TAP reconnected after read error: %v\n", err)
+				}
+				return true
+			}
+			device.log.Errorf("Failed to reconnect the TAP device, retry in %v: %v", interval, rerr)
+			time.Sleep(interval)
+			interval *= 2
+			if interval > tapErrorMaxRetryInterval {
+				interval = tapErrorMaxRetryInterval
+			}
+		}
+		return false
+	default:
+		return false
+	}
+}
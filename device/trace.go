@@ -0,0 +1,134 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+const TraceTimeout = 5 * time.Second
+
+// traceWaiters are the route traces started by us, waiting for the reply
+type traceWaiters struct {
+	sync.Mutex
+	nextID  uint32
+	waiters map[uint32]chan mtypes.TraceMsg
+}
+
+// Trace sends a TracePacket to dst, which is stamped by every hop on the way, and waits for the reply.
+func (device *Device) Trace(dst mtypes.Vertex, timeout time.Duration) (mtypes.TraceMsg, error) {
+	if device.IsSuperNode {
+		return mtypes.TraceMsg{}, errors.New("trace is not supported on the supernode")
+	}
+	if dst == device.ID || dst >= mtypes.NodeID_Special {
+		return mtypes.TraceMsg{}, fmt.Errorf("invalid destination: %v", dst.ToString())
+	}
+	expected, _ := device.graph.Path(device.ID, dst)
+	content := mtypes.TraceMsg{
+		Request_ID: atomic.AddUint32(&device.traces.nextID, 1),
+		Src:        device.ID,
+		Dst:        dst,
+		TTL:        device.EdgeConfig.DefaultTTL,
+		Expected:   expected,
+		Hops:       []mtypes.TraceHop{{NodeID: device.ID}},
+	}
+	reply := make(chan mtypes.TraceMsg, 1)
+	device.traces.Lock()
+	if device.traces.waiters == nil {
+		device.traces.waiters = make(map[uint32]chan mtypes.TraceMsg)
+	}
+	device.traces.waiters[content.Request_ID] = reply
+	device.traces.Unlock()
+	defer func() {
+		device.traces.Lock()
+		delete(device.traces.waiters, content.Request_ID)
+		device.traces.Unlock()
+	}()
+
+	if err := device.sendTrace(content, dst); err != nil {
+		return content, err
+	}
+	select {
+	case ret := <-reply:
+		return ret, nil
+	case <-time.After(timeout):
+		return content, errors.New("timeout")
+	}
+}
+
+// sendTrace sends the trace to the next hop toward to, with the egress time stamped if it's not a reply.
+func (device *Device) sendTrace(content mtypes.TraceMsg, to mtypes.Vertex) error {
+	if content.TTL == 0 {
+		return errors.New("TTL is 0")
+	}
+	content.TTL -= 1
+	next_id := device.graph.Next(device.ID, to)
+	if next_id == mtypes.NodeID_Invalid {
+		return fmt.Errorf("no route to %v", to.ToString())
+	}
+	device.peers.RLock()
+	peer := device.peers.IDMap[next_id]
+	device.peers.RUnlock()
+	if peer == nil {
+		return fmt.Errorf("next hop %v to %v is not a peer", next_id.ToString(), to.ToString())
+	}
+	if !content.Reply {
+		content.Hops[len(content.Hops)-1].Egress = device.graph.GetCurrentTime()
+	}
+	body, err := mtypes.GetByte(&content)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.EdgeConfig.Interface.MTU)
+	header.SetSrc(device.ID)
+	header.SetDst(to)
+	copy(buf[path.EgHeaderLen:], body)
+	device.SendPacket(peer, path.TracePacket, device.EdgeConfig.DefaultTTL, buf, MessageTransportOffsetContent)
+	return nil
+}
+
+func (device *Device) process_trace(peer *Peer, content mtypes.TraceMsg) error {
+	if content.Reply {
+		if content.Src != device.ID {
+			return device.sendTrace(content, content.Src)
+		}
+		device.traces.Lock()
+		reply, has := device.traces.waiters[content.Request_ID]
+		device.traces.Unlock()
+		if has {
+			select {
+			case reply <- content:
+			default:
+			}
+		}
+		return nil
+	}
+	if len(content.Hops) == 0 {
+		return errors.New("TraceMsg without hops")
+	}
+	content.Hops = append(content.Hops, mtypes.TraceHop{
+		NodeID:  device.ID,
+		Ingress: device.graph.GetCurrentTime(),
+	})
+	if content.Dst != device.ID {
+		err := device.sendTrace(content, content.Dst)
+		if err == nil {
+			return nil
+		}
+		content.Error = device.ID.ToString() + ": " + err.Error()
+	}
+	content.Reply = true
+	content.TTL = device.EdgeConfig.DefaultTTL
+	return device.sendTrace(content, content.Src)
+}
@@ -0,0 +1,32 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestTrace(t *testing.T) {
+	devices, _ := genTestPair(t, DefaultMTU)
+	content, err := devices[0].Trace(2, TraceTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Error != "" {
+		t.Fatalf("trace failed: %v", content.Error)
+	}
+	if len(content.Hops) != 2 || content.Hops[0].NodeID != 1 || content.Hops[1].NodeID != 2 {
+		t.Fatalf("unexpected hops: %+v", content.Hops)
+	}
+	if content.Hops[0].Egress.IsZero() || content.Hops[1].Ingress.IsZero() {
+		t.Errorf("hops not stamped: %+v", content.Hops)
+	}
+	if len(content.Expected) != 2 || content.Expected[1] != mtypes.Vertex(2) {
+		t.Errorf("unexpected expected path: %v", content.Expected)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -19,6 +20,7 @@ import (
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
 type IPCError struct {
@@ -98,6 +100,17 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 			sendf("fwmark=%d", device.net.fwmark)
 		}
 
+		sendf("cipher_suite=%s", NoiseConstruction)
+		sendf("node_id=%s", device.ID.ToString())
+
+		msgStats := device.MessageStats()
+		for _, msgType := range sortedKeys(msgStats.Sent) {
+			sendf("msg_sent=%s:%d", msgType, msgStats.Sent[msgType])
+		}
+		for _, msgType := range sortedKeys(msgStats.Recv) {
+			sendf("msg_recv=%s:%d", msgType, msgStats.Recv[msgType])
+		}
+
 		// serialize each peer state
 
 		for _, peer := range device.peers.keyMap {
@@ -117,9 +130,24 @@ func (device *Device) IpcGetOperation(w io.Writer) error {
 
 			sendf("last_handshake_time_sec=%d", secs)
 			sendf("last_handshake_time_nsec=%d", nano)
+			if t := peer.LastEndpointChange.Load().(time.Time); !t.IsZero() {
+				sendf("last_endpoint_change_time_sec=%d", t.Unix())
+			}
 			sendf("tx_bytes=%d", atomic.LoadUint64(&peer.stats.txBytes))
 			sendf("rx_bytes=%d", atomic.LoadUint64(&peer.stats.rxBytes))
 			sendf("persistent_keepalive_interval=%d", atomic.LoadUint32(&peer.persistentKeepaliveInterval))
+			if peer.disabled.Get() {
+				sendf("disabled=true")
+			}
+			sendf("node_id=%s", peer.ID.ToString())
+			if !device.IsSuperNode && device.graph != nil {
+				if next := device.graph.Next(device.ID, peer.ID); next != mtypes.NodeID_Invalid {
+					sendf("next_hop=%s", next.ToString())
+				}
+				if w := device.graph.Weight(device.ID, peer.ID, false); w < mtypes.Infinity {
+					sendf("latency=%f", w)
+				}
+			}
 			sendf("allowed_ip=%s/%d", net.IPv4zero.String(), 0)
 			sendf("allowed_ip=%s/%d", net.IPv6zero.String(), 0)
 		}
@@ -284,7 +312,7 @@ func (device *Device) handlePublicKeyLine(peer *ipcSetPeer, value string) error
 		if err != nil {
 			return errors.New("create new peer by UAPI is not implemented")
 		}
-		peer.Peer, err = device.NewPeer(publicKey, id, false, 0)
+		peer.Peer, err = device.NewPeer(publicKey, id, false, 0, mtypes.PeerQueueInfo{})
 		if err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to create new peer: %w", err)
 		}
@@ -321,13 +349,13 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 	case "preshared_key":
 		device.log.Verbosef("%v - UAPI: Updating preshared key", peer.Peer)
 
-		peer.handshake.mutex.Lock()
-		err := peer.handshake.presharedKey.FromHex(value)
-		peer.handshake.mutex.Unlock()
-
-		if err != nil {
+		var psk NoisePresharedKey
+		if err := psk.FromHex(value); err != nil {
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set preshared key: %w", err)
 		}
+		peer.handshake.mutex.Lock()
+		peer.handshake.setPresharedKey(psk, time.Now())
+		peer.handshake.mutex.Unlock()
 
 	case "endpoint":
 		device.log.Verbosef("%v - UAPI: Updating endpoint", peer.Peer)
@@ -347,16 +375,17 @@ func (device *Device) handlePeerLine(peer *ipcSetPeer, key, value string) error
 			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set persistent keepalive interval: %w", err)
 		}
 
-		old := atomic.SwapUint32(&peer.persistentKeepaliveInterval, uint32(secs))
+		if !peer.dummy {
+			peer.SetPersistentKeepalive(uint32(secs))
+		}
 
-		// Send immediate keepalive if we're turning it on and before it wasn't on.
-		if old == 0 && secs != 0 {
-			if err != nil {
-				return ipcErrorf(ipc.IpcErrorIO, "failed to get tun device status: %w", err)
-			}
-			if device.isUp() && !peer.dummy {
-				peer.SendKeepalive()
-			}
+	case "disabled":
+		device.log.Verbosef("%v - UAPI: Updating disabled", peer.Peer)
+		if value != "true" && value != "false" {
+			return ipcErrorf(ipc.IpcErrorInvalid, "failed to set disabled, invalid value: %v", value)
+		}
+		if !peer.dummy {
+			peer.SetDisabled(value == "true")
 		}
 
 	case "replace_allowed_ips":
@@ -404,6 +433,54 @@ func (device *Device) IpcSet(uapiConf string) error {
 	return device.IpcSetOperation(strings.NewReader(uapiConf))
 }
 
+// IpcTraceOperation traces the route to the NodeID, and writes the expected path and the hops.
+func (device *Device) IpcTraceOperation(w io.Writer, dst string) error {
+	dst_id, err := mtypes.String2NodeID(dst)
+	if err != nil {
+		return ipcErrorf(ipc.IpcErrorInvalid, "invalid NodeID in UAPI trace: %v", dst)
+	}
+	content, err := device.Trace(dst_id, TraceTimeout)
+	expected := make([]string, len(content.Expected))
+	for i, id := range content.Expected {
+		expected[i] = id.ToString()
+	}
+	fmt.Fprintf(w, "trace_expected=%s\n", strings.Join(expected, ","))
+	for _, hop := range content.Hops {
+		fmt.Fprintf(w, "trace_hop=%s:%d:%d\n", hop.NodeID.ToString(), unixNano(hop.Ingress), unixNano(hop.Egress))
+	}
+	if err != nil {
+		fmt.Fprintf(w, "trace_error=%v\n", err)
+	} else if content.Error != "" {
+		fmt.Fprintf(w, "trace_error=%v\n", content.Error)
+	}
+	return nil
+}
+
+// IpcNhTableOperation writes the hash of the local NhTable and the hashes announced by the supernodes.
+func (device *Device) IpcNhTableOperation(w io.Writer) error {
+	status := device.NhTableStatus()
+	fmt.Fprintf(w, "nhtable_hash=%s\n", status.Hash)
+	fmt.Fprintf(w, "nhtable_changed=%d\n", unixNano(status.Changed))
+	afs := make([]string, 0, len(status.SuperNodes))
+	for af := range status.SuperNodes {
+		afs = append(afs, af)
+	}
+	sort.Strings(afs)
+	for _, af := range afs {
+		super := status.SuperNodes[af]
+		fmt.Fprintf(w, "supernode=%s:%s:%d\n", af, super.Hash, unixNano(super.Received))
+	}
+	fmt.Fprintf(w, "converged=%v\n", status.Converged())
+	return nil
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
 func (device *Device) IpcHandle(socket net.Conn) {
 	defer socket.Close()
 
@@ -423,6 +500,8 @@ func (device *Device) IpcHandle(socket net.Conn) {
 		switch op {
 		case "set=1\n":
 			err = device.IpcSetOperation(buffered.Reader)
+		case "nhtable=1\n":
+			err = device.IpcNhTableOperation(buffered.Writer)
 		case "get=1\n":
 			var nextByte byte
 			nextByte, err = buffered.ReadByte()
@@ -435,6 +514,10 @@ func (device *Device) IpcHandle(socket net.Conn) {
 			}
 			err = device.IpcGetOperation(buffered.Writer)
 		default:
+			if strings.HasPrefix(op, "trace=") {
+				err = device.IpcTraceOperation(buffered.Writer, strings.TrimSpace(op[len("trace="):]))
+				break
+			}
 			device.log.Errorf("invalid UAPI operation: %v", op)
 			return
 		}
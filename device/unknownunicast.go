@@ -0,0 +1,44 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"sync/atomic"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// unknownUnicastDst is the dst_nodeID of a unicast frame from the TAP whose destination MAC is not in the L2FIB,
+// by InterfaceConf.UnknownUnicast. NodeID_Invalid means drop it.
+func (device *Device) unknownUnicastDst(frame []byte) mtypes.Vertex {
+	stat := &device.unknownStat
+	switch device.EdgeConfig.Interface.UnknownUnicast {
+	case mtypes.UnknownUnicastDrop:
+		atomic.AddUint64(&stat.Dropped, 1)
+		device.LogDrop("unknown unicast", nil, frame)
+		return mtypes.NodeID_Invalid
+	case mtypes.UnknownUnicastToGateway:
+		if device.graph.Next(device.ID, mtypes.NodeID_Default) == mtypes.NodeID_Invalid {
+			atomic.AddUint64(&stat.Dropped, 1)
+			device.LogDrop("unknown unicast without a default route", nil, frame)
+			return mtypes.NodeID_Invalid
+		}
+		atomic.AddUint64(&stat.ToGateway, 1)
+		return mtypes.NodeID_Default
+	default:
+		atomic.AddUint64(&stat.Flooded, 1)
+		return mtypes.NodeID_Broadcast
+	}
+}
+
+func (device *Device) unknownUnicastStats() mtypes.UnknownUnicastStats {
+	stat := &device.unknownStat
+	return mtypes.UnknownUnicastStats{
+		Flooded:   atomic.LoadUint64(&stat.Flooded),
+		Dropped:   atomic.LoadUint64(&stat.Dropped),
+		ToGateway: atomic.LoadUint64(&stat.ToGateway),
+	}
+}
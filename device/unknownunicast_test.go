@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import (
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+func TestUnknownUnicast(t *testing.T) {
+	device := &Device{ID: 1}
+	device.EdgeConfig = &mtypes.EdgeConfig{}
+	device.graph, _ = path.NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	frame := make([]byte, 14)
+
+	if dst := device.unknownUnicastDst(frame); dst != mtypes.NodeID_Broadcast {
+		t.Errorf("default: dst %v", dst.ToString())
+	}
+	device.EdgeConfig.Interface.UnknownUnicast = mtypes.UnknownUnicastDrop
+	if dst := device.unknownUnicastDst(frame); dst != mtypes.NodeID_Invalid {
+		t.Errorf("drop: dst %v", dst.ToString())
+	}
+	device.EdgeConfig.Interface.UnknownUnicast = mtypes.UnknownUnicastToGateway
+	if dst := device.unknownUnicastDst(frame); dst != mtypes.NodeID_Invalid {
+		t.Errorf("to-gateway without a default route: dst %v", dst.ToString())
+	}
+	device.graph.SetNHTable(mtypes.NextHopTable{1: {2: 2, mtypes.NodeID_Default: 2}})
+	if dst := device.unknownUnicastDst(frame); dst != mtypes.NodeID_Default {
+		t.Errorf("to-gateway: dst %v", dst.ToString())
+	}
+	if s := device.unknownUnicastStats(); s.Flooded != 1 || s.Dropped != 2 || s.ToGateway != 1 {
+		t.Errorf("stats = %+v", s)
+	}
+}
@@ -0,0 +1,34 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package device
+
+import "testing"
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		v    string
+		min  string
+		want bool
+	}{
+		{"0.3.0", "0.3.0", true},
+		{"0.3", "0.3.0", true},
+		{"0.3.0", "0.3", true},
+		{"v0.3.1", "0.3", true},
+		{"0.3", "0.3.1", false},
+		{"0.2.9", "0.3.0", false},
+		{"0.10.0", "0.9.0", true},
+		{"v0.3.5-3-gabcdef", "0.3.5", true},
+		{"v0.3.4-3-gabcdef", "0.3.5", false},
+		{"1", "0.9.9", true},
+		{"", "0.1", false},
+		{"0.3.0", "", true},
+	}
+	for _, tt := range tests {
+		if got := versionAtLeast(tt.v, tt.min); got != tt.want {
+			t.Errorf("versionAtLeast(%q, %q) = %v, want %v", tt.v, tt.min, got, tt.want)
+		}
+	}
+}
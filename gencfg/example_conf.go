@@ -27,24 +27,58 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 	v2 := mtypes.Vertex(2)
 	econfig = mtypes.EdgeConfig{
 		Interface: mtypes.InterfaceConf{
-			IType:         "tap",
-			Name:          "tap1",
-			VPPIFaceID:    1,
-			VPPBridgeID:   4242,
-			MacAddrPrefix: "AA:BB:CC:DD",
-			MTU:           device.DefaultMTU,
-			RecvAddr:      "127.0.0.1:4001",
-			SendAddr:      "127.0.0.1:5001",
-			L2HeaderMode:  "nochg",
+			IType:              "tap",
+			Name:               "tap1",
+			VPPIFaceID:         1,
+			VPPBridgeID:        4242,
+			MacAddrPrefix:      "AA:BB:CC:DD",
+			AutoAddress:        "",
+			MTU:                device.DefaultMTU,
+			RecvAddr:           "127.0.0.1:4001",
+			SendAddr:           "127.0.0.1:5001",
+			RecvBacklog:        0,
+			RecvMaxConns:       0,
+			L2HeaderMode:       "nochg",
+			AddressFamily:      "both",
+			AllowedEtherTypes:  []string{},
+			SockRecvBufferSize: 0,
+			SockSendBufferSize: 0,
+			MSSClamp:           false,
+			ReorderBufferMs:    0,
+			UnknownUnicast:     "flood",
+			ReadBatchSize:      0,
+			NDProxy:            false,
+			OnTapError:         mtypes.OnTapErrorExit,
 		},
-		NodeID:       1,
-		NodeName:     "Node01",
-		PostScript:   "",
-		DefaultTTL:   200,
-		L2FIBTimeout: 3600,
-		PrivKey:      "6GyDagZKhbm5WNqMiRHhkf43RlbMJ34IieTlIuvfJ1M=",
-		ListenPort:   0,
-		AfPrefer:     4,
+		NodeID:           1,
+		NodeName:         "Node01",
+		PostScript:       "",
+		OnChangeScript:   "",
+		DefaultTTL:       200,
+		L2FIBTimeout:     3600,
+		L2FIBTimeoutVLAN: map[uint16]float64{},
+		L2FIBStatic:      []mtypes.L2FIBStaticEntry{},
+		ARPProxy: mtypes.ARPProxyInfo{
+			Enabled: false,
+			Timeout: 0,
+			Static:  []mtypes.ARPProxyEntry{},
+		},
+		ReliableFlood: mtypes.ReliableFloodInfo{
+			EtherTypes: []string{},
+			DstMacs:    []string{},
+			Timeout:    0.5,
+			Retries:    3,
+		},
+		MessageAllowlist: mtypes.MessageAllowlistInfo{
+			SuperNode: []string{},
+			Peers:     []string{},
+		},
+		PrivKey:           "6GyDagZKhbm5WNqMiRHhkf43RlbMJ34IieTlIuvfJ1M=",
+		ListenPort:        0,
+		ListenPortCount:   1,
+		ListenPort_Data:   0,
+		ListenPort_Health: "",
+		AfPrefer:          4,
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "error",
 			LogTransit:  false,
@@ -52,16 +86,33 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 			LogNormal:   false,
 			LogInternal: true,
 			LogNTP:      true,
+			LogDrop:     false,
 		},
 		DynamicRoute: mtypes.DynamicRouteInfo{
 			SendPingInterval:     16,
 			PeerAliveTimeout:     70,
 			DupCheckTimeout:      40,
+			DupCheckTimeoutMin:   0,
 			TimeoutCheckInterval: 20,
 			ConnNextTry:          5,
 			AdditionalCost:       10,
 			DampingResistance:    0.95,
 			SaveNewPeers:         true,
+			SupernodeLostPolicy:  "",
+			NoRoutePolicy:        mtypes.NoRouteDrop,
+			BootstrapNhTableTTL:  0,
+			LatencyLogFile:       "",
+			WaitForSupernode:     0,
+			FlapBreaker: mtypes.FlapInfo{
+				Cycles:   0,
+				Window:   300,
+				Cooldown: 600,
+			},
+			ClockSkew: mtypes.ClockSkewInfo{
+				Threshold: 0,
+				UseRTT:    false,
+			},
+			PingProbeMTUs: []int{},
 			SuperNode: mtypes.SuperInfo{
 				UseSuperNode:         true,
 				PSKey:                "iPM8FXfnHVzwjguZHRW9bLNY+h7+B1O2oTJtktptQkI=",
@@ -71,18 +122,38 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 				PubKeyV6:             "HCfL6YJtpJEGHTlJ2LgVXIWKB/K95P57LHTJ42ZG8VI=",
 				EndpointEdgeAPIUrl:   "http://127.0.0.1:3000/eg_api",
 				SuperNodeInfoTimeout: 50,
+				NhTablePollTimeout:   0,
+				ControlTransport:     "udp",
+				SigningPubKey:        "",
+				WeightV4:             0,
+				WeightV6:             0,
 				SkipLocalIP:          false,
 				AdditionalLocalIP:    []string{"11.11.11.11:11111"},
 			},
 			P2P: mtypes.P2PInfo{
 				UseP2P:           false,
 				SendPeerInterval: 20,
+				DirectPathBonus:  0,
 				GraphRecalculateSetting: mtypes.GraphRecalculateSetting{
 					StaticMode:                false,
 					JitterTolerance:           50,
 					JitterToleranceMultiplier: 1.1,
 					TimeoutCheckInterval:      5,
 					RecalculateCoolDown:       5,
+					RecalcMode:                "event",
+					RecalcInterval:            0,
+					ExternalCostFile:          "",
+					ExternalCostPollInterval:  0,
+					MinCost:                   0,
+					AsymmetricTimeout:         0,
+					ExcludeAsymmetric:         false,
+					MinPeersForRouting:        0,
+					NegativeCyclePolicy:       "",
+					MaxHops:                   0,
+					Algorithm:                 "",
+					MaxEdgesPerNode:           0,
+					SuspectPeriod:             0,
+					SuspectPenalty:            0,
 					ManualLatency: mtypes.DistTable{
 						mtypes.Vertex(1): {
 							mtypes.Vertex(2): 2,
@@ -130,7 +201,11 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 				mtypes.Vertex(1): v1,
 			},
 		},
-		ResetEndPointInterval: 600,
+		ResetEndPointInterval:   600,
+		ResolveEndpointInterval: 60,
+		CipherSuite:             "",
+		RoamingRequireHandshake: false,
+		RoamingIPv6PrefixLen:    64,
 		Peers: []mtypes.PeerInfo{
 			{
 				NodeID:              2,
@@ -139,6 +214,11 @@ func GetExampleEdgeConf(templatePath string, getDemo bool) (mtypes.EdgeConfig, e
 				EndPoint:            "127.0.0.1:3002",
 				PersistentKeepalive: 30,
 				Static:              true,
+				Tags:                []string{},
+				Disabled:            false,
+				AllowedInnerCIDRs:   []string{},
+				Bandwidth:           0,
+				PingInterval:        0,
 			},
 		},
 	}
@@ -188,12 +268,19 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 	sconfig = mtypes.SuperConfig{
 		NodeName:             "NodeSuper",
 		PostScript:           "",
+		OnChangeScript:       "",
 		PrivKeyV4:            "mL5IW0GuqbjgDeOJuPHBU2iJzBPNKhaNEXbIGwwYWWk=",
 		PrivKeyV6:            "+EdOKIoBp/EvIusHDsvXhV1RJYbyN3Qr8nxlz35wl3I=",
 		ListenPort:           3000,
+		AddressFamily:        "both",
 		ListenPort_EdgeAPI:   "3000",
 		ListenPort_ManageAPI: "3000",
 		API_Prefix:           "/eg_api",
+		ReverseProxy: mtypes.ReverseProxyInfo{
+			BasePath:       "",
+			TrustedProxies: []string{},
+			EdgeAPIUrl:     "",
+		},
 		LogLevel: mtypes.LoggerInfo{
 			LogLevel:    "normal",
 			LogTransit:  false,
@@ -201,19 +288,41 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 			LogNormal:   false,
 			LogInternal: true,
 			LogNTP:      true,
+			LogDrop:     false,
 		},
-		RePushConfigInterval:  30,
-		PeerAliveTimeout:      70,
-		DampingResistance:     0.9,
-		HttpPostInterval:      50,
-		SendPingInterval:      15,
-		ResetEndPointInterval: 600,
+		RePushConfigInterval:    30,
+		PeerAliveTimeout:        70,
+		DampingResistance:       0.9,
+		TTLMargin:               0,
+		HttpPostInterval:        50,
+		SendPingInterval:        15,
+		ResetEndPointInterval:   600,
+		ResolveEndpointInterval: 60,
+		HolePunchInterval:       30,
+		HolePunchDelay:          1,
+		MinSupportedVersion:     "",
+		Observer:                false,
+		PeerStore: mtypes.PeerStoreConfig{
+			Type:         "memory",
+			Path:         "",
+			SaveInterval: 60,
+		},
+		AuditLog: mtypes.AuditLogInfo{
+			Path:       "",
+			MaxSize:    100,
+			MaxBackups: 5,
+		},
+		EventLogFile: "",
+		CipherSuite:  "",
+		SigningKey:   "",
 		Passwords: mtypes.Passwords{
 			ShowState:   random_passwd + "_showstate",
 			AddPeer:     random_passwd + "_addpeer",
 			DelPeer:     random_passwd + "_delpeer",
 			UpdatePeer:  random_passwd + "_updatepeer",
 			UpdateSuper: random_passwd + "_updatesuper",
+			Inject:      "",
+			Tokens:      []mtypes.APIToken{},
 		},
 		GraphRecalculateSetting: mtypes.GraphRecalculateSetting{
 			StaticMode: false,
@@ -229,6 +338,20 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 			JitterToleranceMultiplier: 1.01,
 			TimeoutCheckInterval:      5,
 			RecalculateCoolDown:       5,
+			RecalcMode:                "event",
+			RecalcInterval:            0,
+			ExternalCostFile:          "",
+			ExternalCostPollInterval:  0,
+			MinCost:                   0,
+			AsymmetricTimeout:         0,
+			ExcludeAsymmetric:         false,
+			MinPeersForRouting:        0,
+			NegativeCyclePolicy:       "",
+			MaxHops:                   0,
+			Algorithm:                 "",
+			MaxEdgesPerNode:           0,
+			SuspectPeriod:             0,
+			SuspectPenalty:            0,
 		},
 		NextHopTable: mtypes.NextHopTable{
 			mtypes.Vertex(1): {
@@ -238,22 +361,33 @@ func GetExampleSuperConf(templatePath string, getDemo bool) (mtypes.SuperConfig,
 				mtypes.Vertex(1): v1,
 			},
 		},
+		StaticRoutes:       []mtypes.StaticRoute{},
 		EdgeTemplate:       "example_config/super_mode/n1.yaml",
 		UsePSKForInterEdge: true,
 		Peers: []mtypes.SuperPeerInfo{
 			{
-				NodeID:         1,
-				Name:           "Node_01",
-				PubKey:         "ZqzLVSbXzjppERslwbf2QziWruW3V/UIx9oqwU8Fn3I=",
-				PSKey:          "iPM8FXfnHVzwjguZHRW9bLNY+h7+B1O2oTJtktptQkI=",
-				AdditionalCost: 10,
+				NodeID:              1,
+				Name:                "Node_01",
+				PubKey:              "ZqzLVSbXzjppERslwbf2QziWruW3V/UIx9oqwU8Fn3I=",
+				PSKey:               "iPM8FXfnHVzwjguZHRW9bLNY+h7+B1O2oTJtktptQkI=",
+				AdditionalCost:      10,
+				Tags:                []string{"gateway"},
+				PersistentKeepalive: 0,
+				Disabled:            false,
+				Bandwidth:           0,
+				Zone:                "",
 			},
 			{
-				NodeID:         2,
-				Name:           "Node_02",
-				PubKey:         "dHeWQtlTPQGy87WdbUARS4CtwVaR2y7IQ1qcX4GKSXk=",
-				PSKey:          "juJMQaGAaeSy8aDsXSKNsPZv/nFiPj4h/1G70tGYygs=",
-				AdditionalCost: 10,
+				NodeID:              2,
+				Name:                "Node_02",
+				PubKey:              "dHeWQtlTPQGy87WdbUARS4CtwVaR2y7IQ1qcX4GKSXk=",
+				PSKey:               "juJMQaGAaeSy8aDsXSKNsPZv/nFiPj4h/1G70tGYygs=",
+				AdditionalCost:      10,
+				Tags:                []string{"relay"},
+				PersistentKeepalive: 0,
+				Disabled:            false,
+				Bandwidth:           0,
+				Zone:                "",
 			},
 		},
 	}
@@ -75,7 +75,7 @@ func GenNMCfg(NMCinfigPath string, enableP2P bool, printExample bool) (err error
 		}
 	}
 
-	g, _ := path.NewGraph(0, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
+	g, _ := path.NewGraph(len(NMCfg.EdgeNodes), false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
 	edges := []mtypes.PongMsg{}
 	if NMCfg.DistanceMatrix != "" {
 		edges, err = path.ParseDistanceMatrix(NMCfg.DistanceMatrix)
@@ -53,6 +53,17 @@ func (l *UAPIListener) Addr() net.Addr {
 	return l.listener.Addr()
 }
 
+// File returns a copy of the listening socket, so that it can be handed over to another process.
+// After that, the socket path is kept when this listener is closed.
+func (l *UAPIListener) File() (*os.File, error) {
+	unixListener, ok := l.listener.(*net.UnixListener)
+	if !ok {
+		return nil, errors.New("not a unix socket listener")
+	}
+	unixListener.SetUnlinkOnClose(false)
+	return unixListener.File()
+}
+
 func UAPIListen(name string, file *os.File) (net.Listener, error) {
 
 	// wrap file in listener
@@ -36,6 +36,11 @@ func sockPath(iface string) string {
 	return fmt.Sprintf("%s/%s.sock", socketDirectory, iface)
 }
 
+// UAPIDial connects to the UAPI socket of the interface.
+func UAPIDial(name string) (net.Conn, error) {
+	return net.Dial("unix", sockPath(name))
+}
+
 func UAPIOpen(name string) (*os.File, error) {
 	if err := os.MkdirAll(socketDirectory, 0755); err != nil {
 		return nil, err
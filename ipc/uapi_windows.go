@@ -60,6 +60,11 @@ func init() {
 	}
 }
 
+// UAPIDial connects to the UAPI pipe of the interface.
+func UAPIDial(name string) (net.Conn, error) {
+	return winpipe.Dial(`\\.\pipe\ProtectedPrefix\Administrators\WireGuard\`+name, nil, nil)
+}
+
 func UAPIListen(name string) (net.Listener, error) {
 	config := winpipe.ListenConfig{
 		SecurityDescriptor: UAPISecurityDescriptor,
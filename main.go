@@ -33,11 +33,17 @@ const (
 
 var (
 	tconfig      = flag.String("config", "", "Config path for the interface.")
-	mode         = flag.String("mode", "", "Running mode. [super|edge|solve|gencfg]")
+	mode         = flag.String("mode", "", "Running mode. [super|edge|solve|gencfg|benchmark]")
 	printExample = flag.Bool("example", false, "Print example config")
 	cfgmode      = flag.String("cfgmode", "", "Running mode for generated config. [none|super|p2p]")
 	bind         = flag.String("bind", "linux", "UDP socket bind mode. [linux|std]\nYou may need std mode if you want to run Etherguard under WSL.")
 	nouapi       = flag.Bool("no-uapi", false, "Disable UAPI\nWith UAPI, you can check etherguard status by \"wg\" command")
+	trace        = flag.String("trace", "", "Trace the route to this NodeID through the running edge of -config, by UAPI")
+	nhtable      = flag.Bool("nhtable", false, "Show whether the NhTable of the running edge of -config matches the supernodes, by UAPI")
+	replay       = flag.String("replay", "", "Replay the EventLogFile of a supernode with the GraphRecalculateSetting of -config, and show when it pushed the NhTable")
+	benchmark    = flag.Bool("benchmark", false, "Measure the throughput of the data plane, between two edges in this process with dummy TAPs")
+	benchSize    = flag.Int("bench-size", 1400, "Frame size(bytes) of -benchmark, with the ethernet header")
+	benchTime    = flag.Float64("bench-time", 10, "Duration(sec) of -benchmark")
 	version      = flag.Bool("version", false, "Show version")
 	help         = flag.Bool("help", false, "Show this help")
 )
@@ -60,13 +66,38 @@ func main() {
 	nonSecureRand.Seed(time.Now().UnixNano())
 
 	var err error
+	if *trace != "" {
+		*mode = "trace"
+	}
+	if *nhtable {
+		*mode = "nhtable"
+	}
+	if *benchmark {
+		*mode = "benchmark"
+	}
+	if *replay != "" {
+		*mode = "replay"
+	}
+	if flag.Arg(0) == "ctl" {
+		*mode = "ctl"
+	}
 	switch *mode {
+	case "trace":
+		err = Trace(*tconfig, *trace)
+	case "nhtable":
+		err = NhTableStatus(*tconfig)
+	case "replay":
+		err = Replay(*tconfig, *replay)
+	case "ctl":
+		err = Ctl(flag.Args()[1:])
 	case "edge":
 		err = Edge(*tconfig, !*nouapi, *printExample, *bind)
 	case "super":
 		err = Super(*tconfig, !*nouapi, *printExample, *bind)
 	case "solve":
 		err = path.Solve(*tconfig, *printExample)
+	case "benchmark":
+		err = Benchmark(*benchSize, *benchTime, *bind)
 	case "gencfg":
 		switch *cfgmode {
 		case "super":
@@ -0,0 +1,78 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// bearerToken returns the token of the "Authorization: Bearer <token>" header, empty if there is none
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// authorize checks the request for the scope, by the bearer token if there is one, by the Password parameter otherwise.
+// It writes the error response and returns false if not allowed.
+func authorize(w http.ResponseWriter, r *http.Request, params url.Values, scope string) bool {
+	passwords := httpobj.http_passwords.Load().(mtypes.Passwords)
+	if token := bearerToken(r); token != "" {
+		for _, t := range passwords.Tokens {
+			if !checkPassword(token, t.Token) {
+				continue
+			}
+			if t.Revoked {
+				http_error(w, http.StatusUnauthorized, mtypes.API_ErrBadToken, fmt.Sprintf("Token %v: Revoked", t.Name))
+				return false
+			}
+			if !t.HasScope(scope) {
+				http_error(w, http.StatusForbidden, mtypes.API_ErrForbidden, fmt.Sprintf("Token %v: No scope %v", t.Name, scope))
+				return false
+			}
+			return true
+		}
+		http_error(w, http.StatusUnauthorized, mtypes.API_ErrBadToken, "Authorization: Wrong token")
+		return false
+	}
+	password, err := extractParamsStr(params, "Password", w)
+	if err != nil {
+		return false
+	}
+	if !checkPassword(password, passwords.Of(scope)) {
+		http_error(w, http.StatusUnauthorized, mtypes.API_ErrBadPassword, "Paramater Password: Wrong password")
+		return false
+	}
+	return true
+}
+
+// checkAPITokens checks the names are unique and the scopes are known
+func checkAPITokens(tokens []mtypes.APIToken) error {
+	names := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("Passwords.Tokens: Name must be unique and not empty : %q", t.Name)
+		}
+		names[t.Name] = true
+		if t.Token == "" {
+			return fmt.Errorf("Passwords.Tokens[%v]: Token is empty", t.Name)
+		}
+		for _, s := range t.Scopes {
+			if !mtypes.HasTag(mtypes.APIScopes, s) {
+				return fmt.Errorf("Passwords.Tokens[%v]: Scope must be one of %v : %v", t.Name, mtypes.APIScopes, s)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// superAudit is the AuditLog of the supernode, nil if there is none
+var superAudit *auditLog
+
+// auditLog appends a json line to SuperConfig.AuditLog.Path for every NhTable change, with what triggered it
+// and the next hops changed. It rotates the file to Path.1, Path.2 ... when it reaches MaxSize.
+type auditLog struct {
+	path       string
+	maxSize    int64 // bytes, 0 means no rotation
+	maxBackups int
+	file       *os.File
+	size       int64
+	last       mtypes.NextHopTable
+	lastHash   string
+	sync.Mutex
+}
+
+func newAuditLog(conf mtypes.AuditLogInfo) (*auditLog, error) {
+	if conf.Path == "" {
+		return nil, nil
+	}
+	l := &auditLog{
+		path:       conf.Path,
+		maxSize:    int64(conf.MaxSize * 1024 * 1024),
+		maxBackups: conf.MaxBackups,
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("AuditLog: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("AuditLog: %v", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// rotate shifts Path.N-1 to Path.N ... Path to Path.1, dropping the ones beyond MaxBackups. l must be locked.
+func (l *auditLog) rotate() error {
+	l.file.Close()
+	if l.maxBackups <= 0 {
+		os.Remove(l.path)
+	} else {
+		os.Remove(fmt.Sprintf("%v.%v", l.path, l.maxBackups))
+		for i := l.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%v.%v", l.path, i), fmt.Sprintf("%v.%v", l.path, i+1))
+		}
+		os.Rename(l.path, l.path+".1")
+	}
+	return l.open()
+}
+
+// diffNhTable returns the next hops changed from old to cur, sorted by Src and Dst
+func diffNhTable(old mtypes.NextHopTable, cur mtypes.NextHopTable) []mtypes.AuditRouteChange {
+	changes := make([]mtypes.AuditRouteChange, 0)
+	hop := func(nh mtypes.NextHopTable, u, v mtypes.Vertex) *mtypes.Vertex {
+		if next, ok := nh[u][v]; ok {
+			return &next
+		}
+		return nil
+	}
+	seen := make(map[[2]mtypes.Vertex]bool)
+	for _, nh := range []mtypes.NextHopTable{old, cur} {
+		for u, dsts := range nh {
+			for v := range dsts {
+				key := [2]mtypes.Vertex{u, v}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				o, n := hop(old, u, v), hop(cur, u, v)
+				if o != nil && n != nil && *o == *n {
+					continue
+				}
+				changes = append(changes, mtypes.AuditRouteChange{Src: u, Dst: v, Old: o, New: n})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Src != changes[j].Src {
+			return changes[i].Src < changes[j].Src
+		}
+		return changes[i].Dst < changes[j].Dst
+	})
+	return changes
+}
+
+// record writes the change from the last NhTable to cur. The first one after startup lists all the routes as new.
+func (l *auditLog) record(trigger string, cur mtypes.NextHopTable, hash string) error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	if hash == l.lastHash {
+		return nil
+	}
+	entry := mtypes.AuditEntry{
+		Time:    time.Now(),
+		Trigger: trigger,
+		OldHash: l.lastHash,
+		Hash:    hash,
+		Changes: diffNhTable(l.last, cur),
+	}
+	l.last = cur
+	l.lastHash = hash
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *auditLog) close() {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.file.Close()
+}
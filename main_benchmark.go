@@ -0,0 +1,159 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+)
+
+const benchMacPrefix = "AA:BB:CC:DD"
+
+type benchNode struct {
+	device *device.Device
+	tap    *tap.DummyTap
+	pub    device.NoisePublicKey
+}
+
+// newBenchNode starts an edge in static mode with a dummy TAP, listening on a random port of localhost.
+func newBenchNode(id mtypes.Vertex, bindmode string) (*benchNode, error) {
+	thetap, err := tap.CreateDummyTAP()
+	if err != nil {
+		return nil, err
+	}
+	econfig := mtypes.EdgeConfig{
+		NodeID:       id,
+		NodeName:     "Bench" + id.ToString(),
+		DefaultTTL:   200,
+		L2FIBTimeout: 3600,
+		AfPrefer:     4,
+	}
+	econfig.Interface.IType = "dummy"
+	econfig.Interface.MTU = device.DefaultMTU
+	econfig.Interface.MacAddrPrefix = benchMacPrefix
+	econfig.NextHopTable = mtypes.NextHopTable{
+		1: {2: 2},
+		2: {1: 1},
+	}
+	if id == 1 {
+		// unicast to Node 2, instead of broadcast to an unknown MAC
+		peerMac, _ := tap.GetMacAddr(benchMacPrefix, 2)
+		econfig.L2FIBStatic = []mtypes.L2FIBStaticEntry{{MacAddr: peerMac.String(), NodeID: 2}}
+	}
+	graph, err := path.NewGraph(3, false, mtypes.GraphRecalculateSetting{StaticMode: true}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		return nil, err
+	}
+	graph.SetNHTable(econfig.NextHopTable)
+	logger := device.NewLogger(device.LogLevelError, fmt.Sprintf("(%s) ", econfig.NodeName))
+	bind := conn.NewDefaultBind(true, false, bindmode)
+	the_device := device.NewDevice(thetap, id, bind, logger, graph, false, "", &econfig, nil, nil, Version)
+	pri, pub := device.RandomKeyPair()
+	the_device.SetPrivateKey(pri)
+	the_device.IpcSet("listen_port=0\n")
+	return &benchNode{
+		device: the_device,
+		tap:    thetap.(*tap.DummyTap),
+		pub:    pub,
+	}, nil
+}
+
+// port waits until the device is up, and returns its UDP port.
+func (node *benchNode) port() (uint16, error) {
+	for i := 0; i < 50; i++ {
+		if ports := node.device.ListenPorts(); len(ports) > 0 && ports[0] != 0 {
+			return ports[0], nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return 0, fmt.Errorf("Bench%v didn't come up", node.device.ID.ToString())
+}
+
+func (node *benchNode) addPeer(peer *benchNode, id mtypes.Vertex) error {
+	port, err := peer.port()
+	if err != nil {
+		return err
+	}
+	thepeer, err := node.device.NewPeer(peer.pub, id, false, 0, mtypes.PeerQueueInfo{})
+	if err != nil {
+		return err
+	}
+	return thepeer.SetEndpointFromConnURL("127.0.0.1:"+strconv.Itoa(int(port)), 4, 0, true)
+}
+
+func cpuTime() time.Duration {
+	var ru syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &ru)
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// Benchmark runs two edges in this process, connected by UDP on localhost.
+// Node 1 floods frames from its dummy TAP to Node 2 as fast as it can, and the throughput of Node 2 is reported.
+// Both nodes share the CPU of this box, so it's the cost of encrypting and decrypting on one machine.
+func Benchmark(frameSize int, duration float64, bindmode string) error {
+	if frameSize < 14 || frameSize > device.DefaultMTU+14 {
+		return fmt.Errorf("bench-size must in range [14,%v] : %v", device.DefaultMTU+14, frameSize)
+	}
+	if duration <= 0 {
+		return fmt.Errorf("bench-time must > 0 : %v", duration)
+	}
+	src, err := newBenchNode(1, bindmode)
+	if err != nil {
+		return err
+	}
+	defer src.device.Close()
+	dst, err := newBenchNode(2, bindmode)
+	if err != nil {
+		return err
+	}
+	defer dst.device.Close()
+	if err := src.addPeer(dst, 2); err != nil {
+		return err
+	}
+	if err := dst.addPeer(src, 1); err != nil {
+		return err
+	}
+
+	frame := make([]byte, frameSize)
+	dstMac, _ := tap.GetMacAddr(benchMacPrefix, 2)
+	srcMac, _ := tap.GetMacAddr(benchMacPrefix, 1)
+	copy(frame[0:6], dstMac[:])
+	copy(frame[6:12], srcMac[:])
+	frame[12], frame[13] = 0x88, 0xb5 // local experimental EtherType
+
+	fmt.Printf("Benchmark: %v bytes frames for %v, %v CPUs\n", frameSize, mtypes.S2TD(duration), runtime.NumCPU())
+	cpu0 := cpuTime()
+	start := time.Now()
+	src.tap.Flood(frame)
+	time.Sleep(mtypes.S2TD(duration))
+	src.tap.Flood(nil)
+	elapsed := time.Since(start)
+	cpu := cpuTime() - cpu0
+	time.Sleep(time.Second) // wait for the frames in flight
+
+	sent, _, _ := src.tap.Counters()
+	_, received, receivedBytes := dst.tap.Counters()
+	var dropRate float64
+	if sent > 0 && sent > received {
+		dropRate = float64(sent-received) / float64(sent) * 100
+	}
+	fmt.Printf("Sent:       %v frames\n", sent)
+	fmt.Printf("Received:   %v frames\n", received)
+	fmt.Printf("Throughput: %.2f Mbps\n", float64(receivedBytes)*8/elapsed.Seconds()/1e6)
+	fmt.Printf("PPS:        %.0f\n", float64(received)/elapsed.Seconds())
+	fmt.Printf("Drop rate:  %.2f%%\n", dropRate)
+	fmt.Printf("CPU:        %.0f%% (100%% is one core)\n", cpu.Seconds()/elapsed.Seconds()*100)
+	return nil
+}
@@ -0,0 +1,298 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+)
+
+const ctlUsage = `Usage: etherguard-go ctl <interface> <command>
+
+Commands:
+  get               Show the interface and its peers, with the next hop and the latency
+  dump              Print the raw key=value lines of the UAPI get
+  nhtable           Show whether the NhTable matches the supernodes, like -nhtable
+  trace <NodeID>    Trace the route to the NodeID, like -trace
+  set [listen-port <port>] [fwmark <mark>] [private-key <file path>]
+      [peer <base64 public key> [remove] [endpoint <ip>:<port>] [persistent-keepalive <seconds|off>]
+       [preshared-key <file path>] [disabled <true|false>]]...
+                    Change the running interface, like wg set. Peers can be changed but not added
+`
+
+// Ctl talks to the UAPI of a running edge or super node by its interface name, which is the NodeName of the config.
+func Ctl(args []string) error {
+	if len(args) < 2 {
+		fmt.Print(ctlUsage)
+		return fmt.Errorf("ctl: interface and command required")
+	}
+	name, cmd, rest := args[0], args[1], args[2:]
+	switch cmd {
+	case "get", "show":
+		return ctlGet(name)
+	case "dump":
+		lines, err := uapiExchange(name, "get=1\n\n")
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Println(line)
+		}
+		return nil
+	case "nhtable":
+		return nhTableStatusInterface(name)
+	case "trace":
+		if len(rest) != 1 {
+			return fmt.Errorf("ctl trace: NodeID required")
+		}
+		return traceInterface(name, rest[0])
+	case "set":
+		return ctlSet(name, rest)
+	default:
+		fmt.Print(ctlUsage)
+		return fmt.Errorf("ctl: unknown command : %v", cmd)
+	}
+}
+
+// uapiExchange sends the operation to the UAPI and returns the response lines, without the errno.
+func uapiExchange(name string, op string) ([]string, error) {
+	uapi, err := ipc.UAPIDial(name)
+	if err != nil {
+		return nil, fmt.Errorf("connect to UAPI of %v: %v", name, err)
+	}
+	defer uapi.Close()
+	uapi.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprint(uapi, op); err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(uapi)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "errno=") {
+			if line != "errno=0" {
+				return nil, fmt.Errorf("UAPI error: %v", line)
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+func ctlGet(name string) error {
+	lines, err := uapiExchange(name, "get=1\n\n")
+	if err != nil {
+		return err
+	}
+	var handshakeSec int64
+	var rx, tx uint64
+	endPeer := func() {
+		if handshakeSec > 0 {
+			fmt.Printf("  latest handshake: %v ago\n", time.Since(time.Unix(handshakeSec, 0)).Round(time.Second))
+		}
+		if rx > 0 || tx > 0 {
+			fmt.Printf("  transfer: %v received, %v sent\n", humanBytes(rx), humanBytes(tx))
+		}
+		handshakeSec, rx, tx = 0, 0, 0
+	}
+	inPeer := false
+	fmt.Printf("interface: %v\n", name)
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "public_key":
+			if inPeer {
+				endPeer()
+			}
+			inPeer = true
+			fmt.Printf("\npeer: %v\n", hexToBase64(value))
+		case "private_key":
+			var sk device.NoisePrivateKey
+			if err := sk.FromHex(value); err == nil {
+				fmt.Printf("  public key: %v\n", sk.PublicKey().ToString())
+			}
+		case "listen_port":
+			fmt.Printf("  listening port: %v\n", value)
+		case "fwmark":
+			fmt.Printf("  fwmark: 0x%x\n", mustUint(value))
+		case "cipher_suite":
+			fmt.Printf("  cipher suite: %v\n", value)
+		case "node_id":
+			fmt.Printf("  node id: %v\n", value)
+		case "endpoint":
+			fmt.Printf("  endpoint: %v\n", value)
+		case "last_handshake_time_sec":
+			handshakeSec = int64(mustUint(value))
+		case "tx_bytes":
+			tx = mustUint(value)
+		case "rx_bytes":
+			rx = mustUint(value)
+		case "persistent_keepalive_interval":
+			if value != "0" {
+				fmt.Printf("  persistent keepalive: every %v seconds\n", value)
+			}
+		case "disabled":
+			fmt.Printf("  disabled: %v\n", value)
+		case "next_hop":
+			fmt.Printf("  next hop: %v\n", value)
+		case "latency":
+			latency, _ := strconv.ParseFloat(value, 64)
+			fmt.Printf("  latency: %.3fms\n", latency*1000)
+		}
+	}
+	if inPeer {
+		endPeer()
+	}
+	return nil
+}
+
+func ctlSet(name string, args []string) error {
+	var b strings.Builder
+	inPeer := false
+	next := func(i *int) (string, error) {
+		if *i+1 >= len(args) {
+			return "", fmt.Errorf("ctl set: %v requires a value", args[*i])
+		}
+		*i++
+		return args[*i], nil
+	}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "remove" {
+			if !inPeer {
+				return fmt.Errorf("ctl set: remove must follow a peer")
+			}
+			b.WriteString("remove=true\n")
+			continue
+		}
+		value, err := next(&i)
+		if err != nil {
+			return err
+		}
+		switch arg {
+		case "listen-port", "fwmark", "private-key":
+			if inPeer {
+				return fmt.Errorf("ctl set: %v must be before the peers", arg)
+			}
+		case "peer":
+		default:
+			if !inPeer {
+				return fmt.Errorf("ctl set: %v must follow a peer", arg)
+			}
+		}
+		switch arg {
+		case "listen-port":
+			fmt.Fprintf(&b, "listen_port=%v\n", value)
+		case "fwmark":
+			if value == "off" {
+				value = "0"
+			}
+			fmt.Fprintf(&b, "fwmark=%v\n", value)
+		case "private-key":
+			key, err := readKeyFile(value)
+			if err != nil {
+				return err
+			}
+			sk, err := device.Str2PriKey(key)
+			if err != nil {
+				return fmt.Errorf("ctl set: private-key: %v", err)
+			}
+			fmt.Fprintf(&b, "private_key=%v\n", hex.EncodeToString(sk[:]))
+		case "peer":
+			pk, err := device.Str2PubKey(value)
+			if err != nil {
+				return fmt.Errorf("ctl set: peer: %v", err)
+			}
+			inPeer = true
+			fmt.Fprintf(&b, "public_key=%v\n", hex.EncodeToString(pk[:]))
+		case "endpoint":
+			fmt.Fprintf(&b, "endpoint=%v\n", value)
+		case "persistent-keepalive":
+			if value == "off" {
+				value = "0"
+			}
+			fmt.Fprintf(&b, "persistent_keepalive_interval=%v\n", value)
+		case "preshared-key":
+			key, err := readKeyFile(value)
+			if err != nil {
+				return err
+			}
+			psk, err := device.Str2PSKey(key)
+			if err != nil {
+				return fmt.Errorf("ctl set: preshared-key: %v", err)
+			}
+			fmt.Fprintf(&b, "preshared_key=%v\n", hex.EncodeToString(psk[:]))
+		case "disabled":
+			fmt.Fprintf(&b, "disabled=%v\n", value)
+		default:
+			return fmt.Errorf("ctl set: unknown option : %v", arg)
+		}
+	}
+	if b.Len() == 0 {
+		return fmt.Errorf("ctl set: nothing to set")
+	}
+	_, err := uapiExchange(name, "set=1\n"+b.String()+"\n")
+	return err
+}
+
+// readKeyFile reads a base64 key from the file, "-" for stdin like wg(8)
+func readKeyFile(path string) (string, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		content, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func hexToBase64(s string) string {
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return s
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func mustUint(s string) uint64 {
+	n, _ := strconv.ParseUint(s, 10, 64)
+	return n
+}
+
+func humanBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -9,14 +9,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"sort"
 	"strconv"
 	"syscall"
 
-	"github.com/google/shlex"
-
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
@@ -46,14 +45,235 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		fmt.Printf("Error read config: %v\t%v\n", configPath, err)
 		return err
 	}
+	mtypes.ApplyEdgeDefaults(&econfig)
+	if renumbered, ok := os.LookupEnv(ENV_EG_RENUMBERED); ok {
+		NewNodeID, err := mtypes.String2NodeID(renumbered)
+		if err != nil {
+			return fmt.Errorf("%v: %v", ENV_EG_RENUMBERED, err)
+		}
+		econfig.NextHopTable = mtypes.RenumberNhTable(econfig.NextHopTable, econfig.NodeID, NewNodeID)
+		econfig.NodeID = NewNodeID
+	}
 
 	NodeName := econfig.NodeName
 	if len(NodeName) > 32 {
 		return errors.New("Node name can't longer than 32 :" + NodeName)
 	}
+	if econfig.PostScript != "" && !postScriptEnabled {
+		return fmt.Errorf("PostScript is disabled in this build, remove it from the config : %v", econfig.PostScript)
+	}
+	if econfig.OnChangeScript != "" && !postScriptEnabled {
+		return fmt.Errorf("OnChangeScript is disabled in this build, remove it from the config : %v", econfig.OnChangeScript)
+	}
 	if econfig.DynamicRoute.DampingResistance < 0 || econfig.DynamicRoute.DampingResistance >= 1 {
 		return fmt.Errorf("DampingResistance must in range [0,1) : %v", econfig.DynamicRoute.DampingResistance)
 	}
+	if econfig.DynamicRoute.P2P.DirectPathBonus < 0 {
+		return fmt.Errorf("DirectPathBonus must >= 0 : %v", econfig.DynamicRoute.P2P.DirectPathBonus)
+	}
+	for vid := range econfig.L2FIBTimeoutVLAN {
+		if vid > 4094 {
+			return fmt.Errorf("L2FIBTimeoutVLAN: invalid VLAN ID : %v", vid)
+		}
+	}
+	for _, entry := range econfig.L2FIBStatic {
+		if hwaddr, err := net.ParseMAC(entry.MacAddr); err != nil || len(hwaddr) != 6 {
+			return fmt.Errorf("L2FIBStatic: invalid MacAddr : %v", entry.MacAddr)
+		}
+		if entry.NodeID >= mtypes.NodeID_Special {
+			return fmt.Errorf("L2FIBStatic: invalid NodeID : %v", entry.NodeID)
+		}
+	}
+	if econfig.ARPProxy.Timeout < 0 {
+		return fmt.Errorf("ARPProxy.Timeout must >= 0 : %v", econfig.ARPProxy.Timeout)
+	}
+	for _, entry := range econfig.ARPProxy.Static {
+		if net.ParseIP(entry.IP) == nil {
+			return fmt.Errorf("ARPProxy.Static: invalid IP : %v", entry.IP)
+		}
+		if hwaddr, err := net.ParseMAC(entry.MacAddr); err != nil || len(hwaddr) != 6 {
+			return fmt.Errorf("ARPProxy.Static: invalid MacAddr : %v", entry.MacAddr)
+		}
+	}
+	if int(econfig.Interface.MTU) > device.MaxMTU {
+		return fmt.Errorf("MTU must <= %v : %v", device.MaxMTU, econfig.Interface.MTU)
+	}
+	for _, et := range econfig.Interface.AllowedEtherTypes {
+		if _, err := mtypes.ParseEtherType(et); err != nil {
+			return err
+		}
+	}
+	switch econfig.Interface.UnknownUnicast {
+	case "", mtypes.UnknownUnicastFlood, mtypes.UnknownUnicastDrop, mtypes.UnknownUnicastToGateway:
+	default:
+		return fmt.Errorf("UnknownUnicast must be %v, %v or %v : %v", mtypes.UnknownUnicastFlood, mtypes.UnknownUnicastDrop, mtypes.UnknownUnicastToGateway, econfig.Interface.UnknownUnicast)
+	}
+	for _, peerconf := range econfig.Peers {
+		for _, cidr := range peerconf.AllowedInnerCIDRs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return fmt.Errorf("Peers[%v].AllowedInnerCIDRs: invalid CIDR : %v", peerconf.NodeID, cidr)
+			}
+		}
+		if peerconf.PingInterval < 0 || (peerconf.PingInterval > 0 && peerconf.PingInterval >= econfig.DynamicRoute.PeerAliveTimeout) {
+			return fmt.Errorf("Peers[%v].PingInterval must >= 0 and < %v(PeerAliveTimeout) : %v", peerconf.NodeID, econfig.DynamicRoute.PeerAliveTimeout, peerconf.PingInterval)
+		}
+		if peerconf.Bandwidth < 0 {
+			return fmt.Errorf("Peers[%v].Bandwidth must >= 0 : %v", peerconf.NodeID, peerconf.Bandwidth)
+		}
+		if peerconf.Queue.Depth < 0 {
+			return fmt.Errorf("Peers[%v].Queue.Depth must >= 0 : %v", peerconf.NodeID, peerconf.Queue.Depth)
+		}
+		switch peerconf.Queue.FullPolicy {
+		case "", mtypes.QueueFullBlock, mtypes.QueueFullDropOldest:
+		default:
+			return fmt.Errorf("Peers[%v].Queue.FullPolicy must be %v or %v : %v", peerconf.NodeID, mtypes.QueueFullBlock, mtypes.QueueFullDropOldest, peerconf.Queue.FullPolicy)
+		}
+	}
+	switch econfig.DynamicRoute.SupernodeLostPolicy {
+	case "", mtypes.SupernodeLostKeepLast, mtypes.SupernodeLostDropAll:
+	case mtypes.SupernodeLostP2PFallback:
+		if !econfig.DynamicRoute.P2P.UseP2P {
+			return fmt.Errorf("SupernodeLostPolicy %v requires UseP2P", econfig.DynamicRoute.SupernodeLostPolicy)
+		}
+	default:
+		return fmt.Errorf("SupernodeLostPolicy must be %v, %v or %v : %v", mtypes.SupernodeLostKeepLast, mtypes.SupernodeLostP2PFallback, mtypes.SupernodeLostDropAll, econfig.DynamicRoute.SupernodeLostPolicy)
+	}
+	switch econfig.DynamicRoute.NoRoutePolicy {
+	case "", mtypes.NoRouteDrop, mtypes.NoRouteFlood:
+	default:
+		return fmt.Errorf("NoRoutePolicy must be %v or %v : %v", mtypes.NoRouteDrop, mtypes.NoRouteFlood, econfig.DynamicRoute.NoRoutePolicy)
+	}
+	if econfig.DynamicRoute.WaitForSupernode < 0 {
+		return fmt.Errorf("WaitForSupernode must >= 0 : %v", econfig.DynamicRoute.WaitForSupernode)
+	}
+	if econfig.DynamicRoute.WaitForSupernode > 0 && econfig.DynamicRoute.SuperNode.UseSuperNode && econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl == "" {
+		return fmt.Errorf("WaitForSupernode requires EndpointEdgeAPIUrl")
+	}
+	if fb := econfig.DynamicRoute.FlapBreaker; fb.Cycles < 0 || fb.Window < 0 || fb.Cooldown < 0 {
+		return fmt.Errorf("FlapBreaker.Cycles, Window and Cooldown must >= 0 : %v", fb)
+	} else if fb.Cycles > 0 && (fb.Window <= 0 || fb.Cooldown <= 0) {
+		return fmt.Errorf("FlapBreaker.Window and Cooldown must > 0 if Cycles is set : %v", fb)
+	}
+	for _, mtu := range econfig.DynamicRoute.PingProbeMTUs {
+		if mtu <= 0 || mtu > device.MaxMTU {
+			return fmt.Errorf("PingProbeMTUs must in range (0, %v] : %v", device.MaxMTU, mtu)
+		}
+	}
+	if econfig.DynamicRoute.BootstrapNhTableTTL < 0 {
+		return fmt.Errorf("BootstrapNhTableTTL must >= 0 : %v", econfig.DynamicRoute.BootstrapNhTableTTL)
+	}
+	for _, name := range econfig.MessageAllowlist.SuperNode {
+		if usage, err := path.ParseUsage(name); err != nil || !usage.IsControl_Super2Edge() {
+			return fmt.Errorf("MessageAllowlist.SuperNode: %v is never accepted from the supernode", name)
+		}
+	}
+	for _, name := range econfig.MessageAllowlist.Peers {
+		if usage, err := path.ParseUsage(name); err != nil || !(usage.IsNormal() || usage.IsControl_Edge2Edge()) {
+			return fmt.Errorf("MessageAllowlist.Peers: %v is never accepted from a peer", name)
+		}
+	}
+	if econfig.DynamicRoute.ClockSkew.Threshold < 0 {
+		return fmt.Errorf("ClockSkew.Threshold must >= 0 : %v", econfig.DynamicRoute.ClockSkew.Threshold)
+	}
+	if econfig.DynamicRoute.SuperNode.WeightV4 < 0 || econfig.DynamicRoute.SuperNode.WeightV6 < 0 {
+		return fmt.Errorf("WeightV4 and WeightV6 must >= 0 : %v %v", econfig.DynamicRoute.SuperNode.WeightV4, econfig.DynamicRoute.SuperNode.WeightV6)
+	}
+	if econfig.DynamicRoute.SuperNode.NhTablePollTimeout < 0 {
+		return fmt.Errorf("NhTablePollTimeout must >= 0 : %v", econfig.DynamicRoute.SuperNode.NhTablePollTimeout)
+	}
+	if econfig.DynamicRoute.SuperNode.NhTablePollTimeout > 0 && econfig.DynamicRoute.SuperNode.PSKey == "" {
+		return fmt.Errorf("NhTablePollTimeout requires PSKey, the polls are signed with it")
+	}
+	switch econfig.DynamicRoute.SuperNode.ControlTransport {
+	case "", mtypes.ControlTransportUDP:
+	case mtypes.ControlTransportTCP:
+		if econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl == "" {
+			return fmt.Errorf("ControlTransport %v requires EndpointEdgeAPIUrl", econfig.DynamicRoute.SuperNode.ControlTransport)
+		}
+	case mtypes.ControlTransportHTTP:
+		if econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl == "" || econfig.DynamicRoute.SuperNode.PSKey == "" {
+			return fmt.Errorf("ControlTransport %v requires EndpointEdgeAPIUrl and PSKey", econfig.DynamicRoute.SuperNode.ControlTransport)
+		}
+	default:
+		return fmt.Errorf("ControlTransport must be %v, %v or %v : %v", mtypes.ControlTransportUDP, mtypes.ControlTransportTCP, mtypes.ControlTransportHTTP, econfig.DynamicRoute.SuperNode.ControlTransport)
+	}
+	if econfig.Interface.ReadBatchSize < 0 || econfig.Interface.ReadBatchSize > 1024 {
+		return fmt.Errorf("ReadBatchSize must in range [0,1024] : %v", econfig.Interface.ReadBatchSize)
+	}
+	switch econfig.Interface.OnTapError {
+	case "", mtypes.OnTapErrorExit, mtypes.OnTapErrorRetry:
+	case mtypes.OnTapErrorReconnect:
+		switch econfig.Interface.IType {
+		case "tcpsock", "unixsock", "unixgramsock", "unixpacketsock":
+		default:
+			return fmt.Errorf("OnTapError %v only works with the *sock types except udpsock : %v", mtypes.OnTapErrorReconnect, econfig.Interface.IType)
+		}
+	default:
+		return fmt.Errorf("OnTapError must be %v, %v or %v : %v", mtypes.OnTapErrorExit, mtypes.OnTapErrorRetry, mtypes.OnTapErrorReconnect, econfig.Interface.OnTapError)
+	}
+	if econfig.Interface.RecvBacklog < 0 || econfig.Interface.RecvMaxConns < 0 {
+		return fmt.Errorf("RecvBacklog and RecvMaxConns must >= 0 : %v %v", econfig.Interface.RecvBacklog, econfig.Interface.RecvMaxConns)
+	}
+	if econfig.Interface.RecvBacklog > 0 || econfig.Interface.RecvMaxConns > 0 {
+		switch econfig.Interface.IType {
+		case "tcpsock", "unixsock", "unixpacketsock":
+		default:
+			return fmt.Errorf("RecvBacklog and RecvMaxConns only work with tcpsock, unixsock and unixpacketsock : %v", econfig.Interface.IType)
+		}
+	}
+	if econfig.Interface.SockRecvBufferSize < 0 || econfig.Interface.SockSendBufferSize < 0 {
+		return fmt.Errorf("SockRecvBufferSize and SockSendBufferSize must >= 0 : %v %v", econfig.Interface.SockRecvBufferSize, econfig.Interface.SockSendBufferSize)
+	}
+	if econfig.DynamicRoute.SuperNode.SigningPubKey != "" {
+		if _, err := mtypes.ParseSigningPubKey(econfig.DynamicRoute.SuperNode.SigningPubKey); err != nil {
+			return err
+		}
+	}
+	if err := device.CheckCipherSuite(econfig.CipherSuite); err != nil {
+		return err
+	}
+	for _, s := range econfig.ReliableFlood.EtherTypes {
+		if _, err := mtypes.ParseEtherType(s); err != nil {
+			return fmt.Errorf("ReliableFlood.EtherTypes: %v", err)
+		}
+	}
+	for _, s := range econfig.ReliableFlood.DstMacs {
+		if hwaddr, err := net.ParseMAC(s); err != nil || len(hwaddr) != 6 {
+			return fmt.Errorf("ReliableFlood.DstMacs: invalid MacAddr : %v", s)
+		}
+	}
+	if econfig.ReliableFlood.Timeout <= 0 || econfig.ReliableFlood.Retries < 0 {
+		return fmt.Errorf("ReliableFlood.Timeout must > 0 and Retries must >= 0 : %v %v", econfig.ReliableFlood.Timeout, econfig.ReliableFlood.Retries)
+	}
+	if econfig.RoamingIPv6PrefixLen < 0 || econfig.RoamingIPv6PrefixLen > 128 {
+		return fmt.Errorf("RoamingIPv6PrefixLen must in range [0,128] : %v", econfig.RoamingIPv6PrefixLen)
+	}
+	if econfig.ListenPortCount < 0 || econfig.ListenPort+econfig.ListenPortCount > 65536 {
+		return fmt.Errorf("ListenPortCount out of range : %v", econfig.ListenPortCount)
+	}
+	if econfig.Interface.AutoAddress != "" {
+		if econfig.Interface.IType != "tap" {
+			return fmt.Errorf("AutoAddress only works with IType tap : %v", econfig.Interface.IType)
+		}
+		if _, _, err := tap.GetULAAddr(econfig.Interface.AutoAddress, uint32(econfig.NodeID)); err != nil {
+			return err
+		}
+	}
+	if econfig.ListenPort_Data != 0 {
+		if econfig.ListenPort_Data < 0 || econfig.ListenPort_Data > 65535 || econfig.ListenPort_Data == econfig.ListenPort {
+			return fmt.Errorf("ListenPort_Data must in range [1,65535] and different from ListenPort : %v", econfig.ListenPort_Data)
+		}
+		if econfig.ListenPortCount > 1 {
+			return fmt.Errorf("ListenPort_Data can't be used with ListenPortCount > 1 : %v", econfig.ListenPortCount)
+		}
+	}
+	use4, use6, err := mtypes.AddressFamilies(econfig.Interface.AddressFamily)
+	if err != nil {
+		return err
+	}
+	if !use4 && econfig.AfPrefer == 4 || !use6 && econfig.AfPrefer == 6 {
+		return fmt.Errorf("AfPrefer %v is disabled by AddressFamily %v", econfig.AfPrefer, econfig.Interface.AddressFamily)
+	}
 	var logLevel int
 	switch econfig.LogLevel.LogLevel {
 	case "verbose", "debug":
@@ -76,9 +296,17 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		return
 	}
 
-	var thetap tap.Device
+	thetap, inherited, err := inheritedTAP(econfig.Interface, econfig.NodeID)
+	if err != nil {
+		logger.Errorf("Failed to create TAP device: %v", err)
+		os.Exit(ExitSetupFailed)
+	}
 	// open TUN device (or use supplied fd)
 	switch econfig.Interface.IType {
+	case "tap":
+		if !inherited {
+			thetap, err = tap.CreateTAP(econfig.Interface, econfig.NodeID)
+		}
 	case "dummy":
 		thetap, err = tap.CreateDummyTAP()
 	case "stdio":
@@ -97,8 +325,6 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		thetap, err = tap.CreateFdTAP(econfig.Interface, econfig.NodeID)
 	case "vpp":
 		thetap, err = tap.CreateVppTAP(econfig.Interface, econfig.NodeID, econfig.LogLevel.LogLevel)
-	case "tap":
-		thetap, err = tap.CreateTAP(econfig.Interface, econfig.NodeID)
 	default:
 		return errors.New("Unknow interface type:" + econfig.Interface.IType)
 	}
@@ -116,13 +342,31 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if !econfig.DynamicRoute.P2P.UseP2P && !econfig.DynamicRoute.SuperNode.UseSuperNode {
 		econfig.LogLevel.LogNTP = false // NTP in static mode is useless
 	}
-	graph, err := path.NewGraph(3, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
+	graph, err := path.NewGraph(len(econfig.Peers)+1, false, econfig.DynamicRoute.P2P.GraphRecalculateSetting, econfig.DynamicRoute.NTPConfig, econfig.LogLevel)
 	if err != nil {
 		return err
 	}
-	graph.SetNHTable(econfig.NextHopTable)
+	if econfig.DynamicRoute.BootstrapNhTableTTL > 0 && (econfig.DynamicRoute.P2P.UseP2P || econfig.DynamicRoute.SuperNode.UseSuperNode) {
+		graph.SetBootstrapNHTable(econfig.NextHopTable, mtypes.S2TD(econfig.DynamicRoute.BootstrapNhTableTTL))
+	} else {
+		graph.SetNHTable(econfig.NextHopTable)
+	}
+	graph.DirectPathBonus = econfig.DynamicRoute.P2P.DirectPathBonus / 1000 // ms to s
 
-	the_device := device.NewDevice(thetap, econfig.NodeID, conn.NewDefaultBind(true, true, bindmode), logger, graph, false, configPath, &econfig, nil, nil, Version)
+	var bind conn.Bind
+	if econfig.ListenPort_Data != 0 {
+		bind = conn.NewDataPortBind(uint16(econfig.ListenPort_Data), func() conn.Bind {
+			return conn.NewDefaultBind(use4, use6, bindmode)
+		})
+	} else if econfig.ListenPortCount > 1 {
+		bind = conn.NewMultiPortBind(econfig.ListenPortCount, func() conn.Bind {
+			return conn.NewDefaultBind(use4, use6, bindmode)
+		})
+	} else {
+		bind = conn.NewDefaultBind(use4, use6, bindmode)
+	}
+	inheritSockets(bind, NodeName)
+	the_device := device.NewDevice(thetap, econfig.NodeID, bind, logger, graph, false, configPath, &econfig, nil, nil, Version)
 	defer the_device.Close()
 	pk, err := device.Str2PriKey(econfig.PrivKey)
 	if err != nil {
@@ -139,7 +383,10 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 			fmt.Println("Error decode base64 ", err)
 			return err
 		}
-		the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive)
+		if peer, err := the_device.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive, peerconf.Queue); err == nil && peerconf.Disabled {
+			peer.SetDisabled(true)
+		}
+		graph.SetBandwidth(peerconf.NodeID, peerconf.Bandwidth)
 		if peerconf.EndPoint != "" {
 			peer := the_device.LookupPeer(pk)
 			err = peer.SetEndpointFromConnURL(peerconf.EndPoint, 0, econfig.AfPrefer, peerconf.Static)
@@ -151,9 +398,16 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	}
 
 	if econfig.DynamicRoute.SuperNode.UseSuperNode {
+		if econfig.DynamicRoute.WaitForSupernode > 0 {
+			if err := waitForSupernode(econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl, mtypes.S2TD(econfig.DynamicRoute.WaitForSupernode), logger); err != nil {
+				return err
+			}
+		}
 		S4 := true
 		S6 := true
-		if econfig.DynamicRoute.SuperNode.EndpointV4 != "" {
+		// with ControlTransport http, the supernode isn't a peer, RoutineRegister polls it
+		superPeer := econfig.DynamicRoute.SuperNode.ControlTransport != mtypes.ControlTransportHTTP
+		if superPeer && use4 && econfig.DynamicRoute.SuperNode.EndpointV4 != "" {
 			pk, err := device.Str2PubKey(econfig.DynamicRoute.SuperNode.PubKeyV4)
 			if err != nil {
 				fmt.Println("Error decode base64 ", err)
@@ -164,7 +418,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 				fmt.Println("Error decode base64 ", err)
 				return err
 			}
-			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
+			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0, mtypes.PeerQueueInfo{})
 			if err != nil {
 				return err
 			}
@@ -175,7 +429,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 				S4 = false
 			}
 		}
-		if econfig.DynamicRoute.SuperNode.EndpointV6 != "" {
+		if superPeer && use6 && econfig.DynamicRoute.SuperNode.EndpointV6 != "" {
 			pk, err := device.Str2PubKey(econfig.DynamicRoute.SuperNode.PubKeyV6)
 			if err != nil {
 				fmt.Println("Error decode base64 ", err)
@@ -185,7 +439,7 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 				fmt.Println("Error decode base64 ", err)
 				return err
 			}
-			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0)
+			peer, err := the_device.NewPeer(pk, mtypes.NodeID_SuperNode, true, 0, mtypes.PeerQueueInfo{})
 			if err != nil {
 				return err
 			}
@@ -201,13 +455,22 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		}
 	}
 
+	restorePeerSnapshot(the_device, econfig.AfPrefer, logger)
+
 	logger.Verbosef("Device started")
 
 	errs := make(chan error)
 	term := make(chan os.Signal, 1)
+	upgrade := make(chan os.Signal, 1)
 
+	var uapi net.Listener
 	if useUAPI {
-		startUAPI(NodeName, logger, the_device, errs)
+		uapi, _ = startUAPI(NodeName, logger, the_device, errs)
+	}
+
+	var healthListener net.Listener
+	if econfig.ListenPort_Health != "" {
+		healthListener = HealthServer(econfig.ListenPort_Health, the_device, errs)
 	}
 
 	if econfig.PostScript != "" {
@@ -229,31 +492,42 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 		envs["EG_INTERFACE_TYPE"] = econfig.Interface.IType
 		envs["EG_INTERFACE_MAC_PREFIX"] = econfig.Interface.MacAddrPrefix
 		envs["EG_INTERFACE_MAC_ADDR"] = MacAddr.String()
-
-		cmdarg, err := shlex.Split(econfig.PostScript)
-		if err != nil {
-			return fmt.Errorf("error parse PostScript %v", err)
-		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
-		}
-		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
-		cmd.Env = os.Environ()
-		for k, v := range envs {
-			cmd.Env = append(cmd.Env, k+"="+v)
+		envs["EG_LISTEN_PORT"] = fmt.Sprintf("%d", econfig.ListenPort)
+		if econfig.DynamicRoute.SuperNode.UseSuperNode {
+			envs["EG_SUPERNODE_URL"] = econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl
 		}
-		out, err := cmd.CombinedOutput()
+		cleanup, err := postScriptJSON(envs, "EG_PEERS", postScriptPeerList(the_device.SnapshotPeers()))
 		if err != nil {
-			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
+			return err
 		}
-		if econfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
+		err = runPostScript(econfig.PostScript, envs, econfig.LogLevel.LogInternal)
+		cleanup()
+		if err != nil {
+			return err
 		}
 	}
 
+	if onChange := newOnChangeHook(econfig.OnChangeScript, econfig.LogLevel.LogInternal, func(envs map[string]string) (func(), error) {
+		envs["EG_MODE"] = "edge"
+		envs["EG_NODE_NAME"] = econfig.NodeName
+		envs["EG_NODE_ID_INT_DEC"] = fmt.Sprintf("%d", econfig.NodeID)
+		return postScriptState(envs, map[string]interface{}{
+			"EG_NHTABLE": graph.GetNHTable(false),
+			"EG_PEERS":   postScriptPeerList(the_device.SnapshotPeers()),
+		})
+	}); onChange != nil {
+		go onChange.RoutineRun()
+		go func() {
+			for range the_device.Chan_NhTableChanged {
+				onChange.Notify()
+			}
+		}()
+	}
+
 	// wait for program to terminate
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
+	signal.Notify(upgrade, syscall.SIGUSR2)
 
 	the_device.Chan_Device_Initialized <- struct{}{}
 	mtypes.SdNotify(false, mtypes.SdNotifyReady)
@@ -261,15 +535,66 @@ func Edge(configPath string, useUAPI bool, printExample bool, bindmode string) (
 	if econfig.LogLevel.LogInternal {
 		fmt.Printf("Internal: SdNotify:%v err:%v\n", SdNotify, err)
 	}
+	upgradeNotifyReady()
 
-	select {
-	case <-term:
-	case <-errs:
-	case errcode := <-the_device.Wait():
-		if errcode != 0 {
-			return syscall.Errno(errcode)
+	for {
+		select {
+		case <-term:
+		case <-errs:
+		case errcode := <-the_device.Wait():
+			if errcode != 0 {
+				return syscall.Errno(errcode)
+			}
+		case NewNodeID := <-the_device.Chan_Renumbered:
+			// restart like the graceful upgrade, the new process takes the new NodeID from the env even if it's not saved
+			logger.Verbosef("Renumbered to %v, restarting", NewNodeID.ToString())
+			os.Setenv(ENV_EG_RENUMBERED, NewNodeID.ToString())
+			select {
+			case upgrade <- syscall.SIGUSR2:
+			default: // an upgrade is pending already
+			}
+			continue
+		case <-upgrade:
+			files := upgradeFilesOf(NodeName, the_device, uapi)
+			if tapFile, ok := thetap.(interface{ File() *os.File }); ok && econfig.Interface.IType == "tap" {
+				if file, err := dupFile(tapFile.File()); err == nil {
+					files = append(files, upgradeFile{name: "tap", file: file})
+				}
+			}
+			if tcpListener, ok := healthListener.(*net.TCPListener); ok {
+				if file, err := tcpListener.File(); err == nil {
+					files = append(files, upgradeFile{name: "http_health", file: file})
+				}
+			}
+			snapshot, _ := yaml.Marshal(the_device.SnapshotPeers())
+			if err := gracefulUpgrade(files, snapshot); err != nil {
+				logger.Errorf("Graceful upgrade failed: %v", err)
+				continue
+			}
+			logger.Verbosef("Handed over to the new process")
+			// Exit without closing the device, the sockets are shared with the new process now.
+			os.Exit(ExitSetupSuccess)
 		}
+		break
 	}
 	logger.Verbosef("Shutting down")
 	return
 }
+
+// postScriptPeer is a peer in EG_PEERS, the PSKey is not passed to the script
+type postScriptPeer struct {
+	NodeID   mtypes.Vertex
+	PubKey   string
+	EndPoint string
+	Static   bool
+}
+
+// postScriptPeerList converts the peers for EG_PEERS, sorted by NodeID
+func postScriptPeerList(peers []mtypes.PeerInfo) []postScriptPeer {
+	list := make([]postScriptPeer, 0, len(peers))
+	for _, p := range peers {
+		list = append(list, postScriptPeer{NodeID: p.NodeID, PubKey: p.PubKey, EndPoint: p.EndPoint, Static: p.Static})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].NodeID < list[j].NodeID })
+	return list
+}
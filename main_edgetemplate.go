@@ -0,0 +1,90 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func isRemoteEdgeTemplate(template string) bool {
+	return strings.HasPrefix(template, "http://") || strings.HasPrefix(template, "https://")
+}
+
+// fetchEdgeTemplate downloads the EdgeTemplate from the url and validates it.
+// Only https, the template goes into the config of every new peer. ${VAR} in it is not expanded,
+// the environment of the SuperNode is not for the remote to read.
+func fetchEdgeTemplate(url string) (econfig mtypes.EdgeConfig, err error) {
+	if !strings.HasPrefix(url, "https://") {
+		err = errors.New(url + ": EdgeTemplate must be https")
+		return
+	}
+	client := http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%v: %v", url, resp.Status)
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(body, &econfig); err != nil {
+		return econfig, fmt.Errorf("%v: %v", url, err)
+	}
+	if econfig.Interface.IType == "" {
+		return econfig, errors.New(url + ": Interface.IType is empty, not an edge config")
+	}
+	return econfig, nil
+}
+
+// loadEdgeTemplate reads the EdgeTemplate for peer/add at startup. It's a local file or a http(s) url.
+// The example edge config is used if it's empty or failed.
+func loadEdgeTemplate(template string) mtypes.EdgeConfig {
+	if !isRemoteEdgeTemplate(template) {
+		econfig, _ := gencfg.GetExampleEdgeConf(template, true)
+		return econfig
+	}
+	econfig, err := fetchEdgeTemplate(template)
+	if err != nil {
+		fmt.Printf("Error fetch EdgeTemplate: %v\n", err)
+		econfig, _ = gencfg.GetExampleEdgeConf("", true)
+	}
+	return econfig
+}
+
+// RoutineFetchEdgeTemplate fetches the remote EdgeTemplate every interval, so the edge config can be managed centrally.
+// The last good one is kept if the fetch or the validation failed.
+func RoutineFetchEdgeTemplate(url string, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		econfig, err := fetchEdgeTemplate(url)
+		if err != nil {
+			fmt.Printf("Error fetch EdgeTemplate, keep the last one: %v\n", err)
+			continue
+		}
+		httpobj.Lock()
+		*httpobj.http_econfig_tmp = econfig
+		httpobj.Unlock()
+		if httpobj.http_sconfig.LogLevel.LogInternal {
+			fmt.Printf("Internal: EdgeTemplate %v fetched\n", url)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const eventLogFlushInterval = 10 * time.Second
+
+// superEvents is the EventLogFile of the supernode, nil if there is none
+var superEvents *eventLog
+
+// eventLog appends the registers, pongs and recalculations seen by the supernode to SuperConfig.EventLogFile,
+// one CSV line per event, for replaying them offline with -replay.
+type eventLog struct {
+	file *os.File
+	w    *bufio.Writer
+	sync.Mutex
+}
+
+func newEventLog(filename string) (*eventLog, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("EventLogFile: %v", err)
+	}
+	return &eventLog{file: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (l *eventLog) record(event mtypes.SuperEvent) {
+	if l == nil {
+		return
+	}
+	event.Time = time.Now()
+	l.Lock()
+	defer l.Unlock()
+	l.w.WriteString(event.ToCSV() + "\n")
+}
+
+func (l *eventLog) flush() error {
+	if l == nil {
+		return nil
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.w.Flush()
+}
+
+func (l *eventLog) close() {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.w.Flush()
+	l.file.Close()
+}
+
+// RoutineFlushEventLog writes the buffered events to EventLogFile periodically
+func RoutineFlushEventLog(l *eventLog) {
+	for {
+		time.Sleep(eventLogFlushInterval)
+		if err := l.flush(); err != nil {
+			fmt.Printf("Error: EventLogFile: %v\n", err)
+		}
+	}
+}
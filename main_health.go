@@ -0,0 +1,119 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Health check endpoints, no password required.
+// /healthz: the process is up
+// /readyz:  edge: connected to the supernode and received the NhTable. super: UDP listener is up and the graph is initialized
+// /metrics: edge: the dedup window, suppressed duplicates per source, and the outbound queue and endpoint of each peer
+//           super: the cost of the NhTable recalculations
+
+func http_healthz(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func edge_readyz(the_device *device.Device) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := the_device.Ready(); err != nil {
+			http_error(w, http.StatusServiceUnavailable, mtypes.API_ErrNotReady, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	}
+}
+
+func edge_metrics(the_device *device.Device) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics, _ := json.Marshal(the_device.Metrics())
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write(metrics)
+	}
+}
+
+func super_metrics(w http.ResponseWriter, r *http.Request) {
+	httpobj.RLock()
+	graph := httpobj.http_graph
+	httpobj.RUnlock()
+	var metrics mtypes.SuperMetrics
+	if graph != nil {
+		metrics.Recalc = graph.RecalcStats()
+	}
+	ret, _ := json.Marshal(metrics)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+func super_readyz(w http.ResponseWriter, r *http.Request) {
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	if httpobj.http_graph == nil {
+		http_error(w, http.StatusServiceUnavailable, mtypes.API_ErrNotReady, "Graph not initialized")
+		return
+	}
+	listening := func(d *device.Device) bool {
+		ports := d.ListenPorts()
+		return len(ports) > 0 && ports[0] != 0
+	}
+	if httpobj.http_device4 != nil && httpobj.http_sconfig.PrivKeyV4 != "" && !listening(httpobj.http_device4) {
+		http_error(w, http.StatusServiceUnavailable, mtypes.API_ErrNotReady, "IPv4 UDP listener is not up")
+		return
+	}
+	if httpobj.http_device6 != nil && httpobj.http_sconfig.PrivKeyV6 != "" && !listening(httpobj.http_device6) {
+		http_error(w, http.StatusServiceUnavailable, mtypes.API_ErrNotReady, "IPv6 UDP listener is not up")
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// waitForSupernode polls /readyz of the supernode until it's ready, so the edges started together with it don't fail
+func waitForSupernode(apiurl string, timeout time.Duration, logger *device.Logger) error {
+	client := http.Client{
+		Timeout: 3 * time.Second,
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		resp, err := client.Get(apiurl + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("%v", resp.Status)
+		}
+		if time.Now().Add(time.Second).After(deadline) {
+			return fmt.Errorf("supernode %v not ready after %v: %v", apiurl, timeout, err)
+		}
+		logger.Verbosef("Waiting for supernode %v: %v", apiurl, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func HealthServer(listen string, the_device *device.Device, errchan chan error) net.Listener {
+	if len(listen) > 0 && listen[0] != ':' {
+		listen = ":" + listen
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", http_healthz)
+	mux.HandleFunc("/readyz", edge_readyz(the_device))
+	mux.HandleFunc("/metrics", edge_metrics(the_device))
+	return httpListenAndServe("http_health", listen, mux, errchan)
+}
@@ -6,11 +6,17 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"strconv"
 	"strings"
@@ -18,6 +24,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"net"
 	"net/http"
 	"net/url"
 
@@ -32,18 +39,20 @@ import (
 )
 
 type http_shared_objects struct {
-	http_graph         *path.IG
-	http_device4       *device.Device
-	http_device6       *device.Device
-	http_HashSalt      []byte
-	http_NhTable_Hash  string
-	http_PeerInfo_hash string
-	http_NhTableStr    []byte
-	http_PeerInfo      mtypes.API_Peers
-	http_super_chains  *mtypes.SUPER_Events
-	http_pskdb         device.PSKDB
-
-	http_passwords       mtypes.Passwords
+	http_graph            *path.IG
+	http_device4          *device.Device
+	http_device6          *device.Device
+	http_HashSalt         []byte
+	http_NhTable          atomic.Value // *nhTableState, written by PushNewNhTable which may run under RLock
+	http_NhTable_push     sync.Mutex   // serializes PushNewNhTable, so an older NhTable never replaces a newer one
+	http_PeerInfo_hash    string
+	http_PeerInfo         mtypes.API_Peers
+	http_PeerInfo_history []peerInfoSnapshot // the last http_PeerInfo, for peer/diff
+	http_super_chains     *mtypes.SUPER_Events
+	http_pskdb            device.PSKDB
+	http_peerstore        PeerStore
+
+	http_passwords       atomic.Value // mtypes.Passwords, read by authorize without the lock
 	http_StateExpire     time.Time
 	http_StateString_tmp []byte
 
@@ -51,9 +60,16 @@ type http_shared_objects struct {
 	http_PeerState   map[string]*PeerState //the state hash reported by peer
 	http_PeerIPs     map[string]*HttpPeerLocalIP
 
+	http_NhTable_Stale  PeerSet // peers which haven't acked the hash of http_NhTable yet
+	http_PeerInfo_Stale PeerSet // peers which haven't acked http_PeerInfo_hash yet
+	http_ControlConns   ControlConns
+	http_maintenance    device.AtomicBool  // don't push anything to the edges
+	http_signing_key    ed25519.PrivateKey // signs UpdateNhTable and UpdatePeer, nil if SigningKey is empty
+
 	http_sconfig *mtypes.SuperConfig
 
 	http_sconfig_path string
+	http_sconfig_env  bool // the config file has ${VAR}, so it's never written back
 	http_econfig_tmp  *mtypes.EdgeConfig
 
 	sync.RWMutex
@@ -69,17 +85,38 @@ type HttpPeerLocalIP struct {
 }
 
 type HttpState struct {
-	PeerInfo map[mtypes.Vertex]HttpPeerInfo
-	Infinity float64
-	Edges    map[mtypes.Vertex]map[mtypes.Vertex]float64
-	Edges_Nh map[mtypes.Vertex]map[mtypes.Vertex]float64
-	NhTable  mtypes.NextHopTable
-	Dist     mtypes.DistTable
+	PeerInfo     map[mtypes.Vertex]HttpPeerInfo
+	Infinity     float64
+	Edges        map[mtypes.Vertex]map[mtypes.Vertex]float64
+	Edges_Nh     map[mtypes.Vertex]map[mtypes.Vertex]float64
+	NhTable      mtypes.NextHopTable
+	Dist         mtypes.DistTable
+	CipherSuite  mtypes.CipherSuite
+	ExternalCost mtypes.DistTable                    // overrides of Edges from ExternalCostFile, not measured
+	Inject       map[mtypes.Vertex]mtypes.API_Inject // faults injected by peer/inject, included in Edges
+	Maintenance  bool
+	Messages     map[string]mtypes.MessageStats // control messages of the v4 and v6 device
+	Asymmetric   []mtypes.AsymmetricLink        // pairs of nodes reachable in one direction only, for AsymmetricTimeout
+	AdminDown    []mtypes.AdminDownLink         // edges taken out of routing by peer/admindown, measured in Edges still
+	Suspect      []mtypes.SuspectLink           // edges penalized by SuspectPeriod, included in Edges
+}
+
+// HttpFreeze is the part of the SuperConfig returned by super/freeze, ready to paste into a static mode config
+type HttpFreeze struct {
+	NextHopTable            mtypes.NextHopTable `yaml:"NextHopTable"`
+	GraphRecalculateSetting HttpFreezeSetting   `yaml:"GraphRecalculateSetting"`
+}
+
+type HttpFreezeSetting struct {
+	StaticMode    bool             `yaml:"StaticMode"`
+	ManualLatency mtypes.DistTable `yaml:"ManualLatency"` // the edges measured now(ms)
 }
 
 type HttpPeerInfo struct {
 	Name     string
 	LastSeen string
+	Version  string
+	Tags     []string
 }
 
 type PeerState struct {
@@ -90,6 +127,97 @@ type PeerState struct {
 	JETSecret             atomic.Value // mtypes.JWTSecret
 	httpPostCount         atomic.Value // uint64
 	LastSeen              atomic.Value // time.Time
+	Version               atomic.Value // string
+	ListenPorts           atomic.Value // []uint16
+	DataPort              atomic.Value // uint16
+	PollIP                atomic.Value // string, the address of the last poll with ControlTransport http
+	pollTime              atomic.Value // int64, the Time of the last poll
+	postTime              atomic.Value // int64, the Time of the last post to /edge/post/nodeinfo signed with the PSKey
+	nhPollTime            atomic.Value // int64, the Time of the last poll to /edge/nhtable with Since
+}
+
+// PeerSet is a set of PubKeys, safe for concurrent use.
+type PeerSet struct {
+	peers map[string]struct{}
+	sync.Mutex
+}
+
+func (s *PeerSet) Add(PubKey string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.peers == nil {
+		s.peers = make(map[string]struct{})
+	}
+	s.peers[PubKey] = struct{}{}
+}
+
+// AddAll adds every peer in PeerStates, used after the hash changed.
+func (s *PeerSet) AddAll(PeerStates map[string]*PeerState) {
+	s.Lock()
+	defer s.Unlock()
+	if s.peers == nil {
+		s.peers = make(map[string]struct{}, len(PeerStates))
+	}
+	for PubKey := range PeerStates {
+		s.peers[PubKey] = struct{}{}
+	}
+}
+
+func (s *PeerSet) Del(PubKey string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.peers, PubKey)
+}
+
+func (s *PeerSet) List() []string {
+	s.Lock()
+	defer s.Unlock()
+	ret := make([]string, 0, len(s.peers))
+	for PubKey := range s.peers {
+		ret = append(ret, PubKey)
+	}
+	return ret
+}
+
+// ControlConns is the TCP control channels of the EdgeNodes by PubKey, safe for concurrent use.
+type ControlConns struct {
+	conns map[string]*device.ControlConn
+	sync.Mutex
+}
+
+func (c *ControlConns) Get(PubKey string) *device.ControlConn {
+	c.Lock()
+	defer c.Unlock()
+	return c.conns[PubKey]
+}
+
+// Set replaces the control channel of the EdgeNode, and returns the old one.
+func (c *ControlConns) Set(PubKey string, cc *device.ControlConn) *device.ControlConn {
+	c.Lock()
+	defer c.Unlock()
+	if c.conns == nil {
+		c.conns = make(map[string]*device.ControlConn)
+	}
+	old := c.conns[PubKey]
+	c.conns[PubKey] = cc
+	return old
+}
+
+// Del removes the control channel of the EdgeNode, only if it's still cc.
+func (c *ControlConns) Del(PubKey string, cc *device.ControlConn) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conns[PubKey] == cc {
+		delete(c.conns, PubKey)
+	}
+}
+
+// http_error writes an API_Error in json.
+func http_error(w http.ResponseWriter, status int, code string, message string) {
+	body, _ := json.Marshal(mtypes.API_Error{Code: code, Message: message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
 }
 
 func extractParamsStr(params url.Values, key string, w http.ResponseWriter) (string, error) {
@@ -97,8 +225,7 @@ func extractParamsStr(params url.Values, key string, w http.ResponseWriter) (str
 	if !has {
 		errstr := fmt.Sprintf("Paramater %v: Missing paramater.", key)
 		if w != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(errstr))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, errstr)
 		}
 		return "", fmt.Errorf(errstr)
 	}
@@ -114,8 +241,7 @@ func extractParamsFloat(params url.Values, key string, bitSize int, w http.Respo
 	if err != nil {
 		errstr := fmt.Sprintf("Paramater %v: Can't convert to type float%v", key, bitSize)
 		if w != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(errstr))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, errstr)
 		}
 		return 0, fmt.Errorf(errstr)
 	}
@@ -131,8 +257,7 @@ func extractParamsUint(params url.Values, key string, bitSize int, w http.Respon
 	if err != nil {
 		errstr := fmt.Sprintf("Paramater %v: Can't convert to type uint%v", key, bitSize)
 		if w != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(errstr))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, errstr)
 		}
 		return 0, fmt.Errorf(errstr)
 	}
@@ -151,8 +276,11 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 	// No lock
 	api_peerinfo = make(mtypes.API_Peers)
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
-		connV4 := httpobj.http_device4.GetConnurl(peerinfo.NodeID)
-		connV6 := httpobj.http_device6.GetConnurl(peerinfo.NodeID)
+		if peerinfo.Disabled {
+			continue
+		}
+		connV4 := deviceConnurl(httpobj.http_device4, peerinfo.NodeID)
+		connV6 := deviceConnurl(httpobj.http_device6, peerinfo.NodeID)
 
 		if peerinfo.ExternalIP != "" {
 			ExternalIP := peerinfo.ExternalIP
@@ -177,20 +305,30 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 			}
 		}
 
+		if len(connV4)+len(connV6) == 0 {
+			connV4, connV6 = pollConnurl(peerinfo.PubKey)
+		}
 		if len(connV4)+len(connV6) == 0 {
 			continue
 		}
 		api_peerinfo[peerinfo.PubKey] = mtypes.API_Peerinfo{
-			NodeID:  peerinfo.NodeID,
-			PSKey:   peerinfo.PSKey,
-			Connurl: &mtypes.API_connurl{},
+			NodeID:              peerinfo.NodeID,
+			PSKey:               peerinfo.PSKey,
+			PersistentKeepalive: peerinfo.PersistentKeepalive,
+			Connurl:             &mtypes.API_connurl{},
 		}
 		if httpobj.http_PeerState[peerinfo.PubKey].LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
+			ListenPorts := httpobj.http_PeerState[peerinfo.PubKey].ListenPorts.Load().([]uint16)
+			if DataPort := httpobj.http_PeerState[peerinfo.PubKey].DataPort.Load().(uint16); DataPort != 0 {
+				connV4 = dataPortConnurl(connV4, DataPort)
+				connV6 = dataPortConnurl(connV6, DataPort)
+				ListenPorts = nil
+			}
 			if connV4 != "" {
-				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 = map[string]float64{connV4: 4}
+				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV4 = extraPortsConnurl(connV4, ListenPorts, 4)
 			}
 			if connV6 != "" {
-				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV6 = map[string]float64{connV6: 6}
+				api_peerinfo[peerinfo.PubKey].Connurl.ExternalV6 = extraPortsConnurl(connV6, ListenPorts, 6)
 			}
 			if !peerinfo.SkipLocalIP {
 				api_peerinfo[peerinfo.PubKey].Connurl.LocalV4 = httpobj.http_PeerIPs[peerinfo.PubKey].LocalIPv4
@@ -204,10 +342,50 @@ func get_api_peers(old_State_hash string) (api_peerinfo mtypes.API_Peers, StateH
 	StateHash = hash_str
 	if old_State_hash != StateHash {
 		changed = true
+		recordPeerInfo(StateHash, api_peerinfo)
 	}
 	return
 }
 
+// pollConnurl is the endpoint of a peer with ControlTransport http, which the devices have never seen.
+// It's the address of its last poll with its first listen port, assuming NAT doesn't change the port like dataPortConnurl.
+func pollConnurl(PubKey string) (connV4 string, connV6 string) {
+	IP := net.ParseIP(httpobj.http_PeerState[PubKey].PollIP.Load().(string))
+	ListenPorts := httpobj.http_PeerState[PubKey].ListenPorts.Load().([]uint16)
+	if IP == nil || len(ListenPorts) == 0 {
+		return
+	}
+	connurl := net.JoinHostPort(IP.String(), strconv.Itoa(int(ListenPorts[0])))
+	if IP.To4() != nil {
+		return connurl, ""
+	}
+	return "", connurl
+}
+
+// extraPortsConnurl adds the endpoints of the extra listen ports to the external endpoint of the first one.
+// We never see the extra ports from outside, so it's assumed that NAT doesn't change them, like dataPortConnurl.
+func extraPortsConnurl(connurl string, ListenPorts []uint16, priority float64) map[string]float64 {
+	ret := map[string]float64{connurl: priority}
+	host, _, err := net.SplitHostPort(connurl)
+	if err != nil {
+		return ret
+	}
+	for i := 1; i < len(ListenPorts); i++ {
+		ret[net.JoinHostPort(host, strconv.Itoa(int(ListenPorts[i])))] = priority + float64(i)
+	}
+	return ret
+}
+
+// dataPortConnurl replaces the port of the external endpoint seen by the supernode, which is the control port, with the data port.
+// We never see the data port from outside, so it's assumed that NAT doesn't change it, like a forwarded port.
+func dataPortConnurl(connurl string, DataPort uint16) string {
+	host, _, err := net.SplitHostPort(connurl)
+	if err != nil {
+		return connurl
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(DataPort)))
+}
+
 func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 	// Read all params
 	params := r.URL.Query()
@@ -224,33 +402,28 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if NodeID >= mtypes.NodeID_Special {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Can't use special nodeID.")
 		return
 	}
 	// Authentication
 	httpobj.RLock()
 	defer httpobj.RUnlock()
 	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
 		return
 	}
 	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
 		return
 	}
 
 	if _, has := httpobj.http_PeerState[PubKey]; !has {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author."))
+		http_error(w, http.StatusInternalServerError, mtypes.API_ErrInternal, "Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author.")
 		return
 	}
 
 	if httpobj.http_PeerState[PubKey].SuperParamState.Load().(string) != State {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater State: State not correct"))
+		http_error(w, http.StatusConflict, mtypes.API_ErrStateMismatch, "Paramater State: State not correct")
 		return
 	}
 	// Do something
@@ -260,6 +433,7 @@ func edge_get_superparams(w http.ResponseWriter, r *http.Request) {
 		PeerAliveTimeout:  httpobj.http_sconfig.PeerAliveTimeout,
 		AdditionalCost:    httpobj.http_PeerID2Info[NodeID].AdditionalCost,
 		DampingResistance: httpobj.http_sconfig.DampingResistance,
+		TTLMargin:         httpobj.http_sconfig.TTLMargin,
 	}
 	SuperParamStr, _ := json.Marshal(SuperParams)
 	httpobj.http_PeerState[PubKey].SuperParamStateClient.Store(State)
@@ -284,36 +458,32 @@ func edge_get_peerinfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if NodeID >= mtypes.NodeID_Special {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Can't use special nodeID.")
 		return
 	}
 	// Authentication
 	httpobj.RLock()
 	defer httpobj.RUnlock()
 	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
 		return
 	}
 	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
 		return
 	}
 	if httpobj.http_PeerInfo_hash != State {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater State: State not correct"))
+		http_error(w, http.StatusConflict, mtypes.API_ErrStateMismatch, "Paramater State: State not correct")
 		return
 	}
 	if _, has := httpobj.http_PeerState[PubKey]; !has {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author."))
+		http_error(w, http.StatusInternalServerError, mtypes.API_ErrInternal, "Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author.")
 		return
 	}
 
 	// Do something
 	httpobj.http_PeerState[PubKey].PeerInfoState.Store(State)
+	httpobj.http_PeerInfo_Stale.Del(PubKey)
 	http_PeerInfo_2peer := make(mtypes.API_Peers)
 
 	for PeerPubKey, peerinfo := range httpobj.http_PeerInfo {
@@ -346,47 +516,272 @@ func edge_get_nhtable(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
-	State, err := extractParamsStr(params, "State", w)
-	if err != nil {
-		return
+	// State is the hash pushed by UpdateNhTable. Or Since, the hash of the NhTable the edge has, when it polls without a push.
+	// The polls are signed with the PSKey, as they mark the edge up to date.
+	var State, Sig string
+	var Time uint64
+	Since, poll := params["Since"]
+	if !poll {
+		State, err = extractParamsStr(params, "State", w)
+		if err != nil {
+			return
+		}
+	} else {
+		Time, err = extractParamsUint(params, "Time", 63, w)
+		if err != nil {
+			return
+		}
+		Sig, err = extractParamsStr(params, "Sig", w)
+		if err != nil {
+			return
+		}
 	}
 	NodeID, err := extractParamsVertex(params, "NodeID", w)
 	if err != nil {
 		return
 	}
 	if NodeID >= mtypes.NodeID_Special {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Can't use special nodeID.")
 		return
 	}
 	// Authentication
 	httpobj.RLock()
 	defer httpobj.RUnlock()
 	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
 		return
 	}
 	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater PubKey: NodeID and PubKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
 		return
 	}
-	if httpobj.http_NhTable_Hash != State {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("Paramater State: State not correct"))
+	if _, has := httpobj.http_PeerState[PubKey]; !has {
+		http_error(w, http.StatusInternalServerError, mtypes.API_ErrInternal, "Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author.")
 		return
 	}
-	if _, has := httpobj.http_PeerState[PubKey]; !has {
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write([]byte("Paramater PubKey: Not found in httpobj.http_PeerState, this shouldn't happen. Please report to the author."))
+	NhTable := nhTableCurrent()
+	if poll {
+		peerstate := httpobj.http_PeerState[PubKey]
+		if httpobj.http_PeerID2Info[NodeID].PSKey == "" {
+			http_error(w, http.StatusForbidden, mtypes.API_ErrForbidden, "PSKey of this peer is not set at the supernode, it's required by Paramater Since")
+			return
+		}
+		if code, err := checkPollSig(httpobj.http_PeerID2Info[NodeID].PSKey, int64(Time), Sig, []byte(Since[0]), peerstate.nhPollTime.Load().(int64)); err != nil {
+			http_error(w, http.StatusBadRequest, code, err.Error())
+			return
+		}
+		peerstate.nhPollTime.Store(int64(Time))
+		// nothing new while nothing is pushed
+		if Since[0] == NhTable.Hash || httpobj.http_sconfig.Observer || httpobj.http_maintenance.Get() {
+			if Since[0] == NhTable.Hash {
+				httpobj.http_PeerState[PubKey].NhTableState.Store(Since[0])
+				httpobj.http_NhTable_Stale.Del(PubKey)
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		State = NhTable.Hash
+		w.Header().Set(device.NhTableStateHeader, State)
+	} else if NhTable.Hash != State {
+		http_error(w, http.StatusConflict, mtypes.API_ErrStateMismatch, "Paramater State: State not correct")
 		return
 	}
 
 	httpobj.http_PeerState[PubKey].NhTableState.Store(State)
+	httpobj.http_NhTable_Stale.Del(PubKey)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(device.NhTableSaltHeader, base64.StdEncoding.EncodeToString(httpobj.http_HashSalt))
+	w.WriteHeader(http.StatusOK)
+	w.Write(NhTable.Str)
+}
+
+// edge_control upgrades the connection to a TCP control channel, see device.ControlConn.
+func edge_control(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	NodeID, err := extractParamsVertex(params, "NodeID", w)
+	if err != nil {
+		return
+	}
+	PubKey, err := extractParamsStr(params, "PubKey", w)
+	if err != nil {
+		return
+	}
+	if NodeID >= mtypes.NodeID_Special {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Can't use special nodeID.")
+		return
+	}
+	if r.Header.Get("Upgrade") != device.ControlUpgrade {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Header Upgrade: must be "+device.ControlUpgrade)
+		return
+	}
+	pk, err := device.Str2PubKey(PubKey)
+	if err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidPubKey, "Paramater PubKey: "+err.Error())
+		return
+	}
+	httpobj.RLock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	httpobj.RUnlock()
+	if !has || peerinfo.PubKey != PubKey {
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http_error(w, http.StatusInternalServerError, mtypes.API_ErrInternal, "Connection can't be upgraded")
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	challenge := mtypes.RandomBytes(device.ControlChallengeLen, []byte(PubKey))
+	conn.SetDeadline(time.Now().Add(device.ControlDialTimeout))
+	fmt.Fprintf(bufrw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: %v\r\nConnection: Upgrade\r\n%v: %v\r\n\r\n", device.ControlUpgrade, device.ControlChallengeHeader, base64.StdEncoding.EncodeToString(challenge))
+	if err := bufrw.Flush(); err != nil {
+		return
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(bufrw, mac); err != nil {
+		return
+	}
+	var the_device *device.Device
+	var peer *device.Peer
+	for _, d := range super_devices() {
+		if p := d.LookupPeerByStr(PubKey); p != nil && hmac.Equal(d.ControlAuth(pk, challenge), mac) {
+			the_device, peer = d, p
+			break
+		}
+	}
+	if peer == nil {
+		if httpobj.http_sconfig.LogLevel.LogControl {
+			fmt.Printf("Control: TCP control channel of %v from %v: auth failed\n", NodeID.ToString(), httpProxy.clientAddr(r))
+		}
+		return
+	}
+	cc := device.NewControlConn(the_device, conn, bufrw.Reader)
+	if old := httpobj.http_ControlConns.Set(PubKey, cc); old != nil {
+		old.Close()
+	}
+	defer httpobj.http_ControlConns.Del(PubKey, cc)
+	if httpobj.http_sconfig.LogLevel.LogControl {
+		fmt.Printf("Control: TCP control channel of %v connected from %v\n", NodeID.ToString(), httpProxy.clientAddr(r))
+	}
+	for {
+		usage, packet, err := cc.Recv(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout))
+		if err != nil {
+			if httpobj.http_sconfig.LogLevel.LogControl {
+				fmt.Printf("Control: TCP control channel of %v closed: %v\n", NodeID.ToString(), err)
+			}
+			return
+		}
+		if usage != path.Register && usage != path.PongPacket {
+			continue
+		}
+		if err := the_device.ProcessControl(peer, usage, packet); err != nil && httpobj.http_sconfig.LogLevel.LogInternal {
+			fmt.Printf("Internal: Process TCP control message from %v failed: %v\n", NodeID.ToString(), err)
+		}
+	}
+}
+
+// edge_poll is the register of the EdgeNodes with ControlTransport http, which receive nothing from the supernode.
+// The body is the RegisterMsg, signed by mtypes.PollSig with the PSKey of the peer. The reply is the RegisterReplyMsg in json,
+// and the EdgeNode downloads what changed by the state hashes in it, as if they were pushed.
+// The hashes are empty if the supernode doesn't push them now, in maintenance mode or as an observer.
+func edge_poll(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	NodeID, err := extractParamsVertex(params, "NodeID", w)
+	if err != nil {
+		return
+	}
+	PubKey, err := extractParamsStr(params, "PubKey", w)
+	if err != nil {
+		return
+	}
+	Time, err := extractParamsUint(params, "Time", 63, w)
+	if err != nil {
+		return
+	}
+	Sig, err := extractParamsStr(params, "Sig", w)
+	if err != nil {
+		return
+	}
+	if NodeID >= mtypes.NodeID_Special {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Can't use special nodeID.")
+		return
+	}
+	client_body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: Error reading request body: %v", err))
+		return
+	}
+
+	httpobj.RLock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has || peerinfo.PubKey != PubKey {
+		httpobj.RUnlock()
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "Paramater PubKey: NodeID and PubKey are not match")
+		return
+	}
+	peerstate := httpobj.http_PeerState[PubKey]
+	if peerinfo.PSKey == "" {
+		httpobj.RUnlock()
+		http_error(w, http.StatusForbidden, mtypes.API_ErrForbidden, "PSKey of this peer is not set at the supernode, it's required by ControlTransport "+mtypes.ControlTransportHTTP)
+		return
+	}
+	if code, err := checkPollSig(peerinfo.PSKey, int64(Time), Sig, client_body, peerstate.pollTime.Load().(int64)); err != nil {
+		httpobj.RUnlock()
+		http_error(w, http.StatusBadRequest, code, err.Error())
+		return
+	}
+	reg_msg, err := mtypes.ParseRegisterMsg(client_body)
+	if err != nil {
+		httpobj.RUnlock()
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: Error parsing request body: %v", err))
+		return
+	}
+	if check := device.RegisterCheck(httpobj.http_sconfig, Version, NodeID, reg_msg); check.Action != mtypes.NoAction {
+		httpobj.RUnlock()
+		http_error(w, http.StatusForbidden, mtypes.API_ErrForbidden, check.Params)
+		return
+	}
+	peerstate.pollTime.Store(int64(Time))
+	if host, _, err := net.SplitHostPort(httpProxy.clientAddr(r)); err == nil {
+		peerstate.PollIP.Store(host)
+	}
+	reply := registerReplyOf(peerinfo, reg_msg)
+	if httpobj.http_sconfig.Observer || httpobj.http_maintenance.Get() {
+		reply.NhStateHash = ""
+		reply.PeerStateHash = ""
+	}
+	if httpobj.http_maintenance.Get() {
+		reply.SuperParamStateHash = ""
+	}
+	httpobj.RUnlock()
+	if httpobj.http_sconfig.LogLevel.LogControl {
+		fmt.Printf("Control: Recv %v From: %v(HTTP) IP:%v\n", reg_msg.ToString(), NodeID.ToString(), httpProxy.clientAddr(r))
+	}
+	httpobj.http_super_chains.Event_server_register <- reg_msg
+	ret, _ := json.Marshal(reply)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(httpobj.http_NhTableStr))
+	w.Write(ret)
+}
+
+// checkPollSig verifies the Sig of a request signed by mtypes.PollSig, and that its Time is in PollTimeWindow and newer than last.
+// It returns the error code for the 400 reply.
+func checkPollSig(PSKey string, Time int64, Sig string, body []byte, last int64) (string, error) {
+	if expected, err := mtypes.PollSig(PSKey, Time, body); err != nil || !hmac.Equal([]byte(expected), []byte(Sig)) {
+		return mtypes.API_ErrBadSignature, errors.New("Paramater Sig: Signature verification failed")
+	}
+	if skew := time.Since(time.Unix(0, Time)); skew > mtypes.PollTimeWindow || skew < -mtypes.PollTimeWindow {
+		return mtypes.API_ErrBadParam, fmt.Errorf("Paramater Time: %v away from the clock of the supernode", skew)
+	}
+	if Time <= last {
+		return mtypes.API_ErrBadParam, errors.New("Paramater Time: not newer than the last one")
+	}
+	return "", nil
 }
 
 func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
@@ -401,12 +796,19 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if NodeID >= mtypes.NodeID_Special {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Paramater NodeID: Can't use special nodeID."))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Can't use special nodeID.")
 		return
 	}
 
-	JWTSig, err := extractParamsStr(params, "JWTSig", w)
+	// ControlTransport http signs with the PSKey, as the polls don't send the JWTSecret
+	Sig := params.Get("Sig")
+	var JWTSig string
+	var Time uint64
+	if Sig != "" {
+		Time, err = extractParamsUint(params, "Time", 63, w)
+	} else {
+		JWTSig, err = extractParamsStr(params, "JWTSig", w)
+	}
 	if err != nil {
 		return
 	}
@@ -414,13 +816,11 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 	httpobj.RLock()
 	defer httpobj.RUnlock()
 	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("NodeID and PunKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "NodeID and PunKey are not match")
 		return
 	}
 	if httpobj.http_PeerID2Info[NodeID].PubKey != PubKey {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("NodeID and PunKey are not match"))
+		http_error(w, http.StatusForbidden, mtypes.API_ErrPubKeyMismatch, "NodeID and PunKey are not match")
 		return
 	}
 
@@ -429,58 +829,70 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 
 	client_body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Request body: Error reading request body: %v", err)))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: Error reading request body: %v", err))
 		return
 	}
 
-	token_claims := mtypes.API_report_peerinfo_jwt_claims{}
+	client_PostCount := httpPostCount.Load().(uint64)
+	if Sig != "" {
+		peerstate := httpobj.http_PeerState[PubKey]
+		if httpobj.http_PeerID2Info[NodeID].PSKey == "" {
+			http_error(w, http.StatusForbidden, mtypes.API_ErrForbidden, "PSKey of this peer is not set at the supernode, it's required by Paramater Sig")
+			return
+		}
+		if code, err := checkPollSig(httpobj.http_PeerID2Info[NodeID].PSKey, int64(Time), Sig, client_body, peerstate.postTime.Load().(int64)); err != nil {
+			http_error(w, http.StatusBadRequest, code, err.Error())
+			return
+		}
+		peerstate.postTime.Store(int64(Time))
+	} else {
+		// a zero JWTSecret is known by anyone, it's not registered yet, or registered by a poll
+		if JWTSecret.Load().(mtypes.JWTSecret) == (mtypes.JWTSecret{}) {
+			http_error(w, http.StatusForbidden, mtypes.API_ErrForbidden, "Paramater JWTSig: No JWTSecret registered by this peer, sign with Sig")
+			return
+		}
+		token_claims := mtypes.API_report_peerinfo_jwt_claims{}
 
-	token, err := jwt.ParseWithClaims(string(JWTSig), &token_claims, func(token *jwt.Token) (interface{}, error) {
-		// Don't forget to validate the alg is what you expect:
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		token, err := jwt.ParseWithClaims(string(JWTSig), &token_claims, func(token *jwt.Token) (interface{}, error) {
+			// Don't forget to validate the alg is what you expect:
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+			JWTSecretB := JWTSecret.Load().(mtypes.JWTSecret)
+			return JWTSecretB[:], nil
+		})
+		if err != nil {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadSignature, fmt.Sprintf("Paramater JWTSig: Signature verification failed: %v", err))
+			return
+		}
+		if !token.Valid {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadSignature, "Paramater JWTSig: Signature verification failed: Invalid token")
+			return
 		}
-		JWTSecretB := JWTSecret.Load().(mtypes.JWTSecret)
-		return JWTSecretB[:], nil
-	})
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Paramater JWTSig: Signature verification failed: %v", err)))
-		return
-	}
-	if !token.Valid {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Paramater JWTSig: Signature verification failed: Invalid token"))
-		return
-	}
 
-	client_PostCount := token_claims.PostCount
-	client_body_hash := token_claims.BodyHash
+		client_PostCount = token_claims.PostCount
+		client_body_hash := token_claims.BodyHash
 
-	if client_PostCount < httpPostCount.Load().(uint64) {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Request body: postcount too small: %v", httpPostCount)))
-		return
-	}
+		if client_PostCount < httpPostCount.Load().(uint64) {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: postcount too small: %v", httpPostCount))
+			return
+		}
 
-	calculated_body_hash := sha3.Sum512(client_body)
-	if base64.StdEncoding.EncodeToString(calculated_body_hash[:]) == client_body_hash {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Request body: hash not match: %v", client_body_hash)))
-		return
+		calculated_body_hash := sha3.Sum512(client_body)
+		if base64.StdEncoding.EncodeToString(calculated_body_hash[:]) == client_body_hash {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: hash not match: %v", client_body_hash))
+			return
+		}
 	}
 
 	client_body, err = mtypes.GUzip(client_body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Request body: gzip unzip failed"))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, "Request body: gzip unzip failed")
 		return
 	}
 	client_report, err := mtypes.ParseAPI_report_peerinfo(client_body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte(fmt.Sprintf("Request body: Error parsing request body: %v", err)))
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: Error parsing request body: %v", err))
 		return
 	}
 
@@ -503,19 +915,13 @@ func edge_post_nodeinfo(w http.ResponseWriter, r *http.Request) {
 			}
 			applied_pones = append(applied_pones, pong_msg)
 			if httpobj.http_sconfig.LogLevel.LogControl {
-				fmt.Printf("Control: Recv %v S:%v D:%v From: %v(HTTP) IP:%v\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), r.RemoteAddr)
+				fmt.Printf("Control: Recv %v S:%v D:%v From: %v(HTTP) IP:%v\n", pong_msg.ToString(), pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString(), NodeID.ToString(), httpProxy.clientAddr(r))
 			}
 		}
 	}
 	changed := httpobj.http_graph.UpdateLatencyMulti(applied_pones, true, true)
 	if changed {
-		NhTable := httpobj.http_graph.GetNHTable(true)
-		NhTablestr, _ := json.Marshal(NhTable)
-		md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
-		new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-		httpobj.http_NhTable_Hash = new_hash_str
-		httpobj.http_NhTableStr = NhTablestr
-		PushNhTable(false)
+		PushNewNhTable(httpobj.http_graph, "nodeinfo from "+NodeID.ToString())
 	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
@@ -547,25 +953,33 @@ func checkPassword(s1 string, s2 string) bool {
 
 func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.ShowState) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	if !authorize(w, r, params, mtypes.ScopeShowState) {
 		return
 	}
 	httpobj.RLock()
 	defer httpobj.RUnlock()
 	if time.Now().After(httpobj.http_StateExpire) {
 		hs := HttpState{
-			PeerInfo: make(map[mtypes.Vertex]HttpPeerInfo),
-			NhTable:  httpobj.http_graph.GetNHTable(false),
-			Infinity: mtypes.Infinity,
-			Edges:    httpobj.http_graph.GetEdges(false, false),
-			Edges_Nh: httpobj.http_graph.GetEdges(true, true),
-			Dist:     httpobj.http_graph.GetDtst(),
+			PeerInfo:     make(map[mtypes.Vertex]HttpPeerInfo),
+			NhTable:      httpobj.http_graph.GetNHTable(false),
+			Infinity:     mtypes.Infinity,
+			Edges:        httpobj.http_graph.GetEdges(false, false),
+			Edges_Nh:     httpobj.http_graph.GetEdges(true, true),
+			Dist:         httpobj.http_graph.GetDtst(),
+			CipherSuite:  device.GetCipherSuite(),
+			ExternalCost: httpobj.http_graph.GetExternalCost(),
+			Inject:       httpobj.http_graph.GetInject(),
+			Maintenance:  httpobj.http_maintenance.Get(),
+			Asymmetric:   httpobj.http_graph.Asymmetric(),
+			AdminDown:    httpobj.http_graph.AdminDown(),
+			Suspect:      httpobj.http_graph.Suspect(),
+			Messages:     make(map[string]mtypes.MessageStats),
+		}
+		if httpobj.http_device4 != nil {
+			hs.Messages[mtypes.AddressFamilyV4] = httpobj.http_device4.MessageStats()
+		}
+		if httpobj.http_device6 != nil {
+			hs.Messages[mtypes.AddressFamilyV6] = httpobj.http_device6.MessageStats()
 		}
 
 		for _, peerinfo := range httpobj.http_sconfig.Peers {
@@ -573,6 +987,8 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 			hs.PeerInfo[peerinfo.NodeID] = HttpPeerInfo{
 				Name:     peerinfo.Name,
 				LastSeen: LastSeenStr,
+				Version:  httpobj.http_PeerState[peerinfo.PubKey].Version.Load().(string),
+				Tags:     peerinfo.Tags,
 			}
 		}
 		httpobj.http_StateExpire = time.Now().Add(5 * time.Second)
@@ -582,15 +998,67 @@ func manage_get_peerstate(w http.ResponseWriter, r *http.Request) {
 	w.Write(httpobj.http_StateString_tmp)
 }
 
-func manage_peeradd(w http.ResponseWriter, r *http.Request) {
+// manage_freeze returns the current NhTable and the measured edges as a static mode config
+func manage_freeze(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
+	if !authorize(w, r, params, mtypes.ScopeShowState) {
 		return
 	}
-	if !checkPassword(password, httpobj.http_passwords.AddPeer) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	nhTable := httpobj.http_graph.GetNHTable(false)
+	routes := 0
+	for _, dsts := range nhTable {
+		routes += len(dsts)
+	}
+	if routes == 0 {
+		http_error(w, http.StatusServiceUnavailable, mtypes.API_ErrNotReady, "NhTable is empty, nothing to freeze")
+		return
+	}
+	latency := make(mtypes.DistTable)
+	for src, dsts := range httpobj.http_graph.GetRoutedEdges(false) {
+		latency[src] = make(map[mtypes.Vertex]float64, len(dsts))
+		for dst, cost := range dsts {
+			latency[src][dst] = cost * 1000
+		}
+	}
+	ret, _ := yaml.Marshal(HttpFreeze{
+		NextHopTable: nhTable,
+		GraphRecalculateSetting: HttpFreezeSetting{
+			StaticMode:    true,
+			ManualLatency: latency,
+		},
+	})
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "# Frozen at %v, NhTable hash %v\n", time.Now().Format(time.RFC3339), nhTableCurrent().Hash)
+	w.Write(ret)
+}
+
+func manage_peerlist(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeShowState) {
+		return
+	}
+	Tag := params.Get("Tag")
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	peers := make([]mtypes.SuperPeerInfo, 0, len(httpobj.http_sconfig.Peers))
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		if Tag != "" && !mtypes.HasTag(peerinfo.Tags, Tag) {
+			continue
+		}
+		peerinfo.PSKey = ""
+		peers = append(peers, peerinfo)
+	}
+	ret, _ := json.Marshal(peers)
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+func manage_peeradd(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeAddPeer) {
 		return
 	}
 
@@ -613,6 +1081,10 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	if _, err := device.Str2PubKey(PubKey); err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidPubKey, fmt.Sprintf("Paramater PubKey: %v", err))
+		return
+	}
 
 	SkipLocalIPS, err := extractParamsStr(r.Form, "SkipLocalIP", w)
 	if err != nil {
@@ -623,87 +1095,122 @@ func manage_peeradd(w http.ResponseWriter, r *http.Request) {
 
 	PSKey, _ := extractParamsStr(r.Form, "PSKey", nil)
 
+	TagsS, _ := extractParamsStr(r.Form, "Tags", nil)
+	Tags := mtypes.ParseTags(TagsS)
+
+	PersistentKeepalive, _ := extractParamsUint(r.Form, "PersistentKeepalive", 16, nil)
+
+	Zone, _ := extractParamsStr(r.Form, "Zone", nil)
+
+	newpeer := mtypes.SuperPeerInfo{
+		NodeID:              NodeID,
+		Name:                Name,
+		PubKey:              PubKey,
+		PSKey:               PSKey,
+		AdditionalCost:      AdditionalCost,
+		SkipLocalIP:         SkipLocalIP,
+		Tags:                Tags,
+		PersistentKeepalive: uint32(PersistentKeepalive),
+		Zone:                Zone,
+	}
+
 	httpobj.Lock()
 	defer httpobj.Unlock()
 
+	if PSKey == "" && httpobj.http_sconfig.AddressFamily == mtypes.AddressFamilyNone {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater PSKey: Required in AddressFamily "+mtypes.AddressFamilyNone+", the EdgeNodes poll with it")
+		return
+	}
 	for _, peerinfo := range httpobj.http_sconfig.Peers {
 		if peerinfo.NodeID == NodeID {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Paramater NodeID: NodeID exists"))
+			http_error(w, http.StatusConflict, mtypes.API_ErrPeerExists, "Paramater NodeID: NodeID exists")
 			return
 		}
 		if peerinfo.Name == Name {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Paramater Name: Node name exists"))
+			http_error(w, http.StatusConflict, mtypes.API_ErrPeerExists, "Paramater Name: Node name exists")
 			return
 		}
 		if peerinfo.PubKey == PubKey {
-			w.WriteHeader(http.StatusConflict)
-			w.Write([]byte("Paramater PubKey: PubKey exists"))
+			http_error(w, http.StatusConflict, mtypes.API_ErrPeerExists, "Paramater PubKey: PubKey exists")
 			return
 		}
 	}
+	peers := append(append([]mtypes.SuperPeerInfo{}, httpobj.http_sconfig.Peers...), newpeer)
+	if err := checkZones(peers, httpobj.http_sconfig.GraphRecalculateSetting.Algorithm); err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Zone: %v", err))
+		return
+	}
 	if httpobj.http_sconfig.GraphRecalculateSetting.StaticMode {
 		NhTableStr := r.Form.Get("NextHopTable")
 		if NhTableStr == "" {
-			w.WriteHeader(http.StatusExpectationFailed)
-			w.Write([]byte("Paramater NextHopTable: Your NextHopTable is in static mode.\nPlease provide your new NextHopTable in \"NextHopTable\" parmater in json format"))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidNhTable, "Paramater NextHopTable: Your NextHopTable is in static mode. Please provide your new NextHopTable in \"NextHopTable\" parmater in json format")
 			return
 		}
 		var NewNhTable mtypes.NextHopTable
 		err := json.Unmarshal([]byte(NhTableStr), &NewNhTable)
 		if err != nil {
-			w.WriteHeader(http.StatusExpectationFailed)
-			w.Write([]byte(fmt.Sprintf("Paramater NextHopTable: \"%v\", %v", NhTableStr, err)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidNhTable, fmt.Sprintf("Paramater NextHopTable: \"%v\", %v", NhTableStr, err))
 			return
 		}
-		err = checkNhTable(NewNhTable, append(httpobj.http_sconfig.Peers, mtypes.SuperPeerInfo{
-			NodeID:         NodeID,
-			Name:           Name,
-			PubKey:         PubKey,
-			PSKey:          PSKey,
-			AdditionalCost: AdditionalCost,
-			SkipLocalIP:    SkipLocalIP,
-		}))
+		err = checkNhTable(NewNhTable, peers)
 		if err != nil {
-			w.WriteHeader(http.StatusExpectationFailed)
-			w.Write([]byte(fmt.Sprintf("Paramater nexthoptable: \"%v\", %v", NhTableStr, err)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidNhTable, fmt.Sprintf("Paramater nexthoptable: \"%v\", %v", NhTableStr, err))
 			return
 		}
 		httpobj.http_graph.SetNHTable(NewNhTable)
 	}
-	err = super_peeradd(mtypes.SuperPeerInfo{
-		NodeID:         NodeID,
-		Name:           Name,
-		PubKey:         PubKey,
-		PSKey:          PSKey,
-		AdditionalCost: AdditionalCost,
-		SkipLocalIP:    SkipLocalIP,
-	})
+	err = super_peeradd(newpeer)
 	if err != nil {
-		w.WriteHeader(http.StatusExpectationFailed)
-		w.Write([]byte(fmt.Sprintf("Error creating peer: %v", err)))
+		http_error(w, http.StatusInternalServerError, mtypes.API_ErrInternal, fmt.Sprintf("Error creating peer: %v", err))
 		return
 	}
-	httpobj.http_sconfig.Peers = append(httpobj.http_sconfig.Peers, mtypes.SuperPeerInfo{
-		NodeID:         NodeID,
-		Name:           Name,
-		PubKey:         PubKey,
-		PSKey:          PSKey,
-		AdditionalCost: AdditionalCost,
-		SkipLocalIP:    SkipLocalIP,
-	})
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
-	httpobj.http_econfig_tmp.NodeID = NodeID
-	httpobj.http_econfig_tmp.NodeName = Name
-	httpobj.http_econfig_tmp.PrivKey = "Your_Private_Key"
-	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.PSKey = PSKey
-	httpobj.http_econfig_tmp.DynamicRoute.AdditionalCost = AdditionalCost
-	httpobj.http_econfig_tmp.DynamicRoute.SuperNode.SkipLocalIP = SkipLocalIP
-	httpobj.http_econfig_tmp.NextHopTable = make(mtypes.NextHopTable)
-	httpobj.http_econfig_tmp.Peers = make([]mtypes.PeerInfo, 0)
-	ret_str_byte, _ := yaml.Marshal(&httpobj.http_econfig_tmp)
+	httpobj.http_sconfig.Peers = peers
+	saveSuperConfig()
+	ret_str_byte, _ := yaml.Marshal(edgeConfigOf(httpobj.http_PeerID2Info[NodeID], r))
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret_str_byte)
+}
+
+// edgeConfigOf renders the EdgeConfig of the peer from the EdgeTemplate. httpobj must be locked.
+// The supernode doesn't know the private key, so PrivKey is a placeholder. Peers and NextHopTable are pushed by the supernode.
+func edgeConfigOf(peerinfo mtypes.SuperPeerInfo, r *http.Request) *mtypes.EdgeConfig {
+	econfig := *httpobj.http_econfig_tmp
+	econfig.NodeID = peerinfo.NodeID
+	econfig.NodeName = peerinfo.Name
+	econfig.PrivKey = "Your_Private_Key"
+	econfig.DynamicRoute.SuperNode.PSKey = peerinfo.PSKey
+	econfig.DynamicRoute.AdditionalCost = peerinfo.AdditionalCost
+	econfig.DynamicRoute.SuperNode.SkipLocalIP = peerinfo.SkipLocalIP
+	econfig.NextHopTable = make(mtypes.NextHopTable)
+	econfig.Peers = make([]mtypes.PeerInfo, 0)
+	if econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl == "" {
+		econfig.DynamicRoute.SuperNode.EndpointEdgeAPIUrl = httpProxy.externalURL(r, httpobj.http_sconfig)
+	}
+	if httpobj.http_sconfig.AddressFamily == mtypes.AddressFamilyNone {
+		econfig.DynamicRoute.SuperNode.ControlTransport = mtypes.ControlTransportHTTP
+	}
+	return &econfig
+}
+
+// manage_edgeconfig downloads the EdgeConfig of an existing peer, the same one returned by peer/add
+func manage_edgeconfig(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeAddPeer) {
+		return
+	}
+	NodeID, err := extractParamsVertex(params, "NodeID", w)
+	if err != nil {
+		return
+	}
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	peerinfo, has := httpobj.http_PeerID2Info[NodeID]
+	if !has {
+		http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID))
+		return
+	}
+	ret_str_byte, _ := yaml.Marshal(edgeConfigOf(peerinfo, r))
+	w.Header().Set("Content-Type", "application/x-yaml")
 	w.WriteHeader(http.StatusOK)
 	w.Write(ret_str_byte)
 }
@@ -715,13 +1222,7 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	var err error
 	var NodeID mtypes.Vertex
 
-	password, err := extractParamsStr(params, "Password", w)
-	if err != nil {
-		return
-	}
-	if !checkPassword(password, httpobj.http_passwords.UpdatePeer) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	if !authorize(w, r, params, mtypes.ScopeUpdatePeer) {
 		return
 	}
 	NodeID, err = extractParamsVertex(params, "NodeID", w)
@@ -732,8 +1233,7 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	httpobj.Lock()
 	defer httpobj.Unlock()
 	if _, has := httpobj.http_PeerID2Info[toUpdate]; !has {
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
+		http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID))
 		return
 	}
 	PubKey := httpobj.http_PeerID2Info[toUpdate].PubKey
@@ -752,18 +1252,71 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 		new_superpeerinfo.SkipLocalIP = SkipLocalIPVal
 
 	}
+	TagsS, err := extractParamsStr(r.Form, "Tags", nil)
+	if err == nil {
+		new_superpeerinfo.Tags = mtypes.ParseTags(TagsS)
+		Updated_params["Tags"] = strings.Join(new_superpeerinfo.Tags, ",")
+	}
+	PersistentKeepalive, err := extractParamsUint(r.Form, "PersistentKeepalive", 16, nil)
+	if err == nil {
+		Updated_params["PersistentKeepalive"] = fmt.Sprintf("%v", PersistentKeepalive)
+		new_superpeerinfo.PersistentKeepalive = uint32(PersistentKeepalive)
+		for _, d := range super_devices() {
+			if peer := d.LookupPeerByStr(PubKey); peer != nil {
+				peer.SetPersistentKeepalive(new_superpeerinfo.PersistentKeepalive)
+			}
+		}
+	}
+	DisabledS, err := extractParamsStr(r.Form, "Disabled", nil)
+	if err == nil {
+		DisabledVal, err := strconv.ParseBool(DisabledS)
+		if err != nil {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Disabled: Can't convert to type bool : %v", DisabledS))
+			return
+		}
+		Updated_params["Disabled"] = fmt.Sprintf("%v", DisabledVal)
+		new_superpeerinfo.Disabled = DisabledVal
+	}
+	Bandwidth, err := extractParamsFloat(r.Form, "Bandwidth", 64, nil)
+	if err == nil {
+		if Bandwidth < 0 {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Bandwidth must >= 0 : %v", Bandwidth))
+			return
+		}
+		Updated_params["Bandwidth"] = fmt.Sprintf("%v", Bandwidth)
+		new_superpeerinfo.Bandwidth = Bandwidth
+	}
+	Zone, err := extractParamsStr(r.Form, "Zone", nil)
+	if err == nil {
+		Updated_params["Zone"] = Zone
+		new_superpeerinfo.Zone = Zone
+	}
 	if len(Updated_params) == 0 {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("NodeID: " + toUpdate.ToString() + " , no any paramater updated.\n"))
 		return
 	}
 
+	var peers_new []mtypes.SuperPeerInfo
+	for _, peerinfo := range httpobj.http_sconfig.Peers {
+		if peerinfo.NodeID == toUpdate {
+			peers_new = append(peers_new, new_superpeerinfo)
+		} else {
+			peers_new = append(peers_new, peerinfo)
+		}
+	}
+	if err := checkZones(peers_new, httpobj.http_sconfig.GraphRecalculateSetting.Algorithm); err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Zone or Tags: %v", err))
+		return
+	}
+
 	httpobj.http_PeerID2Info[toUpdate] = new_superpeerinfo
 	SuperParams := mtypes.API_SuperParams{
 		SendPingInterval:  httpobj.http_sconfig.SendPingInterval,
 		HttpPostInterval:  httpobj.http_sconfig.HttpPostInterval,
 		PeerAliveTimeout:  httpobj.http_sconfig.PeerAliveTimeout,
 		DampingResistance: httpobj.http_sconfig.DampingResistance,
+		TTLMargin:         httpobj.http_sconfig.TTLMargin,
 		AdditionalCost:    new_superpeerinfo.AdditionalCost,
 	}
 
@@ -772,17 +1325,40 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	new_hash_str := hex.EncodeToString(md5_hash_raw[:])
 	httpobj.http_PeerState[PubKey].SuperParamState.Store(new_hash_str)
 
-	var peers_new []mtypes.SuperPeerInfo
-	for _, peerinfo := range httpobj.http_sconfig.Peers {
-		if peerinfo.NodeID == toUpdate {
-			peers_new = append(peers_new, new_superpeerinfo)
-		} else {
-			peers_new = append(peers_new, peerinfo)
+	httpobj.http_sconfig.Peers = peers_new
+	if gateway := mtypes.HasTag(new_superpeerinfo.Tags, mtypes.TagGateway); httpobj.http_graph.IsGateway(toUpdate) != gateway {
+		// the default routes of other edges move to it, or away from it
+		httpobj.http_graph.SetGateway(toUpdate, gateway)
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "peer/update "+toUpdate.ToString())
 		}
 	}
-	httpobj.http_sconfig.Peers = peers_new
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+	if httpobj.http_graph.Bandwidth(toUpdate) != new_superpeerinfo.Bandwidth {
+		httpobj.http_graph.SetBandwidth(toUpdate, new_superpeerinfo.Bandwidth)
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "peer/update "+toUpdate.ToString())
+		}
+	}
+	if zone, border := httpobj.http_graph.Zone(toUpdate); zone != new_superpeerinfo.Zone || border != mtypes.HasTag(new_superpeerinfo.Tags, mtypes.TagBorder) {
+		httpobj.http_graph.SetZone(toUpdate, new_superpeerinfo.Zone, mtypes.HasTag(new_superpeerinfo.Tags, mtypes.TagBorder))
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "peer/update "+toUpdate.ToString())
+		}
+	}
+	if httpobj.http_graph.IsDisabled(toUpdate) != new_superpeerinfo.Disabled {
+		// route around it and tell other edges to drop it, or bring it back
+		httpobj.http_graph.SetDisabled(toUpdate, new_superpeerinfo.Disabled)
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "peer/update "+toUpdate.ToString())
+		}
+		var peer_state_changed bool
+		httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, peer_state_changed = get_api_peers(httpobj.http_PeerInfo_hash)
+		if peer_state_changed {
+			httpobj.http_PeerInfo_Stale.AddAll(httpobj.http_PeerState)
+			PushPeerinfo(false)
+		}
+	}
+	saveSuperConfig()
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("NodeID: " + toUpdate.ToString() + " updated following values:\n"))
 	for k, v := range Updated_params {
@@ -790,18 +1366,199 @@ func manage_peerupdate(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func manage_superupdate(w http.ResponseWriter, r *http.Request) {
+func manage_peerrenumber(w http.ResponseWriter, r *http.Request) {
 	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeUpdatePeer) {
+		return
+	}
+	NodeID, err := extractParamsVertex(params, "NodeID", w)
+	if err != nil {
+		return
+	}
+	r.ParseForm()
+	NewNodeID, err := extractParamsVertex(r.Form, "NewNodeID", w)
+	if err != nil {
+		return
+	}
+	if NewNodeID >= mtypes.NodeID_Special {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NewNodeID: Can't use special nodeID.")
+		return
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	if _, has := httpobj.http_PeerID2Info[NodeID]; !has {
+		http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID))
+		return
+	}
+	if _, has := httpobj.http_PeerID2Info[NewNodeID]; has {
+		http_error(w, http.StatusConflict, mtypes.API_ErrPeerExists, "Paramater NewNodeID: NodeID exists")
+		return
+	}
+	if httpobj.http_graph.Vertices()[NewNodeID] {
+		// a deleted peer may be still in the graph until its edges are gone, don't mix its latencies in
+		http_error(w, http.StatusConflict, mtypes.API_ErrPeerExists, "Paramater NewNodeID: NodeID is still in the graph")
+		return
+	}
+	super_peerrenumber(NodeID, NewNodeID)
+	saveSuperConfig()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("NodeID: " + NodeID.ToString() + " renumbered to " + NewNodeID.ToString() + "."))
+}
 
+func manage_inject(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeInject) {
+		return
+	}
 	var err error
+	NodeID := mtypes.NodeID_Broadcast
+	if params.Get("NodeID") != "" {
+		NodeID, err = extractParamsVertex(params, "NodeID", w)
+		if err != nil {
+			return
+		}
+		httpobj.RLock()
+		_, has := httpobj.http_PeerID2Info[NodeID]
+		httpobj.RUnlock()
+		if !has {
+			http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID))
+			return
+		}
+	}
+
+	r.ParseForm()
+	Reset, _ := extractParamsStr(r.Form, "Reset", nil)
+	if strings.EqualFold(Reset, "true") {
+		httpobj.http_graph.ResetInject(NodeID)
+		httpobj.RLock()
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "peer/inject "+NodeID.ToString())
+		}
+		httpobj.RUnlock()
+	} else if r.Form.Get("Latency") != "" || r.Form.Get("Jitter") != "" || r.Form.Get("Loss") != "" {
+		if NodeID == mtypes.NodeID_Broadcast {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, "Paramater NodeID: Missing paramater.")
+			return
+		}
+		var inject mtypes.API_Inject
+		if Latency, err := extractParamsFloat(r.Form, "Latency", 64, nil); err == nil {
+			inject.Latency = Latency
+		}
+		if Jitter, err := extractParamsFloat(r.Form, "Jitter", 64, nil); err == nil {
+			inject.Jitter = Jitter
+		}
+		if Loss, err := extractParamsFloat(r.Form, "Loss", 64, nil); err == nil {
+			inject.Loss = Loss
+		}
+		if inject.Latency < 0 || inject.Jitter < 0 {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Latency %v, Jitter %v: Must >= 0.", inject.Latency, inject.Jitter))
+			return
+		}
+		if inject.Loss < 0 || inject.Loss > 1 {
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Loss %v: Must in range [0,1]", inject.Loss))
+			return
+		}
+		httpobj.http_graph.SetInject(NodeID, inject)
+	}
+	ret, _ := json.Marshal(httpobj.http_graph.GetInject())
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
+
+func manage_admindown(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeUpdatePeer) {
+		return
+	}
+	r.ParseForm()
+	Reset, _ := extractParamsStr(r.Form, "Reset", nil)
+	AdminDown, _ := extractParamsStr(r.Form, "AdminDown", nil)
+	if strings.EqualFold(Reset, "true") || AdminDown != "" {
+		var down bool
+		switch strings.ToLower(AdminDown) {
+		case "true":
+			down = true
+		case "false", "":
+			down = false
+		default:
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater AdminDown %v: Must be true or false", AdminDown))
+			return
+		}
+		var Src, Dst mtypes.Vertex
+		var err error
+		if AdminDown != "" {
+			if Src, err = extractParamsVertex(params, "Src", w); err != nil {
+				return
+			}
+			if Dst, err = extractParamsVertex(params, "Dst", w); err != nil {
+				return
+			}
+			httpobj.RLock()
+			_, hasSrc := httpobj.http_PeerID2Info[Src]
+			_, hasDst := httpobj.http_PeerID2Info[Dst]
+			httpobj.RUnlock()
+			if !hasSrc || !hasDst {
+				http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater Src: \"%v\" or Dst: \"%v\" not found", Src, Dst))
+				return
+			}
+			httpobj.http_graph.SetEdgeAdminDown(Src, Dst, down)
+		} else {
+			httpobj.http_graph.ResetEdgeAdminDown(mtypes.NodeID_Broadcast)
+		}
+		httpobj.RLock()
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "peer/admindown")
+		}
+		httpobj.RUnlock()
+	}
+	ret, _ := json.Marshal(httpobj.http_graph.AdminDown())
+	w.WriteHeader(http.StatusOK)
+	w.Write(ret)
+}
 
-	password, err := extractParamsStr(params, "Password", w)
+func manage_maintenance(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeUpdateSuper) {
+		return
+	}
+	r.ParseForm()
+	Maintenance, err := extractParamsStr(r.Form, "Maintenance", w)
 	if err != nil {
 		return
 	}
-	if !checkPassword(password, httpobj.http_passwords.UpdateSuper) {
-		w.WriteHeader(http.StatusUnauthorized)
-		w.Write([]byte("Paramater Password: Wrong password"))
+	var on bool
+	switch strings.ToLower(Maintenance) {
+	case "on":
+		on = true
+	case "off":
+		on = false
+	default:
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater Maintenance %v: Must be on or off", Maintenance))
+		return
+	}
+	if was := httpobj.http_maintenance.Swap(on); was != on {
+		if httpobj.http_sconfig.LogLevel.LogControl {
+			fmt.Printf("Control: Maintenance mode: %v\n", Maintenance)
+		}
+		if !on {
+			// edges may have missed any number of updates, push everything once
+			httpobj.RLock()
+			PushNhTable(true)
+			PushPeerinfo(true)
+			PushServerParams(true)
+			httpobj.RUnlock()
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(fmt.Sprintf("Maintenance: %v\n", strings.ToLower(Maintenance))))
+}
+
+func manage_superupdate(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	var err error
+
+	if !authorize(w, r, params, mtypes.ScopeUpdateSuper) {
 		return
 	}
 
@@ -817,8 +1574,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	PeerAliveTimeout, err := extractParamsFloat(r.Form, "PeerAliveTimeout", 64, nil)
 	if err == nil {
 		if PeerAliveTimeout <= 0 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater PeerAliveTimeout %v: Must > 0.\n", PeerAliveTimeout)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater PeerAliveTimeout %v: Must > 0.", PeerAliveTimeout))
 			return
 		}
 		Updated_params["PeerAliveTimeout"] = fmt.Sprintf("%v", PeerAliveTimeout)
@@ -828,8 +1584,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	DampingResistance, err := extractParamsFloat(r.Form, "DampingResistance", 64, nil)
 	if err == nil {
 		if DampingResistance < 0 || DampingResistance >= 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater DampingResistance %v: Must in range [0,1)\n", DampingResistance)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater DampingResistance %v: Must in range [0,1)", DampingResistance))
 			return
 		}
 		Updated_params["DampingResistance"] = fmt.Sprintf("%v", DampingResistance)
@@ -839,8 +1594,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	SendPingInterval, err := extractParamsFloat(r.Form, "SendPingInterval", 64, nil)
 	if err == nil {
 		if SendPingInterval <= 0 || SendPingInterval >= sconfig_temp.PeerAliveTimeout {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater SendPingInterval: Must > 0 and < %v(PeerAliveTimeout).\n", sconfig_temp.PeerAliveTimeout)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater SendPingInterval: Must > 0 and < %v(PeerAliveTimeout).", sconfig_temp.PeerAliveTimeout))
 			return
 		}
 		Updated_params["SendPingInterval"] = fmt.Sprintf("%v", SendPingInterval)
@@ -849,8 +1603,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 	HttpPostInterval, err := extractParamsFloat(r.Form, "HttpPostInterval", 64, nil)
 	if err == nil {
 		if SendPingInterval <= 0 || SendPingInterval >= sconfig_temp.PeerAliveTimeout {
-			w.WriteHeader(http.StatusBadRequest)
-			w.Write([]byte(fmt.Sprintf("Paramater HttpPostInterval: Must > 0 and < %v(PeerAliveTimeout).\n", sconfig_temp.PeerAliveTimeout)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrBadParam, fmt.Sprintf("Paramater HttpPostInterval: Must > 0 and < %v(PeerAliveTimeout).", sconfig_temp.PeerAliveTimeout))
 			return
 		}
 		Updated_params["HttpPostInterval"] = fmt.Sprintf("%v", HttpPostInterval)
@@ -873,6 +1626,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 		HttpPostInterval:  httpobj.http_sconfig.HttpPostInterval,
 		PeerAliveTimeout:  httpobj.http_sconfig.PeerAliveTimeout,
 		DampingResistance: httpobj.http_sconfig.DampingResistance,
+		TTLMargin:         httpobj.http_sconfig.TTLMargin,
 		AdditionalCost:    10,
 	}
 	httpobj.Lock()
@@ -886,8 +1640,7 @@ func manage_superupdate(w http.ResponseWriter, r *http.Request) {
 		httpobj.http_PeerState[PubKey].SuperParamState.Store(new_hash_str)
 	}
 
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+	saveSuperConfig()
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Supernode: updated following values:\n"))
 	for k, v := range Updated_params {
@@ -903,24 +1656,20 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	var NodeID mtypes.Vertex
 	var PrivKey string
 	var PubKey string
-	password, pwderr := extractParamsStr(params, "Password", nil)
+	_, pwderr := extractParamsStr(params, "Password", nil)
 	httpobj.Lock()
 	defer httpobj.Unlock()
-	if pwderr == nil { // user provide the password
-		if checkPassword(password, httpobj.http_passwords.DelPeer) {
-			NodeID, err = extractParamsVertex(params, "NodeID", w)
-			if err != nil {
-				return
-			}
-			toDelete = NodeID
-			if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
-				w.WriteHeader(http.StatusNotFound)
-				w.Write([]byte(fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID)))
-				return
-			}
-		} else {
-			w.WriteHeader(http.StatusUnauthorized)
-			w.Write([]byte("Paramater Password: Wrong password"))
+	if pwderr == nil || bearerToken(r) != "" { // user provide the password or a token
+		if !authorize(w, r, params, mtypes.ScopeDelPeer) {
+			return
+		}
+		NodeID, err = extractParamsVertex(params, "NodeID", w)
+		if err != nil {
+			return
+		}
+		toDelete = NodeID
+		if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
+			http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater NodeID: \"%v\" not found", NodeID))
 			return
 		}
 	} else { // user don't provide the password
@@ -930,8 +1679,7 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 		}
 		privk, err := device.Str2PriKey(PrivKey)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(fmt.Sprintf("Paramater PrivKey: %v", err)))
+			http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidPrivKey, fmt.Sprintf("Paramater PrivKey: %v", err))
 			return
 		}
 		pubk := privk.PublicKey()
@@ -942,8 +1690,7 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if toDelete == mtypes.NodeID_Broadcast {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(fmt.Sprintf("Paramater PrivKey: \"%v\" not found", PubKey)))
+			http_error(w, http.StatusNotFound, mtypes.API_ErrPeerNotFound, fmt.Sprintf("Paramater PrivKey: \"%v\" not found", PubKey))
 			return
 		}
 	}
@@ -958,13 +1705,73 @@ func manage_peerdel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	httpobj.http_sconfig.Peers = peers_new
-	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
-	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+	saveSuperConfig()
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("NodeID: " + toDelete.ToString() + " deleted."))
 }
 
-func HttpServer(edgeListen string, manageListen string, apiprefix string, errchan chan error) {
+// httpShutdownTimeout bounds how long the in-flight API requests may take at shutdown
+const httpShutdownTimeout = 5 * time.Second
+
+// httpServers are the servers started by httpListenAndServe, for shutdownHttpServers
+var httpServers struct {
+	servers []*http.Server
+	sync.Mutex
+}
+
+func httpListenAndServe(name string, addr string, handler http.Handler, errchan chan error) net.Listener {
+	var listener net.Listener
+	var err error
+	if file, ok := inheritedFile(name); ok {
+		listener, err = net.FileListener(file)
+		file.Close()
+	} else {
+		if addr == "" {
+			addr = ":http"
+		}
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		errchan <- err
+		return nil
+	}
+	server := &http.Server{Handler: handler}
+	httpServers.Lock()
+	httpServers.servers = append(httpServers.servers, server)
+	httpServers.Unlock()
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			errchan <- err
+		}
+	}()
+	return listener
+}
+
+// shutdownHttpServers stops accepting new requests, and waits for the in-flight ones to complete for up to timeout.
+// The connections still active after that are closed.
+func shutdownHttpServers(timeout time.Duration) {
+	httpServers.Lock()
+	servers := httpServers.servers
+	httpServers.servers = nil
+	httpServers.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		}(server)
+	}
+	wg.Wait()
+}
+
+func HttpServer(edgeListen string, manageListen string, apiprefix string, errchan chan error) (listeners map[string]net.Listener) {
+	listeners = make(map[string]net.Listener)
 	if len(apiprefix) > 0 && apiprefix[0] != '/' {
 		apiprefix = "/" + apiprefix
 	}
@@ -980,18 +1787,27 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		mux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		mux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		mux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
+		mux.HandleFunc(apiprefix+"/edge/control", edge_control)
+		mux.HandleFunc(apiprefix+"/edge/poll", edge_poll)
+		mux.HandleFunc(apiprefix+"/manage/peer/list", manage_peerlist)
+		mux.HandleFunc(apiprefix+"/manage/peer/diff", manage_peerdiff)
 		mux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
 		mux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
+		mux.HandleFunc(apiprefix+"/manage/peer/edgeconfig", manage_edgeconfig)
 		mux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
+		mux.HandleFunc(apiprefix+"/manage/peer/renumber", manage_peerrenumber)
+		mux.HandleFunc(apiprefix+"/manage/peer/inject", manage_inject)
+		mux.HandleFunc(apiprefix+"/manage/peer/admindown", manage_admindown)
 		mux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
+		mux.HandleFunc(apiprefix+"/manage/super/freeze", manage_freeze)
 		mux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
+		mux.HandleFunc(apiprefix+"/manage/super/maintenance", manage_maintenance)
+		mux.HandleFunc(apiprefix+"/manage/super/config", manage_superconfig)
+		mux.HandleFunc(apiprefix+"/healthz", http_healthz)
+		mux.HandleFunc(apiprefix+"/readyz", super_readyz)
+		mux.HandleFunc(apiprefix+"/metrics", super_metrics)
 
-		go func() {
-			err := http.ListenAndServe(edgeListen, mux)
-			if err != nil {
-				errchan <- err
-			}
-		}()
+		listeners["http_edge"] = httpListenAndServe("http_edge", edgeListen, httpProxy.handler(mux), errchan)
 		return
 	} else {
 		edgemux := http.NewServeMux()
@@ -1000,27 +1816,33 @@ func HttpServer(edgeListen string, manageListen string, apiprefix string, errcha
 		edgemux.HandleFunc(apiprefix+"/edge/peerinfo", edge_get_peerinfo)
 		edgemux.HandleFunc(apiprefix+"/edge/nhtable", edge_get_nhtable)
 		edgemux.HandleFunc(apiprefix+"/edge/post/nodeinfo", edge_post_nodeinfo)
+		edgemux.HandleFunc(apiprefix+"/edge/control", edge_control)
+		edgemux.HandleFunc(apiprefix+"/edge/poll", edge_poll)
+		managemux.HandleFunc(apiprefix+"/manage/peer/list", manage_peerlist)
+		managemux.HandleFunc(apiprefix+"/manage/peer/diff", manage_peerdiff)
 		managemux.HandleFunc(apiprefix+"/manage/peer/add", manage_peeradd)
 		managemux.HandleFunc(apiprefix+"/manage/peer/del", manage_peerdel)
+		managemux.HandleFunc(apiprefix+"/manage/peer/edgeconfig", manage_edgeconfig)
 		managemux.HandleFunc(apiprefix+"/manage/peer/update", manage_peerupdate)
+		managemux.HandleFunc(apiprefix+"/manage/peer/renumber", manage_peerrenumber)
+		managemux.HandleFunc(apiprefix+"/manage/peer/inject", manage_inject)
+		managemux.HandleFunc(apiprefix+"/manage/peer/admindown", manage_admindown)
 		managemux.HandleFunc(apiprefix+"/manage/super/state", manage_get_peerstate)
+		managemux.HandleFunc(apiprefix+"/manage/super/freeze", manage_freeze)
 		managemux.HandleFunc(apiprefix+"/manage/super/update", manage_superupdate)
+		managemux.HandleFunc(apiprefix+"/manage/super/maintenance", manage_maintenance)
+		managemux.HandleFunc(apiprefix+"/manage/super/config", manage_superconfig)
+		edgemux.HandleFunc(apiprefix+"/healthz", http_healthz)
+		edgemux.HandleFunc(apiprefix+"/readyz", super_readyz)
+		managemux.HandleFunc(apiprefix+"/healthz", http_healthz)
+		managemux.HandleFunc(apiprefix+"/readyz", super_readyz)
+		managemux.HandleFunc(apiprefix+"/metrics", super_metrics)
 
-		go func() {
-			err := http.ListenAndServe(edgeListen, edgemux)
-			if err != nil {
-				errchan <- err
-			}
-		}()
+		listeners["http_edge"] = httpListenAndServe("http_edge", edgeListen, httpProxy.handler(edgemux), errchan)
 
 		if manageListen != "" {
-			go func() {
-				err := http.ListenAndServe(manageListen, managemux)
-				if err != nil {
-					errchan <- err
-				}
-			}()
+			listeners["http_manage"] = httpListenAndServe("http_manage", manageListen, httpProxy.handler(managemux), errchan)
 		}
 	}
-
+	return
 }
@@ -0,0 +1,39 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestCheckPollSig(t *testing.T) {
+	const PSKey = "yl/4SNFee7+kNekajVCrK0toqXJ4mlT4IN0klyAgyqU="
+	body := []byte("body")
+	now := time.Now().UnixNano()
+	sign := func(Time int64) string {
+		sig, _ := mtypes.PollSig(PSKey, Time, body)
+		return sig
+	}
+	if _, err := checkPollSig(PSKey, now, sign(now), body, 0); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if code, err := checkPollSig(PSKey, now, sign(now), []byte("other body"), 0); err == nil || code != mtypes.API_ErrBadSignature {
+		t.Errorf("other body: %v %v", code, err)
+	}
+	if code, err := checkPollSig("FJfjc+wRfk0FSuUkHlXl6D8xPzOKYdy3bxeYr5cpevQ=", now, sign(now), body, 0); err == nil || code != mtypes.API_ErrBadSignature {
+		t.Errorf("wrong PSKey: %v %v", code, err)
+	}
+	if _, err := checkPollSig(PSKey, now, sign(now), body, now); err == nil {
+		t.Error("replay accepted")
+	}
+	old := now - int64(2*mtypes.PollTimeWindow)
+	if _, err := checkPollSig(PSKey, old, sign(old), body, 0); err == nil {
+		t.Error("Time out of the window accepted")
+	}
+}
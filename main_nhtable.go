@@ -0,0 +1,85 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// NhTableStatus asks the running edge of the config by UAPI, and prints whether its NhTable matches the supernodes.
+func NhTableStatus(configPath string) error {
+	var econfig mtypes.EdgeConfig
+	if err := mtypes.ReadYaml(configPath, &econfig); err != nil {
+		return err
+	}
+	return nhTableStatusInterface(econfig.NodeName)
+}
+
+func nhTableStatusInterface(name string) error {
+	uapi, err := ipc.UAPIDial(name)
+	if err != nil {
+		return fmt.Errorf("connect to UAPI of %v: %v", name, err)
+	}
+	defer uapi.Close()
+	uapi.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := fmt.Fprintf(uapi, "nhtable=1\n"); err != nil {
+		return err
+	}
+
+	age := func(nsec string) string {
+		n, _ := strconv.ParseInt(nsec, 10, 64)
+		if n == 0 {
+			return "never"
+		}
+		return time.Since(time.Unix(0, n)).Round(time.Millisecond).String() + " ago"
+	}
+	hash := func(h string) string {
+		if h == "" {
+			return "(none)"
+		}
+		return h
+	}
+	scanner := bufio.NewScanner(uapi)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "nhtable_hash":
+			fmt.Printf("Local NhTable hash: %v\n", hash(kv[1]))
+		case "nhtable_changed":
+			fmt.Printf("Local NhTable updated: %v\n", age(kv[1]))
+		case "supernode":
+			super := strings.SplitN(kv[1], ":", 3)
+			if len(super) == 3 {
+				fmt.Printf("SuperNode %v announced: %v, %v\n", super[0], hash(super[1]), age(super[2]))
+			}
+		case "converged":
+			if kv[1] == "true" {
+				fmt.Println("Converged: yes")
+			} else {
+				fmt.Println("Converged: no, the NhTable is not the one of the supernodes")
+			}
+		case "errno":
+			if kv[1] != "0" {
+				return fmt.Errorf("UAPI error: errno=%v", kv[1])
+			}
+		}
+	}
+	return scanner.Err()
+}
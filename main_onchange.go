@@ -0,0 +1,74 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import "fmt"
+
+// postScriptState passes all the parts of the state to the script, see postScriptJSON
+func postScriptState(envs map[string]string, parts map[string]interface{}) (cleanup func(), err error) {
+	var cleanups []func()
+	cleanup = func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	for name, v := range parts {
+		c, err := postScriptJSON(envs, name, v)
+		if err != nil {
+			cleanup()
+			return func() {}, err
+		}
+		cleanups = append(cleanups, c)
+	}
+	return
+}
+
+// onChangeHook runs OnChangeScript after every NhTable change, with the state from state() in the environment.
+// It runs in a single goroutine, the changes during a run are merged into one more run after it,
+// so a long script never overlaps with itself and the last change is never missed.
+type onChangeHook struct {
+	script      string
+	kick        chan struct{}
+	state       func(envs map[string]string) (cleanup func(), err error)
+	logInternal bool
+}
+
+func newOnChangeHook(script string, logInternal bool, state func(envs map[string]string) (cleanup func(), err error)) *onChangeHook {
+	if script == "" {
+		return nil
+	}
+	return &onChangeHook{
+		script:      script,
+		kick:        make(chan struct{}, 1),
+		state:       state,
+		logInternal: logInternal,
+	}
+}
+
+// Notify schedules a run, it never blocks. It's a no-op for a nil hook.
+func (h *onChangeHook) Notify() {
+	if h == nil {
+		return
+	}
+	select {
+	case h.kick <- struct{}{}:
+	default: // a run is pending already
+	}
+}
+
+func (h *onChangeHook) RoutineRun() {
+	for range h.kick {
+		envs := map[string]string{"EG_EVENT": "nhtable"}
+		cleanup, err := h.state(envs)
+		if err == nil {
+			err = runPostScript(h.script, envs, h.logInternal)
+			cleanup()
+		}
+		if err != nil {
+			fmt.Printf("OnChangeScript: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// peerInfoHistoryLen is how many past http_PeerInfo are kept for peer/diff. A client further behind gets the full list.
+const peerInfoHistoryLen = 16
+
+type peerInfoSnapshot struct {
+	hash  string
+	peers mtypes.API_Peers
+}
+
+// recordPeerInfo keeps the new http_PeerInfo for peer/diff. No lock, lock before call me
+func recordPeerInfo(hash string, peers mtypes.API_Peers) {
+	httpobj.http_PeerInfo_history = append(httpobj.http_PeerInfo_history, peerInfoSnapshot{hash: hash, peers: peers})
+	if len(httpobj.http_PeerInfo_history) > peerInfoHistoryLen {
+		httpobj.http_PeerInfo_history = httpobj.http_PeerInfo_history[1:]
+	}
+}
+
+// diffPeerInfo returns the changes from old to cur. The PSKey is not returned.
+func diffPeerInfo(old mtypes.API_Peers, cur mtypes.API_Peers) (updated mtypes.API_Peers, deleted []string) {
+	updated = make(mtypes.API_Peers)
+	deleted = make([]string, 0)
+	for PubKey, peerinfo := range cur {
+		if oldinfo, has := old[PubKey]; !has || !reflect.DeepEqual(oldinfo, peerinfo) {
+			peerinfo.PSKey = ""
+			updated[PubKey] = peerinfo
+		}
+	}
+	for PubKey := range old {
+		if _, has := cur[PubKey]; !has {
+			deleted = append(deleted, PubKey)
+		}
+	}
+	return
+}
+
+// manage_peerdiff returns the peer list pushed to the EdgeNodes, as the changes since the state hash the client has.
+// 304 Not Modified if nothing changed, so a dashboard can poll it cheaply.
+func manage_peerdiff(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	if !authorize(w, r, params, mtypes.ScopeShowState) {
+		return
+	}
+	Since := params.Get("since")
+	httpobj.RLock()
+	defer httpobj.RUnlock()
+	if Since != "" && Since == httpobj.http_PeerInfo_hash {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	ret := mtypes.API_PeersDiff{
+		Hash: httpobj.http_PeerInfo_hash,
+		Full: true,
+	}
+	old := mtypes.API_Peers{}
+	for _, snapshot := range httpobj.http_PeerInfo_history {
+		if Since != "" && snapshot.hash == Since {
+			old = snapshot.peers
+			ret.Full = false
+			break
+		}
+	}
+	ret.Updated, ret.Deleted = diffPeerInfo(old, httpobj.http_PeerInfo)
+	retbytes, _ := json.Marshal(ret)
+	w.WriteHeader(http.StatusOK)
+	w.Write(retbytes)
+}
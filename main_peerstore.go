@@ -0,0 +1,210 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// PeerStore keeps the last known state of the edges, so that the supernode can
+// bootstrap the graph after a restart or a failover, before fresh pongs arrive.
+type PeerStore interface {
+	Load() (PeerStoreData, error)
+	Save(data PeerStoreData) error
+}
+
+type PeerStoreData struct {
+	SavedAt time.Time
+	Peers   map[string]PeerStoreEntry // PubKey as the key
+	Edges   []mtypes.PongMsg
+}
+
+type PeerStoreEntry struct {
+	NodeID     mtypes.Vertex
+	EndpointV4 string
+	EndpointV6 string
+	LocalIPv4  map[string]float64
+	LocalIPv6  map[string]float64
+	LastSeen   time.Time
+	Version    string
+}
+
+func NewPeerStore(sconfig mtypes.PeerStoreConfig) (PeerStore, error) {
+	switch sconfig.Type {
+	case "", "memory":
+		return &memoryPeerStore{}, nil
+	case "file":
+		if sconfig.Path == "" {
+			return nil, fmt.Errorf("PeerStore.Path is required for PeerStore.Type \"file\"")
+		}
+		return &filePeerStore{path: sconfig.Path}, nil
+	default:
+		return nil, fmt.Errorf("unknown PeerStore.Type: %v", sconfig.Type)
+	}
+}
+
+// memoryPeerStore is the default one, the state is lost after the process exits.
+type memoryPeerStore struct {
+	sync.Mutex
+	data PeerStoreData
+}
+
+func (s *memoryPeerStore) Load() (PeerStoreData, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.data, nil
+}
+
+func (s *memoryPeerStore) Save(data PeerStoreData) error {
+	s.Lock()
+	defer s.Unlock()
+	s.data = data
+	return nil
+}
+
+// filePeerStore saves the state as a json file.
+type filePeerStore struct {
+	sync.Mutex
+	path string
+}
+
+func (s *filePeerStore) Load() (data PeerStoreData, err error) {
+	s.Lock()
+	defer s.Unlock()
+	databyte, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return data, nil
+	} else if err != nil {
+		return
+	}
+	err = json.Unmarshal(databyte, &data)
+	return
+}
+
+func (s *filePeerStore) Save(data PeerStoreData) error {
+	s.Lock()
+	defer s.Unlock()
+	databyte, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temp file first, a crash during writing won't break the old one.
+	tmppath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmppath, databyte, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmppath, s.path)
+}
+
+func super_peerstore_snapshot() PeerStoreData {
+	// No lock, lock before call me
+	data := PeerStoreData{
+		SavedAt: time.Now(),
+		Peers:   make(map[string]PeerStoreEntry, len(httpobj.http_PeerID2Info)),
+		Edges:   httpobj.http_graph.GetLatencies(),
+	}
+	for NodeID, peerinfo := range httpobj.http_PeerID2Info {
+		entry := PeerStoreEntry{
+			NodeID:     NodeID,
+			EndpointV4: deviceConnurl(httpobj.http_device4, NodeID),
+			EndpointV6: deviceConnurl(httpobj.http_device6, NodeID),
+		}
+		if peerstate, has := httpobj.http_PeerState[peerinfo.PubKey]; has {
+			entry.LastSeen = peerstate.LastSeen.Load().(time.Time)
+			entry.Version = peerstate.Version.Load().(string)
+		}
+		if peerips, has := httpobj.http_PeerIPs[peerinfo.PubKey]; has {
+			entry.LocalIPv4 = peerips.LocalIPv4
+			entry.LocalIPv6 = peerips.LocalIPv6
+		}
+		data.Peers[peerinfo.PubKey] = entry
+	}
+	return data
+}
+
+func super_peerstore_save() {
+	httpobj.RLock()
+	data := super_peerstore_snapshot()
+	httpobj.RUnlock()
+	if err := httpobj.http_peerstore.Save(data); err != nil {
+		if httpobj.http_sconfig.LogLevel.LogInternal {
+			fmt.Printf("Internal: Save PeerStore failed: %v\n", err)
+		}
+	}
+}
+
+// super_peerstore_restore loads the last known state, only for the peers which are still in the config.
+func super_peerstore_restore() error {
+	// No lock, lock before call me
+	data, err := httpobj.http_peerstore.Load()
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(data.SavedAt).Seconds()
+	restored := 0
+	for PubKey, entry := range data.Peers {
+		peerinfo, has := httpobj.http_PeerID2Info[entry.NodeID]
+		if !has || peerinfo.PubKey != PubKey {
+			continue
+		}
+		restored++
+		httpobj.http_PeerState[PubKey].LastSeen.Store(entry.LastSeen)
+		httpobj.http_PeerState[PubKey].Version.Store(entry.Version)
+		httpobj.http_PeerIPs[PubKey].LocalIPv4 = entry.LocalIPv4
+		httpobj.http_PeerIPs[PubKey].LocalIPv6 = entry.LocalIPv6
+		if peerinfo.EndPoint != "" {
+			continue
+		}
+		if httpobj.http_device4 != nil && entry.EndpointV4 != "" {
+			if peer4 := httpobj.http_device4.LookupPeerByStr(PubKey); peer4 != nil {
+				peer4.SetEndpointFromConnURL(entry.EndpointV4, 4, 0, false)
+			}
+		}
+		if httpobj.http_device6 != nil && entry.EndpointV6 != "" {
+			if peer6 := httpobj.http_device6.LookupPeerByStr(PubKey); peer6 != nil {
+				peer6.SetEndpointFromConnURL(entry.EndpointV6, 6, 0, false)
+			}
+		}
+	}
+	edges := make([]mtypes.PongMsg, 0, len(data.Edges))
+	for _, pong_msg := range data.Edges {
+		if _, has := httpobj.http_PeerID2Info[pong_msg.Src_nodeID]; !has {
+			continue
+		}
+		if _, has := httpobj.http_PeerID2Info[pong_msg.Dst_nodeID]; !has {
+			continue
+		}
+		pong_msg.TimeToAlive -= elapsed
+		if pong_msg.TimeToAlive <= 0 {
+			continue
+		}
+		edges = append(edges, pong_msg)
+	}
+	if httpobj.http_sconfig.LogLevel.LogInternal {
+		fmt.Printf("Internal: Restored %v peers and %v edges from PeerStore\n", restored, len(edges))
+	}
+	if len(edges) == 0 {
+		return nil
+	}
+	if httpobj.http_graph.UpdateLatencyMulti(edges, true, true) {
+		PushNewNhTable(httpobj.http_graph, "peerstore restore")
+	}
+	return nil
+}
+
+func RoutineSavePeerStore(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		super_peerstore_save()
+	}
+}
@@ -0,0 +1,44 @@
+//go:build !nopostscript
+// +build !nopostscript
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/google/shlex"
+)
+
+// postScriptEnabled is false in the builds with the nopostscript tag, which never execute any command
+const postScriptEnabled = true
+
+// runPostScript executes the PostScript with the environment variables added
+func runPostScript(script string, envs map[string]string, logInternal bool) error {
+	cmdarg, err := shlex.Split(script)
+	if err != nil {
+		return fmt.Errorf("error parse PostScript %v", err)
+	}
+	if logInternal {
+		fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
+	}
+	cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range envs {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
+	}
+	if logInternal {
+		fmt.Printf("PostScript output: %s\n", string(out))
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build nopostscript
+// +build nopostscript
+
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import "errors"
+
+const postScriptEnabled = false
+
+func runPostScript(script string, envs map[string]string, logInternal bool) error {
+	return errors.New("PostScript is disabled in this build")
+}
@@ -0,0 +1,43 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// postScriptMaxEnv is the largest json passed in the environment, a larger one is written to a temporary file
+const postScriptMaxEnv = 32 * 1024
+
+// postScriptJSON passes v to the script in json by the environment variable name,
+// or by a temporary file whose path is in name_FILE. cleanup removes the file after the script is done.
+func postScriptJSON(envs map[string]string, name string, v interface{}) (cleanup func(), err error) {
+	cleanup = func() {}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return cleanup, err
+	}
+	if len(b) <= postScriptMaxEnv {
+		envs[name] = string(b)
+		return
+	}
+	f, err := os.CreateTemp("", "eg_*.json")
+	if err != nil {
+		return cleanup, fmt.Errorf("failed to write %v: %v", name, err)
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return cleanup, fmt.Errorf("failed to write %v: %v", name, err)
+	}
+	envs[name+"_FILE"] = f.Name()
+	return func() { os.Remove(f.Name()) }, nil
+}
@@ -0,0 +1,71 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/path"
+)
+
+// Replay feeds the events captured in the EventLogFile of a supernode to a fresh graph with the GraphRecalculateSetting
+// of the super config, and prints when the supernode pushed UpdateNhTable and the NhTable after each change.
+func Replay(configPath string, eventsPath string) error {
+	var sconfig mtypes.SuperConfig
+	if err := mtypes.ReadYaml(configPath, &sconfig); err != nil {
+		return fmt.Errorf("read config %v: %v", configPath, err)
+	}
+	mtypes.ApplySuperDefaults(&sconfig)
+	if _, err := path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, mtypes.LoggerInfo{}); err != nil {
+		return err
+	}
+	events, err := path.ReadSuperEventsFile(eventsPath)
+	if err != nil {
+		return fmt.Errorf("read events %v: %v", eventsPath, err)
+	}
+	if len(events) == 0 {
+		return fmt.Errorf("no events in %v", eventsPath)
+	}
+	s := path.NewSimNet(3, true, sconfig.GraphRecalculateSetting)
+	start := events[0].Time
+	changes := make(map[string]int)
+	stalePushes := 0
+	fmt.Printf("Replay %v events from %v\n", len(events), start.Format("2006-01-02 15:04:05.000"))
+	s.ReplayEvents(events, func(r path.ReplayStep) {
+		offset := r.Event.Time.Sub(start).Seconds()
+		if r.PushStale {
+			stalePushes++
+			fmt.Printf("+%.3fs %v: NhStateHash changed, push UpdateNhTable to the stale EdgeNodes\n", offset, describeSuperEvent(r.Event))
+		}
+		if r.Changed {
+			changes[r.Event.Kind]++
+			fmt.Printf("+%.3fs %v: NhTable changed, push UpdateNhTable to all EdgeNodes\n", offset, describeSuperEvent(r.Event))
+			NhTablestr, _ := json.Marshal(s.G.GetNHTable(false))
+			fmt.Printf("  NhTable: %s\n", NhTablestr)
+		}
+	})
+	fmt.Printf("\n%v events in %.3fs, %v recalculations\n", len(events), events[len(events)-1].Time.Sub(start).Seconds(), s.Recalc)
+	fmt.Printf("NhTable changed %v times: %v by pong, %v by timeout check, %v by RecalcInterval\n",
+		s.Pushes, changes[mtypes.SuperEventPong], changes[mtypes.SuperEventCheck], changes[mtypes.SuperEventInterval])
+	fmt.Printf("Pushed to the stale EdgeNodes %v times by register\n", stalePushes)
+	return nil
+}
+
+func describeSuperEvent(e mtypes.SuperEvent) string {
+	switch e.Kind {
+	case mtypes.SuperEventRegister:
+		return fmt.Sprintf("register %v NhStateHash %q", e.Src.ToString(), e.NhStateHash)
+	case mtypes.SuperEventPong:
+		return fmt.Sprintf("pong %v->%v %.3fms", e.Src.ToString(), e.Dst.ToString(), e.Latency*1000)
+	case mtypes.SuperEventCheck:
+		return "timeout check"
+	case mtypes.SuperEventInterval:
+		return "recalc interval"
+	}
+	return e.Kind
+}
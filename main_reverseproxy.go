@@ -0,0 +1,165 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// httpProxy is SuperConfig.ReverseProxy of the running supernode
+var httpProxy reverseProxy
+
+// reverseProxy is SuperConfig.ReverseProxy, parsed
+type reverseProxy struct {
+	basePath string
+	trusted  []*net.IPNet
+	edgeURL  string
+}
+
+func parseReverseProxy(conf mtypes.ReverseProxyInfo) (p reverseProxy, err error) {
+	if conf.BasePath != "" {
+		if conf.BasePath[0] != '/' {
+			return p, fmt.Errorf("ReverseProxy.BasePath must start with / : %v", conf.BasePath)
+		}
+		p.basePath = strings.TrimRight(conf.BasePath, "/")
+	}
+	for _, s := range conf.TrustedProxies {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return p, fmt.Errorf("ReverseProxy.TrustedProxies: invalid IP : %v", s)
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return p, fmt.Errorf("ReverseProxy.TrustedProxies: %v", err)
+		}
+		p.trusted = append(p.trusted, ipnet)
+	}
+	if conf.EdgeAPIUrl != "" {
+		u, err := url.Parse(conf.EdgeAPIUrl)
+		if err != nil {
+			return p, fmt.Errorf("ReverseProxy.EdgeAPIUrl: %v", err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return p, fmt.Errorf("ReverseProxy.EdgeAPIUrl must be an http or https URL : %v", conf.EdgeAPIUrl)
+		}
+		p.edgeURL = strings.TrimRight(conf.EdgeAPIUrl, "/")
+	}
+	return p, nil
+}
+
+func (p *reverseProxy) isTrusted(ip net.IP) bool {
+	for _, ipnet := range p.trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// fromTrusted reports whether the request comes from one of TrustedProxies, whose X-Forwarded-* headers are honored
+func (p *reverseProxy) fromTrusted(r *http.Request) bool {
+	ip := remoteIP(r)
+	return ip != nil && p.isTrusted(ip)
+}
+
+// handler strips BasePath from the requests, for the proxies forwarding the path as is.
+// The ones stripping it themselves reach the routes directly.
+func (p *reverseProxy) handler(h http.Handler) http.Handler {
+	if p.basePath == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest := strings.TrimPrefix(r.URL.Path, p.basePath); len(rest) < len(r.URL.Path) && strings.HasPrefix(rest, "/") {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = rest
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientAddr returns the address of the client. Behind a trusted proxy, it's the last address of X-Forwarded-For
+// not added by a trusted proxy, as the ones before it can be forged by the client.
+func (p *reverseProxy) clientAddr(r *http.Request) string {
+	if !p.fromTrusted(r) {
+		return r.RemoteAddr
+	}
+	var hops []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		if !p.isTrusted(ip) || i == 0 {
+			return hop
+		}
+	}
+	return r.RemoteAddr
+}
+
+// externalURL returns the URL of the EdgeAPI as the EdgeNodes see it, for the requests to the ManageAPI.
+// It's EdgeAPIUrl if set. Otherwise, if the EdgeAPI shares the listener with the ManageAPI, it's the URL the request came to,
+// with X-Forwarded-Proto and X-Forwarded-Host from a trusted proxy. If not, it's the host of the request with the port of the EdgeAPI,
+// as the URL of the ManageAPI doesn't serve the EdgeAPI.
+func (p *reverseProxy) externalURL(r *http.Request, sconfig *mtypes.SuperConfig) string {
+	if p.edgeURL != "" {
+		return p.edgeURL
+	}
+	apiprefix := sconfig.API_Prefix
+	if len(apiprefix) > 0 && apiprefix[0] != '/' {
+		apiprefix = "/" + apiprefix
+	}
+	edgePort := strings.TrimPrefix(sconfig.ListenPort_EdgeAPI, ":")
+	if edgePort != strings.TrimPrefix(sconfig.ListenPort_ManageAPI, ":") {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		if edgePort == "" {
+			edgePort = "80"
+		}
+		return "http://" + net.JoinHostPort(host, edgePort) + apiprefix
+	}
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if p.fromTrusted(r) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+			scheme = strings.TrimSpace(strings.Split(proto, ",")[0])
+		}
+		if fhost := r.Header.Get("X-Forwarded-Host"); fhost != "" {
+			host = strings.TrimSpace(strings.Split(fhost, ",")[0])
+		}
+	}
+	return scheme + "://" + host + p.basePath + apiprefix
+}
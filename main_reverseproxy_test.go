@@ -0,0 +1,124 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestParseReverseProxy(t *testing.T) {
+	tests := []struct {
+		conf mtypes.ReverseProxyInfo
+		err  bool
+	}{
+		{mtypes.ReverseProxyInfo{}, false},
+		{mtypes.ReverseProxyInfo{BasePath: "/vpn/", TrustedProxies: []string{"10.0.0.1", "fd00::/64"}, EdgeAPIUrl: "https://example.com/vpn/eg_api"}, false},
+		{mtypes.ReverseProxyInfo{BasePath: "vpn"}, true},
+		{mtypes.ReverseProxyInfo{TrustedProxies: []string{"10.0.0"}}, true},
+		{mtypes.ReverseProxyInfo{TrustedProxies: []string{"10.0.0.0/33"}}, true},
+		{mtypes.ReverseProxyInfo{EdgeAPIUrl: "example.com/eg_api"}, true},
+		{mtypes.ReverseProxyInfo{EdgeAPIUrl: "ftp://example.com/eg_api"}, true},
+	}
+	for _, test := range tests {
+		p, err := parseReverseProxy(test.conf)
+		if (err != nil) != test.err {
+			t.Errorf("parseReverseProxy(%+v): err %v, want err %v", test.conf, err, test.err)
+		}
+		if err == nil && test.conf.BasePath == "/vpn/" && p.basePath != "/vpn" {
+			t.Errorf("basePath = %q", p.basePath)
+		}
+	}
+}
+
+func TestReverseProxyClientAddr(t *testing.T) {
+	p, _ := parseReverseProxy(mtypes.ReverseProxyInfo{TrustedProxies: []string{"10.0.0.0/24"}})
+	tests := []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		// not from a proxy, the header is ignored
+		{"192.0.2.1:1234", []string{"198.51.100.1"}, "192.0.2.1:1234"},
+		{"10.0.0.1:1234", nil, "10.0.0.1:1234"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		// the client prepends a forged address, the proxy appends the real one
+		{"10.0.0.1:1234", []string{"203.0.113.9, 198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"203.0.113.9", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		// a garbage hop stops the walk
+		{"10.0.0.1:1234", []string{"198.51.100.1, garbage, 10.0.0.2"}, "10.0.0.1:1234"},
+		// only the trusted proxies, the first one is the client
+		{"10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/eg_api/healthz", nil)
+		r.RemoteAddr = test.remote
+		for _, h := range test.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		if got := p.clientAddr(r); got != test.want {
+			t.Errorf("clientAddr(%v, %q) = %v, want %v", test.remote, test.xff, got, test.want)
+		}
+	}
+}
+
+func TestReverseProxyHandler(t *testing.T) {
+	p, _ := parseReverseProxy(mtypes.ReverseProxyInfo{BasePath: "/vpn"})
+	var got string
+	h := p.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Path
+	}))
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/vpn/eg_api/healthz", "/eg_api/healthz"},
+		{"/eg_api/healthz", "/eg_api/healthz"},
+		{"/vpnx/eg_api/healthz", "/vpnx/eg_api/healthz"},
+		{"/vpn", "/vpn"},
+	}
+	for _, test := range tests {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", test.path, nil))
+		if got != test.want {
+			t.Errorf("handler(%v) got %v, want %v", test.path, got, test.want)
+		}
+	}
+}
+
+func TestReverseProxyExternalURL(t *testing.T) {
+	shared := &mtypes.SuperConfig{ListenPort_EdgeAPI: "3456", ListenPort_ManageAPI: "3456", API_Prefix: "eg_api"}
+	split := &mtypes.SuperConfig{ListenPort_EdgeAPI: "3456", ListenPort_ManageAPI: "3457", API_Prefix: "/eg_api"}
+	p, _ := parseReverseProxy(mtypes.ReverseProxyInfo{BasePath: "/vpn", TrustedProxies: []string{"10.0.0.1"}})
+	configured, _ := parseReverseProxy(mtypes.ReverseProxyInfo{EdgeAPIUrl: "https://edge.example.com/eg_api/"})
+	tests := []struct {
+		p       reverseProxy
+		sconfig *mtypes.SuperConfig
+		remote  string
+		host    string
+		want    string
+	}{
+		{configured, split, "192.0.2.1:1234", "manage.example.com:3457", "https://edge.example.com/eg_api"},
+		{p, shared, "192.0.2.1:1234", "example.com:3456", "http://example.com:3456/vpn/eg_api"},
+		{p, shared, "10.0.0.1:1234", "backend:3456", "https://example.com/vpn/eg_api"},
+		// the manage listener doesn't serve the EdgeAPI
+		{p, split, "192.0.2.1:1234", "example.com:3457", "http://example.com:3456/eg_api"},
+		{p, split, "192.0.2.1:1234", "[fd00::1]:3457", "http://[fd00::1]:3456/eg_api"},
+		{p, split, "192.0.2.1:1234", "example.com", "http://example.com:3456/eg_api"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/eg_api/manage/peer/add", nil)
+		r.RemoteAddr = test.remote
+		r.Host = test.host
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Host", "example.com")
+		if got := test.p.externalURL(r, test.sconfig); got != test.want {
+			t.Errorf("externalURL(%v, %v) = %v, want %v", test.remote, test.host, got, test.want)
+		}
+	}
+}
@@ -13,14 +13,12 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"os/exec"
 	"os/signal"
+	"sort"
 	"strconv"
 	"syscall"
 	"time"
 
-	"github.com/google/shlex"
-
 	"github.com/KusakabeSi/EtherGuard-VPN/conn"
 	"github.com/KusakabeSi/EtherGuard-VPN/device"
 	"github.com/KusakabeSi/EtherGuard-VPN/gencfg"
@@ -31,6 +29,32 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
+// superOnChange runs the OnChangeScript of the supernode after PushNewNhTable, nil if there is none
+var superOnChange *onChangeHook
+
+// superOnChangeState passes the NhTable pushed to the edges and the peers to the OnChangeScript
+func superOnChangeState(envs map[string]string) (func(), error) {
+	type peer struct {
+		NodeID mtypes.Vertex
+		Name   string
+		PubKey string
+	}
+	httpobj.RLock()
+	NhTable := json.RawMessage(nhTableCurrent().Str)
+	peers := make([]peer, 0, len(httpobj.http_PeerID2Info))
+	for _, p := range httpobj.http_PeerID2Info {
+		peers = append(peers, peer{NodeID: p.NodeID, Name: p.Name, PubKey: p.PubKey})
+	}
+	httpobj.RUnlock()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].NodeID < peers[j].NodeID })
+	envs["EG_MODE"] = "super"
+	envs["EG_NODE_NAME"] = httpobj.http_sconfig.NodeName
+	return postScriptState(envs, map[string]interface{}{
+		"EG_NHTABLE": NhTable,
+		"EG_PEERS":   peers,
+	})
+}
+
 func checkNhTable(NhTable mtypes.NextHopTable, peers []mtypes.SuperPeerInfo) error {
 	allpeer := make(map[mtypes.Vertex]bool, len(peers))
 	for _, peer1 := range peers {
@@ -61,6 +85,123 @@ func checkNhTable(NhTable mtypes.NextHopTable, peers []mtypes.SuperPeerInfo) err
 	return nil
 }
 
+func checkStaticRoutes(routes []mtypes.StaticRoute, peers []mtypes.SuperPeerInfo) error {
+	allpeer := make(map[mtypes.Vertex]bool, len(peers))
+	for _, peer1 := range peers {
+		allpeer[peer1.NodeID] = true
+	}
+	for _, route := range routes {
+		if route.Src == route.Dst {
+			return fmt.Errorf("StaticRoutes %v -> %v: Src and Dst are the same", route.Src, route.Dst)
+		}
+		for _, id := range append([]mtypes.Vertex{route.Src, route.Dst}, route.Via...) {
+			if _, has := allpeer[id]; !has {
+				return fmt.Errorf("StaticRoutes %v -> %v: %v is not in the peer list", route.Src, route.Dst, id)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSuperConfig checks the SuperConfig read from the config file, or PUT to super/config.
+func checkSuperConfig(sconfig *mtypes.SuperConfig) error {
+	if len(sconfig.NodeName) > 32 {
+		return errors.New("Node name can't longer than 32 :" + sconfig.NodeName)
+	}
+	if sconfig.PostScript != "" && !postScriptEnabled {
+		return fmt.Errorf("PostScript is disabled in this build, remove it from the config : %v", sconfig.PostScript)
+	}
+	if sconfig.OnChangeScript != "" && !postScriptEnabled {
+		return fmt.Errorf("OnChangeScript is disabled in this build, remove it from the config : %v", sconfig.OnChangeScript)
+	}
+	if sconfig.PeerAliveTimeout <= 0 {
+		return fmt.Errorf("PeerAliveTimeout must > 0 : %v", sconfig.PeerAliveTimeout)
+	}
+	if sconfig.HttpPostInterval < 0 {
+		return fmt.Errorf("HttpPostInterval must >= 0 : %v", sconfig.HttpPostInterval)
+	} else if sconfig.HttpPostInterval > sconfig.PeerAliveTimeout {
+		return fmt.Errorf("HttpPostInterval must <= PeerAliveTimeout : %v", sconfig.HttpPostInterval)
+	}
+	if sconfig.SendPingInterval <= 0 {
+		return fmt.Errorf("SendPingInterval must > 0 : %v", sconfig.SendPingInterval)
+	}
+	if sconfig.RePushConfigInterval <= 0 {
+		return fmt.Errorf("RePushConfigInterval must > 0 : %v", sconfig.RePushConfigInterval)
+	}
+	if sconfig.DampingResistance < 0 || sconfig.DampingResistance >= 1 {
+		return fmt.Errorf("DampingResistance must in range [0,1) : %v", sconfig.DampingResistance)
+	}
+	if sconfig.HolePunchInterval < 0 || sconfig.HolePunchDelay < 0 {
+		return fmt.Errorf("HolePunchInterval and HolePunchDelay must >= 0 : %v %v", sconfig.HolePunchInterval, sconfig.HolePunchDelay)
+	}
+	if err := device.CheckCipherSuite(sconfig.CipherSuite); err != nil {
+		return err
+	}
+	if sconfig.AddressFamily == mtypes.AddressFamilyNone {
+		for _, peerinfo := range sconfig.Peers {
+			if peerinfo.PSKey == "" {
+				return fmt.Errorf("Peers: PSKey of %v is required in AddressFamily %v, the EdgeNodes poll with it", peerinfo.NodeID.ToString(), mtypes.AddressFamilyNone)
+			}
+		}
+	} else {
+		use4, use6, err := mtypes.AddressFamilies(sconfig.AddressFamily)
+		if err != nil {
+			return fmt.Errorf("%v or %v", err, mtypes.AddressFamilyNone)
+		}
+		if !use6 && sconfig.PrivKeyV4 == "" {
+			return fmt.Errorf("PrivKeyV4 is required in AddressFamily %v", sconfig.AddressFamily)
+		}
+		if !use4 && sconfig.PrivKeyV6 == "" {
+			return fmt.Errorf("PrivKeyV6 is required in AddressFamily %v", sconfig.AddressFamily)
+		}
+	}
+	if sconfig.PeerStore.SaveInterval < 0 {
+		return fmt.Errorf("PeerStore.SaveInterval must >= 0 : %v", sconfig.PeerStore.SaveInterval)
+	}
+	if err := checkAPITokens(sconfig.Passwords.Tokens); err != nil {
+		return err
+	}
+	if _, err := parseReverseProxy(sconfig.ReverseProxy); err != nil {
+		return err
+	}
+	if sconfig.GraphRecalculateSetting.SuspectPeriod >= sconfig.PeerAliveTimeout {
+		return fmt.Errorf("GraphRecalculateSetting.SuspectPeriod must < PeerAliveTimeout : %v %v", sconfig.GraphRecalculateSetting.SuspectPeriod, sconfig.PeerAliveTimeout)
+	}
+	if sconfig.AuditLog.MaxSize < 0 || sconfig.AuditLog.MaxBackups < 0 {
+		return fmt.Errorf("AuditLog.MaxSize and AuditLog.MaxBackups must >= 0 : %v %v", sconfig.AuditLog.MaxSize, sconfig.AuditLog.MaxBackups)
+	}
+	for _, peerinfo := range sconfig.Peers {
+		if peerinfo.Bandwidth < 0 {
+			return fmt.Errorf("Peers[%v].Bandwidth must >= 0 : %v", peerinfo.NodeID, peerinfo.Bandwidth)
+		}
+	}
+	return checkZones(sconfig.Peers, sconfig.GraphRecalculateSetting.Algorithm)
+}
+
+// checkZones requires a border node in every zone if any peer has a Zone, otherwise the zone is cut off from the others
+func checkZones(peers []mtypes.SuperPeerInfo, algorithm string) error {
+	zones := make(map[string]bool)
+	zoned := false
+	for _, peerinfo := range peers {
+		if peerinfo.Zone != "" {
+			zoned = true
+		}
+		zones[peerinfo.Zone] = zones[peerinfo.Zone] || mtypes.HasTag(peerinfo.Tags, mtypes.TagBorder)
+	}
+	if !zoned {
+		return nil
+	}
+	if algorithm == mtypes.AlgorithmWidest {
+		return fmt.Errorf("Peers[].Zone doesn't work with Algorithm %v", mtypes.AlgorithmWidest)
+	}
+	for zone, hasBorder := range zones {
+		if !hasBorder {
+			return fmt.Errorf("Zone %q has no peer tagged %v", zone, mtypes.TagBorder)
+		}
+	}
+	return nil
+}
+
 func printExampleSuperConf() {
 	sconfig, _ := gencfg.GetExampleSuperConf("", true)
 	scprint, _ := yaml.Marshal(sconfig)
@@ -79,29 +220,28 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		fmt.Printf("Error read config: %v\t%v\n", configPath, err)
 		return err
 	}
+	mtypes.ApplySuperDefaults(&sconfig)
 	httpobj.http_sconfig = &sconfig
-	http_econfig_tmp, _ := gencfg.GetExampleEdgeConf(sconfig.EdgeTemplate, true)
+	http_econfig_tmp := loadEdgeTemplate(sconfig.EdgeTemplate)
 	httpobj.http_econfig_tmp = &http_econfig_tmp
 	NodeName := sconfig.NodeName
-	if len(NodeName) > 32 {
-		return errors.New("Node name can't longer than 32 :" + NodeName)
-	}
-	if sconfig.PeerAliveTimeout <= 0 {
-		return fmt.Errorf("PeerAliveTimeout must > 0 : %v", sconfig.PeerAliveTimeout)
-	}
-	if sconfig.HttpPostInterval < 0 {
-		return fmt.Errorf("HttpPostInterval must >= 0 : %v", sconfig.HttpPostInterval)
-	} else if sconfig.HttpPostInterval > sconfig.PeerAliveTimeout {
-		return fmt.Errorf("HttpPostInterval must <= PeerAliveTimeout : %v", sconfig.HttpPostInterval)
+	if err = checkSuperConfig(&sconfig); err != nil {
+		return err
 	}
-	if sconfig.SendPingInterval <= 0 {
-		return fmt.Errorf("SendPingInterval must > 0 : %v", sconfig.SendPingInterval)
+	use4, use6 := false, false
+	if sconfig.AddressFamily != mtypes.AddressFamilyNone {
+		use4, use6, _ = mtypes.AddressFamilies(sconfig.AddressFamily)
 	}
-	if sconfig.RePushConfigInterval <= 0 {
-		return fmt.Errorf("RePushConfigInterval must > 0 : %v", sconfig.RePushConfigInterval)
+	if sconfig.SigningKey != "" {
+		httpobj.http_signing_key, err = mtypes.ParseSigningKey(sconfig.SigningKey)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("SigningPubKey: %v\n", mtypes.SigningPubKey(httpobj.http_signing_key))
 	}
-	if sconfig.DampingResistance < 0 || sconfig.DampingResistance >= 1 {
-		return fmt.Errorf("DampingResistance must in range [0,1) : %v", sconfig.DampingResistance)
+	httpobj.http_peerstore, err = NewPeerStore(sconfig.PeerStore)
+	if err != nil {
+		return err
 	}
 
 	var logLevel int
@@ -126,17 +266,32 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 	)
 
 	httpobj.http_sconfig_path = configPath
+	if raw, err := os.ReadFile(configPath); err == nil && mtypes.UsesEnv(raw) {
+		httpobj.http_sconfig_env = true
+		fmt.Printf("Config file %v has ${VAR}, changes by the ManageAPI won't be saved to it\n", configPath)
+	}
 	httpobj.http_PeerState = make(map[string]*PeerState)
 	httpobj.http_PeerIPs = make(map[string]*HttpPeerLocalIP)
 	httpobj.http_PeerID2Info = make(map[mtypes.Vertex]mtypes.SuperPeerInfo)
 	httpobj.http_HashSalt = []byte(mtypes.RandomStr(32, fmt.Sprintf("%v", time.Now())))
-	httpobj.http_passwords = sconfig.Passwords
+	httpobj.http_passwords.Store(sconfig.Passwords)
+	superOnChange = newOnChangeHook(sconfig.OnChangeScript, sconfig.LogLevel.LogInternal, superOnChangeState)
+	superAudit, err = newAuditLog(sconfig.AuditLog)
+	if err != nil {
+		return err
+	}
+	defer superAudit.close()
+	superEvents, err = newEventLog(sconfig.EventLogFile)
+	if err != nil {
+		return err
+	}
+	defer superEvents.close()
 
 	httpobj.http_super_chains = &mtypes.SUPER_Events{
 		Event_server_pong:     make(chan mtypes.PongMsg, 1<<5),
 		Event_server_register: make(chan mtypes.RegisterMsg, 1<<5),
 	}
-	httpobj.http_graph, err = path.NewGraph(3, true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	httpobj.http_graph, err = path.NewGraph(len(sconfig.Peers), true, sconfig.GraphRecalculateSetting, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogControl: sconfig.LogLevel.LogControl})
 	if err != nil {
 		return err
 	}
@@ -146,14 +301,31 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		if err != nil {
 			return err
 		}
+	} else if len(sconfig.StaticRoutes) > 0 {
+		err = checkStaticRoutes(sconfig.StaticRoutes, sconfig.Peers)
+		if err != nil {
+			return err
+		}
+		err = httpobj.http_graph.SetStaticRoutes(sconfig.StaticRoutes)
+		if err != nil {
+			return err
+		}
 	}
-	thetap4, _ := tap.CreateDummyTAP()
-	httpobj.http_device4 = device.NewDevice(thetap4, mtypes.NodeID_SuperNode, conn.NewDefaultBind(true, false, bindmode), logger4, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
-	defer httpobj.http_device4.Close()
-	thetap6, _ := tap.CreateDummyTAP()
-	httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, conn.NewDefaultBind(false, true, bindmode), logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
-	defer httpobj.http_device6.Close()
-	if sconfig.PrivKeyV4 != "" {
+	if use4 {
+		bind4 := conn.NewDefaultBind(true, false, bindmode)
+		inheritSockets(bind4, NodeName+"_v4")
+		thetap4, _ := tap.CreateDummyTAP()
+		httpobj.http_device4 = device.NewDevice(thetap4, mtypes.NodeID_SuperNode, bind4, logger4, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
+		defer httpobj.http_device4.Close()
+	}
+	if use6 {
+		bind6 := conn.NewDefaultBind(false, true, bindmode)
+		inheritSockets(bind6, NodeName+"_v6")
+		thetap6, _ := tap.CreateDummyTAP()
+		httpobj.http_device6 = device.NewDevice(thetap6, mtypes.NodeID_SuperNode, bind6, logger6, httpobj.http_graph, true, configPath, nil, &sconfig, httpobj.http_super_chains, Version)
+		defer httpobj.http_device6.Close()
+	}
+	if httpobj.http_device4 != nil && sconfig.PrivKeyV4 != "" {
 		pk4, err := device.Str2PriKey(sconfig.PrivKeyV4)
 		if err != nil {
 			fmt.Println("Error decode base64 ", err)
@@ -165,7 +337,7 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 		httpobj.http_device4.IpcSet("replace_peers=true\n")
 	}
 
-	if sconfig.PrivKeyV6 != "" {
+	if httpobj.http_device6 != nil && sconfig.PrivKeyV6 != "" {
 		pk6, err := device.Str2PriKey(sconfig.PrivKeyV6)
 		if err != nil {
 			fmt.Println("Error decode base64 ", err)
@@ -183,18 +355,30 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 			return err
 		}
 	}
-	logger4.Verbosef("Device4 started")
-	logger6.Verbosef("Device6 started")
+	err = super_peerstore_restore()
+	if err != nil {
+		logger4.Errorf("Failed to restore PeerStore: %v", err)
+	}
+	if httpobj.http_device4 != nil {
+		logger4.Verbosef("Device4 started")
+	}
+	if httpobj.http_device6 != nil {
+		logger6.Verbosef("Device6 started")
+	}
 
 	errs := make(chan error, 1<<3)
 	term := make(chan os.Signal, 1)
-	if useUAPI {
-		uapi4, err := startUAPI(NodeName+"_v4", logger4, httpobj.http_device4, errs)
+	upgrade := make(chan os.Signal, 1)
+	var uapi4, uapi6 net.Listener
+	if useUAPI && httpobj.http_device4 != nil {
+		uapi4, err = startUAPI(NodeName+"_v4", logger4, httpobj.http_device4, errs)
 		if err != nil {
 			return err
 		}
 		defer uapi4.Close()
-		uapi6, err := startUAPI(NodeName+"_v6", logger6, httpobj.http_device6, errs)
+	}
+	if useUAPI && httpobj.http_device6 != nil {
+		uapi6, err = startUAPI(NodeName+"_v6", logger6, httpobj.http_device6, errs)
 		if err != nil {
 			return err
 		}
@@ -203,29 +387,43 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 
 	go Event_server_event_hendler(httpobj.http_graph, httpobj.http_super_chains)
 	go RoutinePushSettings(mtypes.S2TD(sconfig.RePushConfigInterval))
+	if isRemoteEdgeTemplate(sconfig.EdgeTemplate) {
+		go RoutineFetchEdgeTemplate(sconfig.EdgeTemplate, mtypes.S2TD(sconfig.RePushConfigInterval))
+	}
 	go RoutineTimeoutCheck()
-	HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, errs)
+	if superEvents != nil {
+		go RoutineFlushEventLog(superEvents)
+	}
+	if httpobj.http_graph.RecalcOnInterval() {
+		go RoutineRecalcInterval(httpobj.http_graph)
+	}
+	go httpobj.http_graph.RoutinePollExternalCost(func() {
+		httpobj.RLock()
+		defer httpobj.RUnlock()
+		if httpobj.http_graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(httpobj.http_graph, "external cost")
+		}
+	})
+	if sconfig.HolePunchInterval > 0 {
+		go RoutineHolePunch(mtypes.S2TD(sconfig.HolePunchInterval), mtypes.S2TD(sconfig.HolePunchDelay))
+	}
+	if sconfig.PeerStore.SaveInterval > 0 {
+		go RoutineSavePeerStore(mtypes.S2TD(sconfig.PeerStore.SaveInterval))
+	}
+	httpProxy, _ = parseReverseProxy(sconfig.ReverseProxy)
+	httpListeners := HttpServer(sconfig.ListenPort_EdgeAPI, sconfig.ListenPort_ManageAPI, sconfig.API_Prefix, errs)
 
 	if sconfig.PostScript != "" {
 		envs := make(map[string]string)
 		envs["EG_MODE"] = "super"
 		envs["EG_NODE_NAME"] = sconfig.NodeName
-		cmdarg, err := shlex.Split(sconfig.PostScript)
-		if err != nil {
-			return fmt.Errorf("error parse PostScript %v", err)
-		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript: exec.Command(%v)\n", cmdarg)
-		}
-		cmd := exec.Command(cmdarg[0], cmdarg[1:]...)
-		out, err := cmd.CombinedOutput()
-		if err != nil {
-			return fmt.Errorf("exec.Command(%v) failed with %v", cmdarg, err)
-		}
-		if sconfig.LogLevel.LogInternal {
-			fmt.Printf("PostScript output: %s\n", string(out))
+		if err := runPostScript(sconfig.PostScript, envs, sconfig.LogLevel.LogInternal); err != nil {
+			return err
 		}
 	}
+	if superOnChange != nil {
+		go superOnChange.RoutineRun()
+	}
 
 	SdNotify, err := mtypes.SdNotify(false, mtypes.SdNotifyReady)
 	if sconfig.LogLevel.LogInternal {
@@ -234,23 +432,81 @@ func Super(configPath string, useUAPI bool, printExample bool, bindmode string)
 
 	signal.Notify(term, syscall.SIGTERM)
 	signal.Notify(term, os.Interrupt)
-	select {
-	case <-term:
-	case <-errs:
-	case <-httpobj.http_device4.Wait():
-	case <-httpobj.http_device6.Wait():
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	upgradeNotifyReady()
+	for {
+		select {
+		case <-term:
+		case <-errs:
+		case <-deviceWait(httpobj.http_device4):
+		case <-deviceWait(httpobj.http_device6):
+		case <-upgrade:
+			var files []upgradeFile
+			if httpobj.http_device4 != nil {
+				files = append(files, upgradeFilesOf(NodeName+"_v4", httpobj.http_device4, uapi4)...)
+			}
+			if httpobj.http_device6 != nil {
+				files = append(files, upgradeFilesOf(NodeName+"_v6", httpobj.http_device6, uapi6)...)
+			}
+			for name, listener := range httpListeners {
+				if tcpListener, ok := listener.(*net.TCPListener); ok {
+					if file, err := tcpListener.File(); err == nil {
+						files = append(files, upgradeFile{name: name, file: file})
+					}
+				}
+			}
+			super_peerstore_save()
+			if err := gracefulUpgrade(files, nil); err != nil {
+				logger4.Errorf("Graceful upgrade failed: %v", err)
+				continue
+			}
+			logger4.Verbosef("Handed over to the new process")
+			// Exit without closing the device, the sockets are shared with the new process now.
+			os.Exit(ExitSetupSuccess)
+		}
+		break
 	}
 	logger4.Verbosef("Shutting down")
+	shutdownHttpServers(httpShutdownTimeout)
+	super_peerstore_save()
 	return
 }
 
-func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
+// deviceWait is device.Wait, but blocks forever on the device of a disabled address family.
+func deviceWait(d *device.Device) chan int {
+	if d == nil {
+		return nil
+	}
+	return d.Wait()
+}
+
+// deviceConnurl is device.GetConnurl, but empty on the device of a disabled address family.
+func deviceConnurl(d *device.Device, NodeID mtypes.Vertex) string {
+	if d == nil {
+		return ""
+	}
+	return d.GetConnurl(NodeID)
+}
+
+// super_devices returns the devices of the enabled address families.
+func super_devices() []*device.Device {
+	devices := make([]*device.Device, 0, 2)
+	for _, d := range []*device.Device{httpobj.http_device4, httpobj.http_device6} {
+		if d != nil {
+			devices = append(devices, d)
+		}
+	}
+	return devices
+}
+
+// super_peeradd_devices creates the peer in the SuperNode devices
+func super_peeradd_devices(peerconf mtypes.SuperPeerInfo) error {
 	// No lock, lock before call me
 	pk, err := device.Str2PubKey(peerconf.PubKey)
 	if err != nil {
 		return fmt.Errorf("error decode base64 :%v", err)
 	}
-	if httpobj.http_sconfig.PrivKeyV4 != "" {
+	if httpobj.http_device4 != nil && httpobj.http_sconfig.PrivKeyV4 != "" {
 		var psk device.NoisePresharedKey
 		if peerconf.PSKey != "" {
 			psk, err = device.Str2PSKey(peerconf.PSKey)
@@ -258,7 +514,7 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 				return fmt.Errorf("error decode base64 :%v", err)
 			}
 		}
-		peer4, err := httpobj.http_device4.NewPeer(pk, peerconf.NodeID, false, 0)
+		peer4, err := httpobj.http_device4.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive, mtypes.PeerQueueInfo{})
 		if err != nil {
 			return fmt.Errorf("error create peer id :%v", err)
 		}
@@ -275,7 +531,7 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 			}
 		}
 	}
-	if httpobj.http_sconfig.PrivKeyV6 != "" {
+	if httpobj.http_device6 != nil && httpobj.http_sconfig.PrivKeyV6 != "" {
 		var psk device.NoisePresharedKey
 		if peerconf.PSKey != "" {
 			psk, err = device.Str2PSKey(peerconf.PSKey)
@@ -283,7 +539,7 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 				return fmt.Errorf("error decode base64 :%v", err)
 			}
 		}
-		peer6, err := httpobj.http_device6.NewPeer(pk, peerconf.NodeID, false, 0)
+		peer6, err := httpobj.http_device6.NewPeer(pk, peerconf.NodeID, false, peerconf.PersistentKeepalive, mtypes.PeerQueueInfo{})
 		if err != nil {
 			return fmt.Errorf("error create peer id :%v", err)
 		}
@@ -300,13 +556,30 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 			}
 		}
 	}
+	return nil
+}
+
+func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
+	// No lock, lock before call me
+	if err := super_peeradd_devices(peerconf); err != nil {
+		// don't leave it in one device if the other one failed
+		for _, d := range super_devices() {
+			d.RemovePeerByID(peerconf.NodeID)
+		}
+		return err
+	}
 	httpobj.http_PeerID2Info[peerconf.NodeID] = peerconf
+	httpobj.http_graph.SetDisabled(peerconf.NodeID, peerconf.Disabled)
+	httpobj.http_graph.SetGateway(peerconf.NodeID, mtypes.HasTag(peerconf.Tags, mtypes.TagGateway))
+	httpobj.http_graph.SetBandwidth(peerconf.NodeID, peerconf.Bandwidth)
+	httpobj.http_graph.SetZone(peerconf.NodeID, peerconf.Zone, mtypes.HasTag(peerconf.Tags, mtypes.TagBorder))
 
 	SuperParams := mtypes.API_SuperParams{
 		SendPingInterval: httpobj.http_sconfig.SendPingInterval,
 		HttpPostInterval: httpobj.http_sconfig.HttpPostInterval,
 		PeerAliveTimeout: httpobj.http_sconfig.PeerAliveTimeout,
 		AdditionalCost:   peerconf.AdditionalCost,
+		TTLMargin:        httpobj.http_sconfig.TTLMargin,
 	}
 
 	SuperParamStr, _ := json.Marshal(SuperParams)
@@ -321,7 +594,16 @@ func super_peeradd(peerconf mtypes.SuperPeerInfo) error {
 	PS.JETSecret.Store(mtypes.JWTSecret{}) // mtypes.JWTSecret
 	PS.httpPostCount.Store(uint64(0))      // uint64
 	PS.LastSeen.Store(time.Time{})         // time.Time
+	PS.Version.Store("")                   // string
+	PS.ListenPorts.Store([]uint16{})       // []uint16
+	PS.DataPort.Store(uint16(0))           // uint16
+	PS.PollIP.Store("")                    // string
+	PS.pollTime.Store(int64(0))            // int64
+	PS.postTime.Store(int64(0))            // int64
+	PS.nhPollTime.Store(int64(0))          // int64
 	httpobj.http_PeerState[peerconf.PubKey] = &PS
+	httpobj.http_NhTable_Stale.Add(peerconf.PubKey)
+	httpobj.http_PeerInfo_Stale.Add(peerconf.PubKey)
 
 	httpobj.http_PeerIPs[peerconf.PubKey] = &HttpPeerLocalIP{}
 	return nil
@@ -332,12 +614,39 @@ func super_peerdel(toDelete mtypes.Vertex) {
 	if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
 		return
 	}
+	PubKey := super_peerforget(toDelete)
+	go super_peerdel_notify(toDelete, PubKey)
+}
+
+// super_peeradd_undo takes back a super_peeradd that has not been announced yet, so the peer is not told to shutdown.
+func super_peeradd_undo(toDelete mtypes.Vertex) {
+	// No lock, lock before call me
+	if _, has := httpobj.http_PeerID2Info[toDelete]; !has {
+		return
+	}
+	super_peerforget(toDelete)
+	for _, d := range super_devices() {
+		d.RemovePeerByID(toDelete)
+	}
+	httpobj.http_graph.RemoveVirt(toDelete, true, false)
+}
+
+// super_peerforget removes the peer from the states of the SuperNode, and returns its PubKey.
+func super_peerforget(toDelete mtypes.Vertex) string {
+	// No lock, lock before call me
 	PubKey := httpobj.http_PeerID2Info[toDelete].PubKey
 	httpobj.http_pskdb.DelNode(toDelete)
 	delete(httpobj.http_PeerState, PubKey)
 	delete(httpobj.http_PeerIPs, PubKey)
+	httpobj.http_NhTable_Stale.Del(PubKey)
+	httpobj.http_PeerInfo_Stale.Del(PubKey)
 	delete(httpobj.http_PeerID2Info, toDelete)
-	go super_peerdel_notify(toDelete, PubKey)
+	httpobj.http_graph.SetDisabled(toDelete, false)
+	httpobj.http_graph.SetGateway(toDelete, false)
+	httpobj.http_graph.SetBandwidth(toDelete, 0)
+	httpobj.http_graph.SetZone(toDelete, "", false)
+	httpobj.http_graph.ResetEdgeAdminDown(toDelete)
+	return PubKey
 }
 
 func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
@@ -354,17 +663,99 @@ func super_peerdel_notify(toDelete mtypes.Vertex, PubKey string) {
 		header.SetSrc(mtypes.NodeID_SuperNode)
 		copy(buf[path.EgHeaderLen:], body)
 		header.SetDst(toDelete)
+		if super_send_control(PubKey, mtypes.Shutdown, buf) {
+			time.Sleep(mtypes.S2TD(0.1))
+			continue
+		}
+		for _, d := range super_devices() {
+			peer := d.LookupPeerByStr(PubKey)
+			d.SendServerUpdate(peer, mtypes.Shutdown, buf)
+		}
+		time.Sleep(mtypes.S2TD(0.1))
+	}
+	if cc := httpobj.http_ControlConns.Get(PubKey); cc != nil {
+		httpobj.http_ControlConns.Del(PubKey, cc)
+		cc.Close()
+	}
+	for _, d := range super_devices() {
+		d.RemovePeerByID(toDelete)
+	}
+	httpobj.http_graph.RemoveVirt(toDelete, true, false)
+}
 
-		peer4 := httpobj.http_device4.LookupPeerByStr(PubKey)
-		httpobj.http_device4.SendPacket(peer4, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+// super_peerrenumber moves the peer from NodeID old to new, and rewrites all the references to it:
+// the peer list, NextHopTable, StaticRoutes, ManualLatency and the graph. The new NhTable is pushed right away.
+// The edge is told to restart with the new NodeID, the other edges pick it up from the next UpdatePeer.
+func super_peerrenumber(old mtypes.Vertex, new mtypes.Vertex) {
+	// No lock, lock before call me
+	peerconf, has := httpobj.http_PeerID2Info[old]
+	if !has {
+		return
+	}
+	peerconf.NodeID = new
+	for i, peerinfo := range httpobj.http_sconfig.Peers {
+		if peerinfo.NodeID == old {
+			httpobj.http_sconfig.Peers[i] = peerconf
+		}
+	}
+	for i, route := range httpobj.http_sconfig.StaticRoutes {
+		route.Src = mtypes.RenumberVertex(route.Src, old, new)
+		route.Dst = mtypes.RenumberVertex(route.Dst, old, new)
+		for j, via := range route.Via {
+			route.Via[j] = mtypes.RenumberVertex(via, old, new)
+		}
+		httpobj.http_sconfig.StaticRoutes[i] = route
+	}
+	httpobj.http_sconfig.NextHopTable = mtypes.RenumberNhTable(httpobj.http_sconfig.NextHopTable, old, new)
+	httpobj.http_sconfig.GraphRecalculateSetting.ManualLatency = mtypes.RenumberDistTable(httpobj.http_sconfig.GraphRecalculateSetting.ManualLatency, old, new)
+	delete(httpobj.http_PeerID2Info, old)
+	httpobj.http_PeerID2Info[new] = peerconf
+	httpobj.http_pskdb.DelNode(old)
+	httpobj.http_graph.Renumber(old, new)
+	PushNewNhTable(httpobj.http_graph, fmt.Sprintf("peer/renumber %v->%v", old.ToString(), new.ToString()))
+	go super_peerrenumber_notify(old, peerconf)
+}
 
-		peer6 := httpobj.http_device6.LookupPeerByStr(PubKey)
-		httpobj.http_device6.SendPacket(peer6, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+func super_peerrenumber_notify(old mtypes.Vertex, peerconf mtypes.SuperPeerInfo) {
+	ServerUpdateMsg := mtypes.ServerUpdateMsg{
+		Node_id: old,
+		Action:  mtypes.Renumber,
+		Code:    0,
+		Params:  peerconf.NodeID.ToString(),
+	}
+	ServerUpdateMsg.Sign(httpobj.http_signing_key)
+	for i := 0; i < 10; i++ {
+		body, _ := mtypes.GetByte(&ServerUpdateMsg)
+		buf := make([]byte, path.EgHeaderLen+len(body))
+		header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+		header.SetSrc(mtypes.NodeID_SuperNode)
+		copy(buf[path.EgHeaderLen:], body)
+		header.SetDst(old)
+		if super_send_control(peerconf.PubKey, mtypes.Renumber, buf) {
+			time.Sleep(mtypes.S2TD(0.1))
+			continue
+		}
+		for _, d := range super_devices() {
+			peer := d.LookupPeerByStr(peerconf.PubKey)
+			d.SendServerUpdate(peer, mtypes.Renumber, buf)
+		}
 		time.Sleep(mtypes.S2TD(0.1))
 	}
-	httpobj.http_device4.RemovePeerByID(toDelete)
-	httpobj.http_device6.RemovePeerByID(toDelete)
-	httpobj.http_graph.RemoveVirt(toDelete, true, false)
+	if cc := httpobj.http_ControlConns.Get(peerconf.PubKey); cc != nil {
+		httpobj.http_ControlConns.Del(peerconf.PubKey, cc)
+		cc.Close()
+	}
+	for _, d := range super_devices() {
+		d.RemovePeerByID(old)
+	}
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	if current, has := httpobj.http_PeerID2Info[peerconf.NodeID]; !has || current.PubKey != peerconf.PubKey {
+		return // deleted or renumbered again in the meantime
+	}
+	if err := super_peeradd_devices(peerconf); err != nil {
+		fmt.Printf("Error: renumber %v to %v: %v\n", old, peerconf.NodeID, err)
+	}
 }
 
 func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
@@ -378,9 +769,13 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 			httpobj.RLock()
 			PubKey := httpobj.http_PeerID2Info[NodeID].PubKey
 			if reg_msg.Node_id < mtypes.NodeID_Special {
+				superEvents.record(mtypes.SuperEvent{Kind: mtypes.SuperEventRegister, Src: NodeID, NhStateHash: reg_msg.NhStateHash})
 				httpobj.http_PeerState[PubKey].LastSeen.Store(time.Now())
 				httpobj.http_PeerState[PubKey].JETSecret.Store(reg_msg.JWTSecret)
 				httpobj.http_PeerState[PubKey].httpPostCount.Store(reg_msg.HttpPostCount)
+				httpobj.http_PeerState[PubKey].Version.Store(reg_msg.Version)
+				httpobj.http_PeerState[PubKey].ListenPorts.Store(reg_msg.ListenPorts)
+				httpobj.http_PeerState[PubKey].DataPort.Store(reg_msg.DataPort)
 				if httpobj.http_PeerState[PubKey].NhTableState.Load().(string) != reg_msg.NhStateHash {
 					httpobj.http_PeerState[PubKey].NhTableState.Store(reg_msg.NhStateHash)
 					should_push_nh = true
@@ -389,14 +784,29 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 					httpobj.http_PeerState[PubKey].PeerInfoState.Store(reg_msg.PeerStateHash)
 					should_push_peer = true
 				}
+				if reg_msg.NhStateHash == nhTableCurrent().Hash {
+					httpobj.http_NhTable_Stale.Del(PubKey)
+				} else {
+					httpobj.http_NhTable_Stale.Add(PubKey)
+				}
+				if reg_msg.PeerStateHash == httpobj.http_PeerInfo_hash {
+					httpobj.http_PeerInfo_Stale.Del(PubKey)
+				} else {
+					httpobj.http_PeerInfo_Stale.Add(PubKey)
+				}
 				if httpobj.http_PeerState[PubKey].SuperParamStateClient.Load().(string) != reg_msg.SuperParamStateHash {
 					httpobj.http_PeerState[PubKey].SuperParamStateClient.Store(reg_msg.SuperParamStateHash)
 					should_push_superparams = true
 				}
+				// built under the lock, but sent without blocking the event loop on a slow control channel
+				go sendRegisterReply(PubKey, registerReplyOf(httpobj.http_PeerID2Info[NodeID], reg_msg))
 			}
 			var peer_state_changed bool
 
 			httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, peer_state_changed = get_api_peers(httpobj.http_PeerInfo_hash)
+			if peer_state_changed {
+				httpobj.http_PeerInfo_Stale.AddAll(httpobj.http_PeerState)
+			}
 			if should_push_peer || peer_state_changed {
 				PushPeerinfo(false)
 			}
@@ -415,25 +825,73 @@ func Event_server_event_hendler(graph *path.IG, events *mtypes.SUPER_Events) {
 				if AdditionalCost_use < 0 {
 					pong_msg.AdditionalCost = AdditionalCost_use
 				}
+				superEvents.record(mtypes.SuperEvent{
+					Kind:           mtypes.SuperEventPong,
+					Src:            pong_msg.Src_nodeID,
+					Dst:            pong_msg.Dst_nodeID,
+					Latency:        pong_msg.Timediff,
+					TimeToAlive:    pong_msg.TimeToAlive,
+					AdditionalCost: pong_msg.AdditionalCost,
+				})
 				changed = httpobj.http_graph.UpdateLatencyMulti([]mtypes.PongMsg{pong_msg}, true, true)
 			} else {
-				changed = httpobj.http_graph.RecalculateNhTable(true)
-
+				superEvents.record(mtypes.SuperEvent{Kind: mtypes.SuperEventCheck})
+				if graph.RecalcOnEvent() {
+					changed = httpobj.http_graph.RecalculateNhTable(true)
+				}
 			}
 			if changed {
-				NhTable := graph.GetNHTable(true)
-				NhTablestr, _ := json.Marshal(NhTable)
-				md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
-				new_hash_str := hex.EncodeToString(md5_hash_raw[:])
-				httpobj.http_NhTable_Hash = new_hash_str
-				httpobj.http_NhTableStr = NhTablestr
-				PushNhTable(false)
+				PushNewNhTable(graph, fmt.Sprintf("pong %v->%v", pong_msg.Src_nodeID.ToString(), pong_msg.Dst_nodeID.ToString()))
 			}
 			httpobj.RUnlock()
 		}
 	}
 }
 
+// PushNewNhTable updates the NhTable hash after it's changed, and pushes UpdateNhTable to EdgeNodes.
+// trigger is what changed it, for the AuditLog.
+// nhTableState is the NhTable pushed to the edges, with its hash.
+type nhTableState struct {
+	Hash string
+	Str  []byte
+}
+
+func nhTableCurrent() *nhTableState {
+	if s, ok := httpobj.http_NhTable.Load().(*nhTableState); ok {
+		return s
+	}
+	return &nhTableState{}
+}
+
+func PushNewNhTable(graph *path.IG, trigger string) {
+	httpobj.http_NhTable_push.Lock()
+	defer httpobj.http_NhTable_push.Unlock()
+	NhTable := graph.GetNHTable(true)
+	NhTablestr, _ := json.Marshal(NhTable)
+	md5_hash_raw := md5.Sum(append(NhTablestr, httpobj.http_HashSalt...))
+	new_hash_str := hex.EncodeToString(md5_hash_raw[:])
+	httpobj.http_NhTable.Store(&nhTableState{Hash: new_hash_str, Str: NhTablestr})
+	httpobj.http_NhTable_Stale.AddAll(httpobj.http_PeerState)
+	if err := superAudit.record(trigger, NhTable, new_hash_str); err != nil {
+		fmt.Printf("Error: AuditLog: %v\n", err)
+	}
+	PushNhTable(false)
+	superOnChange.Notify()
+}
+
+// RoutineRecalcInterval recalculates the NhTable every RecalcInterval, regardless of events.
+func RoutineRecalcInterval(graph *path.IG) {
+	for {
+		time.Sleep(graph.RecalcInterval)
+		httpobj.RLock()
+		superEvents.record(mtypes.SuperEvent{Kind: mtypes.SuperEventInterval})
+		if graph.RecalculateNhTableNow(true) {
+			PushNewNhTable(graph, "recalc interval")
+		}
+		httpobj.RUnlock()
+	}
+}
+
 func RoutinePushSettings(interval time.Duration) {
 	force := false
 	var lastforce time.Time
@@ -466,14 +924,167 @@ func RoutineTimeoutCheck() {
 	}
 }
 
-func PushNhTable(force bool) {
+// RoutineHolePunch finds the pairs of alive EdgeNodes which can't reach each other directly,
+// and tells both of them to send to each other at the same time.
+func RoutineHolePunch(interval time.Duration, delay time.Duration) {
+	for {
+		time.Sleep(interval)
+		httpobj.RLock()
+		PushHolePunch(delay)
+		httpobj.RUnlock()
+	}
+}
+
+func PushHolePunch(delay time.Duration) {
 	// No lock
+	if httpobj.http_sconfig.Observer || httpobj.http_maintenance.Get() {
+		return
+	}
+	alive := make([]mtypes.SuperPeerInfo, 0, len(httpobj.http_PeerID2Info))
+	for _, peerinfo := range httpobj.http_PeerID2Info {
+		peerstate, has := httpobj.http_PeerState[peerinfo.PubKey]
+		if !has || !peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now()) {
+			continue
+		}
+		if api_peer, has := httpobj.http_PeerInfo[peerinfo.PubKey]; !has || api_peer.Connurl == nil || api_peer.Connurl.IsEmpty() {
+			continue
+		}
+		alive = append(alive, peerinfo)
+	}
+	StartAt := time.Now().Add(delay)
+	for i, peer1 := range alive {
+		for _, peer2 := range alive[i+1:] {
+			if httpobj.http_graph.Weight(peer1.NodeID, peer2.NodeID, false) < mtypes.Infinity || httpobj.http_graph.Weight(peer2.NodeID, peer1.NodeID, false) < mtypes.Infinity {
+				continue
+			}
+			if httpobj.http_sconfig.LogLevel.LogControl {
+				fmt.Printf("Control: HolePunch between %v and %v at %v\n", peer1.NodeID.ToString(), peer2.NodeID.ToString(), StartAt)
+			}
+			sendHolePunch(peer1, peer2, StartAt)
+			sendHolePunch(peer2, peer1, StartAt)
+		}
+	}
+}
+
+func sendHolePunch(to mtypes.SuperPeerInfo, about mtypes.SuperPeerInfo, StartAt time.Time) {
+	params, _ := json.Marshal(mtypes.API_HolePunch{
+		PeerID:  about.NodeID,
+		Connurl: *httpobj.http_PeerInfo[about.PubKey].Connurl,
+		StartAt: StartAt,
+	})
 	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+		Node_id: to.NodeID,
+		Action:  mtypes.HolePunch,
+		Code:    0,
+		Params:  string(params),
+	})
+	if err != nil {
+		fmt.Println("Error get byte")
+		return
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+	header.SetDst(mtypes.NodeID_SuperNode)
+	header.SetSrc(mtypes.NodeID_SuperNode)
+	copy(buf[path.EgHeaderLen:], body)
+	if super_send_control(to.PubKey, mtypes.HolePunch, buf) {
+		return
+	}
+	for _, d := range super_devices() {
+		if peer := d.LookupPeerByStr(to.PubKey); peer != nil && peer.GetEndpointDstStr() != "" {
+			d.SendServerUpdate(peer, mtypes.HolePunch, buf)
+		}
+	}
+}
+
+// sendRegisterReply acknowledges the RegisterMsg of an edge with its settings, our state hashes and the warnings about it.
+func sendRegisterReply(PubKey string, reply mtypes.RegisterReplyMsg) {
+	// No lock
+	body, err := mtypes.GetByte(reply)
+	if err != nil {
+		fmt.Println("Error get byte")
+		return
+	}
+	buf := make([]byte, path.EgHeaderLen+len(body))
+	header, _ := path.NewEgHeader(buf[:path.EgHeaderLen], device.DefaultMTU)
+	header.SetDst(mtypes.NodeID_SuperNode)
+	header.SetSrc(mtypes.NodeID_SuperNode)
+	copy(buf[path.EgHeaderLen:], body)
+	if cc := httpobj.http_ControlConns.Get(PubKey); cc != nil && cc.Send(path.RegisterReply, buf) == nil {
+		return
+	}
+	for _, d := range super_devices() {
+		if peer := d.LookupPeerByStr(PubKey); peer != nil && peer.GetEndpointDstStr() != "" {
+			d.SendPacket(peer, path.RegisterReply, 0, buf, device.MessageTransportOffsetContent)
+		}
+	}
+}
+
+func registerReplyOf(to mtypes.SuperPeerInfo, reg_msg mtypes.RegisterMsg) mtypes.RegisterReplyMsg {
+	// No lock
+	reply := mtypes.RegisterReplyMsg{
+		Node_id:             to.NodeID,
+		Version:             Version,
+		NhStateHash:         nhTableCurrent().Hash,
+		PeerStateHash:       httpobj.http_PeerInfo_hash,
+		SuperParamStateHash: httpobj.http_PeerState[to.PubKey].SuperParamState.Load().(string),
+		SuperParams: mtypes.API_SuperParams{
+			SendPingInterval:  httpobj.http_sconfig.SendPingInterval,
+			HttpPostInterval:  httpobj.http_sconfig.HttpPostInterval,
+			PeerAliveTimeout:  httpobj.http_sconfig.PeerAliveTimeout,
+			AdditionalCost:    to.AdditionalCost,
+			DampingResistance: httpobj.http_sconfig.DampingResistance,
+			TTLMargin:         httpobj.http_sconfig.TTLMargin,
+		},
+	}
+	if reg_msg.Version != Version {
+		reply.Warnings = append(reply.Warnings, fmt.Sprintf("Your version: \"%v\" is not the same as the supernode: \"%v\". Please upgrade this edge node.", reg_msg.Version, Version))
+	}
+	if httpobj.http_maintenance.Get() {
+		reply.Warnings = append(reply.Warnings, "The supernode is in maintenance mode, nothing is pushed to the edges until it ends.")
+	}
+	if httpobj.http_sconfig.Observer {
+		reply.Warnings = append(reply.Warnings, "The supernode is an observer, it doesn't push the NhTable.")
+	}
+	return reply
+}
+
+// super_send_control sends a ServerUpdate by the TCP control channel of the peer, returns false if it's not connected.
+func super_send_control(PubKey string, action mtypes.ServerCommand, buf []byte) bool {
+	cc := httpobj.http_ControlConns.Get(PubKey)
+	if cc == nil {
+		return false
+	}
+	return cc.SendServerUpdate(action, buf) == nil
+}
+
+// super_push_targets returns the peers to push to: every peer if force, or only the stale ones.
+func super_push_targets(stale *PeerSet, force bool) []string {
+	// No lock
+	if !force {
+		return stale.List()
+	}
+	ret := make([]string, 0, len(httpobj.http_PeerState))
+	for pkstr := range httpobj.http_PeerState {
+		ret = append(ret, pkstr)
+	}
+	return ret
+}
+
+func PushNhTable(force bool) {
+	// No lock
+	if httpobj.http_sconfig.Observer || httpobj.http_maintenance.Get() {
+		return
+	}
+	NhTableHash := nhTableCurrent().Hash
+	msg := mtypes.ServerUpdateMsg{
 		Node_id: mtypes.NodeID_SuperNode,
 		Action:  mtypes.UpdateNhTable,
 		Code:    0,
-		Params:  string(httpobj.http_NhTable_Hash[:]),
-	})
+		Params:  NhTableHash,
+	}
+	msg.Sign(httpobj.http_signing_key)
+	body, err := mtypes.GetByte(msg)
 	if err != nil {
 		fmt.Println("Error get byte")
 		return
@@ -483,17 +1094,26 @@ func PushNhTable(force bool) {
 	header.SetDst(mtypes.NodeID_SuperNode)
 	header.SetSrc(mtypes.NodeID_SuperNode)
 	copy(buf[path.EgHeaderLen:], body)
-	for pkstr, peerstate := range httpobj.http_PeerState {
+	for _, pkstr := range super_push_targets(&httpobj.http_NhTable_Stale, force) {
+		peerstate, has := httpobj.http_PeerState[pkstr]
+		if !has {
+			httpobj.http_NhTable_Stale.Del(pkstr)
+			continue
+		}
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
 			continue
 		}
-		if force || peerstate.NhTableState.Load().(string) != httpobj.http_NhTable_Hash {
-			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
-			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+		if !force && peerstate.NhTableState.Load().(string) == NhTableHash {
+			httpobj.http_NhTable_Stale.Del(pkstr)
+			continue
+		}
+		if super_send_control(pkstr, mtypes.UpdateNhTable, buf) {
+			continue
+		}
+		for _, d := range super_devices() {
+			if peer := d.LookupPeerByStr(pkstr); peer != nil && peer.GetEndpointDstStr() != "" {
+				d.SendServerUpdate(peer, mtypes.UpdateNhTable, buf)
 			}
 		}
 	}
@@ -501,12 +1121,17 @@ func PushNhTable(force bool) {
 
 func PushPeerinfo(force bool) {
 	//No lock
-	body, err := mtypes.GetByte(mtypes.ServerUpdateMsg{
+	if httpobj.http_sconfig.Observer || httpobj.http_maintenance.Get() {
+		return
+	}
+	msg := mtypes.ServerUpdateMsg{
 		Node_id: mtypes.NodeID_SuperNode,
 		Action:  mtypes.UpdatePeer,
 		Code:    0,
 		Params:  string(httpobj.http_PeerInfo_hash[:]),
-	})
+	}
+	msg.Sign(httpobj.http_signing_key)
+	body, err := mtypes.GetByte(msg)
 	if err != nil {
 		fmt.Println("Error get byte")
 		return
@@ -516,17 +1141,26 @@ func PushPeerinfo(force bool) {
 	header.SetDst(mtypes.NodeID_SuperNode)
 	header.SetSrc(mtypes.NodeID_SuperNode)
 	copy(buf[path.EgHeaderLen:], body)
-	for pkstr, peerstate := range httpobj.http_PeerState {
+	for _, pkstr := range super_push_targets(&httpobj.http_PeerInfo_Stale, force) {
+		peerstate, has := httpobj.http_PeerState[pkstr]
+		if !has {
+			httpobj.http_PeerInfo_Stale.Del(pkstr)
+			continue
+		}
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
 			continue
 		}
-		if force || peerstate.PeerInfoState.Load().(string) != httpobj.http_PeerInfo_hash {
-			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
-			}
-			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+		if !force && peerstate.PeerInfoState.Load().(string) == httpobj.http_PeerInfo_hash {
+			httpobj.http_PeerInfo_Stale.Del(pkstr)
+			continue
+		}
+		if super_send_control(pkstr, mtypes.UpdatePeer, buf) {
+			continue
+		}
+		for _, d := range super_devices() {
+			if peer := d.LookupPeerByStr(pkstr); peer != nil {
+				d.SendServerUpdate(peer, mtypes.UpdatePeer, buf)
 			}
 		}
 	}
@@ -534,6 +1168,9 @@ func PushPeerinfo(force bool) {
 
 func PushServerParams(force bool) {
 	//No lock
+	if httpobj.http_maintenance.Get() {
+		return
+	}
 	for pkstr, peerstate := range httpobj.http_PeerState {
 		isAlive := peerstate.LastSeen.Load().(time.Time).Add(mtypes.S2TD(httpobj.http_sconfig.PeerAliveTimeout)).After(time.Now())
 		if !isAlive && !force {
@@ -556,12 +1193,13 @@ func PushServerParams(force bool) {
 			header.SetDst(mtypes.NodeID_SuperNode)
 			header.SetSrc(mtypes.NodeID_SuperNode)
 			copy(buf[path.EgHeaderLen:], body)
-
-			if peer := httpobj.http_device4.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device4.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+			if super_send_control(pkstr, mtypes.UpdateSuperParams, buf) {
+				continue
 			}
-			if peer := httpobj.http_device6.LookupPeerByStr(pkstr); peer != nil {
-				httpobj.http_device6.SendPacket(peer, path.ServerUpdate, 0, buf, device.MessageTransportOffsetContent)
+			for _, d := range super_devices() {
+				if peer := d.LookupPeerByStr(pkstr); peer != nil {
+					d.SendServerUpdate(peer, mtypes.UpdateSuperParams, buf)
+				}
 			}
 		}
 	}
@@ -569,6 +1207,9 @@ func PushServerParams(force bool) {
 
 func startUAPI(interfaceName string, logger *device.Logger, the_device *device.Device, errs chan error) (net.Listener, error) {
 	fileUAPI, err := func() (*os.File, error) {
+		if file, ok := inheritedFile("uapi_" + interfaceName); ok {
+			return file, nil
+		}
 		uapiFdStr := os.Getenv(ENV_EG_UAPI_FD)
 		if uapiFdStr == "" {
 			return ipc.UAPIOpen(interfaceName)
@@ -0,0 +1,354 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configRedacted replaces the secrets in the config returned by GET super/config.
+// PUT it back as is to keep the current value.
+const configRedacted = "REDACTED"
+
+// superConfigHot are the fields of SuperConfig applied live by PUT super/config. The others need a restart.
+var superConfigHot = map[string]bool{
+	"PeerAliveTimeout":  true,
+	"SendPingInterval":  true,
+	"HttpPostInterval":  true,
+	"DampingResistance": true,
+	"TTLMargin":         true,
+	"Passwords":         true,
+	"NextHopTable":      true,
+	"StaticRoutes":      true,
+	"Peers":             true,
+}
+
+// manage_superconfig exports the effective SuperConfig with GET, and applies a new one with PUT.
+func manage_superconfig(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		if !authorize(w, r, params, mtypes.ScopeShowState) {
+			return
+		}
+		httpobj.RLock()
+		sconfig := redactSuperConfig(*httpobj.http_sconfig)
+		httpobj.RUnlock()
+		body, _ := yaml.Marshal(&sconfig)
+		w.Header().Set("Content-Type", "application/yaml")
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	case http.MethodPut:
+		if !authorize(w, r, params, mtypes.ScopeUpdateSuper) {
+			return
+		}
+		put_superconfig(w, r)
+	default:
+		http_error(w, http.StatusMethodNotAllowed, mtypes.API_ErrBadParam, fmt.Sprintf("Method %v: Must be GET or PUT", r.Method))
+	}
+}
+
+func put_superconfig(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: %v", err))
+		return
+	}
+	var sconfig mtypes.SuperConfig
+	if err := yaml.Unmarshal(body, &sconfig); err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrBadBody, fmt.Sprintf("Request body: %v", err))
+		return
+	}
+	mtypes.ApplySuperDefaults(&sconfig)
+
+	httpobj.Lock()
+	defer httpobj.Unlock()
+	cur := httpobj.http_sconfig
+	curPeers := make(map[mtypes.Vertex]mtypes.SuperPeerInfo, len(cur.Peers))
+	for _, peerinfo := range cur.Peers {
+		curPeers[peerinfo.NodeID] = peerinfo
+	}
+	unredactSuperConfig(&sconfig, cur, curPeers)
+
+	err = checkSuperConfig(&sconfig)
+	if err == nil {
+		err = checkSuperPeers(sconfig.Peers, curPeers)
+	}
+	if err == nil {
+		// the Peers are applied live, but the Algorithm only after a restart
+		err = checkZones(sconfig.Peers, cur.GraphRecalculateSetting.Algorithm)
+	}
+	if err == nil {
+		if cur.GraphRecalculateSetting.StaticMode {
+			err = checkNhTable(sconfig.NextHopTable, sconfig.Peers)
+		} else {
+			err = checkStaticRoutes(sconfig.StaticRoutes, sconfig.Peers)
+		}
+	}
+	if err == nil && !cur.GraphRecalculateSetting.StaticMode {
+		// conflicts are found while pinning, so set it before anything else is changed
+		err = httpobj.http_graph.SetStaticRoutes(sconfig.StaticRoutes)
+	}
+	if err != nil {
+		http_error(w, http.StatusBadRequest, mtypes.API_ErrInvalidConfig, err.Error())
+		return
+	}
+
+	// the hot fields are taken from the new config, the others are kept and reported
+	applied := *cur
+	var restart []string
+	nv := reflect.ValueOf(sconfig)
+	av := reflect.ValueOf(&applied).Elem()
+	for i := 0; i < nv.NumField(); i++ {
+		name := nv.Type().Field(i).Name
+		if superConfigHot[name] {
+			av.Field(i).Set(nv.Field(i))
+		} else if !sameYaml(nv.Field(i).Interface(), av.Field(i).Interface()) {
+			restart = append(restart, name)
+		}
+	}
+
+	var added, deleted, updated []string
+	var addedIDs []mtypes.Vertex
+	newPeers := make(map[mtypes.Vertex]bool, len(applied.Peers))
+	for i, peerinfo := range applied.Peers {
+		newPeers[peerinfo.NodeID] = true
+		old, has := curPeers[peerinfo.NodeID]
+		if !has {
+			continue
+		}
+		if peerinfo.EndPoint != old.EndPoint {
+			restart = append(restart, fmt.Sprintf("Peers[%v].EndPoint", peerinfo.NodeID))
+			peerinfo.EndPoint = old.EndPoint
+		}
+		if peerinfo.PSKey != old.PSKey {
+			restart = append(restart, fmt.Sprintf("Peers[%v].PSKey", peerinfo.NodeID))
+			peerinfo.PSKey = old.PSKey
+		}
+		applied.Peers[i] = peerinfo
+	}
+	// adding a peer is the only step that may fail, do it first and undo it on failure, so nothing else is changed
+	for _, peerinfo := range applied.Peers {
+		if _, has := curPeers[peerinfo.NodeID]; has {
+			continue
+		}
+		if err := super_peeradd(peerinfo); err != nil {
+			for _, id := range addedIDs {
+				super_peeradd_undo(id)
+			}
+			if !cur.GraphRecalculateSetting.StaticMode {
+				httpobj.http_graph.SetStaticRoutes(cur.StaticRoutes)
+			}
+			http_error(w, http.StatusInternalServerError, mtypes.API_ErrInternal, fmt.Sprintf("Error creating peer %v: %v", peerinfo.NodeID, err))
+			return
+		}
+		added = append(added, peerinfo.NodeID.ToString())
+		addedIDs = append(addedIDs, peerinfo.NodeID)
+	}
+	for _, peerinfo := range applied.Peers {
+		old, has := curPeers[peerinfo.NodeID]
+		if !has || sameYaml(peerinfo, old) {
+			continue
+		}
+		updated = append(updated, peerinfo.NodeID.ToString())
+		httpobj.http_PeerID2Info[peerinfo.NodeID] = peerinfo
+		if peerinfo.PersistentKeepalive != old.PersistentKeepalive {
+			for _, d := range super_devices() {
+				if peer := d.LookupPeerByStr(peerinfo.PubKey); peer != nil {
+					peer.SetPersistentKeepalive(peerinfo.PersistentKeepalive)
+				}
+			}
+		}
+		httpobj.http_graph.SetDisabled(peerinfo.NodeID, peerinfo.Disabled)
+		httpobj.http_graph.SetGateway(peerinfo.NodeID, mtypes.HasTag(peerinfo.Tags, mtypes.TagGateway))
+		httpobj.http_graph.SetBandwidth(peerinfo.NodeID, peerinfo.Bandwidth)
+		httpobj.http_graph.SetZone(peerinfo.NodeID, peerinfo.Zone, mtypes.HasTag(peerinfo.Tags, mtypes.TagBorder))
+	}
+	for _, peerinfo := range cur.Peers {
+		if !newPeers[peerinfo.NodeID] {
+			deleted = append(deleted, peerinfo.NodeID.ToString())
+			super_peerdel(peerinfo.NodeID)
+		}
+	}
+
+	*httpobj.http_sconfig = applied
+	httpobj.http_passwords.Store(applied.Passwords)
+	SuperParams := mtypes.API_SuperParams{
+		SendPingInterval:  applied.SendPingInterval,
+		HttpPostInterval:  applied.HttpPostInterval,
+		PeerAliveTimeout:  applied.PeerAliveTimeout,
+		DampingResistance: applied.DampingResistance,
+		TTLMargin:         applied.TTLMargin,
+	}
+	for _, peerinfo := range httpobj.http_PeerID2Info {
+		SuperParams.AdditionalCost = peerinfo.AdditionalCost
+		SuperParamStr, _ := json.Marshal(SuperParams)
+		md5_hash_raw := md5.Sum(append(SuperParamStr, httpobj.http_HashSalt...))
+		httpobj.http_PeerState[peerinfo.PubKey].SuperParamState.Store(hex.EncodeToString(md5_hash_raw[:]))
+	}
+	if applied.GraphRecalculateSetting.StaticMode {
+		httpobj.http_graph.SetNHTable(applied.NextHopTable)
+		PushNewNhTable(httpobj.http_graph, "super/config")
+	} else if httpobj.http_graph.RecalculateNhTableNow(true) {
+		PushNewNhTable(httpobj.http_graph, "super/config")
+	}
+	var peer_state_changed bool
+	httpobj.http_PeerInfo, httpobj.http_PeerInfo_hash, peer_state_changed = get_api_peers(httpobj.http_PeerInfo_hash)
+	if peer_state_changed {
+		httpobj.http_PeerInfo_Stale.AddAll(httpobj.http_PeerState)
+		PushPeerinfo(false)
+	}
+
+	saveSuperConfig()
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Supernode: config applied.\n"))
+	for _, line := range []struct {
+		name string
+		list []string
+	}{
+		{"Peers added", added},
+		{"Peers deleted", deleted},
+		{"Peers updated", updated},
+		{"Restart required, not applied", restart},
+	} {
+		if len(line.list) > 0 {
+			sort.Strings(line.list)
+			w.Write([]byte(fmt.Sprintf("%v: %v\n", line.name, strings.Join(line.list, ", "))))
+		}
+	}
+}
+
+// saveSuperConfig writes the changes by the ManageAPI back to the config file.
+// It's skipped if the file has ${VAR}, because they would be written back by their values, which may be secrets,
+// and the escaped $${VAR} would be expanded on the next start. The changes are lost on restart in that case.
+func saveSuperConfig() {
+	if httpobj.http_sconfig_env {
+		fmt.Printf("Config file %v has ${VAR}, changes are not saved to it\n", httpobj.http_sconfig_path)
+		return
+	}
+	mtypesBytes, _ := yaml.Marshal(httpobj.http_sconfig)
+	ioutil.WriteFile(httpobj.http_sconfig_path, mtypesBytes, 0644)
+}
+
+// checkSuperPeers checks the peers of a new config against each other, and against the current peers.
+func checkSuperPeers(peers []mtypes.SuperPeerInfo, curPeers map[mtypes.Vertex]mtypes.SuperPeerInfo) error {
+	curPubKeys := make(map[string]mtypes.Vertex, len(curPeers))
+	for _, peerinfo := range curPeers {
+		curPubKeys[peerinfo.PubKey] = peerinfo.NodeID
+	}
+	ids := make(map[mtypes.Vertex]bool, len(peers))
+	names := make(map[string]bool, len(peers))
+	pubkeys := make(map[string]bool, len(peers))
+	for _, peerinfo := range peers {
+		if peerinfo.NodeID >= mtypes.NodeID_Special {
+			return fmt.Errorf("Peers[%v]: %v is a special NodeID", peerinfo.NodeID, peerinfo.NodeID)
+		}
+		if _, err := device.Str2PubKey(peerinfo.PubKey); err != nil {
+			return fmt.Errorf("Peers[%v].PubKey: %v", peerinfo.NodeID, err)
+		}
+		if peerinfo.PSKey != "" {
+			if _, err := device.Str2PSKey(peerinfo.PSKey); err != nil {
+				return fmt.Errorf("Peers[%v].PSKey: %v", peerinfo.NodeID, err)
+			}
+		}
+		if ids[peerinfo.NodeID] {
+			return fmt.Errorf("Peers[%v]: NodeID exists", peerinfo.NodeID)
+		}
+		if names[peerinfo.Name] {
+			return fmt.Errorf("Peers[%v]: Name %v exists", peerinfo.NodeID, peerinfo.Name)
+		}
+		if pubkeys[peerinfo.PubKey] {
+			return fmt.Errorf("Peers[%v]: PubKey exists", peerinfo.NodeID)
+		}
+		ids[peerinfo.NodeID] = true
+		names[peerinfo.Name] = true
+		pubkeys[peerinfo.PubKey] = true
+		if id, has := curPubKeys[peerinfo.PubKey]; has && id != peerinfo.NodeID {
+			return fmt.Errorf("Peers[%v].PubKey is used by NodeID %v, delete it first", peerinfo.NodeID, id)
+		}
+		if old, has := curPeers[peerinfo.NodeID]; has && old.PubKey != peerinfo.PubKey {
+			return fmt.Errorf("Peers[%v].PubKey changed, delete it and add it again", peerinfo.NodeID)
+		}
+	}
+	return nil
+}
+
+// redactSuperConfig replaces the private keys, passwords and preshared keys with configRedacted.
+func redactSuperConfig(sconfig mtypes.SuperConfig) mtypes.SuperConfig {
+	redact := func(s *string) {
+		if *s != "" {
+			*s = configRedacted
+		}
+	}
+	redact(&sconfig.PrivKeyV4)
+	redact(&sconfig.PrivKeyV6)
+	redact(&sconfig.SigningKey)
+	redact(&sconfig.Passwords.ShowState)
+	redact(&sconfig.Passwords.AddPeer)
+	redact(&sconfig.Passwords.DelPeer)
+	redact(&sconfig.Passwords.UpdatePeer)
+	redact(&sconfig.Passwords.UpdateSuper)
+	redact(&sconfig.Passwords.Inject)
+	sconfig.Passwords.Tokens = append([]mtypes.APIToken(nil), sconfig.Passwords.Tokens...)
+	for i := range sconfig.Passwords.Tokens {
+		redact(&sconfig.Passwords.Tokens[i].Token)
+	}
+	sconfig.Peers = append([]mtypes.SuperPeerInfo(nil), sconfig.Peers...)
+	for i := range sconfig.Peers {
+		redact(&sconfig.Peers[i].PSKey)
+	}
+	return sconfig
+}
+
+// unredactSuperConfig puts the current secrets back to the fields left as configRedacted.
+func unredactSuperConfig(sconfig *mtypes.SuperConfig, cur *mtypes.SuperConfig, curPeers map[mtypes.Vertex]mtypes.SuperPeerInfo) {
+	keep := func(s *string, cur string) {
+		if *s == configRedacted {
+			*s = cur
+		}
+	}
+	keep(&sconfig.PrivKeyV4, cur.PrivKeyV4)
+	keep(&sconfig.PrivKeyV6, cur.PrivKeyV6)
+	keep(&sconfig.SigningKey, cur.SigningKey)
+	keep(&sconfig.Passwords.ShowState, cur.Passwords.ShowState)
+	keep(&sconfig.Passwords.AddPeer, cur.Passwords.AddPeer)
+	keep(&sconfig.Passwords.DelPeer, cur.Passwords.DelPeer)
+	keep(&sconfig.Passwords.UpdatePeer, cur.Passwords.UpdatePeer)
+	keep(&sconfig.Passwords.UpdateSuper, cur.Passwords.UpdateSuper)
+	keep(&sconfig.Passwords.Inject, cur.Passwords.Inject)
+	for i := range sconfig.Passwords.Tokens {
+		for _, old := range cur.Passwords.Tokens {
+			if old.Name == sconfig.Passwords.Tokens[i].Name {
+				keep(&sconfig.Passwords.Tokens[i].Token, old.Token)
+			}
+		}
+	}
+	for i := range sconfig.Peers {
+		if old, has := curPeers[sconfig.Peers[i].NodeID]; has {
+			keep(&sconfig.Peers[i].PSKey, old.PSKey)
+		}
+	}
+}
+
+// sameYaml compares by the yaml, so nil and empty slices or maps are the same.
+func sameYaml(a, b interface{}) bool {
+	ya, _ := yaml.Marshal(a)
+	yb, _ := yaml.Marshal(b)
+	return bytes.Equal(ya, yb)
+}
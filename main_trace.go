@@ -0,0 +1,99 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/ipc"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Trace asks the running edge of the config to trace the route to dst by UAPI, and prints the path with per-hop latency.
+func Trace(configPath string, dst string) error {
+	var econfig mtypes.EdgeConfig
+	if err := mtypes.ReadYaml(configPath, &econfig); err != nil {
+		return err
+	}
+	return traceInterface(econfig.NodeName, dst)
+}
+
+func traceInterface(name string, dst string) error {
+	uapi, err := ipc.UAPIDial(name)
+	if err != nil {
+		return fmt.Errorf("connect to UAPI of %v: %v", name, err)
+	}
+	defer uapi.Close()
+	uapi.SetDeadline(time.Now().Add(time.Minute))
+	if _, err := fmt.Fprintf(uapi, "trace=%v\n", dst); err != nil {
+		return err
+	}
+
+	var expected []string
+	var hops [][3]string
+	var traceErr string
+	scanner := bufio.NewScanner(uapi)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "trace_expected":
+			if kv[1] != "" {
+				expected = strings.Split(kv[1], ",")
+			}
+		case "trace_hop":
+			hop := strings.SplitN(kv[1], ":", 3)
+			if len(hop) == 3 {
+				hops = append(hops, [3]string{hop[0], hop[1], hop[2]})
+			}
+		case "trace_error":
+			traceErr = kv[1]
+		case "errno":
+			if kv[1] != "0" {
+				return fmt.Errorf("UAPI error: errno=%v", kv[1])
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Trace to %v, expected path: %v\n", dst, strings.Join(expected, " -> "))
+	var lastEgress int64
+	diverged := false
+	for i, hop := range hops {
+		ingress, _ := strconv.ParseInt(hop[1], 10, 64)
+		egress, _ := strconv.ParseInt(hop[2], 10, 64)
+		latency := "-"
+		if i > 0 && ingress != 0 && lastEgress != 0 {
+			latency = fmt.Sprintf("%.3fms", float64(ingress-lastEgress)/float64(time.Millisecond))
+		}
+		note := ""
+		if i >= len(expected) || expected[i] != hop[0] {
+			diverged = true
+			note = " (not expected)"
+		}
+		fmt.Printf("%3d  %-6v %v%v\n", i, hop[0], latency, note)
+		lastEgress = egress
+	}
+	if diverged || len(hops) != len(expected) {
+		fmt.Println("The actual path diverges from the expected path, the NhTable may be stale.")
+	}
+	if traceErr != "" {
+		return fmt.Errorf("trace: %v", traceErr)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/conn"
+	"github.com/KusakabeSi/EtherGuard-VPN/device"
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"github.com/KusakabeSi/EtherGuard-VPN/tap"
+	"golang.org/x/sys/unix"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Graceful upgrade:
+// On SIGUSR2, the running process starts the binary at os.Executable() with the same arguments.
+// The UAPI socket, the UDP sockets and the tap device are passed to the new process as extra files,
+// with their names listed in EG_UPGRADE_FDS, like "uapi_Node01=3,sock4_Node01=4,ready=5".
+// The new process writes one byte to the "ready" pipe after it is initialized,
+// and the old process exits after that. If the new process fails to start, the old one keeps running.
+
+const (
+	ENV_EG_UPGRADE_FDS = "EG_UPGRADE_FDS"
+	ENV_EG_RENUMBERED  = "EG_RENUMBERED" // the NodeID given by the supernode, in case it's not saved to the config
+)
+
+const upgradeReadyTimeout = 30 * time.Second
+
+type upgradeFile struct {
+	name string
+	file *os.File
+}
+
+var inheritedFds = parseInheritedFds(os.Getenv(ENV_EG_UPGRADE_FDS))
+
+func parseInheritedFds(fdsStr string) map[string]int {
+	ret := make(map[string]int)
+	if fdsStr == "" {
+		return ret
+	}
+	for _, item := range strings.Split(fdsStr, ",") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fd, err := strconv.Atoi(kv[1])
+		if err != nil {
+			continue
+		}
+		syscall.CloseOnExec(fd)
+		ret[kv[0]] = fd
+	}
+	return ret
+}
+
+// inheritedFile returns the file passed by the old process, only once for each name.
+func inheritedFile(name string) (*os.File, bool) {
+	fd, ok := inheritedFds[name]
+	if !ok {
+		return nil, false
+	}
+	delete(inheritedFds, name)
+	return os.NewFile(uintptr(fd), name), true
+}
+
+// inheritSockets makes the bind reuse the UDP sockets from the old process, if there are any.
+func inheritSockets(bind conn.Bind, interfaceName string) {
+	ib, ok := bind.(conn.InheritSocketFd)
+	if !ok {
+		return
+	}
+	fd4, has4 := inheritedFds["sock4_"+interfaceName]
+	fd6, has6 := inheritedFds["sock6_"+interfaceName]
+	if !has4 && !has6 {
+		return
+	}
+	delete(inheritedFds, "sock4_"+interfaceName)
+	delete(inheritedFds, "sock6_"+interfaceName)
+	if !has4 {
+		fd4 = -1
+	}
+	if !has6 {
+		fd6 = -1
+	}
+	ib.InheritSocketFd(fd4, fd6)
+}
+
+// inheritedTAP returns the tap device used by the old process, for IType "tap" only.
+func inheritedTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (tap.Device, bool, error) {
+	if iconfig.IType != "tap" {
+		return nil, false, nil
+	}
+	file, ok := inheritedFile("tap")
+	if !ok {
+		return nil, false, nil
+	}
+	thetap, err := tap.CreateTAPFromFile(file, iconfig, NodeID)
+	return thetap, true, err
+}
+
+// restorePeerSnapshot applies the peer endpoints known by the old process.
+func restorePeerSnapshot(the_device *device.Device, AfPrefer int, logger *device.Logger) {
+	file, ok := inheritedFile("snapshot")
+	if !ok {
+		return
+	}
+	defer file.Close()
+	snapshotBytes, err := ioutil.ReadAll(file)
+	if err != nil {
+		logger.Errorf("Failed to read peer snapshot: %v", err)
+		return
+	}
+	var peers []mtypes.PeerInfo
+	if err := yaml.Unmarshal(snapshotBytes, &peers); err != nil {
+		logger.Errorf("Failed to parse peer snapshot: %v", err)
+		return
+	}
+	for _, peerinfo := range peers {
+		pk, err := device.Str2PubKey(peerinfo.PubKey)
+		if err != nil {
+			continue
+		}
+		peer := the_device.LookupPeer(pk)
+		if peer == nil {
+			peer, err = the_device.NewPeer(pk, peerinfo.NodeID, false, peerinfo.PersistentKeepalive, peerinfo.Queue)
+			if err != nil {
+				logger.Errorf("Failed to restore peer %v: %v", peerinfo.NodeID, err)
+				continue
+			}
+			if peerinfo.PSKey != "" {
+				psk, err := device.Str2PSKey(peerinfo.PSKey)
+				if err == nil {
+					peer.SetPSK(psk)
+				}
+			}
+		} else if peer.StaticConn {
+			continue
+		}
+		if peerinfo.EndPoint != "" {
+			peer.SetEndpointFromConnURL(peerinfo.EndPoint, 0, AfPrefer, peerinfo.Static)
+		}
+	}
+}
+
+// upgradeNotifyReady tells the old process that we are ready to take over.
+func upgradeNotifyReady() {
+	file, ok := inheritedFile("ready")
+	if !ok {
+		return
+	}
+	file.Write([]byte{1})
+	file.Close()
+	mtypes.SdNotify(false, "MAINPID="+strconv.Itoa(os.Getpid()))
+}
+
+// upgradeFilesOf collects the UAPI socket and the UDP sockets of a device.
+func upgradeFilesOf(interfaceName string, the_device *device.Device, uapi net.Listener) (files []upgradeFile) {
+	if uapiFile, ok := uapi.(interface{ File() (*os.File, error) }); ok {
+		if file, err := uapiFile.File(); err == nil {
+			files = append(files, upgradeFile{name: "uapi_" + interfaceName, file: file})
+		}
+	}
+	peek, ok := the_device.Bind().(conn.PeekLookAtSocketFd)
+	if !ok {
+		return
+	}
+	dupSocket := func(name string, fd int, err error) {
+		if err != nil {
+			return
+		}
+		newfd, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			return
+		}
+		files = append(files, upgradeFile{name: name, file: os.NewFile(uintptr(newfd), name)})
+	}
+	fd4, err := peek.PeekLookAtSocketFd4()
+	dupSocket("sock4_"+interfaceName, fd4, err)
+	fd6, err := peek.PeekLookAtSocketFd6()
+	dupSocket("sock6_"+interfaceName, fd6, err)
+	return
+}
+
+// gracefulUpgrade starts the new process and waits for it to be ready.
+// The files are closed in this process after it returns.
+func gracefulUpgrade(files []upgradeFile, snapshot []byte) error {
+	defer func() {
+		for _, f := range files {
+			f.file.Close()
+		}
+	}()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, upgradeFile{name: "ready", file: readyW})
+	if snapshot != nil {
+		snapR, snapW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		files = append(files, upgradeFile{name: "snapshot", file: snapR})
+		go func() {
+			snapW.Write(snapshot)
+			snapW.Close()
+		}()
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fdsStr := make([]string, 0, len(files))
+	for i, f := range files {
+		cmd.ExtraFiles = append(cmd.ExtraFiles, f.file)
+		fdsStr = append(fdsStr, fmt.Sprintf("%v=%v", f.name, 3+i))
+	}
+	for _, env := range os.Environ() {
+		if strings.HasPrefix(env, ENV_EG_UPGRADE_FDS+"=") || strings.HasPrefix(env, ENV_EG_UAPI_FD+"=") {
+			continue
+		}
+		cmd.Env = append(cmd.Env, env)
+	}
+	cmd.Env = append(cmd.Env, ENV_EG_UPGRADE_FDS+"="+strings.Join(fdsStr, ","))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	readyW.Close()
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		_, err := readyR.Read(buf)
+		if err != nil {
+			err = errors.New("new process exited before ready")
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timeout waiting for new process")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	cmd.Process.Release()
+	return nil
+}
+
+// dupFile duplicates the fd without touching its blocking mode, unlike file.Fd().
+func dupFile(file *os.File) (*os.File, error) {
+	sysconn, err := file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var newfd int
+	var duperr error
+	err = sysconn.Control(func(fd uintptr) {
+		newfd, duperr = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if duperr != nil {
+		return nil, duperr
+	}
+	return os.NewFile(uintptr(newfd), file.Name()), nil
+}
@@ -4,6 +4,7 @@ import (
 	"math"
 	"strconv"
 	"sync/atomic"
+	"time"
 )
 
 // Nonnegative integer ID of vertex
@@ -14,93 +15,295 @@ const (
 	NodeID_Spread    Vertex = math.MaxUint16 - iota // p2p mode: boardcast to every know peer and prevent dup. super mode: send to supernode
 	NodeID_SuperNode Vertex = math.MaxUint16 - iota
 	NodeID_Invalid   Vertex = math.MaxUint16 - iota
-	NodeID_Special   Vertex = NodeID_Invalid
+	NodeID_Default   Vertex = math.MaxUint16 - iota // NextHopTable only: the next hop to any destination not in the table
+	NodeID_Special   Vertex = NodeID_Default
 )
 
 type EdgeConfig struct {
-	Interface             InterfaceConf    `yaml:"Interface"`
-	NodeID                Vertex           `yaml:"NodeID"`
-	NodeName              string           `yaml:"NodeName"`
-	PostScript            string           `yaml:"PostScript"`
-	DefaultTTL            uint8            `yaml:"DefaultTTL"`
-	L2FIBTimeout          float64          `yaml:"L2FIBTimeout"`
-	PrivKey               string           `yaml:"PrivKey"`
-	ListenPort            int              `yaml:"ListenPort"`
-	AfPrefer              int              `yaml:"AfPrefer"`
-	LogLevel              LoggerInfo       `yaml:"LogLevel"`
-	DynamicRoute          DynamicRouteInfo `yaml:"DynamicRoute"`
-	NextHopTable          NextHopTable     `yaml:"NextHopTable"`
-	ResetEndPointInterval float64          `yaml:"ResetEndPointInterval"`
-	Peers                 []PeerInfo       `yaml:"Peers"`
+	Interface               InterfaceConf        `yaml:"Interface"`
+	NodeID                  Vertex               `yaml:"NodeID"`
+	NodeName                string               `yaml:"NodeName"`
+	PostScript              string               `yaml:"PostScript"`
+	OnChangeScript          string               `yaml:"OnChangeScript"`
+	DefaultTTL              uint8                `yaml:"DefaultTTL"`
+	L2FIBTimeout            float64              `yaml:"L2FIBTimeout"`
+	L2FIBTimeoutVLAN        map[uint16]float64   `yaml:"L2FIBTimeoutVLAN"`
+	L2FIBStatic             []L2FIBStaticEntry   `yaml:"L2FIBStatic"`
+	ARPProxy                ARPProxyInfo         `yaml:"ARPProxy"`
+	ReliableFlood           ReliableFloodInfo    `yaml:"ReliableFlood"`
+	MessageAllowlist        MessageAllowlistInfo `yaml:"MessageAllowlist"`
+	PrivKey                 string               `yaml:"PrivKey"`
+	ListenPort              int                  `yaml:"ListenPort"`
+	ListenPortCount         int                  `yaml:"ListenPortCount"`
+	ListenPort_Data         int                  `yaml:"ListenPort_Data"`
+	ListenPort_Health       string               `yaml:"ListenPort_Health"`
+	AfPrefer                int                  `yaml:"AfPrefer"`
+	LogLevel                LoggerInfo           `yaml:"LogLevel"`
+	DynamicRoute            DynamicRouteInfo     `yaml:"DynamicRoute"`
+	NextHopTable            NextHopTable         `yaml:"NextHopTable"`
+	ResetEndPointInterval   float64              `yaml:"ResetEndPointInterval"`
+	ResolveEndpointInterval float64              `yaml:"ResolveEndpointInterval"`
+	CipherSuite             string               `yaml:"CipherSuite"`
+	RoamingRequireHandshake bool                 `yaml:"RoamingRequireHandshake"`
+	RoamingIPv6PrefixLen    int                  `yaml:"RoamingIPv6PrefixLen"`
+	Peers                   []PeerInfo           `yaml:"Peers"`
 }
 
 type SuperConfig struct {
 	NodeName                string                  `yaml:"NodeName"`
 	PostScript              string                  `yaml:"PostScript"`
+	OnChangeScript          string                  `yaml:"OnChangeScript"`
 	PrivKeyV4               string                  `yaml:"PrivKeyV4"`
 	PrivKeyV6               string                  `yaml:"PrivKeyV6"`
 	ListenPort              int                     `yaml:"ListenPort"`
+	AddressFamily           string                  `yaml:"AddressFamily"`
 	ListenPort_EdgeAPI      string                  `yaml:"ListenPort_EdgeAPI"`
 	ListenPort_ManageAPI    string                  `yaml:"ListenPort_ManageAPI"`
 	API_Prefix              string                  `yaml:"API_Prefix"`
+	ReverseProxy            ReverseProxyInfo        `yaml:"ReverseProxy"`
+	AuditLog                AuditLogInfo            `yaml:"AuditLog"`
+	EventLogFile            string                  `yaml:"EventLogFile"`
 	RePushConfigInterval    float64                 `yaml:"RePushConfigInterval"`
 	HttpPostInterval        float64                 `yaml:"HttpPostInterval"`
 	PeerAliveTimeout        float64                 `yaml:"PeerAliveTimeout"`
 	SendPingInterval        float64                 `yaml:"SendPingInterval"`
 	DampingResistance       float64                 `yaml:"DampingResistance"`
+	TTLMargin               uint8                   `yaml:"TTLMargin"`
 	LogLevel                LoggerInfo              `yaml:"LogLevel"`
 	Passwords               Passwords               `yaml:"Passwords"`
 	GraphRecalculateSetting GraphRecalculateSetting `yaml:"GraphRecalculateSetting"`
 	NextHopTable            NextHopTable            `yaml:"NextHopTable"`
+	StaticRoutes            []StaticRoute           `yaml:"StaticRoutes"`
 	EdgeTemplate            string                  `yaml:"EdgeTemplate"`
 	UsePSKForInterEdge      bool                    `yaml:"UsePSKForInterEdge"`
 	ResetEndPointInterval   float64                 `yaml:"ResetEndPointInterval"`
+	ResolveEndpointInterval float64                 `yaml:"ResolveEndpointInterval"`
+	HolePunchInterval       float64                 `yaml:"HolePunchInterval"`
+	HolePunchDelay          float64                 `yaml:"HolePunchDelay"`
+	MinSupportedVersion     string                  `yaml:"MinSupportedVersion"`
+	Observer                bool                    `yaml:"Observer"`
+	PeerStore               PeerStoreConfig         `yaml:"PeerStore"`
+	CipherSuite             string                  `yaml:"CipherSuite"`
+	SigningKey              string                  `yaml:"SigningKey"`
 	Peers                   []SuperPeerInfo         `yaml:"Peers"`
 }
 
 type Passwords struct {
-	ShowState   string `yaml:"ShowState"`
-	AddPeer     string `yaml:"AddPeer"`
-	DelPeer     string `yaml:"DelPeer"`
-	UpdatePeer  string `yaml:"UpdatePeer"`
-	UpdateSuper string `yaml:"UpdateSuper"`
+	ShowState   string     `yaml:"ShowState"`
+	AddPeer     string     `yaml:"AddPeer"`
+	DelPeer     string     `yaml:"DelPeer"`
+	UpdatePeer  string     `yaml:"UpdatePeer"`
+	UpdateSuper string     `yaml:"UpdateSuper"`
+	Inject      string     `yaml:"Inject"`
+	Tokens      []APIToken `yaml:"Tokens"`
+}
+
+// The scopes of APIToken are named after the passwords, a token with the scope is allowed where the password is
+const (
+	ScopeShowState   = "ShowState"
+	ScopeAddPeer     = "AddPeer"
+	ScopeDelPeer     = "DelPeer"
+	ScopeUpdatePeer  = "UpdatePeer"
+	ScopeUpdateSuper = "UpdateSuper"
+	ScopeInject      = "Inject"
+	ScopeAll         = "*"
+)
+
+var APIScopes = []string{ScopeShowState, ScopeAddPeer, ScopeDelPeer, ScopeUpdatePeer, ScopeUpdateSuper, ScopeInject, ScopeAll}
+
+// APIToken is a bearer token for the HTTP ManageAPI, sent as "Authorization: Bearer <Token>" instead of the Password parameter
+type APIToken struct {
+	Name    string   `yaml:"Name"`
+	Token   string   `yaml:"Token"`
+	Scopes  []string `yaml:"Scopes"`
+	Revoked bool     `yaml:"Revoked"`
+}
+
+// Of returns the password of the scope
+func (p Passwords) Of(scope string) string {
+	switch scope {
+	case ScopeShowState:
+		return p.ShowState
+	case ScopeAddPeer:
+		return p.AddPeer
+	case ScopeDelPeer:
+		return p.DelPeer
+	case ScopeUpdatePeer:
+		return p.UpdatePeer
+	case ScopeUpdateSuper:
+		return p.UpdateSuper
+	case ScopeInject:
+		return p.Inject
+	}
+	return ""
+}
+
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAll {
+			return true
+		}
+	}
+	return false
+}
+
+type ARPProxyInfo struct {
+	Enabled bool            `yaml:"Enabled"`
+	Timeout float64         `yaml:"Timeout"`
+	Static  []ARPProxyEntry `yaml:"Static"`
+}
+
+// ReliableFloodInfo selects the broadcast frames that must be acknowledged by every next hop, and retransmitted if not
+type ReliableFloodInfo struct {
+	EtherTypes []string `yaml:"EtherTypes"`
+	DstMacs    []string `yaml:"DstMacs"`
+	Timeout    float64  `yaml:"Timeout"`
+	Retries    int      `yaml:"Retries"`
+}
+
+type ARPProxyEntry struct {
+	IP      string `yaml:"IP"`
+	MacAddr string `yaml:"MacAddr"`
+}
+
+type L2FIBStaticEntry struct {
+	MacAddr string  `yaml:"MacAddr"`
+	NodeID  Vertex  `yaml:"NodeID"`
+	Timeout float64 `yaml:"Timeout"`
+}
+
+// ReverseProxyInfo is for running the HTTP API behind a reverse proxy
+type ReverseProxyInfo struct {
+	BasePath       string   `yaml:"BasePath"`       // the path prefix the proxy adds in front of API_Prefix
+	TrustedProxies []string `yaml:"TrustedProxies"` // IPs or CIDRs, the X-Forwarded-* headers are honored from these only
+	EdgeAPIUrl     string   `yaml:"EdgeAPIUrl"`     // the external URL of the EdgeAPI, filled into the EndpointEdgeAPIUrl of the new peers
+}
+
+// AuditLogInfo is the append-only log of the NhTable changes on the supernode
+type AuditLogInfo struct {
+	Path       string  `yaml:"Path"`
+	MaxSize    float64 `yaml:"MaxSize"` // MB, rotate the file when it's reached, 0 means never
+	MaxBackups int     `yaml:"MaxBackups"`
+}
+
+// AuditEntry is a line of the AuditLog, for a NhTable change
+type AuditEntry struct {
+	Time    time.Time
+	Trigger string // what made the supernode recalculate, like "pong 1->2"
+	OldHash string
+	Hash    string
+	Changes []AuditRouteChange
+}
+
+// AuditRouteChange is the next hop of Src to Dst before and after, nil if there was no route
+type AuditRouteChange struct {
+	Src Vertex
+	Dst Vertex
+	Old *Vertex `json:",omitempty"`
+	New *Vertex `json:",omitempty"`
+}
+
+type PeerStoreConfig struct {
+	Type         string  `yaml:"Type"`
+	Path         string  `yaml:"Path"`
+	SaveInterval float64 `yaml:"SaveInterval"`
 }
 
 type InterfaceConf struct {
-	IType         string `yaml:"IType"`
-	Name          string `yaml:"Name"`
-	VPPIFaceID    uint32 `yaml:"VPPIFaceID"`
-	VPPBridgeID   uint32 `yaml:"VPPBridgeID"`
-	MacAddrPrefix string `yaml:"MacAddrPrefix"`
-	IPv4CIDR      string `yaml:"IPv4CIDR"`
-	IPv6CIDR      string `yaml:"IPv6CIDR"`
-	IPv6LLPrefix  string `yaml:"IPv6LLPrefix"`
-	MTU           uint16 `yaml:"MTU"`
-	RecvAddr      string `yaml:"RecvAddr"`
-	SendAddr      string `yaml:"SendAddr"`
-	L2HeaderMode  string `yaml:"L2HeaderMode"`
+	IType              string   `yaml:"IType"`
+	Name               string   `yaml:"Name"`
+	VPPIFaceID         uint32   `yaml:"VPPIFaceID"`
+	VPPBridgeID        uint32   `yaml:"VPPBridgeID"`
+	MacAddrPrefix      string   `yaml:"MacAddrPrefix"`
+	IPv4CIDR           string   `yaml:"IPv4CIDR"`
+	IPv6CIDR           string   `yaml:"IPv6CIDR"`
+	IPv6LLPrefix       string   `yaml:"IPv6LLPrefix"`
+	AutoAddress        string   `yaml:"AutoAddress"`
+	MTU                uint16   `yaml:"MTU"`
+	RecvAddr           string   `yaml:"RecvAddr"`
+	SendAddr           string   `yaml:"SendAddr"`
+	RecvBacklog        int      `yaml:"RecvBacklog"`
+	RecvMaxConns       int      `yaml:"RecvMaxConns"`
+	L2HeaderMode       string   `yaml:"L2HeaderMode"`
+	AddressFamily      string   `yaml:"AddressFamily"`
+	AllowedEtherTypes  []string `yaml:"AllowedEtherTypes"`
+	SockRecvBufferSize int      `yaml:"SockRecvBufferSize"`
+	SockSendBufferSize int      `yaml:"SockSendBufferSize"`
+	MSSClamp           bool     `yaml:"MSSClamp"`
+	ReorderBufferMs    float64  `yaml:"ReorderBufferMs"`
+	UnknownUnicast     string   `yaml:"UnknownUnicast"`
+	ReadBatchSize      int      `yaml:"ReadBatchSize"`
+	NDProxy            bool     `yaml:"NDProxy"`
+	OnTapError         string   `yaml:"OnTapError"`
 }
 
+const (
+	OnTapErrorExit      = "exit"      // close the device and exit
+	OnTapErrorRetry     = "retry"     // read again after a while
+	OnTapErrorReconnect = "reconnect" // re-establish the connection of the *sock types, then read again
+)
+
+const (
+	UnknownUnicastFlood     = "flood"      // broadcast it, like a switch
+	UnknownUnicastDrop      = "drop"       // drop it
+	UnknownUnicastToGateway = "to-gateway" // send it by the default route of the NhTable
+)
+
+const (
+	AddressFamilyV4   = "v4"
+	AddressFamilyV6   = "v6"
+	AddressFamilyBoth = "both"
+	AddressFamilyNone = "none" // supernode only: no private keys and no devices, the edges poll the EdgeAPI with ControlTransport http
+)
+
 type PeerInfo struct {
-	NodeID              Vertex `yaml:"NodeID"`
-	PubKey              string `yaml:"PubKey"`
-	PSKey               string `yaml:"PSKey"`
-	EndPoint            string `yaml:"EndPoint"`
-	PersistentKeepalive uint32 `yaml:"PersistentKeepalive"`
-	Static              bool   `yaml:"Static"`
+	NodeID              Vertex        `yaml:"NodeID"`
+	PubKey              string        `yaml:"PubKey"`
+	PSKey               string        `yaml:"PSKey"`
+	EndPoint            string        `yaml:"EndPoint"`
+	PersistentKeepalive uint32        `yaml:"PersistentKeepalive"`
+	Static              bool          `yaml:"Static"`
+	Queue               PeerQueueInfo `yaml:"Queue"`
+	Tags                []string      `yaml:"Tags"`
+	Disabled            bool          `yaml:"Disabled"`
+	AllowedInnerCIDRs   []string      `yaml:"AllowedInnerCIDRs"`
+	Bandwidth           float64       `yaml:"Bandwidth"`
+	PingInterval        float64       `yaml:"PingInterval"`
+}
+
+// PeerQueueInfo is the outbound queue of a peer. The zero value means the default.
+type PeerQueueInfo struct {
+	Depth      int    `yaml:"Depth"`
+	FullPolicy string `yaml:"FullPolicy"`
 }
 
+const (
+	QueueFullBlock      = "block"
+	QueueFullDropOldest = "drop-oldest"
+)
+
 type SuperPeerInfo struct {
-	NodeID         Vertex  `yaml:"NodeID"`
-	Name           string  `yaml:"Name"`
-	PubKey         string  `yaml:"PubKey"`
-	PSKey          string  `yaml:"PSKey"`
-	AdditionalCost float64 `yaml:"AdditionalCost"`
-	SkipLocalIP    bool    `yaml:"SkipLocalIP"`
-	EndPoint       string  `yaml:"EndPoint"`
-	ExternalIP     string  `yaml:"ExternalIP"`
+	NodeID              Vertex   `yaml:"NodeID"`
+	Name                string   `yaml:"Name"`
+	PubKey              string   `yaml:"PubKey"`
+	PSKey               string   `yaml:"PSKey"`
+	AdditionalCost      float64  `yaml:"AdditionalCost"`
+	SkipLocalIP         bool     `yaml:"SkipLocalIP"`
+	EndPoint            string   `yaml:"EndPoint"`
+	ExternalIP          string   `yaml:"ExternalIP"`
+	Tags                []string `yaml:"Tags"`
+	PersistentKeepalive uint32   `yaml:"PersistentKeepalive"`
+	Disabled            bool     `yaml:"Disabled"`
+	Bandwidth           float64  `yaml:"Bandwidth"`
+	Zone                string   `yaml:"Zone"`
 }
 
+// TagGateway marks a peer as having a gateway, the SuperNode routes the unknown destinations of other peers to the nearest one
+const TagGateway = "gateway"
+
+// TagBorder marks a peer as a border node of its Zone, which routes between the zones
+const TagBorder = "border"
+
 type LoggerInfo struct {
 	LogLevel    string `yaml:"LogLevel"`
 	LogTransit  bool   `yaml:"LogTransit"`
@@ -108,6 +311,7 @@ type LoggerInfo struct {
 	LogControl  bool   `yaml:"LogControl"`
 	LogInternal bool   `yaml:"LogInternal"`
 	LogNTP      bool   `yaml:"LogNTP"`
+	LogDrop     bool   `yaml:"LogDrop"`
 }
 
 func (v *Vertex) ToString() string {
@@ -120,23 +324,68 @@ func (v *Vertex) ToString() string {
 		return "Super"
 	case NodeID_Invalid:
 		return "Invalid"
+	case NodeID_Default:
+		return "Default"
 	default:
 		return strconv.Itoa(int(*v))
 	}
 }
 
 type DynamicRouteInfo struct {
-	SendPingInterval     float64   `yaml:"SendPingInterval"`
-	PeerAliveTimeout     float64   `yaml:"PeerAliveTimeout"`
-	TimeoutCheckInterval float64   `yaml:"TimeoutCheckInterval"`
-	ConnNextTry          float64   `yaml:"ConnNextTry"`
-	DupCheckTimeout      float64   `yaml:"DupCheckTimeout"`
-	AdditionalCost       float64   `yaml:"AdditionalCost"`
-	DampingResistance    float64   `yaml:"DampingResistance"`
-	SaveNewPeers         bool      `yaml:"SaveNewPeers"`
-	SuperNode            SuperInfo `yaml:"SuperNode"`
-	P2P                  P2PInfo   `yaml:"P2P"`
-	NTPConfig            NTPInfo   `yaml:"NTPConfig"`
+	SendPingInterval     float64       `yaml:"SendPingInterval"`
+	PeerAliveTimeout     float64       `yaml:"PeerAliveTimeout"`
+	TimeoutCheckInterval float64       `yaml:"TimeoutCheckInterval"`
+	ConnNextTry          float64       `yaml:"ConnNextTry"`
+	DupCheckTimeout      float64       `yaml:"DupCheckTimeout"`
+	DupCheckTimeoutMin   float64       `yaml:"DupCheckTimeoutMin"`
+	AdditionalCost       float64       `yaml:"AdditionalCost"`
+	DampingResistance    float64       `yaml:"DampingResistance"`
+	SaveNewPeers         bool          `yaml:"SaveNewPeers"`
+	SupernodeLostPolicy  string        `yaml:"SupernodeLostPolicy"`
+	NoRoutePolicy        string        `yaml:"NoRoutePolicy"`
+	BootstrapNhTableTTL  float64       `yaml:"BootstrapNhTableTTL"`
+	LatencyLogFile       string        `yaml:"LatencyLogFile"`
+	WaitForSupernode     float64       `yaml:"WaitForSupernode"`
+	FlapBreaker          FlapInfo      `yaml:"FlapBreaker"`
+	ClockSkew            ClockSkewInfo `yaml:"ClockSkew"`
+	PingProbeMTUs        []int         `yaml:"PingProbeMTUs"`
+	SuperNode            SuperInfo     `yaml:"SuperNode"`
+	P2P                  P2PInfo       `yaml:"P2P"`
+	NTPConfig            NTPInfo       `yaml:"NTPConfig"`
+}
+
+const (
+	SupernodeLostKeepLast    = "keep_last"    // keep forwarding with the last NhTable from supernode
+	SupernodeLostP2PFallback = "p2p_fallback" // calculate the NhTable from P2P-learned latencies
+	SupernodeLostDropAll     = "drop_all"     // clear the NhTable, forward nothing until the supernode is back
+)
+
+const (
+	NoRouteDrop  = "drop"  // fail-closed, drop the packets without a next hop
+	NoRouteFlood = "flood" // fail-open, spread them to all the peers
+)
+
+// FlapInfo trips the circuit breaker of a peer re-connected Cycles times in Window(sec).
+// It's taken as down for Cooldown(sec), then tried again.
+type FlapInfo struct {
+	Cycles   int     `yaml:"Cycles"`
+	Window   float64 `yaml:"Window"`
+	Cooldown float64 `yaml:"Cooldown"`
+}
+
+// MessageAllowlistInfo narrows the message types accepted from the supernode and from the other peers, like "PingPacket".
+// Empty means all the types of the role: ServerUpdate and RegisterReply from the supernode,
+// NormalPacket and the edge to edge control messages from the others.
+type MessageAllowlistInfo struct {
+	SuperNode []string `yaml:"SuperNode"`
+	Peers     []string `yaml:"Peers"`
+}
+
+// ClockSkewInfo warns about a peer whose clock is off from ours by more than Threshold(sec), estimated by the pings.
+// With UseRTT, the latency to it is the half of the RTT instead, which doesn't depend on the clocks.
+type ClockSkewInfo struct {
+	Threshold float64 `yaml:"Threshold"`
+	UseRTT    bool    `yaml:"UseRTT"`
 }
 
 type NTPInfo struct {
@@ -158,11 +407,23 @@ type SuperInfo struct {
 	SkipLocalIP          bool     `yaml:"SkipLocalIP"`
 	AdditionalLocalIP    []string `yaml:"AdditionalLocalIP"`
 	SuperNodeInfoTimeout float64  `yaml:"SuperNodeInfoTimeout"`
+	NhTablePollTimeout   float64  `yaml:"NhTablePollTimeout"`
+	ControlTransport     string   `yaml:"ControlTransport"`
+	SigningPubKey        string   `yaml:"SigningPubKey"`
+	WeightV4             int      `yaml:"WeightV4"`
+	WeightV6             int      `yaml:"WeightV6"`
 }
 
+const (
+	ControlTransportUDP  = "udp"
+	ControlTransportTCP  = "tcp"  // control messages to/from the supernode by TCP/TLS to EndpointEdgeAPIUrl, data plane stays on UDP
+	ControlTransportHTTP = "http" // poll EndpointEdgeAPIUrl signed with the PSKey, for a supernode without private keys
+)
+
 type P2PInfo struct {
 	UseP2P                  bool                    `yaml:"UseP2P"`
 	SendPeerInterval        float64                 `yaml:"SendPeerInterval"`
+	DirectPathBonus         float64                 `yaml:"DirectPathBonus"`
 	GraphRecalculateSetting GraphRecalculateSetting `yaml:"GraphRecalculateSetting"`
 }
 
@@ -173,6 +434,51 @@ type GraphRecalculateSetting struct {
 	JitterToleranceMultiplier float64   `yaml:"JitterToleranceMultiplier"`
 	TimeoutCheckInterval      float64   `yaml:"TimeoutCheckInterval"`
 	RecalculateCoolDown       float64   `yaml:"RecalculateCoolDown"`
+	RecalcMode                string    `yaml:"RecalcMode"`
+	RecalcInterval            float64   `yaml:"RecalcInterval"`
+	ExternalCostFile          string    `yaml:"ExternalCostFile"`
+	ExternalCostPollInterval  float64   `yaml:"ExternalCostPollInterval"`
+	MinCost                   float64   `yaml:"MinCost"`
+	AsymmetricTimeout         float64   `yaml:"AsymmetricTimeout"`
+	ExcludeAsymmetric         bool      `yaml:"ExcludeAsymmetric"`
+	MinPeersForRouting        int       `yaml:"MinPeersForRouting"`
+	NegativeCyclePolicy       string    `yaml:"NegativeCyclePolicy"`
+	MaxHops                   int       `yaml:"MaxHops"`
+	Algorithm                 string    `yaml:"Algorithm"`
+	MaxEdgesPerNode           int       `yaml:"MaxEdgesPerNode"`
+	SuspectPeriod             float64   `yaml:"SuspectPeriod"`
+	SuspectPenalty            float64   `yaml:"SuspectPenalty"`
+}
+
+const (
+	RecalcModeEvent    = "event"    // recalculate on latency changes, limited by RecalculateCoolDown
+	RecalcModeInterval = "interval" // recalculate every RecalcInterval only
+	RecalcModeBoth     = "both"
+)
+
+const (
+	AlgorithmShortest = "shortest" // the lowest latency
+	AlgorithmWidest   = "widest"   // the largest bottleneck of the Bandwidth of the peers, then the lowest latency
+)
+
+const (
+	NegativeCycleKeepLast = "keep_last" // keep the last good NhTable if Floyd-Warshall fails with a negative cycle
+	NegativeCycleClear    = "clear"     // install the empty tables, everything is unreachable until the next good recalculation
+)
+
+// CipherSuite is the crypto primitives in use, for audit
+type CipherSuite struct {
+	Construction string
+	DH           string
+	AEAD         string
+	Hash         string
+}
+
+// StaticRoute pins the path from Src to Dst: Src -> Via... -> Dst
+type StaticRoute struct {
+	Src Vertex   `yaml:"Src"`
+	Dst Vertex   `yaml:"Dst"`
+	Via []Vertex `yaml:"Via"`
 }
 
 type DistTable map[Vertex]map[Vertex]float64
@@ -217,9 +523,10 @@ func (Connurl *API_connurl) GetList(UseLocal bool) (ret map[string]float64) {
 }
 
 type API_Peerinfo struct {
-	NodeID  Vertex
-	PSKey   string
-	Connurl *API_connurl
+	NodeID              Vertex
+	PSKey               string
+	PersistentKeepalive uint32
+	Connurl             *API_connurl
 }
 
 type API_SuperParams struct {
@@ -228,6 +535,243 @@ type API_SuperParams struct {
 	PeerAliveTimeout  float64
 	DampingResistance float64
 	AdditionalCost    float64
+	TTLMargin         uint8
+}
+
+// API_Error is the response of the HTTP API on error. Code is stable for programs, Message is for humans.
+type API_Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	API_ErrBadParam       = "bad_param"
+	API_ErrBadBody        = "bad_body"
+	API_ErrBadPassword    = "bad_password"
+	API_ErrBadToken       = "bad_token"
+	API_ErrForbidden      = "forbidden"
+	API_ErrBadSignature   = "bad_signature"
+	API_ErrInvalidPubKey  = "invalid_pubkey"
+	API_ErrInvalidPrivKey = "invalid_privkey"
+	API_ErrInvalidNhTable = "invalid_nhtable"
+	API_ErrInvalidConfig  = "invalid_config"
+	API_ErrPubKeyMismatch = "pubkey_mismatch"
+	API_ErrStateMismatch  = "state_mismatch"
+	API_ErrPeerNotFound   = "peer_not_found"
+	API_ErrPeerExists     = "peer_exists"
+	API_ErrNotReady       = "not_ready"
+	API_ErrInternal       = "internal"
+)
+
+// API_Inject is a fault injected to the links of a node by the ManageAPI, for chaos testing.
+type API_Inject struct {
+	Latency float64 // ms, added to the measured latency
+	Jitter  float64 // ms, a random value in [0,Jitter) is added as well
+	Loss    float64 // [0,1], the probability to drop a measured latency, like a lost ping
+}
+
+// AsymmetricLink is a pair of nodes reachable in one direction only, Src can reach Dst but Dst can't reach Src.
+type AsymmetricLink struct {
+	Src   Vertex
+	Dst   Vertex
+	Since time.Time
+}
+
+// SuspectLink is an edge without a new latency in the last SuspectPeriod of its TimeToAlive, penalized by SuspectPenalty
+type SuspectLink struct {
+	Src     Vertex
+	Dst     Vertex
+	Latency float64   // the last measured, in seconds
+	Since   time.Time // when it became suspect
+	Until   time.Time // when it times out, unless a new latency arrives
+}
+
+// PingProbeStats is the MTUs probed by the pings from a peer, received in PeerAliveTimeout
+type PingProbeStats struct {
+	MaxMTU   int
+	Received []int
+}
+
+// AdminDownLink is an edge taken out of routing by the administrator, with the latency still measured.
+type AdminDownLink struct {
+	Src     Vertex
+	Dst     Vertex
+	Latency float64 // measured, in seconds
+	Since   time.Time
+}
+
+// API_HolePunch is sent by the SuperNode to both EdgeNodes, to start sending to each other at the same time.
+type API_HolePunch struct {
+	PeerID  Vertex
+	Connurl API_connurl
+	StartAt time.Time
+}
+
+// EdgeMetrics is served by the EdgeNode at /metrics
+type EdgeMetrics struct {
+	DupCheck        DupCheckStats
+	Messages        MessageStats
+	EtherType       EtherTypeStats
+	ARPProxy        ARPProxyStats
+	Flood           ReliableFloodStats
+	Unknown         UnknownUnicastStats
+	NoRoute         NoRouteStats
+	InnerACL        InnerACLStats
+	Ingress         IngressStats
+	Breakers        map[Vertex]FlapBreakerState
+	PingProbe       map[Vertex]PingProbeStats
+	ClockSkew       map[Vertex]ClockSkewStats
+	Reorder         ReorderStats
+	Recalc          RecalcStats
+	Asymmetric      []AsymmetricLink // P2P mode only, pairs of peers reachable in one direction only
+	Register        RegisterStatus
+	NhTableRejected uint64 // downloaded NhTables not matching the hash announced by the supernode
+	TapError        TapErrorStats
+	SuperNode       map[string]SuperSessionStats // V4 and V6, with SuperNode.WeightV4 or WeightV6 only
+	Queues          map[Vertex]PeerQueueStats
+	Endpoints       map[Vertex]PeerEndpointStats
+}
+
+type DupCheckStats struct {
+	Window     float64 // current dedup window(sec)
+	Entries    int
+	Suppressed map[Vertex]uint64 // suppressed duplicates per source NodeID
+}
+
+// EtherTypeStats is the count of frames dropped by AllowedEtherTypes, by EtherType
+type EtherTypeStats struct {
+	Dropped map[string]uint64
+}
+
+// TapErrorStats is the count of the TAP read errors survived by InterfaceConf.OnTapError, and the reconnections made
+type TapErrorStats struct {
+	Errors     uint64
+	Reconnects uint64
+	LastError  string
+}
+
+// ARPProxyStats is the count of the IP->MAC entries, and the ARP/ND requests answered locally instead of flooded
+type ARPProxyStats struct {
+	Entries  int
+	Answered map[string]uint64
+}
+
+// ReorderStats is the current occupancy and the counters of the receive reordering buffer of InterfaceConf.ReorderBufferMs
+type ReorderStats struct {
+	Flows     int    // tracked TCP flows
+	Held      int    // frames held now
+	Reordered uint64 // out-of-order frames held
+	Restored  uint64 // held frames delivered in order after the gap was filled
+	TimedOut  uint64 // held frames delivered without the gap filled, after ReorderBufferMs or a RST
+	Overflow  uint64 // held frames delivered early because the buffer was full
+}
+
+// ReliableFloodStats is the count of the ReliableFlood broadcast frames sent to each next hop, and how they ended
+type ReliableFloodStats struct {
+	Pending       int    // waiting for the ack now
+	Sent          uint64 // frames sent to a next hop, not counting the retransmissions
+	Acked         uint64
+	Retransmitted uint64
+	Failed        uint64 // not acked after all the retries
+	Duplicates    uint64 // received again because our ack was lost, acked but not delivered again
+}
+
+// RegisterStatus is the last RegisterReplyMsg from the supernode, LastReply is zero if there is none
+type RegisterStatus struct {
+	Replies     uint64
+	LastReply   time.Time
+	Version     string // of the supernode
+	InSync      bool   // our NhTable, peers and SuperParams are the same as the supernode's
+	SuperParams API_SuperParams
+	Warnings    []string
+}
+
+// SuperSessionStats is the share of the control messages sent to a session of the supernode
+type SuperSessionStats struct {
+	Weight int
+	Alive  bool
+	Sent   uint64
+}
+
+// ClockSkewStats is the clock offset to a peer, estimated by the pings of both directions
+type ClockSkewStats struct {
+	Offset   float64 // sec, the clock of the peer minus ours
+	RTT      float64 // sec
+	Updated  time.Time
+	Exceeded bool // over DynamicRoute.ClockSkew.Threshold
+}
+
+// FlapBreakerState is the circuit breaker of a peer, by DynamicRoute.FlapBreaker
+type FlapBreakerState struct {
+	Cycles    int  // re-connections in the window
+	Open      bool // taken as down, not connecting to it
+	OpenUntil time.Time
+	Trips     uint64
+}
+
+// InnerACLStats is the count of the frames dropped by PeerInfo.AllowedInnerCIDRs, by the source NodeID
+type InnerACLStats struct {
+	Dropped map[Vertex]uint64
+}
+
+// IngressStats is the count of the messages dropped by MessageAllowlist, by the peer and the message type
+type IngressStats struct {
+	Dropped map[Vertex]map[string]uint64
+}
+
+// UnknownUnicastStats is the count of the unicast frames from the TAP whose destination MAC is not in the L2FIB, by how InterfaceConf.UnknownUnicast handled them
+type UnknownUnicastStats struct {
+	Flooded   uint64
+	Dropped   uint64 // by "drop", or by "to-gateway" without a default route
+	ToGateway uint64
+}
+
+// NoRouteStats is the count of the unicast packets without a next hop, by how DynamicRoute.NoRoutePolicy handled them
+type NoRouteStats struct {
+	Dropped uint64
+	Flooded uint64
+}
+
+// SuperMetrics is served by the SuperNode at /metrics
+type SuperMetrics struct {
+	Recalc RecalcStats
+}
+
+// RecalcStats is the cost of the Floyd-Warshall recalculations of the NhTable
+type RecalcStats struct {
+	Total        uint64
+	LastDuration float64 // ms
+	LastVertices int
+	PerMinute    int // recalculations in the last minute
+	Histogram    []HistogramBucket
+	NegCycles    uint64 // recalculations failed with a negative cycle
+	NegCycleNow  bool   // the last recalculation failed, the NhTable is the last good one with NegativeCyclePolicy keep_last
+	MaxHops      int    // the paths removed by GraphRecalculateSetting.MaxHops in the last recalculation
+	EdgesDropped uint64 // the edges dropped by GraphRecalculateSetting.MaxEdgesPerNode
+}
+
+// HistogramBucket counts the values <= LE, and > LE of the previous bucket. LE 0 means +Inf
+type HistogramBucket struct {
+	LE    float64
+	Count uint64
+}
+
+// MessageStats is the count of control messages by type. ServerUpdate is counted by its Action.
+type MessageStats struct {
+	Sent map[string]uint64
+	Recv map[string]uint64
+}
+
+type PeerEndpointStats struct {
+	Endpoint   string
+	LastChange time.Time // zero if never roamed
+	PathMTU    int       // zero if unknown
+}
+
+type PeerQueueStats struct {
+	Depth    int // packets in the outbound queue now
+	Capacity int
+	Dropped  uint64 // dropped by drop-oldest
 }
 
 type StateHash struct {
@@ -238,6 +782,14 @@ type StateHash struct {
 
 type API_Peers map[string]API_Peerinfo // map[PubKey]API_Peerinfo
 
+// API_PeersDiff is the response of peer/diff. Full means Updated is the whole list, the since hash was unknown or too old.
+type API_PeersDiff struct {
+	Hash    string
+	Full    bool
+	Updated API_Peers
+	Deleted []string // PubKey
+}
+
 type JWTSecret [32]byte
 
 const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
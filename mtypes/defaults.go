@@ -0,0 +1,58 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+// ApplyEdgeDefaults fills the omitted fields whose zero value is invalid or keeps a routine spinning, so a minimal config works.
+// Fields where zero is meaningful, like "0 means disabled", are left as is.
+//
+//	DefaultTTL                              200
+//	DynamicRoute.SendPingInterval           16
+//	DynamicRoute.PeerAliveTimeout           70
+//	DynamicRoute.DupCheckTimeout            40
+//	DynamicRoute.ConnNextTry                5
+//	DynamicRoute.P2P.SendPeerInterval       20
+//	DynamicRoute.NTPConfig.MaxServerUse     8
+//	DynamicRoute.NTPConfig.SyncTimeInterval 604800
+//	DynamicRoute.NTPConfig.NTPTimeout       3
+//	ReliableFlood.Timeout                   0.5
+func ApplyEdgeDefaults(econfig *EdgeConfig) {
+	if econfig.DefaultTTL == 0 {
+		econfig.DefaultTTL = 200
+	}
+	dr := &econfig.DynamicRoute
+	defaultFloat(&dr.SendPingInterval, 16)
+	defaultFloat(&dr.PeerAliveTimeout, 70)
+	defaultFloat(&dr.DupCheckTimeout, 40)
+	defaultFloat(&dr.ConnNextTry, 5)
+	defaultFloat(&dr.P2P.SendPeerInterval, 20)
+	applyNTPDefaults(&dr.NTPConfig)
+	defaultFloat(&econfig.ReliableFlood.Timeout, 0.5)
+}
+
+// ApplySuperDefaults is ApplyEdgeDefaults for the SuperNode.
+//
+//	RePushConfigInterval 30
+//	PeerAliveTimeout     70
+//	SendPingInterval     15
+func ApplySuperDefaults(sconfig *SuperConfig) {
+	defaultFloat(&sconfig.RePushConfigInterval, 30)
+	defaultFloat(&sconfig.PeerAliveTimeout, 70)
+	defaultFloat(&sconfig.SendPingInterval, 15)
+}
+
+func applyNTPDefaults(ntp *NTPInfo) {
+	if ntp.MaxServerUse == 0 {
+		ntp.MaxServerUse = 8
+	}
+	defaultFloat(&ntp.SyncTimeInterval, 604800)
+	defaultFloat(&ntp.NTPTimeout, 3)
+}
+
+func defaultFloat(v *float64, def float64) {
+	if *v == 0 {
+		*v = def
+	}
+}
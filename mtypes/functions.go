@@ -3,11 +3,16 @@ package mtypes
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	nonSecureRand "math/rand"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -90,13 +95,205 @@ func ReadYaml(filePath string, out interface{}) (err error) {
 	if err != nil {
 		return
 	}
+	yamlFile, err = ExpandEnv(yamlFile)
+	if err != nil {
+		return fmt.Errorf("%v: %v", filePath, err)
+	}
 	err = yaml.Unmarshal(yamlFile, out)
 	return
 }
 
+var envVarRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// ExpandEnv replaces ${VAR} with the environment variable, and ${VAR:-default} with the default if VAR is unset or empty.
+// $${VAR} is the literal ${VAR}. A ${VAR} without default is an error if VAR is unset. Comment lines are left as is.
+func ExpandEnv(in []byte) ([]byte, error) {
+	var missing []string
+	lines := bytes.SplitAfter(in, []byte("\n"))
+	for i, line := range lines {
+		if isCommentLine(line) {
+			continue
+		}
+		lines[i] = envVarRegex.ReplaceAllFunc(line, func(match []byte) []byte {
+			if match[1] == '$' {
+				return match[1:]
+			}
+			sub := envVarRegex.FindSubmatch(match)
+			name := string(sub[1])
+			val, ok := os.LookupEnv(name)
+			if sub[2] != nil {
+				if val == "" {
+					return sub[3]
+				}
+				return []byte(val)
+			}
+			if !ok {
+				missing = append(missing, name)
+			}
+			return []byte(val)
+		})
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("environment variable not set: %v", strings.Join(missing, ", "))
+	}
+	return bytes.Join(lines, nil), nil
+}
+
+// UsesEnv reports whether the config file has any ${VAR} for ExpandEnv, including the escaped $${VAR}.
+func UsesEnv(in []byte) bool {
+	for _, line := range bytes.SplitAfter(in, []byte("\n")) {
+		if !isCommentLine(line) && envVarRegex.Match(line) {
+			return true
+		}
+	}
+	return false
+}
+
+func isCommentLine(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte("#"))
+}
+
 func AbsInt(a int) int {
 	if a < 0 {
 		a *= -1
 	}
 	return a
 }
+
+// AddressFamilies returns which address families to bind for the AddressFamily setting. Empty means both.
+func AddressFamilies(af string) (use4 bool, use6 bool, err error) {
+	switch af {
+	case "", AddressFamilyBoth:
+		return true, true, nil
+	case AddressFamilyV4:
+		return true, false, nil
+	case AddressFamilyV6:
+		return false, true, nil
+	}
+	return false, false, fmt.Errorf("AddressFamily must be %v, %v or %v : %v", AddressFamilyV4, AddressFamilyV6, AddressFamilyBoth, af)
+}
+
+// EtherTypeLLC stands for the 802.3 frames with a length instead of EtherType, like STP
+const EtherTypeLLC uint16 = 0
+
+var etherTypeNames = map[string]uint16{
+	"ipv4": 0x0800,
+	"arp":  0x0806,
+	"rarp": 0x8035,
+	"ipv6": 0x86dd,
+	"mpls": 0x8847,
+	"lldp": 0x88cc,
+	"llc":  EtherTypeLLC,
+}
+
+// ParseEtherType parses a name in AllowedEtherTypes, like IPv4, ARP, IPv6, LLC or 0x88cc
+func ParseEtherType(s string) (uint16, error) {
+	if et, has := etherTypeNames[strings.ToLower(s)]; has {
+		return et, nil
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		et, err := strconv.ParseUint(s[2:], 16, 16)
+		if err == nil && et >= 0x0600 {
+			return uint16(et), nil
+		}
+	}
+	return 0, fmt.Errorf("AllowedEtherTypes: invalid EtherType : %v", s)
+}
+
+// EtherTypeString is the key of EtherTypeStats
+func EtherTypeString(et uint16) string {
+	if et == EtherTypeLLC {
+		return "LLC"
+	}
+	return fmt.Sprintf("0x%04x", et)
+}
+
+// ParseTags parses comma separated Tags, like "relay,gateway"
+func ParseTags(s string) []string {
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func HasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseSigningKey parses the SigningKey, a base64 encoded 32 bytes ed25519 seed
+func ParseSigningKey(s string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("SigningKey must be %v bytes : %v", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParseSigningPubKey parses the SigningPubKey, a base64 encoded ed25519 public key
+func ParseSigningPubKey(s string) (ed25519.PublicKey, error) {
+	pub, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("SigningPubKey must be %v bytes : %v", ed25519.PublicKeySize, len(pub))
+	}
+	return ed25519.PublicKey(pub), nil
+}
+
+func SigningPubKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// RenumberVertex returns new if v is old, v otherwise
+func RenumberVertex(v, old, new Vertex) Vertex {
+	if v == old {
+		return new
+	}
+	return v
+}
+
+// RenumberNhTable returns a copy of the NextHopTable with all the references to old, as the source,
+// the destination or the next hop, rewritten to new
+func RenumberNhTable(nh NextHopTable, old, new Vertex) NextHopTable {
+	if nh == nil {
+		return nil
+	}
+	ret := make(NextHopTable, len(nh))
+	for u, dsts := range nh {
+		row := make(map[Vertex]Vertex, len(dsts))
+		for v, next := range dsts {
+			row[RenumberVertex(v, old, new)] = RenumberVertex(next, old, new)
+		}
+		ret[RenumberVertex(u, old, new)] = row
+	}
+	return ret
+}
+
+// RenumberDistTable is RenumberNhTable for a DistTable
+func RenumberDistTable(dt DistTable, old, new Vertex) DistTable {
+	if dt == nil {
+		return nil
+	}
+	ret := make(DistTable, len(dt))
+	for u, dsts := range dt {
+		row := make(map[Vertex]float64, len(dsts))
+		for v, dist := range dsts {
+			row[RenumberVertex(v, old, new)] = dist
+		}
+		ret[RenumberVertex(u, old, new)] = row
+	}
+	return ret
+}
@@ -0,0 +1,62 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package mtypes
+
+import (
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("EG_TEST_SET", "value")
+	t.Setenv("EG_TEST_EMPTY", "")
+	tests := []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{"key: ${EG_TEST_SET}", "key: value", false},
+		{"key: ${EG_TEST_EMPTY}", "key: ", false},
+		{"key: ${EG_TEST_UNSET}", "", true},
+		{"key: ${EG_TEST_UNSET:-default}", "key: default", false},
+		{"key: ${EG_TEST_EMPTY:-default}", "key: default", false},
+		{"key: ${EG_TEST_SET:-default}", "key: value", false},
+		{"key: $${EG_TEST_UNSET}", "key: ${EG_TEST_UNSET}", false},
+		{"key: $EG_TEST_SET", "key: $EG_TEST_SET", false},
+		{"# ${EG_TEST_UNSET}\nkey: ${EG_TEST_SET}\n", "# ${EG_TEST_UNSET}\nkey: value\n", false},
+		{"  # $${EG_TEST_SET}", "  # $${EG_TEST_SET}", false},
+	}
+	for _, test := range tests {
+		out, err := ExpandEnv([]byte(test.in))
+		if test.err {
+			if err == nil {
+				t.Errorf("ExpandEnv(%q) = %q, want error", test.in, out)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ExpandEnv(%q): %v", test.in, err)
+		} else if string(out) != test.want {
+			t.Errorf("ExpandEnv(%q) = %q, want %q", test.in, out, test.want)
+		}
+	}
+}
+
+func TestUsesEnv(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"key: value", false},
+		{"key: ${VAR}", true},
+		{"key: $${VAR}", true},
+		{"# key: ${VAR}\nkey: value", false},
+	}
+	for _, test := range tests {
+		if got := UsesEnv([]byte(test.in)); got != test.want {
+			t.Errorf("UsesEnv(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}
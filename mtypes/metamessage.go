@@ -2,9 +2,15 @@ package mtypes
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -30,6 +36,8 @@ type RegisterMsg struct {
 	SuperParamStateHash string
 	JWTSecret           JWTSecret
 	HttpPostCount       uint64
+	ListenPorts         []uint16
+	DataPort            uint16 // ListenPort_Data, 0 if the peers use ListenPorts
 }
 
 func Hash2Str(h string) string {
@@ -52,6 +60,31 @@ func ParseRegisterMsg(bin []byte) (StructPlace RegisterMsg, err error) {
 	return
 }
 
+// RegisterReplyMsg acknowledges an accepted RegisterMsg. It carries the settings assigned to the edge,
+// the state hashes of the supernode and the warnings about the edge, for diagnostics only.
+// A rejected RegisterMsg is answered by a ThrowError ServerUpdateMsg instead.
+type RegisterReplyMsg struct {
+	Node_id             Vertex
+	Version             string // of the supernode
+	NhStateHash         string
+	PeerStateHash       string
+	SuperParamStateHash string
+	SuperParams         API_SuperParams
+	Warnings            []string
+}
+
+func (c *RegisterReplyMsg) ToString() string {
+	return fmt.Sprint("RegisterReplyMsg Node_id:"+c.Node_id.ToString(), " Version:"+c.Version, " NhHash:"+Hash2Str(c.NhStateHash), " PeerHash:"+Hash2Str(c.PeerStateHash), " SuperParamHash:"+Hash2Str(c.SuperParamStateHash), " Warnings:", c.Warnings)
+}
+
+func ParseRegisterReplyMsg(bin []byte) (StructPlace RegisterReplyMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
 type ServerCommand int
 
 const (
@@ -62,6 +95,8 @@ const (
 	UpdatePeer
 	UpdateNhTable
 	UpdateSuperParams
+	HolePunch
+	Renumber
 )
 
 func (a *ServerCommand) ToString() string {
@@ -78,16 +113,38 @@ func (a *ServerCommand) ToString() string {
 		return "UpdateNhTable"
 	case UpdateSuperParams:
 		return "UpdateSuperParams"
+	case HolePunch:
+		return "HolePunch"
+	case Renumber:
+		return "Renumber"
 	default:
 		return "Unknown"
 	}
 }
 
 type ServerUpdateMsg struct {
-	Node_id Vertex
-	Action  ServerCommand
-	Code    int
-	Params  string
+	Node_id   Vertex
+	Action    ServerCommand
+	Code      int
+	Params    string
+	Signature []byte // ed25519 signature by the SigningKey of the supernode, empty if not signed
+}
+
+// SignedData returns the bytes covered by the Signature
+func (c *ServerUpdateMsg) SignedData() []byte {
+	return []byte(c.Node_id.ToString() + "|" + strconv.Itoa(int(c.Action)) + "|" + strconv.Itoa(c.Code) + "|" + c.Params)
+}
+
+// Sign signs the message, nothing happens if key is nil
+func (c *ServerUpdateMsg) Sign(key ed25519.PrivateKey) {
+	if key == nil {
+		return
+	}
+	c.Signature = ed25519.Sign(key, c.SignedData())
+}
+
+func (c *ServerUpdateMsg) Verify(key ed25519.PublicKey) bool {
+	return len(c.Signature) == ed25519.SignatureSize && ed25519.Verify(key, c.SignedData(), c.Signature)
 }
 
 func ParseServerUpdateMsg(bin []byte) (StructPlace ServerUpdateMsg, err error) {
@@ -107,6 +164,8 @@ type PingMsg struct {
 	Src_nodeID   Vertex
 	Time         time.Time
 	RequestReply int
+	ProbeMTU     int                // padded for DynamicRouteInfo.PingProbeMTUs, 0 if not
+	Echo         map[Vertex]float64 // the delay(sec) of the last ping received from the receiver, for the clock offset
 }
 
 func (c *PingMsg) ToString() string {
@@ -142,6 +201,125 @@ func ParsePongMsg(bin []byte) (StructPlace PongMsg, err error) {
 	return
 }
 
+// LatencySample is a line of the DynamicRouteInfo.LatencyLogFile: unix_time,src,dst,latency_ms
+type LatencySample struct {
+	Time    time.Time
+	Src     Vertex
+	Dst     Vertex
+	Latency float64 // in seconds, like PongMsg.Timediff
+}
+
+func (c *LatencySample) ToCSV() string {
+	return fmt.Sprintf("%.3f,%v,%v,%.3f", float64(c.Time.UnixNano())/1e9, c.Src, c.Dst, c.Latency*1000)
+}
+
+func ParseLatencySample(line string) (ret LatencySample, err error) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) != 4 {
+		return ret, fmt.Errorf("want 4 fields, got %v", len(fields))
+	}
+	t, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return
+	}
+	ret.Time = time.Unix(0, int64(t*1e9))
+	if ret.Src, err = String2NodeID(fields[1]); err != nil {
+		return
+	}
+	if ret.Dst, err = String2NodeID(fields[2]); err != nil {
+		return
+	}
+	ms, err := strconv.ParseFloat(fields[3], 64)
+	ret.Latency = ms / 1000
+	return
+}
+
+const (
+	SuperEventRegister = "register" // unix_time,register,node_id,nh_state_hash
+	SuperEventPong     = "pong"     // unix_time,pong,src,dst,latency_ms,ttl,additional_cost
+	SuperEventCheck    = "check"    // unix_time,check : the timeout check
+	SuperEventInterval = "interval" // unix_time,interval : the recalculation of RecalcInterval
+)
+
+// SuperEvent is a line of the SuperConfig.EventLogFile, an event which may make the SuperNode push UpdateNhTable
+type SuperEvent struct {
+	Time           time.Time
+	Kind           string
+	Src            Vertex // the NodeID of a register
+	Dst            Vertex
+	Latency        float64 // in seconds, like PongMsg.Timediff
+	TimeToAlive    float64
+	AdditionalCost float64
+	NhStateHash    string
+}
+
+func (c *SuperEvent) ToCSV() string {
+	t := fmt.Sprintf("%.3f,%v", float64(c.Time.UnixNano())/1e9, c.Kind)
+	switch c.Kind {
+	case SuperEventRegister:
+		return fmt.Sprintf("%v,%v,%v", t, c.Src, c.NhStateHash)
+	case SuperEventPong:
+		return fmt.Sprintf("%v,%v,%v,%.3f,%v,%v", t, c.Src, c.Dst, c.Latency*1000, c.TimeToAlive, c.AdditionalCost)
+	}
+	return t
+}
+
+// ToPong returns the PongMsg of a pong event
+func (c *SuperEvent) ToPong() PongMsg {
+	return PongMsg{
+		Src_nodeID:     c.Src,
+		Dst_nodeID:     c.Dst,
+		Timediff:       c.Latency,
+		TimeToAlive:    c.TimeToAlive,
+		AdditionalCost: c.AdditionalCost,
+	}
+}
+
+func ParseSuperEvent(line string) (ret SuperEvent, err error) {
+	fields := strings.Split(strings.TrimSpace(line), ",")
+	if len(fields) < 2 {
+		return ret, fmt.Errorf("want at least 2 fields, got %v", len(fields))
+	}
+	t, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return
+	}
+	ret.Time = time.Unix(0, int64(t*1e9))
+	ret.Kind = fields[1]
+	want := map[string]int{SuperEventRegister: 4, SuperEventPong: 7, SuperEventCheck: 2, SuperEventInterval: 2}
+	n, ok := want[ret.Kind]
+	if !ok {
+		return ret, fmt.Errorf("unknown event : %v", ret.Kind)
+	}
+	if len(fields) != n {
+		return ret, fmt.Errorf("want %v fields for %v, got %v", n, ret.Kind, len(fields))
+	}
+	switch ret.Kind {
+	case SuperEventRegister:
+		if ret.Src, err = String2NodeID(fields[2]); err != nil {
+			return
+		}
+		ret.NhStateHash = fields[3]
+	case SuperEventPong:
+		if ret.Src, err = String2NodeID(fields[2]); err != nil {
+			return
+		}
+		if ret.Dst, err = String2NodeID(fields[3]); err != nil {
+			return
+		}
+		var ms float64
+		if ms, err = strconv.ParseFloat(fields[4], 64); err != nil {
+			return
+		}
+		ret.Latency = ms / 1000
+		if ret.TimeToAlive, err = strconv.ParseFloat(fields[5], 64); err != nil {
+			return
+		}
+		ret.AdditionalCost, err = strconv.ParseFloat(fields[6], 64)
+	}
+	return
+}
+
 type QueryPeerMsg struct {
 	Request_ID uint32
 }
@@ -177,6 +355,60 @@ func ParseBoardcastPeerMsg(bin []byte) (StructPlace BoardcastPeerMsg, err error)
 	return
 }
 
+type TraceHop struct {
+	NodeID  Vertex
+	Ingress time.Time // zero on the source
+	Egress  time.Time // zero on the destination
+}
+
+// TraceMsg goes from Src to Dst hop by hop, each node on the way appends itself to Hops.
+// Dst turns it into a Reply and sends it back to Src, the reply is not stamped.
+type TraceMsg struct {
+	Request_ID uint32
+	Src        Vertex
+	Dst        Vertex
+	Reply      bool
+	TTL        uint8
+	Error      string   // why the trace stopped before Dst
+	Expected   []Vertex // the path expected by the NhTable of Src
+	Hops       []TraceHop
+}
+
+func (c *TraceMsg) ToString() string {
+	hops := make([]string, len(c.Hops))
+	for i, hop := range c.Hops {
+		hops[i] = hop.NodeID.ToString()
+	}
+	return "TraceMsg Request_ID:" + strconv.Itoa(int(c.Request_ID)) + " Src:" + c.Src.ToString() + " Dst:" + c.Dst.ToString() + " Reply:" + strconv.FormatBool(c.Reply) + " Hops:" + strings.Join(hops, ",")
+}
+
+func ParseTraceMsg(bin []byte) (StructPlace TraceMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
+// BroadcastAckMsg acknowledges a ReliableFlood broadcast frame to the node which sent it to us.
+// The frame is identified by its origin and the sequence number given by the origin.
+type BroadcastAckMsg struct {
+	Src Vertex
+	Seq uint32
+}
+
+func (c *BroadcastAckMsg) ToString() string {
+	return "BroadcastAckMsg Src:" + c.Src.ToString() + " Seq:" + strconv.FormatUint(uint64(c.Seq), 10)
+}
+
+func ParseBroadcastAckMsg(bin []byte) (StructPlace BroadcastAckMsg, err error) {
+	var b bytes.Buffer
+	b.Write(bin)
+	d := gob.NewDecoder(&b)
+	err = d.Decode(&StructPlace)
+	return
+}
+
 type API_report_peerinfo struct {
 	Pongs    []PongMsg
 	LocalV4s map[string]float64
@@ -197,6 +429,27 @@ type API_report_peerinfo_jwt_claims struct {
 	jwt.StandardClaims
 }
 
+// PollTimeWindow is how far the Time of a poll to /edge/poll may be from the clock of the supernode
+const PollTimeWindow = 60 * time.Second
+
+// PollSig signs a poll to /edge/poll with ControlTransport http, the body is the RegisterMsg.
+// The posts to /edge/post/nodeinfo are signed the same way, as the polls don't carry the JWTSecret,
+// and the polls to /edge/nhtable with the Since hash as the body.
+// It's the HMAC-SHA256 of the Time in unix nanoseconds and the body, keyed by the PSKey of the EdgeNode.
+func PollSig(PSKey string, Time int64, body []byte) (string, error) {
+	key, err := base64.StdEncoding.DecodeString(PSKey)
+	if err != nil {
+		return "", fmt.Errorf("PSKey: %v", err)
+	}
+	if len(key) == 0 {
+		return "", errors.New("PSKey: empty")
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strconv.FormatInt(Time, 10) + "\n"))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
 type SUPER_Events struct {
 	Event_server_pong     chan PongMsg
 	Event_server_register chan RegisterMsg
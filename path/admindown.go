@@ -0,0 +1,59 @@
+package path
+
+import (
+	"sort"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// SetEdgeAdminDown takes the edge u->v out of routing, or brings it back. The latency is still measured
+// and reported by GetEdges, only Weight is Infinity. The nhTable is updated on the next recalculation.
+func (g *IG) SetEdgeAdminDown(u, v mtypes.Vertex, down bool) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	key := [2]mtypes.Vertex{u, v}
+	if !down {
+		delete(g.adminDown, key)
+	} else if _, ok := g.adminDown[key]; !ok {
+		g.adminDown[key] = g.now()
+	}
+}
+
+// IsEdgeAdminDown reports whether the edge u->v is taken out of routing by SetEdgeAdminDown.
+func (g *IG) IsEdgeAdminDown(u, v mtypes.Vertex) bool {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	_, ok := g.adminDown[[2]mtypes.Vertex{u, v}]
+	return ok
+}
+
+// ResetEdgeAdminDown brings back all the edges from or to the node, or all edges if id is NodeID_Broadcast.
+func (g *IG) ResetEdgeAdminDown(id mtypes.Vertex) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	for key := range g.adminDown {
+		if id == mtypes.NodeID_Broadcast || key[0] == id || key[1] == id {
+			delete(g.adminDown, key)
+		}
+	}
+}
+
+// AdminDown returns the edges taken out of routing with the measured latency, sorted by Src and Dst.
+func (g *IG) AdminDown() []mtypes.AdminDownLink {
+	g.edgelock.RLock()
+	ret := make([]mtypes.AdminDownLink, 0, len(g.adminDown))
+	for key, since := range g.adminDown {
+		ret = append(ret, mtypes.AdminDownLink{Src: key[0], Dst: key[1], Since: since})
+	}
+	g.edgelock.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Src != ret[j].Src {
+			return ret[i].Src < ret[j].Src
+		}
+		return ret[i].Dst < ret[j].Dst
+	})
+	for i := range ret {
+		ret[i].Latency = g.weight(ret[i].Src, ret[i].Dst, false, false, true)
+	}
+	return ret
+}
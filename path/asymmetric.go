@@ -0,0 +1,102 @@
+package path
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// asymLink tracks a pair of nodes with the edge alive in one direction only.
+type asymLink struct {
+	src, dst mtypes.Vertex // src -> dst is alive, dst -> src is not
+	since    time.Time
+	flagged  bool // asymmetric for AsymmetricTimeout
+}
+
+func pairOf(u, v mtypes.Vertex) [2]mtypes.Vertex {
+	if u > v {
+		u, v = v, u
+	}
+	return [2]mtypes.Vertex{u, v}
+}
+
+// alive reports whether the edge u->v is measured and not timed out. edgelock must be held.
+func (g *IG) alive(u, v mtypes.Vertex, now time.Time) bool {
+	l, ok := g.edges[u][v]
+	return ok && !now.After(l.validUntil)
+}
+
+// checkAsymmetric flags the pairs of nodes reachable in one direction only for AsymmetricTimeout,
+// like behind a one-way firewall. With ExcludeAsymmetric, both directions of a flagged pair are Infinity.
+func (g *IG) checkAsymmetric() {
+	if g.asymTimeout <= 0 {
+		return
+	}
+	now := g.now()
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	next := make(map[[2]mtypes.Vertex]*asymLink)
+	for u := range g.Vert {
+		for v := range g.Vert {
+			if u >= v {
+				continue
+			}
+			fwd, back := g.alive(u, v, now), g.alive(v, u, now)
+			if fwd == back {
+				continue
+			}
+			src, dst := u, v
+			if back {
+				src, dst = v, u
+			}
+			key := pairOf(u, v)
+			a, ok := g.asymmetric[key]
+			if !ok || a.src != src {
+				a = &asymLink{src: src, dst: dst, since: now}
+			}
+			if !a.flagged && now.Sub(a.since) >= g.asymTimeout {
+				a.flagged = true
+				if g.loglevel.LogControl {
+					fmt.Printf("Control: Asymmetric reachability: %v -> %v is alive but %v -> %v is not, for %v\n", src, dst, dst, src, now.Sub(a.since))
+				}
+			}
+			next[key] = a
+		}
+	}
+	for key, a := range g.asymmetric {
+		if _, ok := next[key]; !ok && a.flagged && g.loglevel.LogControl {
+			fmt.Printf("Control: Asymmetric reachability: %v <-> %v recovered\n", a.src, a.dst)
+		}
+	}
+	g.asymmetric = next
+}
+
+// isAsymmetric reports whether u and v are flagged and excluded by ExcludeAsymmetric. edgelock must be held.
+func (g *IG) isAsymmetric(u, v mtypes.Vertex) bool {
+	if !g.gsetting.ExcludeAsymmetric {
+		return false
+	}
+	a, ok := g.asymmetric[pairOf(u, v)]
+	return ok && a.flagged
+}
+
+// Asymmetric returns the flagged pairs of nodes reachable in one direction only.
+func (g *IG) Asymmetric() []mtypes.AsymmetricLink {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	ret := make([]mtypes.AsymmetricLink, 0, len(g.asymmetric))
+	for _, a := range g.asymmetric {
+		if a.flagged {
+			ret = append(ret, mtypes.AsymmetricLink{Src: a.src, Dst: a.dst, Since: a.since})
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Src != ret[j].Src {
+			return ret[i].Src < ret[j].Src
+		}
+		return ret[i].Dst < ret[j].Dst
+	})
+	return ret
+}
@@ -0,0 +1,46 @@
+package path
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// RoutinePollExternalCost loads the cost overrides from ExternalCostFile whenever it's modified,
+// so that an external routing daemon (FRR, BIRD, ...) can influence the Floyd-Warshall input.
+// The file is a DistTable in yaml, same as ManualLatency. recalculate is called after the overrides are replaced.
+func (g *IG) RoutinePollExternalCost(recalculate func()) {
+	filePath := g.gsetting.ExternalCostFile
+	interval := mtypes.S2TD(g.gsetting.ExternalCostPollInterval)
+	if filePath == "" || interval <= 0 {
+		return
+	}
+	var lastModTime time.Time
+	for {
+		if info, err := os.Stat(filePath); err != nil {
+			if !lastModTime.IsZero() {
+				// The file is removed, drop all the overrides
+				lastModTime = time.Time{}
+				g.ReplaceExternalCost(mtypes.DistTable{})
+				recalculate()
+			}
+		} else if !info.ModTime().Equal(lastModTime) {
+			var costs mtypes.DistTable
+			if err := mtypes.ReadYaml(filePath, &costs); err != nil {
+				if g.loglevel.LogInternal {
+					fmt.Printf("Internal: Failed to load ExternalCostFile %v: %v\n", filePath, err)
+				}
+			} else {
+				lastModTime = info.ModTime()
+				g.ReplaceExternalCost(costs)
+				if g.loglevel.LogInternal {
+					fmt.Printf("Internal: ExternalCostFile %v loaded\n", filePath)
+				}
+				recalculate()
+			}
+		}
+		time.Sleep(interval)
+	}
+}
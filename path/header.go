@@ -30,10 +30,13 @@ const (
 	PongPacket //Send to everyone, include server
 	QueryPeer
 	BroadcastPeer
+	TracePacket   // Comes from other peer, stamped by every hop
+	BroadcastAck  // Comes from the next hop of a ReliableFlood broadcast
+	RegisterReply // Comes from server, acknowledges a Register
 )
 
 func (v Usage) IsValid_EgType() bool {
-	if v >= NormalPacket && v <= BroadcastPeer {
+	if v >= NormalPacket && v <= RegisterReply {
 		return true
 	}
 	return false
@@ -63,11 +66,27 @@ func (v Usage) ToString() string {
 		return "QueryPeer"
 	case BroadcastPeer:
 		return "BroadcastPeer"
+	case TracePacket:
+		return "TracePacket"
+	case BroadcastAck:
+		return "BroadcastAck"
+	case RegisterReply:
+		return "RegisterReply"
 	default:
 		return "Unknown:" + string(uint8(v))
 	}
 }
 
+// ParseUsage is the reverse of ToString, for the message types only
+func ParseUsage(s string) (Usage, error) {
+	for v := NormalPacket; v.IsValid_EgType(); v++ {
+		if v.ToString() == s {
+			return v, nil
+		}
+	}
+	return 0, errors.New("unknown message type: " + s)
+}
+
 func (v Usage) IsNormal() bool {
 	return v == NormalPacket
 }
@@ -86,6 +105,12 @@ func (v Usage) IsControl() bool {
 		return true
 	case BroadcastPeer:
 		return true
+	case TracePacket:
+		return true
+	case BroadcastAck:
+		return true
+	case RegisterReply:
+		return true
 	default:
 		return false
 	}
@@ -95,6 +120,8 @@ func (v Usage) IsControl_Super2Edge() bool {
 	switch v {
 	case ServerUpdate:
 		return true
+	case RegisterReply:
+		return true
 	default:
 		return false
 	}
@@ -121,6 +148,10 @@ func (v Usage) IsControl_Edge2Edge() bool {
 		return true
 	case BroadcastPeer:
 		return true
+	case TracePacket:
+		return true
+	case BroadcastAck:
+		return true
 	default:
 		return false
 	}
@@ -0,0 +1,66 @@
+package path
+
+import (
+	"math/rand"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// SetInject injects a fault to all links from/to the node. It's applied to the latencies measured afterwards.
+func (g *IG) SetInject(id mtypes.Vertex, inject mtypes.API_Inject) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	g.injects[id] = inject
+}
+
+// ResetInject removes the fault of the node, or all faults if id is NodeID_Broadcast.
+// The injected latency is removed from the links at once, so they are back to the measured values.
+func (g *IG) ResetInject(id mtypes.Vertex) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if id == mtypes.NodeID_Broadcast {
+		g.injects = make(map[mtypes.Vertex]mtypes.API_Inject)
+	} else {
+		delete(g.injects, id)
+	}
+	for u, dsts := range g.edges {
+		for v, l := range dsts {
+			if l.injected == 0 {
+				continue
+			}
+			_, inject_u := g.injects[u]
+			_, inject_v := g.injects[v]
+			if inject_u || inject_v {
+				continue
+			}
+			l.ping -= l.injected
+			l.injected = 0
+		}
+	}
+}
+
+// GetInject returns the injected faults.
+func (g *IG) GetInject() map[mtypes.Vertex]mtypes.API_Inject {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	ret := make(map[mtypes.Vertex]mtypes.API_Inject, len(g.injects))
+	for id, inject := range g.injects {
+		ret[id] = inject
+	}
+	return ret
+}
+
+// injectDelay returns the latency(s) to add to the link u->v, and whether to drop the measured latency. edgelock must be held.
+func (g *IG) injectDelay(u, v mtypes.Vertex) (delay float64, drop bool) {
+	for _, id := range []mtypes.Vertex{u, v} {
+		inject, ok := g.injects[id]
+		if !ok {
+			continue
+		}
+		if inject.Loss > 0 && rand.Float64() < inject.Loss {
+			return 0, true
+		}
+		delay += inject.Latency + rand.Float64()*inject.Jitter
+	}
+	return delay / 1000, false
+}
@@ -0,0 +1,45 @@
+package path
+
+import (
+	"math"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestInject(t *testing.T) {
+	g, err := NewGraph(3, true, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-9 }
+
+	g.SetInject(2, mtypes.API_Inject{Latency: 100})
+	g.UpdateLatency(1, 2, 0.01, 99999, 0, false, false)
+	g.UpdateLatency(1, 3, 0.01, 99999, 0, false, false)
+	if w := g.Weight(1, 2, false); !near(w, 0.11) {
+		t.Errorf("injected weight 1->2 = %v, want 0.11", w)
+	}
+	if w := g.Weight(1, 3, false); !near(w, 0.01) {
+		t.Errorf("weight 1->3 = %v, want 0.01 without injection", w)
+	}
+
+	g.ResetInject(2)
+	if w := g.Weight(1, 2, false); !near(w, 0.01) {
+		t.Errorf("weight 1->2 after reset = %v, want the measured 0.01", w)
+	}
+	if len(g.GetInject()) != 0 {
+		t.Errorf("GetInject() = %v after reset, want empty", g.GetInject())
+	}
+
+	g.SetInject(3, mtypes.API_Inject{Loss: 1})
+	g.UpdateLatency(3, 1, 0.01, 99999, 0, false, false)
+	if w := g.Weight(3, 1, false); w != mtypes.Infinity {
+		t.Errorf("weight 3->1 = %v, want Infinity with Loss 1", w)
+	}
+	g.ResetInject(mtypes.NodeID_Broadcast)
+	g.UpdateLatency(3, 1, 0.01, 99999, 0, false, false)
+	if w := g.Weight(3, 1, false); !near(w, 0.01) {
+		t.Errorf("weight 3->1 after reset all = %v, want 0.01", w)
+	}
+}
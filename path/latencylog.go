@@ -0,0 +1,87 @@
+package path
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// ReadLatencyLog parses the samples written to DynamicRouteInfo.LatencyLogFile, sorted by time.
+// Empty lines and lines starting with # are skipped.
+func ReadLatencyLog(r io.Reader) ([]mtypes.LatencySample, error) {
+	ret := make([]mtypes.LatencySample, 0)
+	scanner := bufio.NewScanner(r)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sample, err := mtypes.ParseLatencySample(line)
+		if err != nil {
+			return ret, fmt.Errorf("parse error at line %v: %v", ln, err)
+		}
+		ret = append(ret, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return ret, err
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret, nil
+}
+
+func ReadLatencyLogFile(filePath string) ([]mtypes.LatencySample, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadLatencyLog(f)
+}
+
+// LatencyLogToPongs reduces the samples to the median latency of each src -> dst, for Solve
+func LatencyLogToPongs(samples []mtypes.LatencySample) []mtypes.PongMsg {
+	type pair struct{ src, dst mtypes.Vertex }
+	latencies := make(map[pair][]float64)
+	pairs := make([]pair, 0)
+	for _, s := range samples {
+		p := pair{s.Src, s.Dst}
+		if _, ok := latencies[p]; !ok {
+			pairs = append(pairs, p)
+		}
+		latencies[p] = append(latencies[p], s.Latency)
+	}
+	ret := make([]mtypes.PongMsg, 0, len(pairs))
+	for _, p := range pairs {
+		l := latencies[p]
+		sort.Float64s(l)
+		ret = append(ret, mtypes.PongMsg{
+			Src_nodeID:  p.src,
+			Dst_nodeID:  p.dst,
+			Timediff:    l[len(l)/2],
+			TimeToAlive: 999999,
+		})
+	}
+	return ret
+}
+
+// Replay reports the samples to the graph in order, moving the clock to the time of each sample
+// relative to the first one. Returns how many times the NhTable changed.
+func (s *SimNet) Replay(samples []mtypes.LatencySample) int {
+	if len(samples) == 0 {
+		return 0
+	}
+	start := s.Now
+	pushes := s.Pushes
+	for _, sample := range samples {
+		if now := start.Add(sample.Time.Sub(samples[0].Time)); now.After(s.Now) {
+			s.Now = now
+		}
+		s.SetLatency(sample.Src, sample.Dst, sample.Latency)
+	}
+	return s.Pushes - pushes
+}
@@ -0,0 +1,56 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// admitEdge makes room for the new edge u->v with weight w if u already has GraphRecalculateSetting.MaxEdgesPerNode edges,
+// to bound the graph a misbehaving node can report. The least useful edge of u is dropped: the one expired for the longest,
+// or the slowest if none expired. It returns false if the new edge is the slowest itself, which is dropped instead.
+// g.edgelock must be held.
+func (g *IG) admitEdge(u, v mtypes.Vertex, w float64) bool {
+	max := g.gsetting.MaxEdgesPerNode
+	if max <= 0 || len(g.edges[u]) < max {
+		return true
+	}
+	now := g.now()
+	var worst mtypes.Vertex
+	var worstEdge *Latency
+	for dst, e := range g.edges[u] {
+		if worstEdge == nil || lessUseful(e, worstEdge, now) {
+			worst, worstEdge = dst, e
+		}
+	}
+	g.recordEdgeDropped()
+	if !now.After(worstEdge.validUntil) && w >= worstEdge.ping {
+		if g.loglevel.LogInternal {
+			fmt.Printf("Internal: Edge %v -> %v dropped, %v reached MaxEdgesPerNode %v\n", u, v, u, max)
+		}
+		return false
+	}
+	delete(g.edges[u], worst)
+	if g.loglevel.LogInternal {
+		fmt.Printf("Internal: Edge %v -> %v dropped for %v -> %v, %v reached MaxEdgesPerNode %v\n", u, worst, u, v, u, max)
+	}
+	return true
+}
+
+// lessUseful reports whether the edge a is less useful than b: expired ones first, the longest expired first, then the slowest
+func lessUseful(a, b *Latency, now time.Time) bool {
+	aExpired, bExpired := now.After(a.validUntil), now.After(b.validUntil)
+	if aExpired != bExpired {
+		return aExpired
+	}
+	if aExpired {
+		return a.validUntil.Before(b.validUntil)
+	}
+	return a.ping > b.ping
+}
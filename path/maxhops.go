@@ -0,0 +1,111 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"fmt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// applyMaxHops reroutes the destinations further than GraphRecalculateSetting.MaxHops, to cap the worst-case latency
+// of the long detours after partial failures. Such a destination is sent by the shortest path within MaxHops instead,
+// or taken as unreachable if there is none.
+// It's a Bellman-Ford bounded by the hops, run per destination over the nodes already within MaxHops: a node too far takes
+// the best neighbor close enough, so the routes of the others are never changed and every path stays loop free.
+func (g *IG) applyMaxHops(dist mtypes.DistTable, next mtypes.NextHopTable) (pruned int) {
+	if g.gsetting.MaxHops <= 0 {
+		return 0
+	}
+	dsts := make(map[mtypes.Vertex]bool)
+	for _, row := range next {
+		for v := range row {
+			dsts[v] = true
+		}
+	}
+	for v := range dsts {
+		hops := make(map[mtypes.Vertex]int, len(next)) // the nodes within MaxHops to v
+		hops[v] = 0
+		var tooFar []mtypes.Vertex
+		for u := range next {
+			if u == v {
+				continue
+			}
+			if _, ok := next[u][v]; !ok {
+				continue
+			}
+			if path, err := nhTablePath(next, u, v); err == nil && len(path)-1 <= g.gsetting.MaxHops {
+				hops[u] = len(path) - 1
+			} else {
+				tooFar = append(tooFar, u)
+			}
+		}
+		pruned += len(tooFar)
+		for len(tooFar) > 0 {
+			type choice struct {
+				next mtypes.Vertex
+				dist float64
+			}
+			chosen := make(map[mtypes.Vertex]choice)
+			for _, u := range tooFar {
+				best := choice{next: mtypes.NodeID_Invalid, dist: mtypes.Infinity}
+				for _, y := range g.Neighbors(u) {
+					h, ok := hops[y]
+					if !ok || h+1 > g.gsetting.MaxHops {
+						continue
+					}
+					w := g.Weight(u, y, true)
+					if w >= mtypes.Infinity {
+						continue
+					}
+					if d := w + distOf(dist, y, v); d < best.dist {
+						best = choice{next: y, dist: d}
+					}
+				}
+				if best.next != mtypes.NodeID_Invalid {
+					chosen[u] = best
+				}
+			}
+			if len(chosen) == 0 {
+				break
+			}
+			remain := tooFar[:0]
+			for _, u := range tooFar {
+				c, ok := chosen[u]
+				if !ok {
+					remain = append(remain, u)
+					continue
+				}
+				next[u][v] = c.next
+				if _, ok := dist[u]; ok {
+					dist[u][v] = c.dist
+				}
+				hops[u] = hops[c.next] + 1
+			}
+			tooFar = remain
+		}
+		for _, u := range tooFar {
+			delete(next[u], v)
+			if _, ok := dist[u]; ok {
+				dist[u][v] = mtypes.Infinity
+			}
+		}
+	}
+	if pruned > 0 && g.loglevel.LogInternal {
+		fmt.Printf("Internal: %v paths longer than MaxHops %v rerouted or removed\n", pruned, g.gsetting.MaxHops)
+	}
+	return pruned
+}
+
+func distOf(dist mtypes.DistTable, u, v mtypes.Vertex) float64 {
+	if u == v {
+		return 0
+	}
+	if d, ok := dist[u][v]; ok {
+		return d
+	}
+	return mtypes.Infinity
+}
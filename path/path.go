@@ -15,13 +15,14 @@ import (
 )
 
 func (g *IG) GetCurrentTime() time.Time {
-	return time.Now().Add(g.ntp_offset).Round(0)
+	return g.now().Add(g.ntp_offset).Round(0)
 }
 
 type Latency struct {
 	ping           float64
 	ping_old       float64
 	additionalCost float64
+	injected       float64 // by SetInject, included in ping
 	validUntil     time.Time
 }
 
@@ -39,13 +40,37 @@ type IG struct {
 	SuperNodeInfoTimeout time.Duration
 	RecalculateCoolDown  time.Duration
 	TimeoutCheckInterval time.Duration
+	RecalcInterval       time.Duration
+	DirectPathBonus      float64 // seconds, prefer the direct edge if it's not slower than the best path by this value
+	minCost              float64 // seconds, the floor of the edge weight
+	suspectPeriod        time.Duration
+	suspectPenalty       float64 // seconds, added to the weight of the suspect edges
 	recalculateTime      time.Time
 	dlTable              mtypes.DistTable
 	nhTable              mtypes.NextHopTable
+	staticRoutes         mtypes.NextHopTable // pinned entries, overlaid onto the calculated nhTable
+	bootstrap            mtypes.NextHopTable // NextHopTable from the config, fills the gaps of the calculated nhTable until bootstrapExpire
+	bootstrapExpire      time.Time
+	externalCost         mtypes.DistTable          // cost overrides from an external routing daemon, in seconds
+	disabled             map[mtypes.Vertex]bool    // peers under maintenance, all the edges from or to them are Infinity
+	gateways             map[mtypes.Vertex]bool    // peers with a gateway, the nearest one is the default route of the others
+	bandwidth            map[mtypes.Vertex]float64 // link capacity(Mbps) of the peers for Algorithm widest, see SetBandwidth
+	zones                map[mtypes.Vertex]string  // the zones of the peers other than "", see SetZone
+	borders              map[mtypes.Vertex]bool    // the border nodes routing between the zones
+	asymmetric           map[[2]mtypes.Vertex]*asymLink
+	adminDown            map[[2]mtypes.Vertex]time.Time // edges taken out of routing by SetEdgeAdminDown, and since when
+	asymTimeout          time.Duration
+	injects              map[mtypes.Vertex]mtypes.API_Inject
 	changed              bool
+	routingReady         bool // MinPeersForRouting reached, the calculated nhTable is used from now on
+	coldStart            bool // no nhTable calculated since startup or ClearNHTable, the next one skips the cooldown
 	NhTableExpire        time.Time
 	IsSuperMode          bool
 	loglevel             mtypes.LoggerInfo
+	num_node             int              // expected node count, used to pre-size the maps
+	now                  func() time.Time // replaced by SimNet for virtual time
+	recalc               recalcStats
+	paths                pathCache
 
 	ntp_wg      sync.WaitGroup
 	ntp_info    mtypes.NTPInfo
@@ -57,11 +82,71 @@ func NewGraph(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateS
 	g := IG{
 		edgelock:             &sync.RWMutex{},
 		gsetting:             theconfig,
+		coldStart:            true,
 		RecalculateCoolDown:  mtypes.S2TD(theconfig.RecalculateCoolDown),
 		TimeoutCheckInterval: mtypes.S2TD(theconfig.TimeoutCheckInterval),
+		RecalcInterval:       mtypes.S2TD(theconfig.RecalcInterval),
 		ntp_info:             ntpinfo,
+		now:                  time.Now,
 	}
+	switch theconfig.RecalcMode {
+	case "", mtypes.RecalcModeEvent:
+	case mtypes.RecalcModeInterval, mtypes.RecalcModeBoth:
+		if g.RecalcInterval <= 0 {
+			return nil, fmt.Errorf("RecalcInterval must > 0 in RecalcMode %v : %v", theconfig.RecalcMode, theconfig.RecalcInterval)
+		}
+	default:
+		return nil, fmt.Errorf("unknown RecalcMode : %v", theconfig.RecalcMode)
+	}
+	switch theconfig.Algorithm {
+	case "", mtypes.AlgorithmShortest, mtypes.AlgorithmWidest:
+	default:
+		return nil, fmt.Errorf("unknown Algorithm : %v", theconfig.Algorithm)
+	}
+	switch theconfig.NegativeCyclePolicy {
+	case "", mtypes.NegativeCycleKeepLast, mtypes.NegativeCycleClear:
+	default:
+		return nil, fmt.Errorf("unknown NegativeCyclePolicy : %v", theconfig.NegativeCyclePolicy)
+	}
+	if theconfig.MinCost < 0 {
+		return nil, fmt.Errorf("MinCost must >= 0 : %v", theconfig.MinCost)
+	}
+	g.minCost = theconfig.MinCost / 1000
+	if theconfig.AsymmetricTimeout < 0 {
+		return nil, fmt.Errorf("AsymmetricTimeout must >= 0 : %v", theconfig.AsymmetricTimeout)
+	}
+	g.asymTimeout = mtypes.S2TD(theconfig.AsymmetricTimeout)
+	if theconfig.MinPeersForRouting < 0 {
+		return nil, fmt.Errorf("MinPeersForRouting must >= 0 : %v", theconfig.MinPeersForRouting)
+	}
+	if theconfig.SuspectPeriod < 0 || theconfig.SuspectPenalty < 0 {
+		return nil, fmt.Errorf("SuspectPeriod and SuspectPenalty must >= 0 : %v %v", theconfig.SuspectPeriod, theconfig.SuspectPenalty)
+	}
+	if theconfig.SuspectPeriod > 0 && theconfig.SuspectPenalty == 0 {
+		return nil, fmt.Errorf("SuspectPenalty must > 0 with SuspectPeriod : %v", theconfig.SuspectPeriod)
+	}
+	g.suspectPeriod = mtypes.S2TD(theconfig.SuspectPeriod)
+	g.suspectPenalty = theconfig.SuspectPenalty / 1000
+	if theconfig.MaxHops < 0 {
+		return nil, fmt.Errorf("MaxHops must >= 0 : %v", theconfig.MaxHops)
+	}
+	if theconfig.MaxEdgesPerNode < 0 {
+		return nil, fmt.Errorf("MaxEdgesPerNode must >= 0 : %v", theconfig.MaxEdgesPerNode)
+	}
+	if num_node < 0 {
+		num_node = 0
+	}
+	g.num_node = num_node
 	g.Vert = make(map[mtypes.Vertex]bool, num_node)
+	g.externalCost = make(mtypes.DistTable)
+	g.disabled = make(map[mtypes.Vertex]bool)
+	g.gateways = make(map[mtypes.Vertex]bool)
+	g.bandwidth = make(map[mtypes.Vertex]float64)
+	g.zones = make(map[mtypes.Vertex]string)
+	g.borders = make(map[mtypes.Vertex]bool)
+	g.asymmetric = make(map[[2]mtypes.Vertex]*asymLink)
+	g.adminDown = make(map[[2]mtypes.Vertex]time.Time)
+	g.injects = make(map[mtypes.Vertex]mtypes.API_Inject)
 	g.edges = make(map[mtypes.Vertex]map[mtypes.Vertex]*Latency, num_node)
 	g.IsSuperMode = IsSuperMode
 	g.loglevel = loglevel
@@ -85,7 +170,7 @@ func (g *IG) ShouldUpdate(oldval float64, newval float64, withCooldown bool) boo
 		return true
 	}
 	if withCooldown {
-		if g.recalculateTime.Add(g.RecalculateCoolDown).After(time.Now()) {
+		if g.recalculateTime.Add(g.RecalculateCoolDown).After(g.now()) {
 			return false
 		}
 	}
@@ -121,20 +206,75 @@ func (g *IG) CheckAnyShouldUpdate(withCooldown bool) bool {
 	return false
 }
 
+// RecalcOnEvent reports whether latency changes should trigger a recalculation.
+func (g *IG) RecalcOnEvent() bool {
+	return g.gsetting.RecalcMode != mtypes.RecalcModeInterval
+}
+
+// RecalcOnInterval reports whether RecalculateNhTableNow should be called every RecalcInterval.
+func (g *IG) RecalcOnInterval() bool {
+	return g.gsetting.RecalcMode == mtypes.RecalcModeInterval || g.gsetting.RecalcMode == mtypes.RecalcModeBoth
+}
+
 func (g *IG) RecalculateNhTable(checkchange bool) (changed bool) {
+	g.checkAsymmetric()
 	if g.gsetting.StaticMode {
 		if g.changed {
 			changed = checkchange
 		}
 		return
 	}
+	if g.coldStart {
+		// the first table after startup or ClearNHTable, converge right away instead of waiting for the cooldown
+		return g.recalculateNhTable(checkchange)
+	}
 	if !g.CheckAnyShouldUpdate(true) {
 		return
 	}
+	return g.recalculateNhTable(checkchange)
+}
+
+// RecalculateNhTableNow runs Floyd-Warshall regardless of JitterTolerance and RecalculateCoolDown.
+func (g *IG) RecalculateNhTableNow(checkchange bool) (changed bool) {
+	g.checkAsymmetric()
+	if g.gsetting.StaticMode {
+		return false
+	}
+	return g.recalculateNhTable(checkchange)
+}
 
-	dist, next, _ := g.FloydWarshall(false)
-	changed = false
-	if checkchange {
+func (g *IG) recalculateNhTable(checkchange bool) (changed bool) {
+	if !g.routingReady {
+		// keep the nhTable from the config until enough peers reported, instead of converging on an incomplete view
+		peers := g.reportedPeers()
+		if peers < g.gsetting.MinPeersForRouting {
+			return false
+		}
+		g.routingReady = true
+		if g.gsetting.MinPeersForRouting > 0 {
+			changed = checkchange
+			if g.loglevel.LogControl {
+				fmt.Printf("Control: %v peers reported, MinPeersForRouting %v reached, start routing\n", peers, g.gsetting.MinPeersForRouting)
+			}
+		}
+	}
+	start := time.Now()
+	dist, next, err := g.FloydWarshall(false)
+	g.recordRecalc(time.Since(start), len(dist))
+	g.recordNegativeCycle(err == ErrNegativeCycle)
+	if err == ErrNegativeCycle && g.gsetting.NegativeCyclePolicy != mtypes.NegativeCycleClear {
+		// a corrupt measurement shouldn't take down the routing, keep forwarding with the last good tables
+		if g.loglevel.LogControl {
+			fmt.Printf("Control: Floyd-Warshall failed: %v, keep the last NhTable\n", err)
+		}
+		g.recalculateTime = g.now()
+		return
+	}
+	g.applyBootstrap(next)
+	g.applyStaticRoutes(next)
+	g.recordMaxHops(g.applyMaxHops(dist, next))
+	g.applyGateways(dist, next)
+	if checkchange && !changed {
 	CheckLoop:
 		for src, dsts := range next {
 			for dst, old_next := range dsts {
@@ -145,9 +285,16 @@ func (g *IG) RecalculateNhTable(checkchange bool) (changed bool) {
 				}
 			}
 		}
+		for src := range g.nhTable {
+			_, had := g.nhTable[src][mtypes.NodeID_Default]
+			if _, has := next[src][mtypes.NodeID_Default]; had && !has {
+				changed = true // the default route is gone, not visible in the loop above
+			}
+		}
 	}
 	g.dlTable, g.nhTable = dist, next
-	g.recalculateTime = time.Now()
+	g.recalculateTime = g.now()
+	g.coldStart = false
 
 	return
 }
@@ -161,7 +308,7 @@ func (g *IG) RemoveVirt(v mtypes.Vertex, recalculate bool, checkchange bool) (ch
 	}
 	g.edgelock.Unlock()
 	g.changed = true
-	if recalculate {
+	if recalculate && g.RecalcOnEvent() {
 		changed = g.RecalculateNhTable(checkchange)
 	}
 	return
@@ -189,7 +336,11 @@ func (g *IG) UpdateLatencyMulti(pong_info []mtypes.PongMsg, recalculate bool, ch
 				newval = g.gsetting.ManualLatency[u][v] / 1000 // s to ms
 			}
 		}
-		w := newval
+		injected, drop := g.injectDelay(u, v)
+		if drop {
+			continue
+		}
+		w := newval + injected
 		additionalCost := pong_msg.AdditionalCost
 		if additionalCost < 0 {
 			additionalCost = 0
@@ -198,7 +349,7 @@ func (g *IG) UpdateLatencyMulti(pong_info []mtypes.PongMsg, recalculate bool, ch
 		g.Vert[v] = true
 		if _, ok := g.edges[u]; !ok {
 			g.recalculateTime = time.Time{}
-			g.edges[u] = make(map[mtypes.Vertex]*Latency)
+			g.edges[u] = make(map[mtypes.Vertex]*Latency, g.num_node)
 		}
 		g.edgelock.Unlock()
 		oldval := g.OldWeight(u, v, false)
@@ -206,23 +357,38 @@ func (g *IG) UpdateLatencyMulti(pong_info []mtypes.PongMsg, recalculate bool, ch
 		should_update = should_update || g.ShouldUpdate(oldval, w, false)
 		if _, ok := g.edges[u][v]; ok {
 			g.edges[u][v].ping = w
-			g.edges[u][v].validUntil = time.Now().Add(mtypes.S2TD(pong_msg.TimeToAlive))
+			g.edges[u][v].injected = injected
+			g.edges[u][v].validUntil = g.now().Add(mtypes.S2TD(pong_msg.TimeToAlive))
 			g.edges[u][v].additionalCost = additionalCost / 1000
-		} else {
+		} else if g.admitEdge(u, v, w) {
 			g.edges[u][v] = &Latency{
 				ping:           w,
 				ping_old:       mtypes.Infinity,
-				validUntil:     time.Now().Add(mtypes.S2TD(pong_msg.TimeToAlive)),
+				injected:       injected,
+				validUntil:     g.now().Add(mtypes.S2TD(pong_msg.TimeToAlive)),
 				additionalCost: additionalCost / 1000,
 			}
 		}
 	}
 	g.edgelock.Unlock()
-	if should_update && recalculate {
+	if should_update && recalculate && g.RecalcOnEvent() {
 		changed = g.RecalculateNhTable(checkchange)
 	}
 	return
 }
+
+// reportedPeers counts the peers reported their own latencies. A peer only seen as the dst of the others is not counted.
+func (g *IG) reportedPeers() (n int) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	for _, dsts := range g.edges {
+		if len(dsts) > 0 {
+			n++
+		}
+	}
+	return
+}
+
 func (g *IG) Vertices() map[mtypes.Vertex]bool {
 	vr := make(map[mtypes.Vertex]bool)
 	g.edgelock.RLock()
@@ -242,16 +408,27 @@ func (g *IG) Neighbors(v mtypes.Vertex) (vs []mtypes.Vertex) {
 }
 
 func (g *IG) Next(u, v mtypes.Vertex) mtypes.Vertex {
-	if _, ok := g.nhTable[u]; !ok {
-		return mtypes.NodeID_Invalid
+	if next, ok := nextHop(g.nhTable, u, v); ok {
+		return next
 	}
-	if _, ok := g.nhTable[u][v]; !ok {
-		return mtypes.NodeID_Invalid
+	return mtypes.NodeID_Invalid
+}
+
+// nextHop is nhTable[u][v], or the default route nhTable[u][NodeID_Default] if v is not in the table.
+func nextHop(nhTable mtypes.NextHopTable, u, v mtypes.Vertex) (mtypes.Vertex, bool) {
+	if next, ok := nhTable[u][v]; ok {
+		return next, true
 	}
-	return g.nhTable[u][v]
+	next, ok := nhTable[u][mtypes.NodeID_Default]
+	return next, ok
 }
 
 func (g *IG) Weight(u, v mtypes.Vertex, withAC bool) (ret float64) {
+	return g.weight(u, v, withAC, true, true)
+}
+
+// weight is Weight, with or without the edges taken out of routing by SetEdgeAdminDown, and with or without SuspectPenalty.
+func (g *IG) weight(u, v mtypes.Vertex, withAC bool, withAdminDown bool, withSuspect bool) (ret float64) {
 	g.edgelock.RLock()
 	defer g.edgelock.RUnlock()
 	//defer func() { fmt.Println(u, v, ret) }()
@@ -264,10 +441,25 @@ func (g *IG) Weight(u, v mtypes.Vertex, withAC bool) (ret float64) {
 	if _, ok := g.edges[u][v]; !ok {
 		return mtypes.Infinity
 	}
-	if time.Now().After(g.edges[u][v].validUntil) {
+	if g.now().After(g.edges[u][v].validUntil) {
+		return mtypes.Infinity
+	}
+	if g.disabled[u] || g.disabled[v] || g.isAsymmetric(u, v) {
+		return mtypes.Infinity
+	}
+	if _, down := g.adminDown[[2]mtypes.Vertex{u, v}]; down && withAdminDown {
 		return mtypes.Infinity
 	}
 	ret = g.edges[u][v].ping
+	if cost, ok := g.externalCost[u][v]; ok {
+		ret = cost
+	}
+	if ret < g.minCost {
+		ret = g.minCost
+	}
+	if withSuspect && g.isSuspect(g.edges[u][v], g.now()) {
+		ret += g.suspectPenalty
+	}
 	if withAC {
 		ret += g.edges[u][v].additionalCost
 	}
@@ -311,6 +503,115 @@ func (g *IG) SetWeight(u, v mtypes.Vertex, weight float64) {
 	g.edges[u][v].ping = weight
 }
 
+// SetExternalCost overrides the measured latency from u to v with cost(ms) while the link is alive.
+func (g *IG) SetExternalCost(u, v mtypes.Vertex, cost float64) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if _, ok := g.externalCost[u]; !ok {
+		g.externalCost[u] = make(map[mtypes.Vertex]float64)
+	}
+	g.externalCost[u][v] = externalCostToS(cost)
+}
+
+// ReplaceExternalCost replaces all the cost overrides(ms).
+func (g *IG) ReplaceExternalCost(costs mtypes.DistTable) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	g.externalCost = make(mtypes.DistTable, len(costs))
+	for u, dsts := range costs {
+		g.externalCost[u] = make(map[mtypes.Vertex]float64, len(dsts))
+		for v, cost := range dsts {
+			g.externalCost[u][v] = externalCostToS(cost)
+		}
+	}
+}
+
+// GetExternalCost returns the cost overrides(ms).
+func (g *IG) GetExternalCost() mtypes.DistTable {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	costs := make(mtypes.DistTable, len(g.externalCost))
+	for u, dsts := range g.externalCost {
+		costs[u] = make(map[mtypes.Vertex]float64, len(dsts))
+		for v, cost := range dsts {
+			if cost >= mtypes.Infinity {
+				costs[u][v] = mtypes.Infinity
+			} else {
+				costs[u][v] = cost * 1000
+			}
+		}
+	}
+	return costs
+}
+
+// SetDisabled excludes v from routing, or brings it back. The nhTable is updated on the next recalculation.
+func (g *IG) SetDisabled(v mtypes.Vertex, disabled bool) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if disabled {
+		g.disabled[v] = true
+	} else {
+		delete(g.disabled, v)
+	}
+}
+
+// SetGateway marks v as having a gateway, or not. The nhTable is updated on the next recalculation.
+func (g *IG) SetGateway(v mtypes.Vertex, gateway bool) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if gateway {
+		g.gateways[v] = true
+	} else {
+		delete(g.gateways, v)
+	}
+}
+
+// IsGateway reports whether v is marked by SetGateway.
+func (g *IG) IsGateway(v mtypes.Vertex) bool {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	return g.gateways[v]
+}
+
+// applyGateways sets the default route of every node, except the gateways themselves,
+// to the next hop towards the nearest reachable gateway. Ties go to the lower NodeID.
+func (g *IG) applyGateways(dist mtypes.DistTable, next mtypes.NextHopTable) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	for u := range next {
+		if g.gateways[u] {
+			continue
+		}
+		best, bestDist := mtypes.NodeID_Invalid, mtypes.Infinity
+		for gw := range g.gateways {
+			d, ok := dist[u][gw]
+			if _, reachable := next[u][gw]; !ok || !reachable || d >= mtypes.Infinity {
+				continue
+			}
+			if d < bestDist || (d == bestDist && gw < best) {
+				best, bestDist = gw, d
+			}
+		}
+		if best != mtypes.NodeID_Invalid {
+			next[u][mtypes.NodeID_Default] = next[u][best]
+		}
+	}
+}
+
+// IsDisabled reports whether v is excluded from routing by SetDisabled.
+func (g *IG) IsDisabled(v mtypes.Vertex) bool {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	return g.disabled[v]
+}
+
+func externalCostToS(cost float64) float64 {
+	if cost >= mtypes.Infinity {
+		return mtypes.Infinity
+	}
+	return cost / 1000
+}
+
 func (g *IG) SetOldWeight(u, v mtypes.Vertex, weight float64) {
 	g.edgelock.Lock()
 	defer g.edgelock.Unlock()
@@ -337,7 +638,33 @@ func (g *IG) RemoveAllNegativeValue() {
 	}
 }
 
+// ErrNegativeCycle is returned by FloydWarshall if the negative cycle is still there after removing the negative values.
+// The tables returned with it are empty.
+var ErrNegativeCycle = errors.New("negative cycle detected again")
+
+// FloydWarshall calculates the tables by the Algorithm of GraphRecalculateSetting.
+// If the widest paths loop hop by hop, the shortest paths are used instead.
 func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, next mtypes.NextHopTable, err error) {
+	if g.zoned() {
+		return g.floydWarshallZoned(again)
+	}
+	if g.gsetting.Algorithm != mtypes.AlgorithmWidest {
+		return g.floydWarshall(again, false)
+	}
+	dist, next, err = g.floydWarshall(again, true)
+	if err != nil {
+		return
+	}
+	if loopErr := loopFree(next); loopErr != nil {
+		if g.loglevel.LogControl {
+			fmt.Printf("Control: Widest paths not consistent: %v, use the shortest paths\n", loopErr)
+		}
+		return g.floydWarshall(again, false)
+	}
+	return
+}
+
+func (g *IG) floydWarshall(again bool, widest bool) (dist mtypes.DistTable, next mtypes.NextHopTable, err error) {
 	if g.loglevel.LogInternal {
 		if !again {
 			fmt.Println("Internal: Start Floyd Warshall algorithm")
@@ -347,11 +674,15 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, next mtypes.NextH
 		}
 	}
 	vert := g.Vertices()
-	dist = make(mtypes.DistTable)
-	next = make(mtypes.NextHopTable)
+	var width mtypes.DistTable // the bottleneck of the paths, for widest only
+	if widest {
+		width = g.linkWidths(vert)
+	}
+	dist = make(mtypes.DistTable, len(vert))
+	next = make(mtypes.NextHopTable, len(vert))
 	for u := range vert {
-		dist[u] = make(map[mtypes.Vertex]float64)
-		next[u] = make(map[mtypes.Vertex]mtypes.Vertex)
+		dist[u] = make(map[mtypes.Vertex]float64, len(vert))
+		next[u] = make(map[mtypes.Vertex]mtypes.Vertex, len(vert))
 		for v := range vert {
 			dist[u][v] = mtypes.Infinity
 		}
@@ -371,7 +702,13 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, next mtypes.NextH
 		for i := range vert {
 			for j := range vert {
 				if dist[i][k] < mtypes.Infinity && dist[k][j] < mtypes.Infinity {
-					if dist[i][j] > dist[i][k]+dist[k][j] {
+					if widest && i != j {
+						if better, bottleneck := widerPath(width, dist, i, k, j); better || dist[i][j] >= mtypes.Infinity {
+							width[i][j] = bottleneck
+							dist[i][j] = dist[i][k] + dist[k][j]
+							next[i][j] = next[i][k]
+						}
+					} else if dist[i][j] > dist[i][k]+dist[k][j] {
 						dist[i][j] = dist[i][k] + dist[k][j]
 						next[i][j] = next[i][k]
 					}
@@ -387,12 +724,15 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, next mtypes.NextH
 				}
 				g.RemoveAllNegativeValue()
 				err = errors.New("negative cycle detected")
-				dist, next, _ = g.FloydWarshall(true)
+				var againErr error
+				if dist, next, againErr = g.floydWarshall(true, widest); againErr != nil {
+					err = againErr
+				}
 				return
 			} else {
 				dist = make(mtypes.DistTable)
 				next = make(mtypes.NextHopTable)
-				err = errors.New("negative cycle detected again")
+				err = ErrNegativeCycle
 				if g.loglevel.LogInternal {
 					fmt.Println("Internal: Error: Negative cycle detected again")
 				}
@@ -400,26 +740,136 @@ func (g *IG) FloydWarshall(again bool) (dist mtypes.DistTable, next mtypes.NextH
 			}
 		}
 	}
+	if g.DirectPathBonus > 0 && !widest {
+		g.applyDirectPathBonus(dist, next)
+	}
 	return
 }
 
+// applyDirectPathBonus is applied after the Floyd-Warshall is done instead of in Weight(),
+// so that the bonus never makes any cost negative.
+// Forwarding to a direct neighbor always ends the path, so it can't create loops.
+func (g *IG) applyDirectPathBonus(dist mtypes.DistTable, next mtypes.NextHopTable) {
+	for u := range next {
+		for _, v := range g.Neighbors(u) {
+			if next[u][v] == v {
+				continue
+			}
+			w := g.Weight(u, v, true)
+			if w < mtypes.Infinity && w-g.DirectPathBonus <= dist[u][v] {
+				dist[u][v] = w
+				next[u][v] = v
+			}
+		}
+	}
+}
+
+// SetStaticRoutes pins the path of some (src,dst) pairs, the rest are still calculated by Floyd-Warshall.
+// The pinned paths are checked for conflicts and cycles before applied.
+func (g *IG) SetStaticRoutes(routes []mtypes.StaticRoute) error {
+	pinned := make(mtypes.NextHopTable)
+	for _, route := range routes {
+		hops := append(append([]mtypes.Vertex{route.Src}, route.Via...), route.Dst)
+		for i := 0; i < len(hops)-1; i++ {
+			u, next := hops[i], hops[i+1]
+			if _, ok := pinned[u]; !ok {
+				pinned[u] = make(map[mtypes.Vertex]mtypes.Vertex)
+			}
+			if old, ok := pinned[u][route.Dst]; ok && old != next {
+				return fmt.Errorf("StaticRoutes conflict: %v -> %v via %v and %v", u, route.Dst, old, next)
+			}
+			pinned[u][route.Dst] = next
+		}
+	}
+	for _, route := range routes {
+		if _, err := nhTablePath(pinned, route.Src, route.Dst); err != nil {
+			return fmt.Errorf("StaticRoutes %v -> %v: %v", route.Src, route.Dst, err)
+		}
+	}
+	g.edgelock.Lock()
+	g.staticRoutes = pinned
+	g.edgelock.Unlock()
+	return nil
+}
+
+// applyStaticRoutes overlays the pinned entries onto the calculated nhTable.
+// Entries of removed nodes are skipped, and so are the entries whose pinned path has a dead link,
+// which fall back to the calculated path instead of blackholing the traffic.
+func (g *IG) applyStaticRoutes(next mtypes.NextHopTable) {
+	g.edgelock.RLock()
+	pinned := g.staticRoutes
+	g.edgelock.RUnlock()
+	for u, dsts := range pinned {
+		if _, ok := next[u]; !ok {
+			continue
+		}
+		for dst, nexthop := range dsts {
+			if _, ok := next[dst]; !ok {
+				continue
+			}
+			if !g.pinnedPathUp(pinned, u, dst) {
+				continue
+			}
+			next[u][dst] = nexthop
+		}
+	}
+}
+
+// pinnedPathUp reports whether every link of the pinned path from u to dst is up.
+// The whole path is checked, not only the first hop, so no node is pinned towards a node which falls back.
+func (g *IG) pinnedPathUp(pinned mtypes.NextHopTable, u, dst mtypes.Vertex) bool {
+	path, err := nhTablePath(pinned, u, dst)
+	if err != nil {
+		return false
+	}
+	for i := 0; i < len(path)-1; i++ {
+		if g.Weight(path[i], path[i+1], true) >= mtypes.Infinity {
+			return false
+		}
+	}
+	return true
+}
+
+// Path returns the path from u to v in the NhTable, cached until the NhTable changes. Don't modify the returned slice.
 func (g *IG) Path(u, v mtypes.Vertex) (path []mtypes.Vertex, err error) {
 	g.edgelock.RLock()
 	defer g.edgelock.RUnlock()
+	return g.paths.path(g.nhTable, u, v)
+}
+
+// Hops returns the hop count from u to v in the NhTable, -1 if there is no path or it loops.
+// Unlike Path, it doesn't allocate, so it's cheap enough for every packet.
+func (g *IG) Hops(u, v mtypes.Vertex) int {
+	nhTable := g.nhTable
+	for hops := 0; hops <= len(nhTable); hops++ {
+		if u == v {
+			return hops
+		}
+		next, ok := nextHop(nhTable, u, v)
+		if !ok {
+			return -1
+		}
+		u = next
+	}
+	return -1
+}
+
+func nhTablePath(nhTable mtypes.NextHopTable, u, v mtypes.Vertex) (path []mtypes.Vertex, err error) {
 	footprint := make(map[mtypes.Vertex]bool)
 	for u != v {
 		if _, has := footprint[u]; has {
 			return path, fmt.Errorf("cycle detected in nhTable, s:%v e:%v path:%v", u, v, path)
 		}
-		if _, ok := g.nhTable[u]; !ok {
+		if _, ok := nhTable[u]; !ok {
 			return path, fmt.Errorf("nhTable[%v] not exist", u)
 		}
-		if _, ok := g.nhTable[u][v]; !ok {
+		next, ok := nextHop(nhTable, u, v)
+		if !ok {
 			return path, fmt.Errorf("nhTable[%v][%v] not exist", u, v)
 		}
 		path = append(path, u)
 		footprint[u] = true
-		u = g.nhTable[u][v]
+		u = next
 	}
 	path = append(path, u)
 	return path, nil
@@ -429,12 +879,74 @@ func (g *IG) SetNHTable(nh mtypes.NextHopTable) { // set nhTable from supernode
 	g.edgelock.Lock()
 	defer g.edgelock.Unlock()
 	g.nhTable = nh
+	g.bootstrap = nil
+	g.changed = true
+	g.NhTableExpire = g.now().Add(g.SuperNodeInfoTimeout)
+}
+
+// SetBootstrapNHTable uses the NextHopTable from the config before the first NhTable from supernode,
+// so we can forward instead of black-holing at cold start. It's honored for ttl, or until SetNHTable.
+// In the meantime, the NhTable calculated from the P2P-learned latencies wins, and the bootstrap only fills the gaps.
+func (g *IG) SetBootstrapNHTable(nh mtypes.NextHopTable, ttl time.Duration) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	g.nhTable = nh
+	g.bootstrap = nh
+	g.bootstrapExpire = g.now().Add(ttl)
 	g.changed = true
-	g.NhTableExpire = time.Now().Add(g.SuperNodeInfoTimeout)
+}
+
+// BootstrapExpire returns when the bootstrap NhTable expires, zero if there is none.
+func (g *IG) BootstrapExpire() time.Time {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	if g.bootstrap == nil {
+		return time.Time{}
+	}
+	return g.bootstrapExpire
+}
+
+// DropBootstrap stops using the bootstrap NhTable.
+// It returns false if there is none, because it's replaced by the supernode already.
+func (g *IG) DropBootstrap() bool {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if g.bootstrap == nil {
+		return false
+	}
+	g.bootstrap = nil
+	return true
+}
+
+func (g *IG) applyBootstrap(next mtypes.NextHopTable) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	if g.bootstrap == nil || g.now().After(g.bootstrapExpire) {
+		return
+	}
+	for u, dsts := range g.bootstrap {
+		if _, ok := next[u]; !ok {
+			next[u] = make(map[mtypes.Vertex]mtypes.Vertex, len(dsts))
+		}
+		for v, nh := range dsts {
+			if _, ok := next[u][v]; !ok {
+				next[u][v] = nh
+			}
+		}
+	}
+}
+
+// ClearNHTable drops all routes. Unlike SetNHTable, it doesn't refresh NhTableExpire.
+func (g *IG) ClearNHTable() {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	g.nhTable = make(mtypes.NextHopTable)
+	g.changed = true
+	g.coldStart = true
 }
 
 func (g *IG) GetNHTable(recalculate bool) mtypes.NextHopTable {
-	if recalculate && time.Now().After(g.NhTableExpire) {
+	if recalculate && g.now().After(g.NhTableExpire) {
 		g.RecalculateNhTable(false)
 	}
 	return g.nhTable
@@ -444,6 +956,7 @@ func (g *IG) GetDtst() mtypes.DistTable {
 	return g.dlTable
 }
 
+// GetEdges returns the weight of all edges. The edges taken out of routing by SetEdgeAdminDown report the measured value, see AdminDown.
 func (g *IG) GetEdges(isOld bool, withAC bool) (edges map[mtypes.Vertex]map[mtypes.Vertex]float64) {
 	vert := g.Vertices()
 	edges = make(map[mtypes.Vertex]map[mtypes.Vertex]float64, len(vert))
@@ -454,7 +967,7 @@ func (g *IG) GetEdges(isOld bool, withAC bool) (edges map[mtypes.Vertex]map[mtyp
 				if isOld {
 					edges[src][dst] = g.OldWeight(src, dst, withAC)
 				} else {
-					edges[src][dst] = g.Weight(src, dst, withAC)
+					edges[src][dst] = g.weight(src, dst, withAC, false, true)
 				}
 			}
 		}
@@ -462,6 +975,52 @@ func (g *IG) GetEdges(isOld bool, withAC bool) (edges map[mtypes.Vertex]map[mtyp
 	return
 }
 
+// GetRoutedEdges returns the weight of the edges in routing, without the ones taken out by SetEdgeAdminDown.
+// SuspectPenalty is not added, it only moves the routes away from an edge for a while before it times out.
+func (g *IG) GetRoutedEdges(withAC bool) (edges map[mtypes.Vertex]map[mtypes.Vertex]float64) {
+	vert := g.Vertices()
+	edges = make(map[mtypes.Vertex]map[mtypes.Vertex]float64, len(vert))
+	for src := range vert {
+		for dst := range vert {
+			if src == dst {
+				continue
+			}
+			w := g.weight(src, dst, withAC, true, false)
+			if w >= mtypes.Infinity {
+				continue
+			}
+			if _, ok := edges[src]; !ok {
+				edges[src] = make(map[mtypes.Vertex]float64)
+			}
+			edges[src][dst] = w
+		}
+	}
+	return
+}
+
+// GetLatencies returns all the edges that are still valid, in the form of pong messages.
+// It can be fed back into UpdateLatencyMulti to rebuild the graph.
+func (g *IG) GetLatencies() (pongs []mtypes.PongMsg) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	now := g.now()
+	for u, dsts := range g.edges {
+		for v, latency := range dsts {
+			if now.After(latency.validUntil) {
+				continue
+			}
+			pongs = append(pongs, mtypes.PongMsg{
+				Src_nodeID:     u,
+				Dst_nodeID:     v,
+				Timediff:       latency.ping,
+				TimeToAlive:    latency.validUntil.Sub(now).Seconds(),
+				AdditionalCost: latency.additionalCost * 1000,
+			})
+		}
+	}
+	return
+}
+
 func (g *IG) GetBoardcastList(id mtypes.Vertex) (tosend map[mtypes.Vertex]bool) {
 	tosend = make(map[mtypes.Vertex]bool)
 	for _, element := range g.nhTable[id] {
@@ -540,13 +1099,20 @@ func Solve(filePath string, pe bool) error {
 	}
 
 	g, _ := NewGraph(3, false, mtypes.GraphRecalculateSetting{}, mtypes.NTPInfo{}, mtypes.LoggerInfo{LogInternal: false})
-	inputb, err := ioutil.ReadFile(filePath)
-	if err != nil {
-		return err
+	var all_edge []mtypes.PongMsg
+	if strings.HasSuffix(filePath, ".csv") {
+		samples, err := ReadLatencyLogFile(filePath)
+		if err != nil {
+			return err
+		}
+		all_edge = LatencyLogToPongs(samples)
+	} else {
+		inputb, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		all_edge, _ = ParseDistanceMatrix(string(inputb))
 	}
-
-	input := string(inputb)
-	all_edge, _ := ParseDistanceMatrix(input)
 	g.UpdateLatencyMulti(all_edge, false, false)
 	dist, next, err := g.FloydWarshall(false)
 	if err != nil {
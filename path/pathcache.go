@@ -0,0 +1,57 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+const pathCacheMax = 65536 // paths beyond this are computed without caching
+
+type pathKey struct {
+	src, dst mtypes.Vertex
+}
+
+type cachedPath struct {
+	path []mtypes.Vertex
+	err  error
+}
+
+// pathCache remembers the paths walked in the nhTable. GetBoardcastThroughList walks Path(src, x) for every x
+// in the broadcast list of every frame, so it's hot for the broadcast-heavy workloads.
+// The nhTable is never modified in place, it's replaced as a whole, so the cache is keyed by the map it's built from
+// and dropped once the nhTable is a different one.
+type pathCache struct {
+	table mtypes.NextHopTable // keeps the map alive, so its address isn't reused by a new one
+	paths map[pathKey]cachedPath
+	sync.Mutex
+}
+
+func sameTable(a, b mtypes.NextHopTable) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// path returns the path from u to v in nhTable. The returned slice is shared, don't modify it.
+func (c *pathCache) path(nhTable mtypes.NextHopTable, u, v mtypes.Vertex) ([]mtypes.Vertex, error) {
+	key := pathKey{src: u, dst: v}
+	c.Lock()
+	defer c.Unlock()
+	if c.paths == nil || !sameTable(c.table, nhTable) {
+		c.table = nhTable
+		c.paths = make(map[pathKey]cachedPath)
+	}
+	if p, ok := c.paths[key]; ok {
+		return p.path, p.err
+	}
+	path, err := nhTablePath(nhTable, u, v)
+	if len(c.paths) < pathCacheMax {
+		c.paths[key] = cachedPath{path: path, err: err}
+	}
+	return path, err
+}
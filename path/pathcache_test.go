@@ -0,0 +1,70 @@
+package path
+
+import (
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestPathCache(t *testing.T) {
+	s := newTriangle(t)
+	p1, _ := s.G.Path(1, 2)
+	p2, _ := s.G.Path(1, 2)
+	if &p1[0] != &p2[0] {
+		t.Error("Path(1, 2) is not cached")
+	}
+	s.Advance(10 * time.Second)
+	s.SetLink(1, 2, 0.100)
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.G.SetNHTable(mtypes.NextHopTable{1: {2: 2}})
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.G.Path(1, 3); err == nil {
+		t.Error("Path(1, 3) not in the NhTable")
+	}
+	s.G.ClearNHTable()
+	if _, err := s.G.Path(1, 2); err == nil {
+		t.Error("Path(1, 2) after ClearNHTable")
+	}
+}
+
+// 50 nodes in a ring, with a chord to the opposite side from every 5th node
+func newBroadcastNet() *SimNet {
+	const n = 50
+	s := NewSimNet(n, true, simSetting)
+	for i := mtypes.Vertex(1); i <= n; i++ {
+		s.SetLink(i, i%n+1, 0.010)
+		if i%5 == 0 {
+			s.SetLink(i, (i+n/2-1)%n+1, 0.030)
+		}
+	}
+	s.G.RecalculateNhTableNow(false)
+	return s
+}
+
+func benchmarkBroadcast(b *testing.B, cached bool) {
+	s := newBroadcastNet()
+	vert := s.G.Vertices()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !cached {
+			s.G.paths.paths = nil
+		}
+		for src := range vert {
+			for self := range vert {
+				if _, errs := s.G.GetBoardcastThroughList(self, src, src); len(errs) > 0 {
+					b.Fatal(errs)
+				}
+			}
+		}
+	}
+}
+
+func BenchmarkBroadcastThroughList(b *testing.B) {
+	b.Run("cached", func(b *testing.B) { benchmarkBroadcast(b, true) })
+	b.Run("uncached", func(b *testing.B) { benchmarkBroadcast(b, false) })
+}
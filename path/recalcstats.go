@@ -0,0 +1,115 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// recalcBuckets are the upper bounds(ms) of the histogram of the Floyd-Warshall durations, the last one is +Inf
+var recalcBuckets = []float64{1, 10, 100, 1000}
+
+// recalcStats tells when the O(n^3) Floyd-Warshall is becoming a bottleneck
+type recalcStats struct {
+	total        uint64
+	lastDuration time.Duration
+	lastVertices int
+	recent       []time.Time // the recalculations in the last minute
+	histogram    []uint64    // len(recalcBuckets)+1
+	negCycles    uint64
+	negCycleNow  bool
+	maxHops      int    // the paths removed by MaxHops in the last recalculation
+	edgesDropped uint64 // by MaxEdgesPerNode
+	sync.Mutex
+}
+
+func (g *IG) recordRecalc(d time.Duration, vertices int) {
+	s := &g.recalc
+	now := g.now()
+	s.Lock()
+	s.total++
+	s.lastDuration = d
+	s.lastVertices = vertices
+	if s.histogram == nil {
+		s.histogram = make([]uint64, len(recalcBuckets)+1)
+	}
+	ms := float64(d) / float64(time.Millisecond)
+	i := 0
+	for i < len(recalcBuckets) && ms > recalcBuckets[i] {
+		i++
+	}
+	s.histogram[i]++
+	s.recent = append(s.recent, now)
+	s.trim(now)
+	s.Unlock()
+	if g.loglevel.LogInternal {
+		fmt.Printf("Internal: Floyd Warshall done in %v, %v vertices\n", d, vertices)
+	}
+}
+
+func (g *IG) recordNegativeCycle(failed bool) {
+	s := &g.recalc
+	s.Lock()
+	defer s.Unlock()
+	if failed {
+		s.negCycles++
+	}
+	s.negCycleNow = failed && g.gsetting.NegativeCyclePolicy != mtypes.NegativeCycleClear
+}
+
+func (g *IG) recordMaxHops(pruned int) {
+	s := &g.recalc
+	s.Lock()
+	defer s.Unlock()
+	s.maxHops = pruned
+}
+
+func (g *IG) recordEdgeDropped() {
+	s := &g.recalc
+	s.Lock()
+	defer s.Unlock()
+	s.edgesDropped++
+}
+
+func (s *recalcStats) trim(now time.Time) {
+	i := 0
+	for i < len(s.recent) && now.Sub(s.recent[i]) > time.Minute {
+		i++
+	}
+	s.recent = s.recent[i:]
+}
+
+// RecalcStats returns the duration and vertex count of the last Floyd-Warshall, and how often it runs.
+func (g *IG) RecalcStats() mtypes.RecalcStats {
+	s := &g.recalc
+	s.Lock()
+	defer s.Unlock()
+	s.trim(g.now())
+	ret := mtypes.RecalcStats{
+		Total:        s.total,
+		LastDuration: float64(s.lastDuration) / float64(time.Millisecond),
+		LastVertices: s.lastVertices,
+		PerMinute:    len(s.recent),
+		Histogram:    make([]mtypes.HistogramBucket, len(recalcBuckets)+1),
+		NegCycles:    s.negCycles,
+		NegCycleNow:  s.negCycleNow,
+		MaxHops:      s.maxHops,
+		EdgesDropped: s.edgesDropped,
+	}
+	for i := range ret.Histogram {
+		if i < len(recalcBuckets) {
+			ret.Histogram[i].LE = recalcBuckets[i]
+		}
+		if s.histogram != nil {
+			ret.Histogram[i].Count = s.histogram[i]
+		}
+	}
+	return ret
+}
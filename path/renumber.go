@@ -0,0 +1,58 @@
+package path
+
+import (
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// Renumber moves everything the graph knows about the vertex old to new: the latencies, the NhTable and
+// all the tables referencing it, and the marks like SetDisabled, SetGateway, SetBandwidth and SetEdgeAdminDown. new must not be in the graph.
+// The routes are not recalculated, the caller pushes the renumbered NhTable.
+func (g *IG) Renumber(old, new mtypes.Vertex) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if g.Vert[old] {
+		delete(g.Vert, old)
+		g.Vert[new] = true
+	}
+	edges := make(map[mtypes.Vertex]map[mtypes.Vertex]*Latency, len(g.edges))
+	for u, dsts := range g.edges {
+		row := make(map[mtypes.Vertex]*Latency, len(dsts))
+		for v, l := range dsts {
+			row[mtypes.RenumberVertex(v, old, new)] = l
+		}
+		edges[mtypes.RenumberVertex(u, old, new)] = row
+	}
+	g.edges = edges
+	g.dlTable = mtypes.RenumberDistTable(g.dlTable, old, new)
+	g.nhTable = mtypes.RenumberNhTable(g.nhTable, old, new)
+	g.staticRoutes = mtypes.RenumberNhTable(g.staticRoutes, old, new)
+	g.bootstrap = mtypes.RenumberNhTable(g.bootstrap, old, new)
+	g.externalCost = mtypes.RenumberDistTable(g.externalCost, old, new)
+	g.gsetting.ManualLatency = mtypes.RenumberDistTable(g.gsetting.ManualLatency, old, new)
+	for _, marks := range []map[mtypes.Vertex]bool{g.disabled, g.gateways} {
+		if marks[old] {
+			delete(marks, old)
+			marks[new] = true
+		}
+	}
+	if mbps, ok := g.bandwidth[old]; ok {
+		delete(g.bandwidth, old)
+		g.bandwidth[new] = mbps
+	}
+	if inject, ok := g.injects[old]; ok {
+		delete(g.injects, old)
+		g.injects[new] = inject
+	}
+	for key, since := range g.adminDown {
+		if key[0] == old || key[1] == old {
+			delete(g.adminDown, key)
+			g.adminDown[[2]mtypes.Vertex{mtypes.RenumberVertex(key[0], old, new), mtypes.RenumberVertex(key[1], old, new)}] = since
+		}
+	}
+	for key := range g.asymmetric {
+		if key[0] == old || key[1] == old {
+			delete(g.asymmetric, key) // found again with the new pair on the next check
+		}
+	}
+	g.changed = true
+}
@@ -0,0 +1,88 @@
+package path
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// ReadSuperEvents parses the events written to SuperConfig.EventLogFile, sorted by time.
+// Empty lines and lines starting with # are skipped.
+func ReadSuperEvents(r io.Reader) ([]mtypes.SuperEvent, error) {
+	ret := make([]mtypes.SuperEvent, 0)
+	scanner := bufio.NewScanner(r)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		event, err := mtypes.ParseSuperEvent(line)
+		if err != nil {
+			return ret, fmt.Errorf("parse error at line %v: %v", ln, err)
+		}
+		ret = append(ret, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return ret, err
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret, nil
+}
+
+func ReadSuperEventsFile(filePath string) ([]mtypes.SuperEvent, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSuperEvents(f)
+}
+
+// ReplayStep is what the SuperNode did for an event of ReplayEvents
+type ReplayStep struct {
+	Event     mtypes.SuperEvent
+	Changed   bool // the NhTable changed, UpdateNhTable is pushed to all the EdgeNodes
+	PushStale bool // a register with a new NhStateHash, UpdateNhTable is pushed to the EdgeNodes not up to date
+}
+
+// ReplayEvents feeds the events to the graph like Event_server_event_hendler and RoutineRecalcInterval of the SuperNode,
+// moving the clock to the time of each event relative to the first one. step is called for every event, if not nil.
+// Returns how many times the NhTable changed.
+func (s *SimNet) ReplayEvents(events []mtypes.SuperEvent, step func(ReplayStep)) int {
+	if len(events) == 0 {
+		return 0
+	}
+	start := s.Now
+	pushes := s.Pushes
+	nhStates := make(map[mtypes.Vertex]string)
+	for _, event := range events {
+		if now := start.Add(event.Time.Sub(events[0].Time)); now.After(s.Now) {
+			s.Now = now
+		}
+		r := ReplayStep{Event: event}
+		switch event.Kind {
+		case mtypes.SuperEventRegister:
+			if nhStates[event.Src] != event.NhStateHash {
+				nhStates[event.Src] = event.NhStateHash
+				r.PushStale = true
+			}
+		case mtypes.SuperEventPong:
+			s.Recalc++
+			r.Changed = s.pushed(s.G.UpdateLatencyMulti([]mtypes.PongMsg{event.ToPong()}, true, true))
+		case mtypes.SuperEventCheck:
+			r.Changed = s.Tick()
+		case mtypes.SuperEventInterval:
+			s.Recalc++
+			r.Changed = s.pushed(s.G.RecalculateNhTableNow(true))
+		}
+		if step != nil {
+			step(r)
+		}
+	}
+	return s.Pushes - pushes
+}
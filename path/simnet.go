@@ -0,0 +1,87 @@
+package path
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// SimNet drives an IG with scripted latency events over virtual time, like the SuperNode does.
+// It's for testing the convergence of the routing, the clock only moves by Advance.
+type SimNet struct {
+	G      *IG
+	Now    time.Time
+	TTL    float64 // TimeToAlive of the latencies, in seconds
+	Pushes int     // how many times the NhTable changed, which makes the SuperNode push UpdateNhTable
+	Recalc int     // how many times RecalculateNhTable is called
+}
+
+func NewSimNet(num_node int, IsSuperMode bool, theconfig mtypes.GraphRecalculateSetting) *SimNet {
+	s := &SimNet{
+		Now: time.Unix(0, 0),
+		TTL: 70,
+	}
+	s.G, _ = NewGraph(num_node, IsSuperMode, theconfig, mtypes.NTPInfo{}, mtypes.LoggerInfo{})
+	s.G.now = func() time.Time { return s.Now }
+	return s
+}
+
+func (s *SimNet) Advance(d time.Duration) {
+	s.Now = s.Now.Add(d)
+}
+
+// SetLatency reports the latency(sec) from u to v, and recalculates.
+// Returns true if the NhTable changed.
+func (s *SimNet) SetLatency(u, v mtypes.Vertex, latency float64) bool {
+	s.Recalc++
+	return s.pushed(s.G.UpdateLatency(u, v, latency, s.TTL, 0, true, true))
+}
+
+// SetLink reports the same latency(sec) in both direction.
+func (s *SimNet) SetLink(u, v mtypes.Vertex, latency float64) bool {
+	s.Recalc++
+	return s.pushed(s.G.UpdateLatencyMulti([]mtypes.PongMsg{
+		{Src_nodeID: u, Dst_nodeID: v, Timediff: latency, TimeToAlive: s.TTL},
+		{Src_nodeID: v, Dst_nodeID: u, Timediff: latency, TimeToAlive: s.TTL},
+	}, true, true))
+}
+
+// Tick recalculates without any new latency, like the timeout check of the SuperNode.
+func (s *SimNet) Tick() bool {
+	if !s.G.RecalcOnEvent() {
+		return false
+	}
+	s.Recalc++
+	return s.pushed(s.G.RecalculateNhTable(true))
+}
+
+// Interval advances the clock by RecalcInterval and recalculates, like RoutineRecalcInterval of the SuperNode.
+func (s *SimNet) Interval() bool {
+	s.Advance(s.G.RecalcInterval)
+	s.Recalc++
+	return s.pushed(s.G.RecalculateNhTableNow(true))
+}
+
+func (s *SimNet) pushed(changed bool) bool {
+	if changed {
+		s.Pushes++
+	}
+	return changed
+}
+
+func (s *SimNet) Next(u, v mtypes.Vertex) mtypes.Vertex {
+	return s.G.Next(u, v)
+}
+
+// ExpectPath returns an error if the path from u to v in the NhTable is not the expected one.
+func (s *SimNet) ExpectPath(u, v mtypes.Vertex, expected ...mtypes.Vertex) error {
+	path, err := s.G.Path(u, v)
+	if err != nil {
+		return err
+	}
+	if fmt.Sprint(path) != fmt.Sprint(expected) {
+		return fmt.Errorf("path %v -> %v: expected %v, got %v", u, v, expected, path)
+	}
+	return nil
+}
@@ -0,0 +1,827 @@
+package path
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+var simSetting = mtypes.GraphRecalculateSetting{
+	JitterTolerance:           5,
+	JitterToleranceMultiplier: 1.01,
+	RecalculateCoolDown:       5,
+}
+
+// A, B and C are fully connected with the same latency.
+func newTriangle(t *testing.T) *SimNet {
+	s := NewSimNet(3, true, simSetting)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(1, 3, 0.010)
+	s.SetLink(3, 2, 0.010)
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSimNetRerouteOnDegrade(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(10 * time.Second)
+	pushes := s.Pushes
+	if !s.SetLink(1, 2, 0.050) {
+		t.Fatal("NhTable not changed after A-B degraded")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s.Pushes != pushes+1 {
+		t.Fatalf("expected 1 push, got %v", s.Pushes-pushes)
+	}
+}
+
+func TestSimNetCoolDown(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(time.Second)
+	if s.SetLink(1, 2, 0.050) {
+		t.Fatal("NhTable changed in the cooldown")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.Advance(5 * time.Second)
+	if !s.Tick() {
+		t.Fatal("NhTable not changed after the cooldown")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetFirstCalcNoCoolDown(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(time.Second)
+	s.G.ClearNHTable()
+	if !s.Tick() {
+		t.Fatal("empty NhTable not calculated in the cooldown")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if s.SetLink(1, 2, 0.050) {
+		t.Fatal("NhTable changed in the cooldown after the first calculation")
+	}
+}
+
+func TestSimNetLinkTimeout(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(40 * time.Second)
+	s.SetLink(1, 3, 0.010)
+	s.SetLink(3, 2, 0.010)
+	s.Advance(40 * time.Second) // A-B is not refreshed for 80s, longer than the TTL
+	if !s.Tick() {
+		t.Fatal("NhTable not changed after A-B timed out")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExpectPath(2, 1, 2, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetRecalcInterval(t *testing.T) {
+	setting := simSetting
+	setting.RecalcMode = mtypes.RecalcModeInterval
+	setting.RecalcInterval = 10
+	s := NewSimNet(3, true, setting)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(1, 3, 0.010)
+	s.SetLink(3, 2, 0.010)
+	if s.Pushes != 0 {
+		t.Fatal("NhTable changed by events in interval mode")
+	}
+	if !s.Interval() {
+		t.Fatal("NhTable not changed after the interval")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	// Not applied until the next interval
+	s.SetLink(1, 2, 0.021)
+	if s.Tick() {
+		t.Fatal("NhTable changed by the timeout check in interval mode")
+	}
+	if !s.Interval() {
+		t.Fatal("NhTable not changed after the interval")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetExternalCost(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(10 * time.Second)
+	s.G.SetExternalCost(1, 2, 50)
+	if !s.Tick() {
+		t.Fatal("NhTable not changed after the external cost override")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	// The measured latency doesn't change the overridden cost
+	s.Advance(10 * time.Second)
+	s.SetLink(1, 2, 0.001)
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.G.ReplaceExternalCost(mtypes.DistTable{})
+	s.Advance(10 * time.Second)
+	if !s.Tick() {
+		t.Fatal("NhTable not changed after the external cost removed")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Near-zero latencies on a LAN make a detour as cheap as the direct link, MinCost keeps the direct one.
+func TestSimNetMinCost(t *testing.T) {
+	for _, tc := range []struct {
+		minCost  float64
+		expected []mtypes.Vertex
+	}{
+		{0, []mtypes.Vertex{1, 3, 2}},
+		{1, []mtypes.Vertex{1, 2}},
+	} {
+		setting := simSetting
+		setting.MinCost = tc.minCost
+		s := NewSimNet(3, true, setting)
+		s.SetLink(1, 2, 0.0001)
+		s.SetLink(1, 3, -0.0001)
+		s.SetLink(3, 2, 0)
+		if err := s.ExpectPath(1, 2, tc.expected...); err != nil {
+			t.Errorf("MinCost %v: %v", tc.minCost, err)
+		}
+	}
+}
+
+func TestSimNetBootstrap(t *testing.T) {
+	s := NewSimNet(3, true, simSetting)
+	s.G.SetBootstrapNHTable(mtypes.NextHopTable{
+		1: {2: 2, 3: 2},
+		2: {1: 1, 3: 3},
+		3: {1: 2, 2: 2},
+	}, 30*time.Second)
+	if err := s.ExpectPath(1, 3, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	s.SetLink(1, 3, 0.010) // learned, wins over the bootstrap
+	if err := s.ExpectPath(1, 3, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExpectPath(2, 3, 2, 3); err != nil {
+		t.Fatalf("gap not filled by the bootstrap: %v", err)
+	}
+	s.Advance(40 * time.Second)
+	if s.G.BootstrapExpire().After(s.Now) || !s.G.DropBootstrap() {
+		t.Fatal("bootstrap not expired")
+	}
+	s.Interval()
+	if next := s.Next(2, 3); next != mtypes.NodeID_Invalid {
+		t.Fatalf("bootstrap still used after expired: %v", next)
+	}
+
+	s.G.SetBootstrapNHTable(mtypes.NextHopTable{1: {2: 2}}, 30*time.Second)
+	s.G.SetNHTable(mtypes.NextHopTable{1: {2: 2}})
+	if !s.G.BootstrapExpire().IsZero() || s.G.DropBootstrap() {
+		t.Fatal("bootstrap not replaced by the NhTable from supernode")
+	}
+}
+
+func TestSimNetRecalcStats(t *testing.T) {
+	s := newTriangle(t)
+	stats := s.G.RecalcStats()
+	if stats.Total == 0 || stats.LastVertices != 3 || stats.PerMinute != int(stats.Total) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	var count uint64
+	for _, b := range stats.Histogram {
+		count += b.Count
+	}
+	if count != stats.Total || len(stats.Histogram) != len(recalcBuckets)+1 {
+		t.Fatalf("histogram doesn't match the total: %+v", stats)
+	}
+	s.Advance(2 * time.Minute)
+	if stats := s.G.RecalcStats(); stats.PerMinute != 0 {
+		t.Fatalf("expected 0 recalculations in the last minute, got %v", stats.PerMinute)
+	}
+}
+
+func TestSimNetHops(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(10 * time.Second)
+	s.SetLink(1, 2, 0.050)
+	for _, tc := range []struct {
+		u, v mtypes.Vertex
+		hops int
+	}{
+		{1, 1, 0},
+		{1, 3, 1},
+		{1, 2, 2},
+		{1, 4, -1},
+	} {
+		if hops := s.G.Hops(tc.u, tc.v); hops != tc.hops {
+			t.Errorf("Hops(%v, %v) = %v, want %v", tc.u, tc.v, hops, tc.hops)
+		}
+	}
+	s.G.SetNHTable(mtypes.NextHopTable{1: {3: 2}, 2: {3: 1}})
+	if hops := s.G.Hops(1, 3); hops != -1 {
+		t.Errorf("Hops in a loop = %v, want -1", hops)
+	}
+}
+
+func TestSimNetDisabled(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(10 * time.Second)
+	s.SetLink(1, 2, 0.050)
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.G.SetDisabled(3, true)
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after Node 3 disabled")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if hops := s.G.Hops(1, 3); hops != -1 {
+		t.Errorf("disabled Node 3 still reachable in %v hops", hops)
+	}
+	s.G.SetDisabled(3, false)
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after Node 3 enabled")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetAdminDown(t *testing.T) {
+	s := newTriangle(t)
+	s.Advance(10 * time.Second)
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.G.SetEdgeAdminDown(1, 2, true)
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after 1->2 admin down")
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExpectPath(2, 1, 2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if w := s.G.Weight(1, 2, false); w != mtypes.Infinity {
+		t.Errorf("Weight of admin down edge = %v", w)
+	}
+	if w := s.G.GetEdges(false, false)[1][2]; w != 0.010 {
+		t.Errorf("GetEdges of admin down edge = %v, want the measured 0.010", w)
+	}
+	if _, ok := s.G.GetRoutedEdges(false)[1][2]; ok {
+		t.Error("admin down edge in GetRoutedEdges")
+	}
+	if down := s.G.AdminDown(); len(down) != 1 || down[0].Src != 1 || down[0].Dst != 2 || down[0].Latency != 0.010 {
+		t.Errorf("AdminDown() = %+v", down)
+	}
+	s.G.ResetEdgeAdminDown(2)
+	if s.G.IsEdgeAdminDown(1, 2) {
+		t.Error("still admin down after reset")
+	}
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after 1->2 admin up")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetStaticRoutesDown(t *testing.T) {
+	s := newTriangle(t)
+	if err := s.G.SetStaticRoutes([]mtypes.StaticRoute{{Src: 1, Dst: 2, Via: []mtypes.Vertex{3}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.G.RecalculateNhTableNow(true)
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.G.SetEdgeAdminDown(3, 2, true)
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after the pinned link 3->2 went down")
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExpectPath(3, 2, 3, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.G.SetEdgeAdminDown(3, 2, false)
+	s.G.RecalculateNhTableNow(true)
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetNegativeCycle(t *testing.T) {
+	for _, policy := range []string{"", mtypes.NegativeCycleClear} {
+		setting := simSetting
+		setting.NegativeCyclePolicy = policy
+		s := NewSimNet(3, true, setting)
+		s.SetLink(1, 2, 0.010)
+		s.SetLink(1, 3, 0.010)
+		s.SetLink(3, 2, 0.010)
+		if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+			t.Fatal(err)
+		}
+		// a negative override is not removed by RemoveAllNegativeValue, without the MinCost floor it's a cycle again
+		s.G.minCost = -mtypes.Infinity
+		s.G.SetExternalCost(1, 3, -100)
+		s.G.SetExternalCost(3, 1, -100)
+		s.G.RecalculateNhTableNow(true)
+		stats := s.G.RecalcStats()
+		if stats.NegCycles != 1 || stats.NegCycleNow != (policy == "") {
+			t.Errorf("%q: stats = %+v", policy, stats)
+		}
+		if kept := s.G.Next(1, 2) == 2; kept != (policy == "") {
+			t.Errorf("%q: Next(1, 2) = %v", policy, s.G.Next(1, 2))
+		}
+		s.G.ReplaceExternalCost(mtypes.DistTable{})
+		s.G.RecalculateNhTableNow(true)
+		if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+			t.Fatalf("%q: %v", policy, err)
+		}
+		if stats := s.G.RecalcStats(); stats.NegCycleNow {
+			t.Errorf("%q: still failed after recovered", policy)
+		}
+	}
+}
+
+// B can't reach A directly, like behind a one-way firewall.
+func TestSimNetAsymmetric(t *testing.T) {
+	setting := simSetting
+	setting.AsymmetricTimeout = 10
+	setting.ExcludeAsymmetric = true
+	s := NewSimNet(3, true, setting)
+	s.SetLink(1, 3, 0.010)
+	s.SetLink(3, 2, 0.010)
+	s.SetLatency(1, 2, 0.010)
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ExpectPath(2, 1, 2, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.G.Asymmetric()) != 0 {
+		t.Fatalf("flagged before AsymmetricTimeout: %v", s.G.Asymmetric())
+	}
+	s.Advance(10 * time.Second)
+	if !s.Interval() {
+		t.Fatal("NhTable not changed after 1 <-> 2 flagged")
+	}
+	if asym := s.G.Asymmetric(); len(asym) != 1 || asym[0].Src != 1 || asym[0].Dst != 2 {
+		t.Fatalf("unexpected asymmetric links: %v", asym)
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	s.SetLatency(2, 1, 0.010)
+	s.Interval()
+	if len(s.G.Asymmetric()) != 0 {
+		t.Fatalf("still flagged after 2 -> 1 is back: %v", s.G.Asymmetric())
+	}
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A - B - C in a line, C has a gateway, Node 9 is not in the VPN.
+func TestSimNetGateway(t *testing.T) {
+	s := NewSimNet(3, true, simSetting)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(2, 3, 0.010)
+	if next := s.Next(1, 9); next != mtypes.NodeID_Invalid {
+		t.Fatalf("routed to %v without a gateway", next)
+	}
+	s.G.SetGateway(3, true)
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after Node 3 became a gateway")
+	}
+	if err := s.ExpectPath(1, 9, 1, 2, 3); err == nil {
+		t.Fatal("Node 3 forwards Node 9 without a default route of its own")
+	}
+	for _, tt := range [][2]mtypes.Vertex{{1, 2}, {2, 3}, {3, mtypes.NodeID_Invalid}} {
+		if next := s.Next(tt[0], 9); next != tt[1] {
+			t.Errorf("Next(%v, 9) = %v, want %v", tt[0], next, tt[1])
+		}
+	}
+	if err := s.ExpectPath(1, 3, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	s.G.SetGateway(3, false)
+	if !s.pushed(s.G.RecalculateNhTableNow(true)) {
+		t.Fatal("NhTable not changed after Node 3 is no longer a gateway")
+	}
+	if next := s.Next(1, 9); next != mtypes.NodeID_Invalid {
+		t.Fatalf("still routed to %v", next)
+	}
+}
+
+func TestSimNetMinPeersForRouting(t *testing.T) {
+	setting := simSetting
+	setting.MinPeersForRouting = 3
+	s := NewSimNet(3, true, setting)
+	if s.SetLink(1, 2, 0.010) {
+		t.Fatal("NhTable pushed with 2 of 3 peers reported")
+	}
+	// 3 is seen by 2, but hasn't reported itself
+	if s.SetLatency(2, 3, 0.010) {
+		t.Fatal("NhTable pushed with a peer not reported")
+	}
+	if next := s.Next(1, 2); next != mtypes.NodeID_Invalid {
+		t.Fatalf("routed to %v before MinPeersForRouting", next)
+	}
+	if !s.SetLink(2, 3, 0.010) {
+		t.Fatal("NhTable not pushed after MinPeersForRouting reached")
+	}
+	if err := s.ExpectPath(1, 3, 1, 2, 3); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetReplay(t *testing.T) {
+	log := `# unix_time,src,dst,latency_ms
+1634284810.000,1,2,50.000
+1634284810.000,2,1,50.000
+1634284800.000,1,2,10.000
+1634284800.000,2,1,10.000
+1634284800.000,1,3,10.000
+1634284800.000,3,1,10.000
+1634284800.500,2,3,10.000
+1634284800.500,3,2,10.000
+`
+	samples, err := ReadLatencyLog(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 8 || samples[0].Latency != 0.010 {
+		t.Fatalf("samples = %v", samples)
+	}
+	if sample, _ := mtypes.ParseLatencySample(samples[7].ToCSV()); sample != samples[7] {
+		t.Errorf("%v != %v", sample.ToCSV(), samples[7].ToCSV())
+	}
+	if _, err := ReadLatencyLog(strings.NewReader("1634284800,1,2\n")); err == nil {
+		t.Error("no error with 3 fields")
+	}
+
+	s := NewSimNet(3, true, simSetting)
+	if s.Replay(samples) == 0 {
+		t.Fatal("NhTable not changed by the replay")
+	}
+	if s.Now != time.Unix(10, 0) {
+		t.Errorf("clock at %v, want 10s", s.Now)
+	}
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pong := range LatencyLogToPongs(samples) {
+		if pong.Src_nodeID == 1 && pong.Dst_nodeID == 2 && pong.Timediff != 0.050 {
+			t.Errorf("median of 1 -> 2 = %v, want 0.050", pong.Timediff)
+		}
+	}
+}
+
+// A - B - C in a line, C has a gateway and is renumbered to 7.
+func TestSimNetRenumber(t *testing.T) {
+	s := NewSimNet(3, true, simSetting)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(2, 3, 0.010)
+	s.G.SetGateway(3, true)
+	s.G.RecalculateNhTableNow(true)
+
+	s.G.Renumber(3, 7)
+	if s.G.Vert[3] || !s.G.Vert[7] || s.G.IsGateway(3) || !s.G.IsGateway(7) {
+		t.Fatalf("Vert %v, gateway 3 %v, gateway 7 %v", s.G.Vert, s.G.IsGateway(3), s.G.IsGateway(7))
+	}
+	// the NhTable is rewritten without a recalculation
+	if err := s.ExpectPath(1, 7, 1, 2, 7); err != nil {
+		t.Fatal(err)
+	}
+	if next := s.Next(7, 2); next != 2 {
+		t.Errorf("Next(7, 2) = %v, want 2", next)
+	}
+	for u, dsts := range s.G.GetNHTable(false) {
+		if _, ok := dsts[3]; ok || u == 3 {
+			t.Fatalf("NodeID 3 left in the NhTable of %v", u)
+		}
+	}
+	if s.G.Weight(2, 7, false) != 0.010 || s.G.Weight(2, 3, false) != mtypes.Infinity {
+		t.Errorf("latency of 2 -> 7 %v, 2 -> 3 %v", s.G.Weight(2, 7, false), s.G.Weight(2, 3, false))
+	}
+	s.G.RecalculateNhTableNow(true)
+	if err := s.ExpectPath(1, 7, 1, 2, 7); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetMaxHops(t *testing.T) {
+	for _, maxHops := range []int{0, 2, 1} {
+		setting := simSetting
+		setting.MaxHops = maxHops
+		s := NewSimNet(4, true, setting)
+		s.SetLink(1, 2, 0.010)
+		s.SetLink(2, 3, 0.010)
+		s.SetLink(3, 4, 0.010)
+		s.SetLink(1, 4, 0.500)
+		switch maxHops {
+		case 0:
+			if err := s.ExpectPath(1, 4, 1, 2, 3, 4); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			// too far by the shortest path, but it's a neighbor
+			if err := s.ExpectPath(1, 4, 1, 4); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.ExpectPath(1, 3, 1, 2, 3); err != nil {
+				t.Fatal(err)
+			}
+		case 1:
+			if _, err := s.G.Path(1, 3); err == nil {
+				t.Error("1 -> 3 is reachable with MaxHops 1")
+			}
+			if d := s.G.GetDtst()[1][3]; d != mtypes.Infinity {
+				t.Errorf("distance 1 -> 3 = %v, want Infinity", d)
+			}
+		}
+		if maxHops > 0 && s.G.RecalcStats().MaxHops == 0 {
+			t.Errorf("MaxHops %v: no path counted", maxHops)
+		}
+	}
+}
+
+func TestSimNetMaxHopsDetour(t *testing.T) {
+	setting := simSetting
+	setting.MaxHops = 2
+	s := NewSimNet(6, true, setting)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(2, 3, 0.010)
+	s.SetLink(3, 4, 0.010)
+	s.SetLink(4, 5, 0.010)
+	s.SetLink(1, 6, 0.100)
+	s.SetLink(6, 5, 0.100)
+	// 1 -> 5 is 4 hops by the shortest path, take the slower one within 2 hops
+	if err := s.ExpectPath(1, 5, 1, 6, 5); err != nil {
+		t.Fatal(err)
+	}
+	if d := s.G.GetDtst()[1][5]; d < 0.199 || d > 0.201 {
+		t.Errorf("distance 1 -> 5 = %v, want 0.2", d)
+	}
+	// no path within 2 hops
+	if _, err := s.G.Path(2, 5); err == nil {
+		t.Error("2 -> 5 is reachable with MaxHops 2")
+	}
+	if err := s.ExpectPath(3, 5, 3, 4, 5); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSimNetWidest(t *testing.T) {
+	for _, algorithm := range []string{"", mtypes.AlgorithmWidest} {
+		setting := simSetting
+		setting.Algorithm = algorithm
+		s := NewSimNet(4, true, setting)
+		// 1 -> 2 -> 4 is fast but narrow, 1 -> 3 -> 4 is slow but wide
+		s.G.SetBandwidth(2, 10)
+		s.G.SetBandwidth(3, 1000)
+		s.SetLink(1, 2, 0.010)
+		s.SetLink(2, 4, 0.010)
+		s.SetLink(1, 3, 0.050)
+		s.SetLink(3, 4, 0.050)
+		want := []mtypes.Vertex{1, 2, 4}
+		if algorithm == mtypes.AlgorithmWidest {
+			want = []mtypes.Vertex{1, 3, 4}
+		}
+		if err := s.ExpectPath(1, 4, want...); err != nil {
+			t.Fatalf("Algorithm %q: %v", algorithm, err)
+		}
+		// the same bottleneck, the lower latency wins
+		s.G.SetBandwidth(2, 1000)
+		s.Interval()
+		if err := s.ExpectPath(1, 4, 1, 2, 4); err != nil {
+			t.Fatalf("Algorithm %q: %v", algorithm, err)
+		}
+	}
+	if _, err := NewGraph(4, true, mtypes.GraphRecalculateSetting{Algorithm: "fastest"}, mtypes.NTPInfo{}, mtypes.LoggerInfo{}); err == nil {
+		t.Error("unknown Algorithm accepted")
+	}
+}
+
+func TestSimNetMaxEdgesPerNode(t *testing.T) {
+	setting := simSetting
+	setting.MaxEdgesPerNode = 2
+	s := NewSimNet(4, true, setting)
+	s.SetLatency(1, 2, 0.010)
+	s.SetLatency(1, 3, 0.030)
+	// slower than all, dropped itself
+	s.SetLatency(1, 4, 0.050)
+	if s.G.Weight(1, 4, false) != mtypes.Infinity || len(s.G.Neighbors(1)) != 2 {
+		t.Fatalf("1 -> 4 admitted beyond MaxEdgesPerNode: %v", s.G.Neighbors(1))
+	}
+	// faster, replaces the slowest
+	s.SetLatency(1, 4, 0.020)
+	if s.G.Weight(1, 3, false) != mtypes.Infinity || s.G.Weight(1, 4, false) != 0.020 {
+		t.Fatalf("1 -> 3 not replaced: %v", s.G.Neighbors(1))
+	}
+	// updating an existing edge doesn't count
+	s.SetLatency(1, 2, 0.040)
+	if len(s.G.Neighbors(1)) != 2 || s.G.Weight(1, 2, false) != 0.040 {
+		t.Fatalf("existing edge not updated: %v", s.G.Neighbors(1))
+	}
+	if stats := s.G.RecalcStats(); stats.EdgesDropped != 2 {
+		t.Errorf("EdgesDropped = %v", stats.EdgesDropped)
+	}
+}
+
+func TestSimNetReplayEvents(t *testing.T) {
+	log := `# captured by EventLogFile
+1634284800.000,pong,1,2,10.000,30,0
+1634284800.000,pong,2,1,10.000,30,0
+1634284800.000,pong,1,3,10.000,30,0
+1634284800.000,pong,3,1,10.000,30,0
+1634284800.000,pong,2,3,10.000,30,0
+1634284800.000,pong,3,2,10.000,30,0
+1634284801.000,register,1,
+1634284805.000,register,1,4f1c
+1634284806.000,register,1,4f1c
+1634284810.000,pong,1,2,50.000,30,0
+1634284810.000,pong,2,1,50.000,30,0
+1634284815.000,check
+`
+	events, err := ReadSuperEvents(strings.NewReader(log))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 12 || events[6].Kind != mtypes.SuperEventRegister || events[7].NhStateHash != "4f1c" {
+		t.Fatalf("events = %v", events)
+	}
+	for _, event := range events {
+		if parsed, _ := mtypes.ParseSuperEvent(event.ToCSV()); parsed != event {
+			t.Errorf("%v != %v", parsed.ToCSV(), event.ToCSV())
+		}
+	}
+	if _, err := ReadSuperEvents(strings.NewReader("1634284800,pong,1,2,10\n")); err == nil {
+		t.Error("no error with 5 fields for a pong")
+	}
+	if _, err := ReadSuperEvents(strings.NewReader("1634284800,hello\n")); err == nil {
+		t.Error("no error with an unknown event")
+	}
+
+	s := NewSimNet(3, true, simSetting)
+	var steps []ReplayStep
+	pushes := s.ReplayEvents(events, func(r ReplayStep) { steps = append(steps, r) })
+	if len(steps) != len(events) || pushes != s.Pushes {
+		t.Fatalf("%v steps, %v pushes", len(steps), pushes)
+	}
+	if !steps[0].Changed {
+		t.Error("the first pong didn't change the NhTable")
+	}
+	if steps[6].PushStale || !steps[7].PushStale || steps[8].PushStale {
+		t.Errorf("register push = %v %v %v, want false true false", steps[6].PushStale, steps[7].PushStale, steps[8].PushStale)
+	}
+	// 1 -> 2 recalculates right away, 2 -> 1 is in the RecalculateCoolDown and waits for the timeout check
+	if !steps[9].Changed || steps[10].Changed || !steps[11].Changed {
+		t.Errorf("changed = %v %v %v, want true false true", steps[9].Changed, steps[10].Changed, steps[11].Changed)
+	}
+	if err := s.ExpectPath(2, 1, 2, 3, 1); err != nil {
+		t.Fatal(err)
+	}
+	if s.Now != time.Unix(15, 0) {
+		t.Errorf("clock at %v, want 15s", s.Now)
+	}
+}
+
+// Zone a is 1 - 2 - 3, zone b is 4 - 5 - 6, the borders are 3, 4 and 6. 7 is in zone c without a border.
+func TestSimNetZones(t *testing.T) {
+	s := NewSimNet(7, true, simSetting)
+	for _, v := range []mtypes.Vertex{1, 2, 3} {
+		s.G.SetZone(v, "a", v == 3)
+	}
+	for _, v := range []mtypes.Vertex{4, 5, 6} {
+		s.G.SetZone(v, "b", v != 5)
+	}
+	s.G.SetZone(7, "c", false)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(2, 3, 0.010)
+	s.SetLink(1, 3, 0.030)
+	s.SetLink(4, 5, 0.010)
+	s.SetLink(5, 6, 0.010)
+	s.SetLink(4, 6, 0.050)
+	s.SetLink(3, 4, 0.020)
+	s.SetLink(3, 6, 0.005)
+	s.SetLink(1, 5, 0.001) // not between borders
+	s.SetLink(1, 7, 0.001)
+	s.G.RecalculateNhTableNow(true)
+	for _, c := range [][]mtypes.Vertex{
+		{1, 2, 3, 6, 5},
+		{5, 6, 3, 2, 1},
+		{2, 3, 4},
+		{4, 5, 6}, // inside the zone, not through 3
+		{6, 5},
+	} {
+		if err := s.ExpectPath(c[0], c[len(c)-1], c...); err != nil {
+			t.Error(err)
+		}
+	}
+	if path, err := s.G.Path(1, 7); err == nil {
+		t.Errorf("1 -> 7 routed through %v, zone c has no border", path)
+	}
+
+	s.G.SetZone(4, "b", false)
+	s.G.SetZone(6, "b", false)
+	s.G.RecalculateNhTableNow(true)
+	if _, err := s.G.Path(1, 5); err == nil {
+		t.Error("1 -> 5 routed without a border in zone b")
+	}
+}
+
+func TestSimNetZonesLoopFree(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 20; round++ {
+		s := NewSimNet(30, true, simSetting)
+		for v := mtypes.Vertex(1); v <= 30; v++ {
+			s.G.SetZone(v, fmt.Sprint(v%3), v <= 6)
+		}
+		for i := 0; i < 90; i++ {
+			u, v := mtypes.Vertex(rng.Intn(30)+1), mtypes.Vertex(rng.Intn(30)+1)
+			if u != v {
+				s.SetLink(u, v, float64(rng.Intn(100)+1)/1000)
+			}
+		}
+		s.G.RecalculateNhTableNow(true)
+		if err := loopFree(s.G.GetNHTable(false)); err != nil {
+			t.Fatalf("round %v: %v", round, err)
+		}
+	}
+}
+
+func TestSimNetSuspect(t *testing.T) {
+	setting := simSetting
+	setting.SuspectPeriod = 40
+	setting.SuspectPenalty = 100
+	s := NewSimNet(3, true, setting)
+	s.SetLink(1, 2, 0.010)
+	s.SetLink(1, 3, 0.010)
+	s.SetLink(3, 2, 0.010)
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 - 2 misses the pongs for 35s, suspect after 30s but not timed out
+	s.Advance(35 * time.Second)
+	s.SetLink(1, 3, 0.010)
+	s.SetLink(3, 2, 0.010)
+	s.Tick()
+	if err := s.ExpectPath(1, 2, 1, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	suspect := s.G.Suspect()
+	if len(suspect) != 2 || suspect[0].Src != 1 || suspect[0].Dst != 2 || suspect[0].Latency != 0.010 || suspect[0].Until != time.Unix(70, 0) {
+		t.Fatalf("suspect = %+v", suspect)
+	}
+	if w := s.G.Weight(1, 2, false); w != 0.110 {
+		t.Errorf("weight of the suspect 1 -> 2 = %v, want 0.110", w)
+	}
+	if w := s.G.GetRoutedEdges(false)[1][2]; w != 0.010 {
+		t.Errorf("GetRoutedEdges of the suspect 1 -> 2 = %v, want the unpenalized 0.010", w)
+	}
+
+	// back before the timeout
+	s.Advance(10 * time.Second)
+	s.SetLink(1, 2, 0.010)
+	if err := s.ExpectPath(1, 2, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if suspect := s.G.Suspect(); len(suspect) != 0 {
+		t.Errorf("suspect = %+v", suspect)
+	}
+
+	if _, err := NewGraph(3, true, mtypes.GraphRecalculateSetting{SuspectPeriod: 10}, mtypes.NTPInfo{}, mtypes.LoggerInfo{}); err == nil {
+		t.Error("no error with SuspectPeriod but no SuspectPenalty")
+	}
+}
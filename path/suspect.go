@@ -0,0 +1,45 @@
+package path
+
+import (
+	"sort"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// isSuspect reports whether the edge is in the last SuspectPeriod of its TimeToAlive without a new latency.
+// A suspect edge costs SuspectPenalty more, so the routes move away from it before it times out. g.edgelock must be held.
+func (g *IG) isSuspect(l *Latency, now time.Time) bool {
+	return g.suspectPeriod > 0 && !now.After(l.validUntil) && now.After(l.validUntil.Add(-g.suspectPeriod))
+}
+
+// Suspect returns the edges penalized by SuspectPeriod with the measured latency, sorted by Src and Dst.
+func (g *IG) Suspect() []mtypes.SuspectLink {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	ret := make([]mtypes.SuspectLink, 0)
+	if g.suspectPeriod <= 0 {
+		return ret
+	}
+	now := g.now()
+	for u, edges := range g.edges {
+		for v, l := range edges {
+			if g.isSuspect(l, now) {
+				ret = append(ret, mtypes.SuspectLink{
+					Src:     u,
+					Dst:     v,
+					Latency: l.ping,
+					Since:   l.validUntil.Add(-g.suspectPeriod),
+					Until:   l.validUntil,
+				})
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Src != ret[j].Src {
+			return ret[i].Src < ret[j].Src
+		}
+		return ret[i].Dst < ret[j].Dst
+	})
+	return ret
+}
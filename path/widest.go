@@ -0,0 +1,79 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// SetBandwidth sets the link capacity(Mbps) of v for GraphRecalculateSetting.Algorithm widest, 0 means unknown.
+// The nhTable is updated on the next recalculation.
+func (g *IG) SetBandwidth(v mtypes.Vertex, mbps float64) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if mbps > 0 {
+		g.bandwidth[v] = mbps
+	} else {
+		delete(g.bandwidth, v)
+	}
+}
+
+// Bandwidth returns the link capacity(Mbps) of v set by SetBandwidth, 0 if unknown
+func (g *IG) Bandwidth(v mtypes.Vertex) float64 {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	return g.bandwidth[v]
+}
+
+// linkWidths returns the capacity of every edge, the smaller one of both ends. The unknown ones are unlimited(Infinity).
+func (g *IG) linkWidths(vert map[mtypes.Vertex]bool) mtypes.DistTable {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	bw := func(v mtypes.Vertex) float64 {
+		if b, ok := g.bandwidth[v]; ok {
+			return b
+		}
+		return mtypes.Infinity
+	}
+	width := make(mtypes.DistTable, len(vert))
+	for u := range vert {
+		width[u] = make(map[mtypes.Vertex]float64, len(vert))
+		for v := range vert {
+			width[u][v] = bw(u)
+			if b := bw(v); b < width[u][v] {
+				width[u][v] = b
+			}
+		}
+		width[u][u] = mtypes.Infinity
+	}
+	return width
+}
+
+// widerPath reports whether the path i->k->j is better than the current i->j for Algorithm widest:
+// a larger bottleneck, or the same bottleneck with a lower latency.
+func widerPath(width, dist mtypes.DistTable, i, k, j mtypes.Vertex) (better bool, bottleneck float64) {
+	bottleneck = width[i][k]
+	if width[k][j] < bottleneck {
+		bottleneck = width[k][j]
+	}
+	if bottleneck != width[i][j] {
+		return bottleneck > width[i][j], bottleneck
+	}
+	return dist[i][j] > dist[i][k]+dist[k][j], bottleneck
+}
+
+// loopFree returns an error if following next from any node loops before the destination.
+// The widest path with the latency as the tie-breaker is not always consistent hop by hop, unlike the shortest path.
+func loopFree(next mtypes.NextHopTable) error {
+	for u, dsts := range next {
+		for v := range dsts {
+			if _, err := nhTablePath(next, u, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
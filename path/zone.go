@@ -0,0 +1,201 @@
+/* SPDX-License-Identifier: MIT
+ *
+ * Copyright (C) 2017-2021 Kusakabe Si. All Rights Reserved.
+ */
+
+package path
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+// SetZone assigns v to a zone, "" means the default zone. A border node of a zone routes between the zones.
+// Once any node is in a zone other than "", Floyd-Warshall runs in two levels, see floydWarshallZoned.
+// The nhTable is updated on the next recalculation.
+func (g *IG) SetZone(v mtypes.Vertex, zone string, border bool) {
+	g.edgelock.Lock()
+	defer g.edgelock.Unlock()
+	if zone != "" {
+		g.zones[v] = zone
+	} else {
+		delete(g.zones, v)
+	}
+	if border {
+		g.borders[v] = true
+	} else {
+		delete(g.borders, v)
+	}
+}
+
+// Zone returns the zone of v set by SetZone, and whether it's a border node
+func (g *IG) Zone(v mtypes.Vertex) (zone string, border bool) {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	return g.zones[v], g.borders[v]
+}
+
+func (g *IG) zoned() bool {
+	g.edgelock.RLock()
+	defer g.edgelock.RUnlock()
+	return len(g.zones) > 0
+}
+
+// floydWarshallZoned is the two-level Floyd-Warshall for large meshes.
+// Level 1 runs within each zone with the edges inside it. Level 2 runs on the border nodes only, with the edges between
+// the zones and the level 1 distances between the borders of the same zone.
+// A path to another zone goes to the border with the lowest total cost, then along the border nodes to the destination zone.
+// A path inside a zone leaves it only if it's shorter through the borders. A zone without border nodes can't reach the others.
+// It costs O(Z * (n/Z)^3 + B^3 + n^2 * B) instead of O(n^3), for Z zones and B border nodes.
+func (g *IG) floydWarshallZoned(again bool) (dist mtypes.DistTable, next mtypes.NextHopTable, err error) {
+	if g.loglevel.LogInternal {
+		fmt.Println("Internal: Start two-level Floyd Warshall algorithm")
+	}
+	vert := g.Vertices()
+	g.edgelock.RLock()
+	zone := make(map[mtypes.Vertex]string, len(vert))
+	members := make(map[string][]mtypes.Vertex)
+	borders := make(map[string][]mtypes.Vertex)
+	allBorders := make([]mtypes.Vertex, 0)
+	for u := range vert {
+		zone[u] = g.zones[u]
+		members[zone[u]] = append(members[zone[u]], u)
+		if g.borders[u] {
+			borders[zone[u]] = append(borders[zone[u]], u)
+			allBorders = append(allBorders, u)
+		}
+	}
+	g.edgelock.RUnlock()
+
+	zdist := make(mtypes.DistTable, len(vert))
+	znext := make(mtypes.NextHopTable, len(vert))
+	link := make(mtypes.DistTable, len(vert))
+	for u := range vert {
+		zdist[u] = make(map[mtypes.Vertex]float64, len(members[zone[u]]))
+		znext[u] = make(map[mtypes.Vertex]mtypes.Vertex, len(members[zone[u]]))
+		link[u] = make(map[mtypes.Vertex]float64)
+		for _, v := range members[zone[u]] {
+			zdist[u][v] = mtypes.Infinity
+		}
+		zdist[u][u] = 0
+		for _, v := range g.Neighbors(u) {
+			w := g.Weight(u, v, true)
+			wo := g.Weight(u, v, false)
+			if w < mtypes.Infinity {
+				link[u][v] = w
+				if zone[u] == zone[v] {
+					zdist[u][v] = w
+					znext[u][v] = v
+				}
+			}
+			g.SetOldWeight(u, v, wo)
+		}
+	}
+	// level 1
+	for _, nodes := range members {
+		relax(nodes, zdist, znext)
+	}
+	// level 2
+	bdist := make(mtypes.DistTable, len(allBorders))
+	bnext := make(mtypes.NextHopTable, len(allBorders))
+	for _, u := range allBorders {
+		bdist[u] = make(map[mtypes.Vertex]float64, len(allBorders))
+		bnext[u] = make(map[mtypes.Vertex]mtypes.Vertex, len(allBorders))
+		for _, v := range allBorders {
+			bdist[u][v] = mtypes.Infinity
+			if zone[u] == zone[v] {
+				bdist[u][v] = zdist[u][v]
+			} else if w, ok := link[u][v]; ok {
+				bdist[u][v] = w
+			}
+			if bdist[u][v] < mtypes.Infinity {
+				bnext[u][v] = v
+			}
+		}
+	}
+	relax(allBorders, bdist, bnext)
+	// combine: the cost of each border b to v, through the best border of the zone of v.
+	// Then each u goes to the border with the lowest total cost, or stays in the zone if v is there and it's not longer.
+	dist = make(mtypes.DistTable, len(vert))
+	next = make(mtypes.NextHopTable, len(vert))
+	for u := range vert {
+		dist[u] = make(map[mtypes.Vertex]float64, len(vert))
+		next[u] = make(map[mtypes.Vertex]mtypes.Vertex, len(vert))
+	}
+	for v := range vert {
+		toV := make(map[mtypes.Vertex]float64, len(allBorders))
+		entry := make(map[mtypes.Vertex]mtypes.Vertex, len(allBorders))
+		for _, b := range allBorders {
+			toV[b] = mtypes.Infinity
+			for _, bv := range borders[zone[v]] {
+				if d := bdist[b][bv] + zdist[bv][v]; d < toV[b] {
+					toV[b], entry[b] = d, bv
+				}
+			}
+		}
+		for u := range vert {
+			dist[u][v] = mtypes.Infinity
+			if d, ok := zdist[u][v]; ok {
+				dist[u][v] = d
+				if n, ok := znext[u][v]; ok {
+					next[u][v] = n
+				}
+			}
+			exit := mtypes.Vertex(0)
+			best := dist[u][v]
+			for _, b := range borders[zone[u]] {
+				if d := zdist[u][b] + toV[b]; d < best {
+					best, exit = d, b
+				}
+			}
+			if best >= dist[u][v] {
+				continue
+			}
+			dist[u][v] = best
+			if exit != u {
+				next[u][v] = znext[u][exit]
+			} else if hop := bnext[u][entry[u]]; zone[hop] == zone[u] {
+				next[u][v] = znext[u][hop]
+			} else {
+				next[u][v] = hop
+			}
+		}
+	}
+	for i := range dist {
+		if dist[i][i] < 0 {
+			if !again {
+				g.RemoveAllNegativeValue()
+				err = errors.New("negative cycle detected")
+				var againErr error
+				if dist, next, againErr = g.floydWarshallZoned(true); againErr != nil {
+					err = againErr
+				}
+				return
+			}
+			dist = make(mtypes.DistTable)
+			next = make(mtypes.NextHopTable)
+			err = ErrNegativeCycle
+			return
+		}
+	}
+	if g.DirectPathBonus > 0 {
+		g.applyDirectPathBonus(dist, next)
+	}
+	return
+}
+
+// relax runs the Floyd-Warshall iterations on the vertices, with the edges already in dist and next
+func relax(vert []mtypes.Vertex, dist mtypes.DistTable, next mtypes.NextHopTable) {
+	for _, k := range vert {
+		for _, i := range vert {
+			for _, j := range vert {
+				if dist[i][k] < mtypes.Infinity && dist[k][j] < mtypes.Infinity && dist[i][j] > dist[i][k]+dist[k][j] {
+					dist[i][j] = dist[i][k] + dist[k][j]
+					next[i][j] = next[i][k]
+				}
+			}
+		}
+	}
+}
@@ -32,6 +32,31 @@ func GetSrcMacAddr(packet []byte) (srcMacAddr MacAddress) {
 	return
 }
 
+// GetVLANID returns the VLAN ID if the frame is 802.1Q or 802.1ad tagged
+func GetVLANID(packet []byte) (vid uint16, tagged bool) {
+	if len(packet) < 16 {
+		return 0, false
+	}
+	ethertype := uint16(packet[12])<<8 | uint16(packet[13])
+	if ethertype != 0x8100 && ethertype != 0x88a8 {
+		return 0, false
+	}
+	return (uint16(packet[14])<<8 | uint16(packet[15])) & 0x0fff, true
+}
+
+// GetEtherType returns the EtherType of the frame, after the 802.1Q and 802.1ad tags
+func GetEtherType(packet []byte) uint16 {
+	offset := 12
+	for len(packet) >= offset+2 {
+		ethertype := uint16(packet[offset])<<8 | uint16(packet[offset+1])
+		if ethertype != 0x8100 && ethertype != 0x88a8 {
+			return ethertype
+		}
+		offset += 4
+	}
+	return 0
+}
+
 func GetIP(version int, netcidr string, uid uint32) (net.IP, net.IPMask, error) {
 	_, the_net, err := net.ParseCIDR(netcidr)
 	if err != nil {
@@ -81,6 +106,21 @@ func GetIP(version int, netcidr string, uid uint32) (net.IP, net.IPMask, error)
 	return result_ip, the_net.Mask, nil
 }
 
+// GetULAAddr returns the address of the NodeID in the IPv6 ULA prefix(fc00::/7), like fd12:3456:789a::1 for NodeID 1 in fd12:3456:789a::/64
+func GetULAAddr(prefix string, uid uint32) (net.IP, net.IPMask, error) {
+	_, the_net, err := net.ParseCIDR(prefix)
+	if err != nil || the_net.IP.To4() != nil || the_net.IP[0]&0xfe != 0xfc {
+		return nil, nil, fmt.Errorf("Not a valid IPv6 ULA prefix: %v", prefix)
+	}
+	if ones, _ := the_net.Mask.Size(); ones > 112 {
+		return nil, nil, fmt.Errorf("The ULA prefix %v is too long for NodeIDs, must be /112 or shorter", prefix)
+	}
+	if uid == 0 {
+		return nil, nil, fmt.Errorf("NodeID 0 has no address in the ULA prefix %v", prefix)
+	}
+	return GetIP(6, prefix, uid)
+}
+
 func GetMacAddr(prefix string, uid uint32) (mac MacAddress, err error) {
 	macprefix, _, err := prefixStr2prefix(prefix)
 	if err != nil {
@@ -136,3 +176,8 @@ type Device interface {
 	Events() chan Event             // returns a constant channel of events related to the device
 	Close() error                   // stops the device and closes the event channel
 }
+
+// Reconnector is a Device which can re-establish its underlying connection after a read error, like the *sock types
+type Reconnector interface {
+	Reconnect() error
+}
@@ -1,31 +1,68 @@
 package tap
 
-import "errors"
+import (
+	"errors"
+	"sync/atomic"
+)
 
 type DummyTap struct {
-	stopRead chan struct{}
-	events   chan Event
+	readCount  uint64 // keep the 64-bit counters 64-bit aligned
+	writeCount uint64
+	writeBytes uint64
+	stopRead   chan struct{}
+	events     chan Event
+	flood      atomic.Value // []byte
+	floodStart chan struct{}
 }
 
 // New creates and returns a new TUN interface for the application.
 func CreateDummyTAP() (tapdev Device, err error) {
 	// Setup TUN Config
 	tapdev = &DummyTap{
-		stopRead: make(chan struct{}, 1<<5),
-		events:   make(chan Event, 1<<5),
+		stopRead:   make(chan struct{}, 1<<5),
+		events:     make(chan Event, 1<<5),
+		floodStart: make(chan struct{}, 1),
 	}
 	tapdev.Events() <- EventUp
 	return
 }
 
+// Flood makes Read return this frame as fast as it's called, nil to stop.
+// Used as the traffic source of the benchmark.
+func (tap *DummyTap) Flood(frame []byte) {
+	tap.flood.Store(frame)
+	if frame != nil {
+		select {
+		case tap.floodStart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Counters returns the frames read, the frames written and the bytes written.
+func (tap *DummyTap) Counters() (read uint64, written uint64, writtenBytes uint64) {
+	return atomic.LoadUint64(&tap.readCount), atomic.LoadUint64(&tap.writeCount), atomic.LoadUint64(&tap.writeBytes)
+}
+
 // SetMTU sets the Maximum Tansmission Unit Size for a
 // Packet on the interface.
 
-func (tap *DummyTap) Read([]byte, int) (int, error) {
-	_ = <-tap.stopRead
-	return 0, errors.New("Device stopped")
+func (tap *DummyTap) Read(buf []byte, offset int) (int, error) {
+	for {
+		if frame, _ := tap.flood.Load().([]byte); frame != nil {
+			atomic.AddUint64(&tap.readCount, 1)
+			return copy(buf[offset:], frame), nil
+		}
+		select {
+		case <-tap.stopRead:
+			return 0, errors.New("Device stopped")
+		case <-tap.floodStart:
+		}
+	}
 } // read a packet from the device (without any additional headers)
 func (tap *DummyTap) Write(packet []byte, size int) (int, error) {
+	atomic.AddUint64(&tap.writeCount, 1)
+	atomic.AddUint64(&tap.writeBytes, uint64(len(packet)-size))
 	return size, nil
 } // writes a packet to the device (without any additional headers)
 func (tap *DummyTap) Flush() error {
@@ -41,6 +78,7 @@ func (tap *DummyTap) Events() chan Event {
 	return tap.events
 } // returns a constant channel of events related to the device
 func (tap *DummyTap) Close() error {
+	tap.flood.Store([]byte(nil))
 	tap.events <- EventDown
 	tap.stopRead <- struct{}{}
 	//close(tap.stopRead)
@@ -107,7 +107,7 @@ func (tap *NativeTap) routineHackListener() {
 }
 
 func createNetlinkSocket() (int, error) {
-	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW, unix.NETLINK_ROUTE)
+	sock, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
 	if err != nil {
 		return -1, err
 	}
@@ -582,6 +582,16 @@ func CreateTAPFromFile(file *os.File, iconfig mtypes.InterfaceConf, NodeID mtype
 			return nil, err
 		}
 	}
+	if iconfig.AutoAddress != "" {
+		ip, mask, err := GetULAAddr(iconfig.AutoAddress, uint32(NodeID))
+		if err != nil {
+			return nil, err
+		}
+		err = tap.addIPAddr("6", ip, mask)
+		if err != nil {
+			return nil, err
+		}
+	}
 	if iconfig.IPv4CIDR != "" {
 		cidrstr := iconfig.IPv4CIDR
 		ip, mask, err := GetIP(4, cidrstr, uint32(NodeID))
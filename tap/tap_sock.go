@@ -4,21 +4,36 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
 )
 
+// sockWriteTimeout is how long a write to one of the RecvMaxConns connections may block.
+// A connection not reading is dropped, instead of stalling the frames to all the others.
+var sockWriteTimeout = time.Second
+
 type SockServerTap struct {
 	name     string
 	mtu      int
 	protocol string
 	server   *net.Listener
+	sendAddr string
 	connRx   *net.Conn
 	connTx   *net.Conn
 	static   bool
 	loglevel mtypes.LoggerInfo
 
+	// With RecvMaxConns, every accepted connection is served at once, by routineReadConn
+	maxConns  int
+	conns     map[net.Conn]struct{}
+	connsLock sync.Mutex
+	rx        chan []byte // the frames read from conns
+	stop      chan struct{}
+
 	closed bool
 	events chan Event
 }
@@ -32,6 +47,7 @@ func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.
 		mtu:      1500,
 		protocol: protocol,
 		server:   nil,
+		sendAddr: iconfig.SendAddr,
 		connRx:   nil,
 		connTx:   nil,
 		static:   false,
@@ -45,11 +61,22 @@ func CreateSockTAP(iconfig mtypes.InterfaceConf, protocol string, NodeID mtypes.
 	}
 
 	if iconfig.RecvAddr != "" {
-		server, err := net.Listen(protocol, iconfig.RecvAddr)
+		var server net.Listener
+		if iconfig.RecvBacklog > 0 {
+			server, err = listenBacklog(protocol, iconfig.RecvAddr, iconfig.RecvBacklog)
+		} else {
+			server, err = net.Listen(protocol, iconfig.RecvAddr)
+		}
 		if err != nil {
 			return nil, err
 		}
 		tap.server = &server
+		if iconfig.RecvMaxConns > 0 {
+			tap.maxConns = iconfig.RecvMaxConns
+			tap.conns = make(map[net.Conn]struct{}, iconfig.RecvMaxConns)
+			tap.rx = make(chan []byte, 1<<5)
+			tap.stop = make(chan struct{})
+		}
 		go tap.RoutineAcceptConnection()
 	}
 
@@ -91,6 +118,10 @@ func (tap *SockServerTap) RoutineAcceptConnection() {
 		if tap.loglevel.LogInternal {
 			fmt.Printf("Internal: New connection accepted from %v\n", conn.RemoteAddr())
 		}
+		if tap.maxConns > 0 {
+			tap.addConn(conn)
+			continue
+		}
 		if tap.connRx != nil {
 			if tap.loglevel.LogInternal {
 				fmt.Printf("Internal: Old connection %v closed due to new connection\n", (*tap.connRx).RemoteAddr())
@@ -105,6 +136,143 @@ func (tap *SockServerTap) RoutineAcceptConnection() {
 	}
 }
 
+// addConn serves one more connection, or rejects it by closing it if RecvMaxConns are served already
+func (tap *SockServerTap) addConn(conn net.Conn) {
+	tap.connsLock.Lock()
+	defer tap.connsLock.Unlock()
+	if len(tap.conns) >= tap.maxConns {
+		if tap.loglevel.LogInternal {
+			fmt.Printf("Internal: Connection %v rejected, RecvMaxConns %v reached\n", conn.RemoteAddr(), tap.maxConns)
+		}
+		conn.Close()
+		return
+	}
+	tap.conns[conn] = struct{}{}
+	go tap.routineReadConn(conn)
+}
+
+// delConnLocked closes the connection and stops serving it. connsLock must be held.
+func (tap *SockServerTap) delConnLocked(conn net.Conn) {
+	if _, ok := tap.conns[conn]; !ok {
+		return
+	}
+	delete(tap.conns, conn)
+	conn.Close()
+	if tap.loglevel.LogInternal {
+		fmt.Printf("Internal: Connection closed: %v\n", conn.RemoteAddr())
+	}
+}
+
+func (tap *SockServerTap) routineReadConn(conn net.Conn) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			tap.connsLock.Lock()
+			tap.delConnLocked(conn)
+			tap.connsLock.Unlock()
+			return
+		}
+		frame := make([]byte, n)
+		copy(frame, buf[:n])
+		select {
+		case tap.rx <- frame:
+		case <-tap.stop:
+			return
+		}
+	}
+}
+
+// listenBacklog is net.Listen with the backlog of listen(2), which net.Listen always takes from net.core.somaxconn
+func listenBacklog(protocol string, addr string, backlog int) (net.Listener, error) {
+	var family, sotype int
+	var sa syscall.Sockaddr
+	switch protocol {
+	case "tcp":
+		taddr, err := net.ResolveTCPAddr(protocol, addr)
+		if err != nil {
+			return nil, err
+		}
+		sotype = syscall.SOCK_STREAM
+		if ip4 := taddr.IP.To4(); ip4 != nil {
+			family = syscall.AF_INET
+			sa4 := &syscall.SockaddrInet4{Port: taddr.Port}
+			copy(sa4.Addr[:], ip4)
+			sa = sa4
+		} else {
+			family = syscall.AF_INET6
+			sa6 := &syscall.SockaddrInet6{Port: taddr.Port}
+			copy(sa6.Addr[:], taddr.IP.To16()) // all zero for no IP, which takes IPv4 too
+			sa = sa6
+		}
+	case "unix", "unixpacket":
+		family = syscall.AF_UNIX
+		sotype = syscall.SOCK_STREAM
+		if protocol == "unixpacket" {
+			sotype = syscall.SOCK_SEQPACKET
+		}
+		sa = &syscall.SockaddrUnix{Name: addr}
+	default:
+		return nil, fmt.Errorf("RecvBacklog doesn't work with %v", protocol)
+	}
+	fd, err := syscall.Socket(family, sotype, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+	if family != syscall.AF_UNIX {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	}
+	if family == syscall.AF_INET6 {
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+	f := os.NewFile(uintptr(fd), protocol+":"+addr)
+	defer f.Close()
+	server, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := server.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+	return server, nil
+}
+
+// Reconnect dials SendAddr again after the connection is lost, like the process behind it restarted.
+// With RecvAddr only, the connection is dropped and a new one is accepted by RoutineAcceptConnection.
+func (tap *SockServerTap) Reconnect() error {
+	if tap.closed {
+		return errors.New("Tap closed")
+	}
+	if tap.sendAddr == "" {
+		tap.connRx = nil
+		return nil
+	}
+	client, err := net.Dial(tap.protocol, tap.sendAddr)
+	if err != nil {
+		return err
+	}
+	if tap.connTx != nil {
+		(*tap.connTx).Close()
+	}
+	if tap.loglevel.LogInternal {
+		fmt.Printf("Internal: Reconnected to %v\n", tap.sendAddr)
+	}
+	tap.connTx = &client
+	if tap.server == nil {
+		tap.connRx = &client
+	}
+	return nil
+}
+
 // SetMTU sets the Maximum Tansmission Unit Size for a
 // Packet on the interface.
 
@@ -112,6 +280,14 @@ func (tap *SockServerTap) Read(buf []byte, offset int) (size int, err error) {
 	if tap.closed {
 		return 0, errors.New("Tap closed")
 	}
+	if tap.maxConns > 0 {
+		select {
+		case frame := <-tap.rx:
+			return copy(buf[offset:], frame), nil
+		case <-tap.stop:
+			return 0, errors.New("Tap closed")
+		}
+	}
 	if tap.connRx == nil {
 		time.Sleep(time.Second)
 		return 0, nil
@@ -130,6 +306,20 @@ func (tap *SockServerTap) Write(buf []byte, offset int) (size int, err error) {
 	if tap.closed {
 		return 0, errors.New("Tap closed")
 	}
+	if tap.maxConns > 0 && !tap.static {
+		tap.connsLock.Lock()
+		defer tap.connsLock.Unlock()
+		for conn := range tap.conns {
+			conn.SetWriteDeadline(time.Now().Add(sockWriteTimeout))
+			if _, err := conn.Write(buf[offset:]); err != nil {
+				if tap.loglevel.LogInternal {
+					fmt.Printf("Internal: Write to %v failed: %v\n", conn.RemoteAddr(), err)
+				}
+				tap.delConnLocked(conn)
+			}
+		}
+		return len(buf) - offset, nil
+	}
 	if tap.connTx == nil {
 		return
 	}
@@ -157,6 +347,14 @@ func (tap *SockServerTap) Events() chan Event {
 func (tap *SockServerTap) Close() error {
 	tap.events <- EventDown
 	tap.closed = true
+	if tap.maxConns > 0 {
+		close(tap.stop)
+		tap.connsLock.Lock()
+		for conn := range tap.conns {
+			tap.delConnLocked(conn)
+		}
+		tap.connsLock.Unlock()
+	}
 	if tap.connRx != nil {
 		(*tap.connRx).Close()
 	}
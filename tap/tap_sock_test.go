@@ -0,0 +1,136 @@
+package tap
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+)
+
+func TestSockTapReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accept := func() net.Conn {
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	tapdev, err := CreateSockTAP(mtypes.InterfaceConf{SendAddr: listener.Addr().String()}, "tcp", 1, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tapdev.Close()
+	buf := make([]byte, 64)
+
+	// the process behind SendAddr restarts
+	accept().Close()
+	if _, err := tapdev.Read(buf, 0); err == nil {
+		t.Fatal("read from a closed connection succeeded")
+	}
+	if err := tapdev.(Reconnector).Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	conn := accept()
+	defer conn.Close()
+	if _, err := conn.Write([]byte("frame")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tapdev.Read(buf, 0); err != nil || string(buf[:n]) != "frame" {
+		t.Fatalf("read after reconnect: %q %v", buf[:n], err)
+	}
+	if _, err := tapdev.Write([]byte("back"), 0); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "back" {
+		t.Fatalf("write after reconnect: %q %v", buf[:n], err)
+	}
+}
+
+func TestSockTapMaxConns(t *testing.T) {
+	addr := filepath.Join(t.TempDir(), "tap.sock")
+	tapdev, err := CreateSockTAP(mtypes.InterfaceConf{RecvAddr: addr, RecvBacklog: 4, RecvMaxConns: 2}, "unixpacket", 1, mtypes.LoggerInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("unixpacket", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	buf := make([]byte, 64)
+	conns := []net.Conn{dial(), dial()}
+	for i, conn := range conns {
+		defer conn.Close()
+		frame := fmt.Sprintf("frame%v", i)
+		if _, err := conn.Write([]byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+		if n, err := tapdev.Read(buf, 0); err != nil || string(buf[:n]) != frame {
+			t.Fatalf("read from connection %v: %q %v", i, buf[:n], err)
+		}
+	}
+	// the third one is over RecvMaxConns
+	if n, err := dial().Read(buf); err == nil {
+		t.Fatalf("connection over RecvMaxConns served: %q", buf[:n])
+	}
+	if _, err := tapdev.Write([]byte("back"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for i, conn := range conns {
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "back" {
+			t.Fatalf("write to connection %v: %q %v", i, buf[:n], err)
+		}
+	}
+	// a closed one frees its place
+	conns[0].Close()
+	time.Sleep(100 * time.Millisecond)
+	conn := dial()
+	defer conn.Close()
+	if _, err := conn.Write([]byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := tapdev.Read(buf, 0); err != nil || string(buf[:n]) != "again" {
+		t.Fatalf("read after a connection closed: %q %v", buf[:n], err)
+	}
+	// one stops reading, it's dropped when its buffer is full, the other still gets the frames
+	sockWriteTimeout = 50 * time.Millisecond
+	defer func() { sockWriteTimeout = time.Second }()
+	big := make([]byte, 8192)
+	for i := 0; i < 1024; i++ {
+		tapdev.Write(big, 0)
+		conn.Read(buf)
+	}
+	for {
+		if _, err := conns[1].Read(buf); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("connection not reading is still served: %v", err)
+		}
+	}
+	if _, err := tapdev.Write([]byte("alive"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "alive" {
+		t.Fatalf("write after a connection dropped: %q %v", buf[:n], err)
+	}
+	tapdev.Close()
+	if _, err := os.Stat(addr); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on close: %v", err)
+	}
+}
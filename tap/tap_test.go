@@ -0,0 +1,23 @@
+package tap
+
+import (
+	"testing"
+)
+
+func TestGetULAAddr(t *testing.T) {
+	ip, mask, err := GetULAAddr("fd12:3456:789a::/64", 258)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ones, _ := mask.Size(); ip.String() != "fd12:3456:789a::102" || ones != 64 {
+		t.Errorf("got %v/%v", ip, ones)
+	}
+	for _, prefix := range []string{"2001:db8::/64", "10.0.0.0/8", "fd00::/120", "fd00::"} {
+		if _, _, err := GetULAAddr(prefix, 1); err == nil {
+			t.Errorf("%v accepted", prefix)
+		}
+	}
+	if _, _, err := GetULAAddr("fd00::/64", 0); err == nil {
+		t.Error("NodeID 0 accepted")
+	}
+}
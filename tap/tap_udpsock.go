@@ -6,8 +6,12 @@ import (
 	"net"
 
 	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
+const udpSockBatchBufSize = 65535
+
 type UdpSockTap struct {
 	name    string
 	mtu     int
@@ -15,6 +19,48 @@ type UdpSockTap struct {
 	send    *net.UDPAddr
 	static  bool
 	events  chan Event
+	batch   *udpSockBatch
+}
+
+// udpSockBatch reads up to ReadBatchSize datagrams per syscall, by recvmmsg on Linux.
+// Other platforms read one datagram per call of ReadBatch. The datagrams are returned by Read one by one.
+type udpSockBatch struct {
+	conn interface {
+		ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	}
+	msgs []ipv4.Message
+	n    int
+	next int
+}
+
+func newUdpSockBatch(c *net.UDPConn, size int) *udpSockBatch {
+	b := &udpSockBatch{
+		msgs: make([]ipv4.Message, size),
+	}
+	if addr, ok := c.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && len(addr.IP) == net.IPv6len {
+		b.conn = ipv6.NewPacketConn(c)
+	} else {
+		b.conn = ipv4.NewPacketConn(c)
+	}
+	for i := range b.msgs {
+		b.msgs[i].Buffers = [][]byte{make([]byte, udpSockBatchBufSize)}
+	}
+	return b
+}
+
+// read copies the next datagram of the batch to buf, and reads a new batch if they are all returned
+func (b *udpSockBatch) read(buf []byte) (int, *net.UDPAddr, error) {
+	if b.next >= b.n {
+		n, err := b.conn.ReadBatch(b.msgs, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		b.n, b.next = n, 0
+	}
+	m := &b.msgs[b.next]
+	b.next++
+	source, _ := m.Addr.(*net.UDPAddr)
+	return copy(buf, m.Buffers[0][:m.N]), source, nil
 }
 
 // New creates and returns a new TUN interface for the application.
@@ -48,6 +94,9 @@ func CreateUDPSockTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (tapde
 		return nil, err
 	}
 	tap.recv = listener
+	if iconfig.ReadBatchSize > 1 {
+		tap.batch = newUdpSockBatch(listener, iconfig.ReadBatchSize)
+	}
 
 	if iconfig.SendAddr != "" {
 		sendAddr, err := net.ResolveUDPAddr("udp", iconfig.SendAddr)
@@ -68,8 +117,15 @@ func CreateUDPSockTAP(iconfig mtypes.InterfaceConf, NodeID mtypes.Vertex) (tapde
 // Packet on the interface.
 
 func (tap *UdpSockTap) Read(buf []byte, offset int) (int, error) {
-	size, source, err := tap.recv.ReadFromUDP(buf[offset:])
-	if tap.static == false {
+	var size int
+	var source *net.UDPAddr
+	var err error
+	if tap.batch != nil {
+		size, source, err = tap.batch.read(buf[offset:])
+	} else {
+		size, source, err = tap.recv.ReadFromUDP(buf[offset:])
+	}
+	if tap.static == false && source != nil {
 		tap.send = source
 	}
 	return size, err
@@ -0,0 +1,80 @@
+package tap
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/KusakabeSi/EtherGuard-VPN/mtypes"
+	"golang.org/x/net/ipv4"
+)
+
+func newTestUdpSockTap(tb testing.TB, batch int) (*UdpSockTap, *net.UDPConn) {
+	tapdev, err := CreateUDPSockTAP(mtypes.InterfaceConf{RecvAddr: "127.0.0.1:0", ReadBatchSize: batch}, 1)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tap := tapdev.(*UdpSockTap)
+	tb.Cleanup(func() { tap.Close() })
+	sender, err := net.DialUDP("udp", nil, tap.recv.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { sender.Close() })
+	return tap, sender
+}
+
+func TestUdpSockTapReadBatch(t *testing.T) {
+	tap, sender := newTestUdpSockTap(t, 4)
+	for i := 0; i < 6; i++ {
+		sender.Write([]byte(fmt.Sprintf("frame %v", i)))
+	}
+	buf := make([]byte, 1600)
+	for i := 0; i < 6; i++ {
+		size, err := tap.Read(buf, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("frame %v", i); !bytes.Equal(buf[10:10+size], []byte(want)) {
+			t.Fatalf("read %q, want %q", buf[10:10+size], want)
+		}
+	}
+	if tap.send.String() != sender.LocalAddr().String() {
+		t.Errorf("reply to %v, want %v", tap.send, sender.LocalAddr())
+	}
+}
+
+// Each iteration is a frame, sent in batches of 64 by sendmmsg.
+func benchmarkUdpSockTapRead(b *testing.B, batch int) {
+	tap, sender := newTestUdpSockTap(b, batch)
+	tap.recv.SetReadBuffer(1 << 22)
+	out := ipv4.NewPacketConn(sender)
+	msgs := make([]ipv4.Message, 64)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 64)}
+	}
+	buf := make([]byte, 1600)
+	b.ResetTimer()
+	for sent := 0; sent < b.N; sent += len(msgs) {
+		n := len(msgs)
+		if b.N-sent < n {
+			n = b.N - sent
+		}
+		for written := 0; written < n; {
+			w, err := out.WriteBatch(msgs[written:n], 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			written += w
+		}
+		for i := 0; i < n; i++ {
+			if _, err := tap.Read(buf, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkUdpSockTapRead(b *testing.B)        { benchmarkUdpSockTapRead(b, 0) }
+func BenchmarkUdpSockTapReadBatch32(b *testing.B) { benchmarkUdpSockTapRead(b, 32) }